@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APITokenPrefix starts every bot API token, which tells them apart from
+// access tokens
+const APITokenPrefix = "nwa_"
+
+// Scopes an API token can be granted
+const (
+	ScopeRead = "read"
+	ScopeSend = "send"
+)
+
+// APIToken is what a valid bot API token grants: the bot it acts as, what it
+// may do and in which conversations
+type APIToken struct {
+	ID              string
+	BotID           string
+	Scopes          []string
+	ConversationIDs []string
+}
+
+// Allows reports whether the token grants scope in the conversation
+func (t *APIToken) Allows(scope, conversationID string) bool {
+	hasScope := false
+	for _, s := range t.Scopes {
+		if s == scope {
+			hasScope = true
+			break
+		}
+	}
+	if !hasScope {
+		return false
+	}
+	for _, id := range t.ConversationIDs {
+		if id == conversationID {
+			return true
+		}
+	}
+	return false
+}
+
+// APITokenValidator looks up bot API tokens. It returns nil for tokens that
+// are unknown, expired or revoked.
+type APITokenValidator interface {
+	AuthenticateAPIToken(token string) (*APIToken, error)
+}
+
+// IsAPIToken reports whether a bearer token is a bot API token
+func IsAPIToken(token string) bool {
+	return strings.HasPrefix(token, APITokenPrefix)
+}
+
+// APITokenFromContext returns the API token a request was authenticated
+// with, or nil for requests made with a user session
+func APITokenFromContext(c *gin.Context) *APIToken {
+	if value, ok := c.Get("apiToken"); ok {
+		return value.(*APIToken)
+	}
+	return nil
+}
+
+// RequireScope lets requests made with an API token through only if the
+// token grants scope in the conversation named by the :id route parameter.
+// Requests made with a user session are not affected.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token := APITokenFromContext(c); token != nil && !token.Allows(scope, c.Param("id")) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API token does not allow " + scope + " in this conversation"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
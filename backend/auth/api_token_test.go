@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/gin-gonic/gin"
+)
+
+// testAPITokens is an APITokenValidator over a fixed set of tokens
+type testAPITokens map[string]*APIToken
+
+func (v testAPITokens) AuthenticateAPIToken(token string) (*APIToken, error) {
+	if token == APITokenPrefix+"broken" {
+		return nil, errors.New("database is down")
+	}
+	return v[token], nil
+}
+
+func TestAPITokenAllows(t *testing.T) {
+	token := &APIToken{Scopes: []string{ScopeRead}, ConversationIDs: []string{"c1", "c2"}}
+	if !token.Allows(ScopeRead, "c2") {
+		t.Error("read in c2 is not allowed")
+	}
+	if token.Allows(ScopeSend, "c1") {
+		t.Error("send is allowed without the scope")
+	}
+	if token.Allows(ScopeRead, "c3") {
+		t.Error("read is allowed in another conversation")
+	}
+}
+
+func TestAPITokenMiddleware(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	apiTokens := testAPITokens{
+		APITokenPrefix + "reader": {ID: "t1", BotID: "bot", Scopes: []string{ScopeRead}, ConversationIDs: []string{"c1"}},
+	}
+	r := gin.New()
+	r.Use(Middleware(tokens, testSessions{"s1": true}, apiTokens))
+	echo := func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("userID"))
+	}
+	r.GET("/conversations/:id/messages", RequireScope(ScopeRead), echo)
+	r.POST("/conversations/:id/messages", RequireScope(ScopeSend), echo)
+	userToken, _, err := tokens.IssueAccessToken(&models.User{ID: "u1"}, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+		body   string
+	}{
+		{name: "in scope", method: http.MethodGet, path: "/conversations/c1/messages", token: APITokenPrefix + "reader", status: http.StatusOK, body: "bot"},
+		{name: "missing scope", method: http.MethodPost, path: "/conversations/c1/messages", token: APITokenPrefix + "reader", status: http.StatusForbidden},
+		{name: "other conversation", method: http.MethodGet, path: "/conversations/c2/messages", token: APITokenPrefix + "reader", status: http.StatusForbidden},
+		{name: "unknown token", method: http.MethodGet, path: "/conversations/c1/messages", token: APITokenPrefix + "revoked", status: http.StatusUnauthorized},
+		{name: "lookup fails", method: http.MethodGet, path: "/conversations/c1/messages", token: APITokenPrefix + "broken", status: http.StatusInternalServerError},
+		{name: "user session is not limited", method: http.MethodPost, path: "/conversations/c2/messages", token: userToken, status: http.StatusOK, body: "u1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestRequireAdminRejectsAPITokens(t *testing.T) {
+	r := gin.New()
+	r.Use(Middleware(newTestTokenManager(t), testSessions{}, testAPITokens{
+		APITokenPrefix + "bot": {ID: "t1", BotID: "bot", Scopes: []string{ScopeRead}},
+	}))
+	r.GET("/admin", RequireAdmin(nil), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.Header.Set("Authorization", "Bearer "+APITokenPrefix+"bot")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cookie session mode keeps tokens in HttpOnly cookies instead of handing
+// them to JavaScript. The refresh token is only sent to the auth endpoints.
+const (
+	AccessTokenCookie  = "access_token"
+	RefreshTokenCookie = "refresh_token"
+	accessCookiePath   = "/"
+	refreshCookiePath  = "/api/v1/auth/"
+)
+
+// SetSessionCookies stores a session's tokens in HttpOnly cookies
+func SetSessionCookies(c *gin.Context, accessToken string, accessExpiresAt time.Time, refreshToken string, refreshTTL time.Duration, secure bool) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(AccessTokenCookie, accessToken, int(time.Until(accessExpiresAt).Seconds()), accessCookiePath, "", secure, true)
+	c.SetCookie(RefreshTokenCookie, refreshToken, int(refreshTTL.Seconds()), refreshCookiePath, "", secure, true)
+}
+
+// ClearSessionCookies removes the session cookies
+func ClearSessionCookies(c *gin.Context, secure bool) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(AccessTokenCookie, "", -1, accessCookiePath, "", secure, true)
+	c.SetCookie(RefreshTokenCookie, "", -1, refreshCookiePath, "", secure, true)
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const googleUserInfoURL = "https://www.googleapis.com/oauth2/v2/userinfo"
+
+// GoogleProvider signs users in with Google OAuth and the userinfo endpoint
+type GoogleProvider struct {
+	config *oauth2.Config
+}
+
+func NewGoogleProvider(clientID, clientSecret, redirectURL string) *GoogleProvider {
+	return &GoogleProvider{
+		config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email", "https://www.googleapis.com/auth/userinfo.profile"},
+			Endpoint:     google.Endpoint,
+		},
+	}
+}
+
+func (p *GoogleProvider) Name() string {
+	return "google"
+}
+
+func (p *GoogleProvider) DisplayName() string {
+	return "Google"
+}
+
+func (p *GoogleProvider) AuthCodeURL(ctx context.Context, state, nonce, codeVerifier string) (string, error) {
+	return p.config.AuthCodeURL(state, oauth2.AccessTypeOnline, oauth2.S256ChallengeOption(codeVerifier)), nil
+}
+
+func (p *GoogleProvider) Exchange(ctx context.Context, code, nonce, codeVerifier string) (*Identity, error) {
+	token, err := p.config.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("exchange code: %w", err)
+	}
+
+	resp, err := p.config.Client(ctx, token).Get(googleUserInfoURL)
+	if err != nil {
+		return nil, fmt.Errorf("get user info: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get user info: %s", resp.Status)
+	}
+
+	var userInfo struct {
+		ID            string `json:"id"`
+		Email         string `json:"email"`
+		VerifiedEmail bool   `json:"verified_email"`
+		Name          string `json:"name"`
+		Picture       string `json:"picture"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		return nil, fmt.Errorf("decode user info: %w", err)
+	}
+	if userInfo.ID == "" {
+		return nil, fmt.Errorf("user info has no id")
+	}
+
+	return &Identity{
+		Provider:      p.Name(),
+		Subject:       userInfo.ID,
+		Email:         userInfo.Email,
+		EmailVerified: userInfo.VerifiedEmail,
+		Name:          userInfo.Name,
+		AvatarURL:     userInfo.Picture,
+	}, nil
+}
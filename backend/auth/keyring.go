@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Algorithms access tokens can be signed with
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+var (
+	// ErrNoSigningKey is returned when no key is active for signing yet
+	ErrNoSigningKey = errors.New("no active signing key")
+	// ErrUnknownSigningKey is returned for tokens whose kid is not in the
+	// keyring, usually because the key has been retired
+	ErrUnknownSigningKey = errors.New("unknown signing key")
+)
+
+// SigningKey is an asymmetric key access tokens are signed with. A key is
+// published before it activates so verifiers can fetch it ahead of time, and
+// stays published until RetiresAt so tokens it signed remain verifiable.
+type SigningKey struct {
+	ID          string
+	Algorithm   string
+	PrivateKey  crypto.Signer
+	ActivatesAt time.Time
+	// RetiresAt is zero while the key is the newest active key
+	RetiresAt time.Time
+}
+
+// Keyring holds the signing keys currently in use. It is safe for concurrent
+// use and is refreshed in place when keys rotate.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys []SigningKey
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{}
+}
+
+// SetKeys replaces the keys in the keyring
+func (k *Keyring) SetKeys(keys []SigningKey) {
+	keys = append([]SigningKey(nil), keys...)
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ActivatesAt.Before(keys[j].ActivatesAt)
+	})
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+}
+
+// SigningKey returns the most recently activated key
+func (k *Keyring) SigningKey() (SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now()
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if !k.keys[i].ActivatesAt.After(now) {
+			return k.keys[i], nil
+		}
+	}
+	return SigningKey{}, ErrNoSigningKey
+}
+
+// VerificationKey returns the public key for a kid that has not been retired
+func (k *Keyring) VerificationKey(kid string) (SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now()
+	for _, key := range k.keys {
+		if key.ID == kid && (key.RetiresAt.IsZero() || now.Before(key.RetiresAt)) {
+			return key, nil
+		}
+	}
+	return SigningKey{}, fmt.Errorf("%w: %s", ErrUnknownSigningKey, kid)
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of every published key, including keys that
+// are about to activate
+func (k *Keyring) JWKS() JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now()
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range k.keys {
+		if !key.RetiresAt.IsZero() && !now.Before(key.RetiresAt) {
+			continue
+		}
+		set.Keys = append(set.Keys, key.JWK())
+	}
+	return set
+}
+
+// JWK returns the key's public half in JSON Web Key format
+func (key SigningKey) JWK() JWK {
+	jwk := JWK{
+		Use:       "sig",
+		Algorithm: key.Algorithm,
+		KeyID:     key.ID,
+	}
+	switch pub := key.PrivateKey.Public().(type) {
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	}
+	return jwk
+}
+
+// signingMethod returns the JWT signing method of the key's algorithm
+func (key SigningKey) signingMethod() (jwt.SigningMethod, error) {
+	switch key.Algorithm {
+	case AlgorithmEdDSA:
+		return jwt.SigningMethodEdDSA, nil
+	case AlgorithmRS256:
+		return jwt.SigningMethodRS256, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", key.Algorithm)
+	}
+}
+
+// GenerateSigningKey creates a new private key for the algorithm
+func GenerateSigningKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case AlgorithmEdDSA:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	case AlgorithmRS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+}
+
+// MarshalSigningKey encodes a private key as PKCS #8 DER
+func MarshalSigningKey(privateKey crypto.Signer) ([]byte, error) {
+	return x509.MarshalPKCS8PrivateKey(privateKey)
+}
+
+// ParseSigningKey decodes a PKCS #8 DER private key
+func ParseSigningKey(der []byte) (crypto.Signer, error) {
+	privateKey, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot sign")
+	}
+	return signer, nil
+}
@@ -1,53 +1,120 @@
 package auth
 
 import (
+	"log"
 	"net/http"
-	"os"
 	"strings"
 
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 )
 
-func AuthMiddleware(c *gin.Context) {
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-		c.Abort()
-		return
-	}
+// SessionValidator reports whether a server-side session is still usable
+type SessionValidator interface {
+	IsSessionActive(sessionID string) (bool, error)
+}
 
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	if tokenString == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token format"})
-		c.Abort()
-		return
-	}
+// Middleware rejects requests without a valid access token for an active
+// session, and sets userID and sessionID on the context. The token comes
+// from the Authorization header or, in cookie session mode, the access token
+// cookie. When apiTokens is set, bot API tokens are accepted too; userID is
+// then the bot and apiToken holds the token's grant.
+func Middleware(tokens *TokenManager, sessions SessionValidator, apiTokens APITokenValidator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var tokenString string
+		if authHeader := c.GetHeader("Authorization"); authHeader != "" {
+			tokenString = strings.TrimPrefix(authHeader, "Bearer ")
+			if tokenString == "" || tokenString == authHeader {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token format"})
+				c.Abort()
+				return
+			}
+		} else if cookie, err := c.Cookie(AccessTokenCookie); err == nil && cookie != "" {
+			tokenString = cookie
+		} else {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+			c.Abort()
+			return
+		}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
+		if IsAPIToken(tokenString) {
+			if apiTokens == nil {
+				c.JSON(http.StatusForbidden, gin.H{"error": "API tokens are not accepted here"})
+				c.Abort()
+				return
+			}
+			apiToken, err := apiTokens.AuthenticateAPIToken(tokenString)
+			if err != nil {
+				log.Printf("Failed to check API token: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API token"})
+				c.Abort()
+				return
+			}
+			if apiToken == nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+				c.Abort()
+				return
+			}
 
-	if err != nil || !token.Valid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-		c.Abort()
-		return
-	}
+			c.Set("userID", apiToken.BotID)
+			c.Set("apiToken", apiToken)
+			c.Next()
+			return
+		}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
-		c.Abort()
-		return
-	}
+		claims, err := tokens.ParseAccessToken(tokenString)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
 
-	userID, ok := claims["sub"].(string)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID in token"})
-		c.Abort()
-		return
+		active, err := sessions.IsSessionActive(claims.SessionID)
+		if err != nil {
+			log.Printf("Failed to check session %s: %v", claims.SessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session"})
+			c.Abort()
+			return
+		}
+		if !active {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+			c.Abort()
+			return
+		}
+
+		c.Set("userID", claims.Subject)
+		c.Set("sessionID", claims.SessionID)
+		c.Next()
 	}
+}
 
-	c.Set("userID", userID)
-	c.Next()
+// RoleLookup returns the role of a user, such as models.RoleAdmin, or an
+// empty role for unknown users
+type RoleLookup interface {
+	GetRole(userID string) (string, error)
+}
+
+// RequireAdmin lets through only requests made with a user session of an
+// admin. It must run after Middleware.
+func RequireAdmin(roles RoleLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if APITokenFromContext(c) != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API tokens are not accepted here"})
+			c.Abort()
+			return
+		}
+		role, err := roles.GetRole(c.GetString("userID"))
+		if err != nil {
+			log.Printf("Failed to check role of %s: %v", c.GetString("userID"), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check role"})
+			c.Abort()
+			return
+		}
+		if role != models.RoleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin role required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
 }
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testSessions is a SessionValidator over a fixed set of active sessions
+type testSessions map[string]bool
+
+func (s testSessions) IsSessionActive(sessionID string) (bool, error) {
+	if sessionID == "broken" {
+		return false, errors.New("database is down")
+	}
+	return s[sessionID], nil
+}
+
+// newMiddlewareRouter serves /me, which echoes the authenticated user and
+// session
+func newMiddlewareRouter(tokens *TokenManager, sessions SessionValidator) *gin.Engine {
+	r := gin.New()
+	r.GET("/me", Middleware(tokens, sessions, nil), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("userID")+"/"+c.GetString("sessionID"))
+	})
+	return r
+}
+
+func TestMiddleware(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	r := newMiddlewareRouter(tokens, testSessions{"s1": true})
+	issue := func(sessionID string) string {
+		token, _, err := tokens.IssueAccessToken(&models.User{ID: "u1"}, sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		status int
+		body   string
+	}{
+		{name: "bearer token", header: "Bearer " + issue("s1"), status: http.StatusOK, body: "u1/s1"},
+		{name: "cookie", cookie: issue("s1"), status: http.StatusOK, body: "u1/s1"},
+		{name: "no token", status: http.StatusUnauthorized},
+		{name: "not a bearer token", header: issue("s1"), status: http.StatusUnauthorized},
+		{name: "garbage", header: "Bearer garbage", status: http.StatusUnauthorized},
+		{name: "revoked session", header: "Bearer " + issue("s2"), status: http.StatusUnauthorized},
+		{name: "session lookup fails", header: "Bearer " + issue("broken"), status: http.StatusInternalServerError},
+		{name: "API token", header: "Bearer " + APITokenPrefix + "abc", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/me", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: AccessTokenCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCProvider signs users in with any OpenID Connect provider, such as
+// Keycloak or Dex. The provider's configuration is discovered from the issuer
+// on first use, so the server can start while the provider is unreachable.
+type OIDCProvider struct {
+	name         string
+	displayName  string
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+
+	mu       sync.Mutex
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func NewOIDCProvider(name, displayName, issuer, clientID, clientSecret, redirectURL string, scopes []string) *OIDCProvider {
+	if len(scopes) == 0 {
+		scopes = []string{"profile", "email"}
+	}
+	if displayName == "" {
+		displayName = name
+	}
+	return &OIDCProvider{
+		name:         name,
+		displayName:  displayName,
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		scopes:       scopes,
+	}
+}
+
+func (p *OIDCProvider) Name() string {
+	return p.name
+}
+
+func (p *OIDCProvider) DisplayName() string {
+	return p.displayName
+}
+
+// discover fetches the issuer's discovery document, once it succeeds
+func (p *OIDCProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config != nil {
+		return p.config, p.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discover %s: %w", p.issuer, err)
+	}
+
+	p.config = &oauth2.Config{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		RedirectURL:  p.redirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID}, p.scopes...),
+		Endpoint:     provider.Endpoint(),
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.clientID})
+	return p.config, p.verifier, nil
+}
+
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, codeVerifier string) (string, error) {
+	config, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(codeVerifier)), nil
+}
+
+func (p *OIDCProvider) Exchange(ctx context.Context, code, nonce, codeVerifier string) (*Identity, error) {
+	config, verifier, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("exchange code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("verify id_token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		Name              string `json:"name"`
+		PreferredUsername string `json:"preferred_username"`
+		Picture           string `json:"picture"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("decode id_token claims: %w", err)
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.PreferredUsername
+	}
+
+	return &Identity{
+		Provider:      p.name,
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          name,
+		AvatarURL:     claims.Picture,
+	}, nil
+}
@@ -0,0 +1,319 @@
+// Package oidctest provides a minimal OpenID Connect provider for tests and
+// local development. It supports discovery, the authorization code flow with
+// PKCE (S256 only), and RS256 signed ID tokens. Users sign in without a
+// password by picking an account, or directly with login_hint.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	keyID   = "oidctest"
+	codeTTL = time.Minute
+)
+
+// User is an account at the fake provider
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+}
+
+type authCode struct {
+	user          User
+	clientID      string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	expiresAt     time.Time
+}
+
+// Server is a fake OpenID Connect provider. It implements http.Handler and
+// is typically served with httptest.NewServer or from cmd/fakeoidc.
+type Server struct {
+	// Issuer must match the URL the server is reachable at
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// TokenTTL is how long issued ID tokens are valid
+	TokenTTL time.Duration
+
+	key *rsa.PrivateKey
+	mux *http.ServeMux
+
+	mu    sync.Mutex
+	users []User
+	codes map[string]authCode
+}
+
+// NewServer creates a provider with a fresh signing key. Set Issuer before
+// serving requests if the address is not known yet.
+func NewServer(issuer, clientID, clientSecret string) (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Issuer:       issuer,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenTTL:     time.Hour,
+		key:          key,
+		mux:          http.NewServeMux(),
+		codes:        make(map[string]authCode),
+	}
+	s.mux.HandleFunc("/.well-known/openid-configuration", s.handleDiscovery)
+	s.mux.HandleFunc("/keys", s.handleKeys)
+	s.mux.HandleFunc("/authorize", s.handleAuthorize)
+	s.mux.HandleFunc("/token", s.handleToken)
+	return s, nil
+}
+
+// AddUser registers an account users can sign in as
+func (s *Server) AddUser(user User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, user)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.Issuer,
+		"authorization_endpoint":                s.Issuer + "/authorize",
+		"token_endpoint":                        s.Issuer + "/token",
+		"jwks_uri":                              s.Issuer + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+	})
+}
+
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	pub := s.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+var chooserTemplate = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<html><head><title>Fake OIDC sign in</title></head>
+<body>
+<h1>Sign in as</h1>
+{{range .Users}}
+<p><a href="{{$.Base}}&login_hint={{.Subject}}">{{.Name}} &lt;{{.Email}}&gt;</a></p>
+{{else}}
+<p>No users configured.</p>
+{{end}}
+</body></html>
+`))
+
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI := q.Get("redirect_uri")
+
+	if q.Get("client_id") != s.ClientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if redirectURI == "" {
+		http.Error(w, "missing redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" {
+		redirectError(w, r, redirectURI, q.Get("state"), "unsupported_response_type")
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		redirectError(w, r, redirectURI, q.Get("state"), "invalid_request")
+		return
+	}
+
+	s.mu.Lock()
+	users := append([]User(nil), s.users...)
+	s.mu.Unlock()
+
+	hint := q.Get("login_hint")
+	if hint == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		chooserTemplate.Execute(w, map[string]interface{}{
+			"Base":  r.URL.Path + "?" + r.URL.RawQuery,
+			"Users": users,
+		})
+		return
+	}
+
+	var user *User
+	for i := range users {
+		if users[i].Subject == hint || users[i].Email == hint {
+			user = &users[i]
+			break
+		}
+	}
+	if user == nil {
+		redirectError(w, r, redirectURI, q.Get("state"), "access_denied")
+		return
+	}
+
+	code := randomString()
+	s.mu.Lock()
+	s.codes[code] = authCode{
+		user:          *user,
+		clientID:      s.ClientID,
+		redirectURI:   redirectURI,
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		expiresAt:     time.Now().Add(codeTTL),
+	}
+	s.mu.Unlock()
+
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := target.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	target.RawQuery = params.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	if clientID != s.ClientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(s.ClientSecret)) != 1 {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	// Codes are single use
+	code := r.PostForm.Get("code")
+	s.mu.Lock()
+	grant, ok := s.codes[code]
+	delete(s.codes, code)
+	s.mu.Unlock()
+
+	if !ok || time.Now().After(grant.expiresAt) || grant.clientID != clientID ||
+		grant.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != grant.codeChallenge {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            s.Issuer,
+		"sub":            grant.user.Subject,
+		"aud":            clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(s.TokenTTL).Unix(),
+		"email":          grant.user.Email,
+		"email_verified": grant.user.EmailVerified,
+		"name":           grant.user.Name,
+	}
+	if grant.nonce != "" {
+		claims["nonce"] = grant.nonce
+	}
+	if grant.user.Picture != "" {
+		claims["picture"] = grant.user.Picture
+	}
+
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = keyID
+	signed, err := idToken.SignedString(s.key)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   int(s.TokenTTL.Seconds()),
+		"id_token":     signed,
+	})
+}
+
+func redirectError(w http.ResponseWriter, r *http.Request, redirectURI, state, code string) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := target.Query()
+	params.Set("error", code)
+	params.Set("state", state)
+	target.RawQuery = params.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func tokenError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// Identity is the account a user signed in with at an identity provider
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	AvatarURL     string
+}
+
+// Provider is an identity provider users can sign in with. Every login uses
+// PKCE; providers that issue ID tokens also check the nonce.
+type Provider interface {
+	// Name is the provider's URL-safe identifier, e.g. "google"
+	Name() string
+	// DisplayName is shown on the login button
+	DisplayName() string
+	// AuthCodeURL returns the URL the browser is sent to for signing in
+	AuthCodeURL(ctx context.Context, state, nonce, codeVerifier string) (string, error)
+	// Exchange redeems the authorization code and returns the signed in identity
+	Exchange(ctx context.Context, code, nonce, codeVerifier string) (*Identity, error)
+}
+
+// RandomString returns a random URL-safe string for OAuth state and nonces
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are the claims carried by an access token
+type Claims struct {
+	Name      string `json:"name"`
+	Email     string `json:"email,omitempty"`
+	AvatarURL string `json:"avatar_url"`
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// TokenManager issues and verifies short-lived access tokens. Access tokens
+// are tied to a server-side session so they stop working once the session is
+// revoked. They are signed with the keyring's current key and name it in the
+// kid header, so other services can verify them from the JWKS. Single-purpose
+// tokens are only ever checked by this server and use the HMAC secret.
+type TokenManager struct {
+	keyring   *Keyring
+	issuer    string
+	secret    []byte
+	accessTTL time.Duration
+}
+
+func NewTokenManager(keyring *Keyring, issuer, secret string, accessTTL time.Duration) *TokenManager {
+	return &TokenManager{
+		keyring:   keyring,
+		issuer:    issuer,
+		secret:    []byte(secret),
+		accessTTL: accessTTL,
+	}
+}
+
+// IssueAccessToken mints an access token for the user's session
+func (m *TokenManager) IssueAccessToken(user *models.User, sessionID string) (string, time.Time, error) {
+	key, err := m.keyring.SigningKey()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	method, err := key.signingMethod()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(m.accessTTL)
+
+	token := jwt.NewWithClaims(method, Claims{
+		Name:      user.Name,
+		Email:     user.Email,
+		AvatarURL: user.AvatarURL,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.issuer,
+			Subject:   user.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	token.Header["kid"] = key.ID
+
+	tokenString, err := token.SignedString(key.PrivateKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tokenString, expiresAt, nil
+}
+
+// ParseAccessToken verifies an access token and returns its claims
+func (m *TokenManager) ParseAccessToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := m.keyring.VerificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		// The algorithm is fixed by the key, never taken from the token
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.PrivateKey.Public(), nil
+	}, jwt.WithIssuer(m.issuer))
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if claims.Subject == "" || claims.SessionID == "" {
+		return nil, errors.New("token is missing subject or session")
+	}
+	return claims, nil
+}
+
+// Audiences of single-purpose tokens. They keep these tokens from being
+// accepted for a different purpose. They carry no session, so they are never
+// accepted as access tokens.
+const (
+	emailLoginAudience = "email-login"
+)
+
+// IssueEmailLoginToken signs a single-use email login token. The token ID is
+// recorded server-side so the token can only be redeemed once.
+func (m *TokenManager) IssueEmailLoginToken(email, tokenID string, ttl time.Duration) (string, error) {
+	return m.issuePurposeToken(emailLoginAudience, email, tokenID, ttl)
+}
+
+// ParseEmailLoginToken verifies an email login token and returns its email
+// and token ID
+func (m *TokenManager) ParseEmailLoginToken(tokenString string) (string, string, error) {
+	return m.parsePurposeToken(emailLoginAudience, tokenString)
+}
+
+func (m *TokenManager) issuePurposeToken(audience, subject, tokenID string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		ID:        tokenID,
+		Subject:   subject,
+		Audience:  jwt.ClaimStrings{audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	})
+	return token.SignedString(m.secret)
+}
+
+func (m *TokenManager) parsePurposeToken(audience, tokenString string) (string, string, error) {
+	claims := &jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return m.secret, nil
+	}, jwt.WithAudience(audience))
+	if err != nil {
+		return "", "", err
+	}
+	if !token.Valid || claims.Subject == "" || claims.ID == "" {
+		return "", "", errors.New("invalid " + audience + " token")
+	}
+	return claims.Subject, claims.ID, nil
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+)
+
+// newTestTokenManager returns a token manager with a single active EdDSA key
+func newTestTokenManager(t testing.TB) *TokenManager {
+	t.Helper()
+	key, err := GenerateSigningKey(AlgorithmEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := NewKeyring()
+	keyring.SetKeys([]SigningKey{{ID: "k1", Algorithm: AlgorithmEdDSA, PrivateKey: key, ActivatesAt: time.Now().Add(-time.Minute)}})
+	return NewTokenManager(keyring, "https://chat.example.com", strings.Repeat("s", 32), time.Minute)
+}
+
+func TestAccessToken(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	user := &models.User{ID: "u1", Name: "Alice", Email: "alice@example.com"}
+
+	token, expiresAt, err := tokens.IssueAccessToken(user, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(expiresAt); d <= 0 || d > time.Minute {
+		t.Errorf("token expires in %s, want the access token TTL", d)
+	}
+
+	claims, err := tokens.ParseAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "u1" || claims.SessionID != "s1" || claims.Email != user.Email {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	// Another server's keys don't verify it, nor does a different issuer
+	if _, err := newTestTokenManager(t).ParseAccessToken(token); err == nil {
+		t.Error("token verified with a different key")
+	}
+	other := NewTokenManager(tokens.keyring, "https://other.example.com", string(tokens.secret), time.Minute)
+	if _, err := other.ParseAccessToken(token); err == nil {
+		t.Error("token verified for a different issuer")
+	}
+}
+
+func TestAccessTokenRequiresSession(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	token, _, err := tokens.IssueAccessToken(&models.User{ID: "u1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.ParseAccessToken(token); err == nil {
+		t.Error("token without a session was accepted")
+	}
+}
+
+func TestAccessTokenKeyRetirement(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	token, _, err := tokens.IssueAccessToken(&models.User{ID: "u1"}, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := tokens.keyring.SigningKey()
+	key.RetiresAt = time.Now().Add(-time.Second)
+	tokens.keyring.SetKeys([]SigningKey{key})
+	if _, err := tokens.ParseAccessToken(token); err == nil {
+		t.Error("token signed by a retired key was accepted")
+	}
+}
+
+func TestPurposeTokensAreNotInterchangeable(t *testing.T) {
+	tokens := newTestTokenManager(t)
+
+	login, err := tokens.IssueEmailLoginToken("alice@example.com", "t1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email, tokenID, err := tokens.ParseEmailLoginToken(login)
+	if err != nil || email != "alice@example.com" || tokenID != "t1" {
+		t.Fatalf("ParseEmailLoginToken = %q, %q, %v", email, tokenID, err)
+	}
+
+	if _, err := tokens.ParseAccessToken(login); err == nil {
+		t.Error("email login token was accepted as an access token")
+	}
+
+	expired, _ := tokens.IssueEmailLoginToken("alice@example.com", "t2", -time.Minute)
+	if _, _, err := tokens.ParseEmailLoginToken(expired); err == nil {
+		t.Error("expired email login token was accepted")
+	}
+}
@@ -0,0 +1,72 @@
+// Package backplane fans WebSocket traffic out between backend nodes and
+// tracks which users are connected to any of them. Each node publishes what
+// it delivers to its own connections, and every other node delivers the same
+// payload to the recipients connected to it.
+package backplane
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Kinds of events sent between nodes
+const (
+	// KindDeliver asks nodes to send Payload to the connections of UserIDs
+	// that can read ConversationID. Without UserIDs, as for announcements to
+	// everyone, it goes to every connection.
+	KindDeliver = "deliver"
+	// KindDisconnect asks nodes to close the connections of SessionIDs with
+	// CloseCode
+	KindDisconnect = "disconnect"
+	// KindListSessions asks nodes to answer with a KindSessions event with
+	// the same RequestID
+	KindListSessions = "list_sessions"
+	// KindSessions answers KindListSessions with the node's connections in
+	// Payload
+	KindSessions = "sessions"
+)
+
+// Event is something every node has to apply to its local connections
+type Event struct {
+	// Node is the ID of the node that published the event, set by Publish.
+	// Nodes ignore their own events.
+	Node           string          `json:"node"`
+	Kind           string          `json:"kind"`
+	ConversationID string          `json:"conversation_id,omitempty"`
+	UserIDs        []string        `json:"user_ids,omitempty"`
+	SessionIDs     []string        `json:"session_ids,omitempty"`
+	Payload        json.RawMessage `json:"payload,omitempty"`
+	// CloseCode is the WebSocket close code of a disconnect; nodes use their
+	// default if it is 0
+	CloseCode int `json:"close_code,omitempty"`
+	// RequestID pairs a KindSessions answer with its KindListSessions
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Backplane carries events between the nodes of a deployment
+type Backplane interface {
+	// Publish sends an event to every other node
+	Publish(ctx context.Context, event Event) error
+	// Subscribe calls handler with every event published by other nodes.
+	// It must be called once, before the first Publish.
+	Subscribe(handler func(Event)) error
+	Close() error
+}
+
+// Presence tracks the WebSocket connections of users across nodes. Nodes
+// send heartbeats, and the connections of a node that stops sending them
+// are dropped.
+type Presence interface {
+	// Connect records a connection of the user to this node
+	Connect(ctx context.Context, userID, connectionID string) error
+	// Disconnect removes a connection recorded with Connect
+	Disconnect(ctx context.Context, userID, connectionID string) error
+	// Online reports which of the users have a connection to a live node
+	Online(ctx context.Context, userIDs []string) (map[string]bool, error)
+}
+
+// NodeLister is implemented by presence stores that know every live node
+type NodeLister interface {
+	// Nodes returns the nodes with a live heartbeat, this one included
+	Nodes(ctx context.Context) ([]string, error)
+}
@@ -0,0 +1,253 @@
+package backplane
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+const testHeartbeat = 20 * time.Millisecond
+
+// testNode is a node of the implementation under test
+type testNode interface {
+	Backplane
+	Presence
+	NodeLister
+	Stop()
+}
+
+// testCluster starts nodes that share a backplane
+type testCluster struct {
+	node func(t *testing.T, id string) testNode
+	// expire lets the heartbeats of stopped nodes run out
+	expire func()
+}
+
+func memoryCluster(t *testing.T) testCluster {
+	memory := NewMemory(testHeartbeat)
+	return testCluster{
+		node: func(t *testing.T, id string) testNode {
+			node := memory.Node(id)
+			t.Cleanup(func() { node.Close() })
+			return node
+		},
+		expire: func() {},
+	}
+}
+
+func redisCluster(t *testing.T) testCluster {
+	server := miniredis.RunT(t)
+	return testCluster{
+		node: func(t *testing.T, id string) testNode {
+			node, err := NewRedis("redis://"+server.Addr(), id, testHeartbeat)
+			if err != nil {
+				t.Fatalf("start node %s: %v", id, err)
+			}
+			t.Cleanup(func() { node.Close() })
+			return node
+		},
+		// miniredis only expires keys when told to
+		expire: func() { server.FastForward(heartbeatMisses * testHeartbeat) },
+	}
+}
+
+// TestBackplaneContract runs the same checks against every implementation
+// that can run without external services
+func TestBackplaneContract(t *testing.T) {
+	clusters := map[string]func(*testing.T) testCluster{
+		"memory": memoryCluster,
+		"redis":  redisCluster,
+	}
+	for name, newCluster := range clusters {
+		t.Run(name, func(t *testing.T) {
+			t.Run("FanOut", func(t *testing.T) { testFanOut(t, newCluster(t)) })
+			t.Run("Presence", func(t *testing.T) { testPresence(t, newCluster(t)) })
+			t.Run("DeadNode", func(t *testing.T) { testDeadNode(t, newCluster(t)) })
+			t.Run("Close", func(t *testing.T) { testClose(t, newCluster(t)) })
+		})
+	}
+}
+
+func testFanOut(t *testing.T, cluster testCluster) {
+	a := cluster.node(t, "a")
+	b := cluster.node(t, "b")
+	c := cluster.node(t, "c")
+	fromA := subscribe(t, a, "c1")
+	fromB := subscribe(t, b, "c1")
+	fromC := subscribe(t, c, "c1")
+
+	err := a.Publish(context.Background(), Event{
+		Kind:           KindDeliver,
+		ConversationID: "c1",
+		UserIDs:        []string{"alice"},
+		Payload:        json.RawMessage(`{"type":"message"}`),
+	})
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	for name, events := range map[string]<-chan Event{"b": fromB, "c": fromC} {
+		event := receive(t, events)
+		if event.Node != "a" || event.Kind != KindDeliver {
+			t.Errorf("node %s got %+v, want a deliver from a", name, event)
+		}
+		if string(event.Payload) != `{"type":"message"}` {
+			t.Errorf("node %s got payload %s", name, event.Payload)
+		}
+	}
+	expectNoEvent(t, fromA)
+}
+
+func testPresence(t *testing.T, cluster testCluster) {
+	ctx := context.Background()
+	a := cluster.node(t, "a")
+	b := cluster.node(t, "b")
+
+	if err := a.Connect(ctx, "alice", "conn-1"); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := b.Connect(ctx, "alice", "conn-2"); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	expectOnline(t, b, map[string]bool{"alice": true, "bob": false})
+
+	// Still connected to b
+	if err := a.Disconnect(ctx, "alice", "conn-1"); err != nil {
+		t.Fatalf("disconnect: %v", err)
+	}
+	expectOnline(t, a, map[string]bool{"alice": true})
+
+	if err := b.Disconnect(ctx, "alice", "conn-2"); err != nil {
+		t.Fatalf("disconnect: %v", err)
+	}
+	expectOnline(t, a, map[string]bool{"alice": false})
+
+	online, err := a.Online(ctx, nil)
+	if err != nil || len(online) != 0 {
+		t.Errorf("online for no users = %v, %v; want empty", online, err)
+	}
+}
+
+func testDeadNode(t *testing.T, cluster testCluster) {
+	ctx := context.Background()
+	a := cluster.node(t, "a")
+	b := cluster.node(t, "b")
+
+	if err := a.Connect(ctx, "alice", "conn-1"); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := b.Connect(ctx, "bob", "conn-2"); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	expectOnline(t, a, map[string]bool{"alice": true, "bob": true})
+	expectNodes(t, b, "a", "b")
+
+	b.Stop()
+	cluster.expire()
+	eventually(t, "bob to go offline", func() bool {
+		online, err := a.Online(ctx, []string{"alice", "bob"})
+		return err == nil && online["alice"] && !online["bob"]
+	})
+	expectNodes(t, a, "a")
+}
+
+func testClose(t *testing.T, cluster testCluster) {
+	ctx := context.Background()
+	a := cluster.node(t, "a")
+	b := cluster.node(t, "b")
+
+	if err := b.Connect(ctx, "bob", "conn-1"); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	// Closed nodes are removed without waiting for their heartbeat to expire
+	if err := b.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	expectOnline(t, a, map[string]bool{"bob": false})
+	expectNodes(t, a, "a")
+}
+
+// TestRedisRemoveDeadNodes checks that cleanup removes the stored connections
+// of expired nodes and leaves live ones alone
+func TestRedisRemoveDeadNodes(t *testing.T) {
+	server := miniredis.RunT(t)
+	ctx := context.Background()
+	// A long heartbeat keeps the nodes' own cleanup out of the way
+	a, err := NewRedis("redis://"+server.Addr(), "a", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	b, err := NewRedis("redis://"+server.Addr(), "b", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	if err := b.Connect(ctx, "bob", "conn-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.removeDeadNodes(ctx); err != nil {
+		t.Fatalf("remove dead nodes: %v", err)
+	}
+	if !server.Exists(redisPresenceKey("bob")) {
+		t.Fatal("connection of a live node was removed")
+	}
+
+	b.Stop()
+	server.Del(redisNodeKey("b"))
+	if err := a.removeDeadNodes(ctx); err != nil {
+		t.Fatalf("remove dead nodes: %v", err)
+	}
+	for _, key := range []string{redisPresenceKey("bob"), redisNodeConnectionsKey("b")} {
+		if server.Exists(key) {
+			t.Errorf("%s was not removed", key)
+		}
+	}
+	if nodes, _ := server.Members(redisNodesKey); len(nodes) != 1 || nodes[0] != "a" {
+		t.Errorf("nodes = %v, want [a]", nodes)
+	}
+}
+
+func expectOnline(t *testing.T, p Presence, want map[string]bool) {
+	t.Helper()
+	userIDs := make([]string, 0, len(want))
+	for userID := range want {
+		userIDs = append(userIDs, userID)
+	}
+	online, err := p.Online(context.Background(), userIDs)
+	if err != nil {
+		t.Fatalf("online: %v", err)
+	}
+	for userID, wantOnline := range want {
+		if online[userID] != wantOnline {
+			t.Errorf("online[%s] = %v, want %v", userID, online[userID], wantOnline)
+		}
+	}
+}
+
+func expectNodes(t *testing.T, lister NodeLister, want ...string) {
+	t.Helper()
+	nodes, err := lister.Nodes(context.Background())
+	if err != nil {
+		t.Fatalf("nodes: %v", err)
+	}
+	if strings.Join(nodes, ",") != strings.Join(want, ",") {
+		t.Errorf("nodes = %v, want %v", nodes, want)
+	}
+}
+
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(testHeartbeat)
+	}
+}
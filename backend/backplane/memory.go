@@ -0,0 +1,203 @@
+package backplane
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is an in-memory stand-in for Redis, for tests and single process
+// deployments. Nodes created from the same Memory see each other's events
+// and connections, with the same heartbeat and cleanup rules as Redis.
+type Memory struct {
+	mu        sync.Mutex
+	heartbeat time.Duration
+	nodes     map[string]*MemoryNode
+	// lastBeat is when each node last sent a heartbeat
+	lastBeat map[string]time.Time
+	// connections maps user IDs to "node/connection" connections
+	connections map[string]map[string]string
+}
+
+func NewMemory(heartbeat time.Duration) *Memory {
+	return &Memory{
+		heartbeat:   heartbeat,
+		nodes:       make(map[string]*MemoryNode),
+		lastBeat:    make(map[string]time.Time),
+		connections: make(map[string]map[string]string),
+	}
+}
+
+// MemoryNode is one node of a Memory backplane
+type MemoryNode struct {
+	memory  *Memory
+	id      string
+	handler func(Event)
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Node starts a node that sends heartbeats until it is closed or stopped
+func (m *Memory) Node(id string) *MemoryNode {
+	node := &MemoryNode{
+		memory: m,
+		id:     id,
+		done:   make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	m.removeNode(id)
+	m.nodes[id] = node
+	m.lastBeat[id] = time.Now()
+	m.mu.Unlock()
+
+	go node.run()
+	return node
+}
+
+func (n *MemoryNode) Publish(ctx context.Context, event Event) error {
+	event.Node = n.id
+
+	n.memory.mu.Lock()
+	var handlers []func(Event)
+	for id, node := range n.memory.nodes {
+		if id != n.id && node.handler != nil {
+			handlers = append(handlers, node.handler)
+		}
+	}
+	n.memory.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+	return nil
+}
+
+func (n *MemoryNode) Subscribe(handler func(Event)) error {
+	n.memory.mu.Lock()
+	defer n.memory.mu.Unlock()
+	n.handler = handler
+	return nil
+}
+
+func (n *MemoryNode) Connect(ctx context.Context, userID, connectionID string) error {
+	n.memory.mu.Lock()
+	defer n.memory.mu.Unlock()
+
+	connections, ok := n.memory.connections[userID]
+	if !ok {
+		connections = make(map[string]string)
+		n.memory.connections[userID] = connections
+	}
+	connections[n.id+"/"+connectionID] = n.id
+	return nil
+}
+
+func (n *MemoryNode) Disconnect(ctx context.Context, userID, connectionID string) error {
+	n.memory.mu.Lock()
+	defer n.memory.mu.Unlock()
+
+	delete(n.memory.connections[userID], n.id+"/"+connectionID)
+	if len(n.memory.connections[userID]) == 0 {
+		delete(n.memory.connections, userID)
+	}
+	return nil
+}
+
+func (n *MemoryNode) Online(ctx context.Context, userIDs []string) (map[string]bool, error) {
+	n.memory.mu.Lock()
+	defer n.memory.mu.Unlock()
+
+	online := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		online[userID] = false
+		for _, node := range n.memory.connections[userID] {
+			if n.memory.alive(node) {
+				online[userID] = true
+				break
+			}
+		}
+	}
+	return online, nil
+}
+
+func (n *MemoryNode) Nodes(ctx context.Context) ([]string, error) {
+	n.memory.mu.Lock()
+	defer n.memory.mu.Unlock()
+
+	var nodes []string
+	for node := range n.memory.lastBeat {
+		if n.memory.alive(node) {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// run sends heartbeats and cleans up after dead nodes until the node is
+// closed or stopped
+func (n *MemoryNode) run() {
+	ticker := time.NewTicker(n.memory.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			n.memory.mu.Lock()
+			n.memory.lastBeat[n.id] = time.Now()
+			for id := range n.memory.lastBeat {
+				if !n.memory.alive(id) {
+					n.memory.removeNode(id)
+				}
+			}
+			n.memory.mu.Unlock()
+		}
+	}
+}
+
+// Stop stops the node's heartbeats without removing its connections, as if
+// the process had crashed. Other nodes drop its connections once its
+// heartbeat expires.
+func (n *MemoryNode) Stop() {
+	n.once.Do(func() {
+		close(n.done)
+	})
+}
+
+// Close stops the node and removes its connections
+func (n *MemoryNode) Close() error {
+	n.Stop()
+	n.memory.mu.Lock()
+	defer n.memory.mu.Unlock()
+	if n.memory.nodes[n.id] == n {
+		n.memory.removeNode(n.id)
+	}
+	return nil
+}
+
+// alive reports whether the node sent a heartbeat recently enough. The
+// caller must hold m.mu.
+func (m *Memory) alive(node string) bool {
+	lastBeat, ok := m.lastBeat[node]
+	return ok && time.Since(lastBeat) < heartbeatMisses*m.heartbeat
+}
+
+// removeNode deletes a node and its connections. The caller must hold m.mu.
+func (m *Memory) removeNode(node string) {
+	for userID, connections := range m.connections {
+		for connection, connectionNode := range connections {
+			if connectionNode == node {
+				delete(connections, connection)
+			}
+		}
+		if len(connections) == 0 {
+			delete(m.connections, userID)
+		}
+	}
+	delete(m.nodes, node)
+	delete(m.lastBeat, node)
+}
@@ -0,0 +1,174 @@
+package backplane
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// postgresChannel is the NOTIFY channel every node listens on
+	postgresChannel = "nwa_backplane"
+	// maxNotifyPayload keeps NOTIFY payloads under Postgres' 8000 byte limit.
+	// Larger events are stored in backplane_events and notified by ID.
+	maxNotifyPayload = 7900
+	// eventRetention is how long stored events are kept for other nodes to
+	// fetch
+	eventRetention = time.Minute
+	// listenerPingInterval is how often an idle listener checks that its
+	// connection is still alive
+	listenerPingInterval = 90 * time.Second
+)
+
+// Postgres is a backplane that uses LISTEN/NOTIFY on the application
+// database, so running several nodes needs nothing but Postgres. Events too
+// large for a notification are written to an unlogged table and only their
+// ID is notified; the receiving nodes fetch the row.
+type Postgres struct {
+	db       *sql.DB
+	node     string
+	listener *pq.Listener
+}
+
+// notification is the payload of a NOTIFY: the event itself, or the ID of
+// the backplane_events row holding it
+type notification struct {
+	Event
+	Ref int64 `json:"ref,omitempty"`
+}
+
+// NewPostgres returns a backplane for node that listens on a dedicated
+// connection to dsn and publishes through db
+func NewPostgres(db *sql.DB, dsn, node string) *Postgres {
+	listener := pq.NewListener(dsn, 100*time.Millisecond, 10*time.Second, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			log.Printf("Backplane listener disconnected: %v", err)
+		case pq.ListenerEventReconnected:
+			// Notifications sent while disconnected are lost
+			log.Printf("Backplane listener reconnected")
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Printf("Backplane listener failed to connect: %v", err)
+		}
+	})
+	return &Postgres{
+		db:       db,
+		node:     node,
+		listener: listener,
+	}
+}
+
+func (p *Postgres) Publish(ctx context.Context, event Event) error {
+	event.Node = p.node
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if len(body) > maxNotifyPayload {
+		var id int64
+		err := p.db.QueryRowContext(ctx, `
+			INSERT INTO backplane_events (payload)
+			VALUES ($1)
+			RETURNING id
+		`, body).Scan(&id)
+		if err != nil {
+			return err
+		}
+		_, err = p.db.ExecContext(ctx, `
+			DELETE FROM backplane_events
+			WHERE created_at < $1
+		`, time.Now().Add(-eventRetention))
+		if err != nil {
+			log.Printf("Failed to prune backplane events: %v", err)
+		}
+
+		body, err = json.Marshal(notification{Event: Event{Node: p.node, Kind: event.Kind}, Ref: id})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = p.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, postgresChannel, string(body))
+	return err
+}
+
+func (p *Postgres) Subscribe(handler func(Event)) error {
+	if err := p.listener.Listen(postgresChannel); err != nil {
+		return err
+	}
+	go p.listen(handler)
+	return nil
+}
+
+// listen hands notifications to handler until the listener is closed
+func (p *Postgres) listen(handler func(Event)) {
+	ticker := time.NewTicker(listenerPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case n, ok := <-p.listener.Notify:
+			if !ok {
+				return
+			}
+			// A nil notification follows a reconnect
+			if n == nil {
+				continue
+			}
+			event, ok := p.decode(n.Extra)
+			if ok {
+				handler(event)
+			}
+
+		case <-ticker.C:
+			go p.listener.Ping()
+		}
+	}
+}
+
+// decode parses a notification, fetching the event if only its ID was
+// notified. Events published by this node are skipped.
+func (p *Postgres) decode(payload string) (Event, bool) {
+	var n notification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		log.Printf("Invalid backplane notification: %v", err)
+		return Event{}, false
+	}
+	if n.Node == p.node {
+		return Event{}, false
+	}
+	if n.Ref == 0 {
+		return n.Event, true
+	}
+
+	var body []byte
+	err := p.db.QueryRow(`
+		SELECT payload
+		FROM backplane_events
+		WHERE id = $1
+	`, n.Ref).Scan(&body)
+	if err == sql.ErrNoRows {
+		log.Printf("Backplane event %d expired before it was fetched", n.Ref)
+		return Event{}, false
+	}
+	if err != nil {
+		log.Printf("Failed to fetch backplane event %d: %v", n.Ref, err)
+		return Event{}, false
+	}
+
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		log.Printf("Invalid backplane event %d: %v", n.Ref, err)
+		return Event{}, false
+	}
+	return event, true
+}
+
+func (p *Postgres) Close() error {
+	return p.listener.Close()
+}
@@ -0,0 +1,152 @@
+package backplane
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/google/uuid"
+)
+
+// subscribe collects the events a backplane receives for conversationID.
+// The notification channel is shared by every test schema, so events of
+// other tests are filtered out.
+func subscribe(t *testing.T, b Backplane, conversationID string) <-chan Event {
+	t.Helper()
+	events := make(chan Event, 16)
+	err := b.Subscribe(func(event Event) {
+		if event.ConversationID == conversationID {
+			events <- event
+		}
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	return events
+}
+
+func receive(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+		return Event{}
+	}
+}
+
+func expectNoEvent(t *testing.T, events <-chan Event) {
+	t.Helper()
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %+v", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPostgresFanOut(t *testing.T) {
+	db := dbtest.Open(t)
+	dsn := dbtest.URL(t)
+	ctx := context.Background()
+	conversationID := uuid.NewString()
+
+	a := NewPostgres(db, dsn, "node-a-"+uuid.NewString())
+	t.Cleanup(func() { a.Close() })
+	b := NewPostgres(db, dsn, "node-b-"+uuid.NewString())
+	t.Cleanup(func() { b.Close() })
+
+	fromA := subscribe(t, a, conversationID)
+	fromB := subscribe(t, b, conversationID)
+
+	err := a.Publish(ctx, Event{
+		Kind:           KindDeliver,
+		ConversationID: conversationID,
+		UserIDs:        []string{"alice"},
+		Payload:        json.RawMessage(`{"type":"message"}`),
+	})
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	event := receive(t, fromB)
+	if event.Node != a.node || event.Kind != KindDeliver {
+		t.Errorf("event = %+v, want a deliver from %s", event, a.node)
+	}
+	if len(event.UserIDs) != 1 || event.UserIDs[0] != "alice" {
+		t.Errorf("user IDs = %v, want [alice]", event.UserIDs)
+	}
+	if string(event.Payload) != `{"type":"message"}` {
+		t.Errorf("payload = %s", event.Payload)
+	}
+	// Nodes ignore their own events
+	expectNoEvent(t, fromA)
+}
+
+func TestPostgresLargeEvent(t *testing.T) {
+	db := dbtest.Open(t)
+	dsn := dbtest.URL(t)
+	ctx := context.Background()
+	conversationID := uuid.NewString()
+
+	a := NewPostgres(db, dsn, "node-a-"+uuid.NewString())
+	t.Cleanup(func() { a.Close() })
+	b := NewPostgres(db, dsn, "node-b-"+uuid.NewString())
+	t.Cleanup(func() { b.Close() })
+	fromB := subscribe(t, b, conversationID)
+
+	// Too large for a notification, so it is stored and fetched by ID
+	text := strings.Repeat("x", 2*maxNotifyPayload)
+	payload, _ := json.Marshal(map[string]string{"content": text})
+	err := a.Publish(ctx, Event{
+		Kind:           KindDeliver,
+		ConversationID: conversationID,
+		Payload:        payload,
+	})
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	event := receive(t, fromB)
+	if event.Node != a.node {
+		t.Errorf("node = %q, want %q", event.Node, a.node)
+	}
+	if string(event.Payload) != string(payload) {
+		t.Errorf("payload of %d bytes, want %d", len(event.Payload), len(payload))
+	}
+
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM backplane_events`).Scan(&stored); err != nil {
+		t.Fatalf("count stored events: %v", err)
+	}
+	if stored != 1 {
+		t.Errorf("stored events = %d, want 1", stored)
+	}
+}
+
+func TestPostgresDecode(t *testing.T) {
+	db := dbtest.Open(t)
+	p := &Postgres{db: db, node: "node-a"}
+
+	if _, ok := p.decode(`not json`); ok {
+		t.Error("invalid notification was decoded")
+	}
+	if _, ok := p.decode(`{"node":"node-a","kind":"deliver"}`); ok {
+		t.Error("own event was decoded")
+	}
+	// The stored event was pruned before it was fetched
+	if _, ok := p.decode(`{"node":"node-b","kind":"deliver","ref":999999}`); ok {
+		t.Error("missing stored event was decoded")
+	}
+
+	event, ok := p.decode(`{"node":"node-b","kind":"disconnect","session_ids":["s1"],"close_code":4001}`)
+	if !ok {
+		t.Fatal("event was not decoded")
+	}
+	if event.Kind != KindDisconnect || event.CloseCode != 4001 || len(event.SessionIDs) != 1 {
+		t.Errorf("event = %+v", event)
+	}
+}
@@ -0,0 +1,340 @@
+package backplane
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisChannel is the pub/sub channel every node subscribes to
+	redisChannel = "nwa:backplane"
+	// redisNodesKey is the set of nodes that have announced themselves
+	redisNodesKey = "nwa:nodes"
+	// heartbeatMisses is how many heartbeats a node can miss before its
+	// connections are dropped
+	heartbeatMisses = 3
+)
+
+// redisNodeKey expires unless the node keeps sending heartbeats
+func redisNodeKey(node string) string {
+	return "nwa:node:" + node
+}
+
+// redisNodeConnectionsKey lists the "user/connection" connections of a node, so
+// they can be removed when the node dies
+func redisNodeConnectionsKey(node string) string {
+	return "nwa:node:" + node + ":connections"
+}
+
+// redisPresencePrefix is the prefix of redisPresenceKey
+const redisPresencePrefix = "nwa:presence:"
+
+// redisPresenceKey maps the "node/connection" connections of a user to the node
+func redisPresenceKey(userID string) string {
+	return redisPresencePrefix + userID
+}
+
+// removeNodeScript deletes a node and every connection recorded for it in
+// one step, so a connection recorded meanwhile can't be left behind. Unless
+// ARGV[2] is "1" the node is only removed if its heartbeat key has expired,
+// which a node that came back between the check and the removal would
+// otherwise lose its connections to. The presence keys are derived from the
+// connections set, so this needs a single Redis server rather than a cluster.
+//
+// KEYS: node key, node connections key, nodes set
+// ARGV: node, force, presence key prefix
+var removeNodeScript = redis.NewScript(`
+if ARGV[2] ~= "1" and redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+for _, connection in ipairs(redis.call("SMEMBERS", KEYS[2])) do
+	local slash = string.find(connection, "/", 1, true)
+	if slash then
+		local userID = string.sub(connection, 1, slash - 1)
+		local connectionID = string.sub(connection, slash + 1)
+		redis.call("HDEL", ARGV[3] .. userID, ARGV[1] .. "/" .. connectionID)
+	end
+end
+redis.call("DEL", KEYS[1], KEYS[2])
+redis.call("SREM", KEYS[3], ARGV[1])
+return 1
+`)
+
+// Redis is a backplane and presence store on Redis. Events are sent with
+// pub/sub. Every heartbeat interval a node refreshes a key that expires
+// after a few missed heartbeats and removes the connections of nodes whose
+// key has expired.
+type Redis struct {
+	client    *redis.Client
+	node      string
+	heartbeat time.Duration
+	pubsub    *redis.PubSub
+	done      chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
+}
+
+// NewRedis connects to the Redis server at url, e.g. redis://localhost:6379/0,
+// and starts sending heartbeats for node
+func NewRedis(url, node string, heartbeat time.Duration) (*Redis, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	r := &Redis{
+		client:    redis.NewClient(options),
+		node:      node,
+		heartbeat: heartbeat,
+		done:      make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Connections left by an earlier process with the same node ID are gone
+	if err := r.removeNode(ctx, node); err != nil {
+		r.client.Close()
+		return nil, err
+	}
+	if err := r.beat(ctx); err != nil {
+		r.client.Close()
+		return nil, err
+	}
+
+	go r.run()
+	return r, nil
+}
+
+func (r *Redis) Publish(ctx context.Context, event Event) error {
+	event.Node = r.node
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, redisChannel, body).Err()
+}
+
+func (r *Redis) Subscribe(handler func(Event)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	r.pubsub = r.client.Subscribe(ctx, redisChannel)
+	// Wait for the subscription so no event published afterwards is missed
+	if _, err := r.pubsub.Receive(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		for message := range r.pubsub.Channel() {
+			var event Event
+			if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+				log.Printf("Invalid backplane event: %v", err)
+				continue
+			}
+			if event.Node != r.node {
+				handler(event)
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *Redis) Connect(ctx context.Context, userID, connectionID string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redisPresenceKey(userID), r.node+"/"+connectionID, r.node)
+		pipe.SAdd(ctx, redisNodeConnectionsKey(r.node), userID+"/"+connectionID)
+		return nil
+	})
+	return err
+}
+
+func (r *Redis) Disconnect(ctx context.Context, userID, connectionID string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, redisPresenceKey(userID), r.node+"/"+connectionID)
+		pipe.SRem(ctx, redisNodeConnectionsKey(r.node), userID+"/"+connectionID)
+		return nil
+	})
+	return err
+}
+
+func (r *Redis) Online(ctx context.Context, userIDs []string) (map[string]bool, error) {
+	online := make(map[string]bool, len(userIDs))
+	if len(userIDs) == 0 {
+		return online, nil
+	}
+
+	connections := make([]*redis.StringSliceCmd, len(userIDs))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, userID := range userIDs {
+			connections[i] = pipe.HVals(ctx, redisPresenceKey(userID))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Nodes that died since the last cleanup still have connections listed,
+	// so only nodes with a live heartbeat key count
+	alive := make(map[string]*redis.IntCmd)
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, cmd := range connections {
+			for _, node := range cmd.Val() {
+				if _, ok := alive[node]; !ok {
+					alive[node] = pipe.Exists(ctx, redisNodeKey(node))
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, userID := range userIDs {
+		online[userID] = false
+		for _, node := range connections[i].Val() {
+			if alive[node].Val() > 0 {
+				online[userID] = true
+				break
+			}
+		}
+	}
+	return online, nil
+}
+
+func (r *Redis) Nodes(ctx context.Context) ([]string, error) {
+	members, err := r.client.SMembers(ctx, redisNodesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// Dead nodes stay in the set until the next cleanup
+	alive := make([]*redis.IntCmd, len(members))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, node := range members {
+			alive[i] = pipe.Exists(ctx, redisNodeKey(node))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []string
+	for i, node := range members {
+		if alive[i].Val() > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// run sends heartbeats and cleans up after dead nodes until Close
+func (r *Redis) run() {
+	ticker := time.NewTicker(r.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), r.heartbeat)
+			if err := r.beat(ctx); err != nil {
+				log.Printf("Failed to send presence heartbeat: %v", err)
+			}
+			if err := r.removeDeadNodes(ctx); err != nil {
+				log.Printf("Failed to clean up dead nodes: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// beat announces the node and keeps it alive for a few more heartbeats
+func (r *Redis) beat(ctx context.Context) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, redisNodesKey, r.node)
+		pipe.Set(ctx, redisNodeKey(r.node), time.Now().Unix(), heartbeatMisses*r.heartbeat)
+		return nil
+	})
+	return err
+}
+
+// removeDeadNodes drops the connections of nodes whose heartbeat key has
+// expired. Any node may do this; removing a node twice is harmless.
+func (r *Redis) removeDeadNodes(ctx context.Context) error {
+	nodes, err := r.client.SMembers(ctx, redisNodesKey).Result()
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if node == r.node {
+			continue
+		}
+		removed, err := r.runRemoveNode(ctx, node, false)
+		if err != nil {
+			return err
+		}
+		if removed {
+			log.Printf("Node %s stopped sending heartbeats, removed its connections", node)
+		}
+	}
+	return nil
+}
+
+// removeNode deletes a node and every connection recorded for it
+func (r *Redis) removeNode(ctx context.Context, node string) error {
+	_, err := r.runRemoveNode(ctx, node, true)
+	return err
+}
+
+// runRemoveNode runs removeNodeScript and reports whether the node was
+// removed. Without force a node with a live heartbeat key is kept.
+func (r *Redis) runRemoveNode(ctx context.Context, node string, force bool) (bool, error) {
+	forceArg := "0"
+	if force {
+		forceArg = "1"
+	}
+	keys := []string{redisNodeKey(node), redisNodeConnectionsKey(node), redisNodesKey}
+	removed, err := removeNodeScript.Run(ctx, r.client, keys, node, forceArg, redisPresencePrefix).Int()
+	if err != nil {
+		return false, err
+	}
+	return removed == 1, nil
+}
+
+// Stop stops the node's heartbeats without removing its connections, as if
+// the process had crashed. Other nodes drop its connections once its
+// heartbeat key expires.
+func (r *Redis) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.done)
+	})
+}
+
+// Close stops the heartbeats and removes the node's connections, so other
+// nodes don't have to wait for it to expire
+func (r *Redis) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		r.Stop()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := r.removeNode(ctx, r.node); err != nil {
+			log.Printf("Failed to remove node %s from Redis: %v", r.node, err)
+		}
+		if r.pubsub != nil {
+			r.pubsub.Close()
+		}
+		err = r.client.Close()
+	})
+	return err
+}
@@ -0,0 +1,49 @@
+// Command fakeoidc runs a local OpenID Connect provider for development and
+// manual testing of the login flow. Point the backend at it with:
+//
+//	OIDC_PROVIDERS=dev
+//	OIDC_DEV_ISSUER=http://localhost:9998
+//	OIDC_DEV_CLIENT_ID=not-whatsapp
+//	OIDC_DEV_CLIENT_SECRET=secret
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth/oidctest"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:9998", "Address to listen on")
+	issuer := flag.String("issuer", "http://localhost:9998", "Issuer URL the provider is reachable at")
+	clientID := flag.String("client-id", "not-whatsapp", "OAuth client ID")
+	clientSecret := flag.String("client-secret", "secret", "OAuth client secret")
+	users := flag.String("users", "alice:alice@example.com:Alice,bob:bob@example.com:Bob", "Comma separated subject:email:name accounts")
+	flag.Parse()
+
+	server, err := oidctest.NewServer(*issuer, *clientID, *clientSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, spec := range strings.Split(*users, ",") {
+		parts := strings.SplitN(strings.TrimSpace(spec), ":", 3)
+		if len(parts) != 3 {
+			log.Fatalf("Invalid user %q, expected subject:email:name", spec)
+		}
+		server.AddUser(oidctest.User{
+			Subject:       parts[0],
+			Email:         parts[1],
+			EmailVerified: true,
+			Name:          parts[2],
+		})
+	}
+
+	log.Printf("Fake OIDC provider %s listening on %s", *issuer, *addr)
+	if err := http.ListenAndServe(*addr, server); err != nil {
+		log.Fatal(err)
+	}
+}
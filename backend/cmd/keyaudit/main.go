@@ -0,0 +1,295 @@
+// Command keyaudit independently audits the server's key transparency log.
+//
+// It pins the log's signing key and the last tree head it has seen in a local
+// state file, checks that every new tree head is a consistent extension of the
+// previous one, recomputes the root from the raw entries and optionally checks
+// that a user's current key is included. Tree heads received by other users
+// can be passed with -peer to detect a server presenting different views of
+// the log to different people.
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/transparency"
+)
+
+// auditState is persisted between runs
+type auditState struct {
+	LogPublicKey []byte                       `json:"log_public_key"`
+	TreeHead     *transparency.SignedTreeHead `json:"tree_head"`
+}
+
+type auditor struct {
+	server string
+	client *http.Client
+	key    ed25519.PublicKey
+}
+
+func main() {
+	server := flag.String("server", "http://localhost:8080", "Backend base URL")
+	statePath := flag.String("state", ".keyaudit.json", "File the pinned log key and last tree head are kept in")
+	userID := flag.String("user", "", "Check that this user's current key is in the log")
+	peerPath := flag.String("peer", "", "Tree head JSON received by another user to cross-check")
+	flag.Parse()
+
+	a := &auditor{
+		server: *server,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	state, err := loadState(*statePath)
+	if err != nil {
+		log.Fatalf("Failed to load state: %v", err)
+	}
+
+	if err := a.checkLogKey(state); err != nil {
+		log.Fatalf("Log key check failed: %v", err)
+	}
+
+	var sth transparency.SignedTreeHead
+	if err := a.get("/api/v1/keylog/tree-head", nil, &sth); err != nil {
+		log.Fatalf("Failed to fetch tree head: %v", err)
+	}
+	if err := sth.Verify(a.key); err != nil {
+		log.Fatalf("Tree head rejected: %v", err)
+	}
+	log.Printf("Tree head verified: size %d", sth.TreeSize)
+
+	if state.TreeHead != nil {
+		if err := a.checkConsistency(state.TreeHead, &sth); err != nil {
+			log.Fatalf("Log is not consistent with the last audited tree head: %v", err)
+		}
+		log.Printf("Consistent with previously audited size %d", state.TreeHead.TreeSize)
+	}
+
+	latestKeys, err := a.checkEntries(&sth)
+	if err != nil {
+		log.Fatalf("Entry audit failed: %v", err)
+	}
+	log.Printf("Recomputed root over %d entries matches the tree head", sth.TreeSize)
+
+	if *userID != "" {
+		if err := a.checkUser(*userID, &sth, latestKeys); err != nil {
+			log.Fatalf("User key check failed: %v", err)
+		}
+		log.Printf("Current key of user %s is included in the log", *userID)
+	}
+
+	if *peerPath != "" {
+		if err := a.checkPeer(*peerPath, &sth); err != nil {
+			log.Fatalf("Peer tree head check failed: %v", err)
+		}
+		log.Printf("Peer tree head is consistent with ours")
+	}
+
+	state.TreeHead = &sth
+	if err := saveState(*statePath, state); err != nil {
+		log.Fatalf("Failed to save state: %v", err)
+	}
+	log.Println("Audit passed")
+}
+
+// checkLogKey fetches the log's signing key and compares it with the pinned one
+func (a *auditor) checkLogKey(state *auditState) error {
+	var resp struct {
+		PublicKey []byte `json:"public_key"`
+	}
+	if err := a.get("/api/v1/keylog/public-key", nil, &resp); err != nil {
+		return err
+	}
+	if len(resp.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("server returned an invalid log key")
+	}
+
+	if state.LogPublicKey == nil {
+		log.Printf("Pinning log key on first use")
+		state.LogPublicKey = resp.PublicKey
+	} else if !bytes.Equal(state.LogPublicKey, resp.PublicKey) {
+		return errors.New("log key differs from the pinned key")
+	}
+
+	a.key = state.LogPublicKey
+	return nil
+}
+
+// checkConsistency verifies that newer extends older
+func (a *auditor) checkConsistency(older, newer *transparency.SignedTreeHead) error {
+	if newer.TreeSize < older.TreeSize {
+		return fmt.Errorf("log shrank from %d to %d entries", older.TreeSize, newer.TreeSize)
+	}
+	if older.TreeSize == 0 {
+		return nil
+	}
+
+	var proof models.KeyLogConsistency
+	params := url.Values{}
+	params.Set("first", fmt.Sprint(older.TreeSize))
+	params.Set("second", fmt.Sprint(newer.TreeSize))
+	if err := a.get("/api/v1/keylog/proof/consistency", params, &proof); err != nil {
+		return err
+	}
+
+	return transparency.VerifyConsistency(older.TreeSize, newer.TreeSize, older.RootHash, newer.RootHash, proof.Proof)
+}
+
+// checkEntries downloads every entry, recomputes the root and returns the
+// latest logged key for each user
+func (a *auditor) checkEntries(sth *transparency.SignedTreeHead) (map[string]string, error) {
+	leaves := make([][]byte, 0, sth.TreeSize)
+	latestKeys := make(map[string]string)
+
+	for start := uint64(0); start < sth.TreeSize; {
+		params := url.Values{}
+		params.Set("start", fmt.Sprint(start))
+		params.Set("end", fmt.Sprint(sth.TreeSize))
+
+		var entries []models.KeyLogEntry
+		if err := a.get("/api/v1/keylog/entries", params, &entries); err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("log returned no entries at index %d", start)
+		}
+
+		for _, entry := range entries {
+			if entry.LeafIndex != start {
+				return nil, fmt.Errorf("expected entry %d, got %d", start, entry.LeafIndex)
+			}
+
+			var leaf models.KeyLogLeaf
+			if err := json.Unmarshal(entry.LeafData, &leaf); err != nil {
+				return nil, fmt.Errorf("entry %d has malformed leaf data: %v", start, err)
+			}
+			if leaf.UserID != entry.UserID || leaf.PublicKey != entry.PublicKey {
+				return nil, fmt.Errorf("entry %d does not match its leaf data", start)
+			}
+
+			leaves = append(leaves, transparency.LeafHash(entry.LeafData))
+			latestKeys[leaf.UserID] = leaf.PublicKey
+			start++
+		}
+	}
+
+	if !bytes.Equal(transparency.RootHash(leaves), sth.RootHash) {
+		return nil, errors.New("recomputed root does not match the tree head")
+	}
+	return latestKeys, nil
+}
+
+// checkUser verifies that the key the server hands out for a user is the
+// latest one in the log, with a valid inclusion proof
+func (a *auditor) checkUser(userID string, sth *transparency.SignedTreeHead, latestKeys map[string]string) error {
+	var resp struct {
+		Entry    models.KeyLogEntry           `json:"entry"`
+		TreeHead *transparency.SignedTreeHead `json:"tree_head"`
+		Proof    models.KeyLogProof           `json:"proof"`
+	}
+	if err := a.get("/api/v1/keylog/users/"+url.PathEscape(userID), nil, &resp); err != nil {
+		return err
+	}
+
+	if err := resp.TreeHead.Verify(a.key); err != nil {
+		return err
+	}
+	if resp.TreeHead.TreeSize != sth.TreeSize || !bytes.Equal(resp.TreeHead.RootHash, sth.RootHash) {
+		// The log may have grown since we fetched our head, but it must not fork
+		if err := a.checkConsistency(sth, resp.TreeHead); err != nil {
+			return fmt.Errorf("user lookup was served from a different log view: %v", err)
+		}
+	}
+
+	var leaf models.KeyLogLeaf
+	if err := json.Unmarshal(resp.Entry.LeafData, &leaf); err != nil {
+		return err
+	}
+	if leaf.UserID != userID {
+		return errors.New("server returned an entry for a different user")
+	}
+	if latest, ok := latestKeys[userID]; ok && resp.TreeHead.TreeSize == sth.TreeSize && latest != leaf.PublicKey {
+		return errors.New("server returned a key that is not the user's latest logged key")
+	}
+
+	return transparency.VerifyInclusion(
+		transparency.LeafHash(resp.Entry.LeafData),
+		resp.Proof.LeafIndex,
+		resp.TreeHead.TreeSize,
+		resp.Proof.AuditPath,
+		resp.TreeHead.RootHash,
+	)
+}
+
+// checkPeer verifies a tree head another user received is signed by the log
+// and lies on the same history as ours
+func (a *auditor) checkPeer(path string, sth *transparency.SignedTreeHead) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var peer transparency.SignedTreeHead
+	if err := json.Unmarshal(data, &peer); err != nil {
+		return err
+	}
+	if err := peer.Verify(a.key); err != nil {
+		return err
+	}
+
+	if peer.TreeSize <= sth.TreeSize {
+		return a.checkConsistency(&peer, sth)
+	}
+	return a.checkConsistency(sth, &peer)
+}
+
+func (a *auditor) get(path string, params url.Values, v interface{}) error {
+	target := a.server + path
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+
+	resp, err := a.client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func loadState(path string) (*auditState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &auditState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state auditState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func saveState(path string, state *auditState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,40 @@
+// Command protocolschema writes the JSON Schema of the WebSocket protocol,
+// which is published in docs/protocol.schema.json for frontend and bot
+// clients. With -check it instead fails if the published file is out of
+// date.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/protocol"
+)
+
+func main() {
+	out := flag.String("o", "docs/protocol.schema.json", "file to write the schema to")
+	check := flag.Bool("check", false, "fail if the file doesn't match the schema instead of writing it")
+	flag.Parse()
+
+	schema, err := protocol.SchemaJSON()
+	if err != nil {
+		log.Fatalf("Failed to generate schema: %v", err)
+	}
+
+	if *check {
+		current, err := os.ReadFile(*out)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", *out, err)
+		}
+		if !bytes.Equal(current, schema) {
+			log.Fatalf("%s is out of date, run go generate ./protocol", *out)
+		}
+		return
+	}
+
+	if err := os.WriteFile(*out, schema, 0o644); err != nil {
+		log.Fatalf("Failed to write %s: %v", *out, err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/config"
+	"github.com/RatneshMaurya/not-whatsapp/backend/crypto"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	// Load environment variables
+	if err := godotenv.Load(); err != nil {
+		log.Printf("Warning: .env file not found, using environment variables")
+	}
+
+	// Parse command line flags
+	rewrap := flag.Bool("rewrap", true, "Rewrap conversation keys and TOTP secrets under the primary master key")
+	seal := flag.Bool("seal", true, "Seal message content and TOTP secrets stored before encryption at rest was enabled")
+	unseal := flag.Bool("unseal", false, "Decrypt all sealed message content and TOTP secrets back to plaintext")
+	batchSize := flag.Int("batch", 500, "Rows per transaction")
+	flag.Parse()
+
+	cfg := config.LoadConfig()
+	keyring, err := crypto.LoadKeyring(cfg.MasterKeys, cfg.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Invalid master key configuration: %v", err)
+	}
+	if keyring == nil {
+		log.Fatal("MASTER_KEYS or MASTER_KEY_FILE must be set")
+	}
+
+	// Initialize database connection
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// Test the connection
+	if err := db.Ping(); err != nil {
+		log.Fatal(err)
+	}
+
+	cipher := services.NewContentCipher(db, keyring)
+	twoFactor := services.NewTwoFactorService(db, cipher, cfg.TOTPIssuer)
+
+	if *unseal {
+		log.Println("Unsealing message content...")
+		total := runBatches(*batchSize, cipher.UnsealAll)
+		log.Printf("Unsealed %d messages", total)
+		total = runBatches(*batchSize, twoFactor.UnsealSecrets)
+		log.Printf("Unsealed %d TOTP secrets", total)
+		return
+	}
+
+	if *rewrap {
+		log.Printf("Rewrapping conversation keys under master key %s...", keyring.Primary().ID)
+		total := runBatches(*batchSize, cipher.RewrapKeys)
+		log.Printf("Rewrapped %d conversation keys", total)
+	}
+
+	if *seal {
+		log.Println("Sealing plaintext message content...")
+		total := runBatches(*batchSize, cipher.SealPlaintext)
+		log.Printf("Sealed %d messages", total)
+	}
+
+	// Sealing a TOTP secret always wraps it under the primary master key
+	if *rewrap || *seal {
+		log.Println("Sealing TOTP secrets...")
+		total := runBatches(*batchSize, twoFactor.SealSecrets)
+		log.Printf("Sealed %d TOTP secrets", total)
+	}
+}
+
+// runBatches calls step until it reports no more work
+func runBatches(batchSize int, step func(int) (int, error)) int {
+	total := 0
+	for {
+		n, err := step(batchSize)
+		if err != nil {
+			log.Fatalf("Failed after %d rows: %v", total, err)
+		}
+		if n == 0 {
+			return total
+		}
+		total += n
+		log.Printf("Processed %d rows", total)
+	}
+}
@@ -0,0 +1,52 @@
+// Command setrole gives a user a role, such as admin to use the admin API.
+//
+//	go run ./cmd/setrole -email alice@example.com -role admin
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	// Load environment variables
+	if err := godotenv.Load(); err != nil {
+		log.Printf("Warning: .env file not found, using environment variables")
+	}
+
+	// Parse command line flags
+	email := flag.String("email", "", "Email of the user")
+	role := flag.String("role", models.RoleAdmin, "Role to give the user: user or admin")
+	flag.Parse()
+
+	if *email == "" {
+		log.Fatal("-email is required")
+	}
+	if *role != models.RoleUser && *role != models.RoleAdmin {
+		log.Fatalf("Unknown role %q", *role)
+	}
+
+	// Initialize database connection
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// Test the connection
+	if err := db.Ping(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := services.NewUserService(db).SetRole(*email, *role); err != nil {
+		log.Fatalf("Failed to set role: %v", err)
+	}
+	log.Printf("%s is now %s", *email, *role)
+}
@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Builtins returns a registry with the commands built into the server
+func Builtins() *Registry {
+	r := NewRegistry()
+	r.Register(Command{
+		Name:        "shrug",
+		Description: "Posts a message with a shrug appended",
+		Usage:       "/shrug [message]",
+		Handler:     shrug,
+	})
+	r.Register(Command{
+		Name:        "me",
+		Description: "Posts an action, like \"Alice waves\"",
+		Usage:       "/me <action>",
+		Handler:     me,
+	})
+	r.Register(Command{
+		Name:        "poll",
+		Description: "Posts a poll with numbered options",
+		Usage:       "/poll <question> | <option> | <option> [| ...]",
+		Handler:     poll,
+	})
+	return r
+}
+
+func shrug(ctx context.Context, inv Invocation) (*Response, error) {
+	text := `¯\_(ツ)_/¯`
+	if inv.Args != "" {
+		text = inv.Args + " " + text
+	}
+	return &Response{Text: text, Visibility: Public}, nil
+}
+
+func me(ctx context.Context, inv Invocation) (*Response, error) {
+	if inv.Args == "" {
+		return &Response{Text: "Usage: /me <action>", Visibility: Ephemeral}, nil
+	}
+	return &Response{Text: "_" + inv.UserName + " " + inv.Args + "_", Visibility: Public}, nil
+}
+
+func poll(ctx context.Context, inv Invocation) (*Response, error) {
+	var parts []string
+	for _, part := range strings.Split(inv.Args, "|") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) < 3 {
+		return &Response{Text: "Usage: /poll <question> | <option> | <option> [| ...]", Visibility: Ephemeral}, nil
+	}
+	if len(parts) > 11 {
+		return &Response{Text: "A poll can have at most 10 options", Visibility: Ephemeral}, nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Poll: %s", parts[0])
+	for i, option := range parts[1:] {
+		fmt.Fprintf(&b, "\n%d. %s", i+1, option)
+	}
+	b.WriteString("\nReply with the number of your choice.")
+	return &Response{Text: b.String(), Visibility: Public}, nil
+}
@@ -0,0 +1,107 @@
+// Package commands parses slash commands such as "/poll" in messages and
+// provides the commands built into the server. Commands registered by bots
+// are dispatched by services.CommandService.
+package commands
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Who sees the reply to a command
+const (
+	// Ephemeral replies are only shown to the user who ran the command and
+	// are not stored
+	Ephemeral = "ephemeral"
+	// Public replies are posted to the conversation as a message
+	Public = "public"
+)
+
+// Invocation is a command a user ran in a conversation
+type Invocation struct {
+	// Name is the command without its slash, e.g. "poll"
+	Name           string
+	Args           string
+	ConversationID string
+	UserID         string
+	UserName       string
+}
+
+// Response is what a command replies with. An empty Text posts nothing.
+type Response struct {
+	Text       string
+	Visibility string
+}
+
+// Handler runs a command
+type Handler func(ctx context.Context, inv Invocation) (*Response, error)
+
+// Command is a command handled in-process
+type Command struct {
+	Name        string
+	Description string
+	Usage       string
+	Handler     Handler
+}
+
+// Registry holds in-process commands by name. Commands are registered at
+// startup; lookups are safe for concurrent use afterwards.
+type Registry struct {
+	commands map[string]Command
+}
+
+func NewRegistry() *Registry {
+	return &Registry{commands: make(map[string]Command)}
+}
+
+// Register adds a command, replacing any command with the same name
+func (r *Registry) Register(command Command) {
+	r.commands[command.Name] = command
+}
+
+// Lookup returns the command with the name
+func (r *Registry) Lookup(name string) (Command, bool) {
+	command, ok := r.commands[name]
+	return command, ok
+}
+
+// Commands returns every command sorted by name
+func (r *Registry) Commands() []Command {
+	commands := make([]Command, 0, len(r.commands))
+	for _, command := range r.commands {
+		commands = append(commands, command)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+	return commands
+}
+
+// validName restricts command names to what is easy to type
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// ValidName reports whether name can be used as a command name
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// Parse splits a message like "/poll Lunch? | Pizza | Sushi" into the
+// command name and its arguments. Messages that don't start with a slash
+// followed by a valid name, such as "/usr/bin is full", are not commands.
+func Parse(content string) (name, args string, ok bool) {
+	if !strings.HasPrefix(content, "/") {
+		return "", "", false
+	}
+	name = content[1:]
+	if end := strings.IndexFunc(name, unicode.IsSpace); end >= 0 {
+		name, args = name[:end], name[end:]
+	}
+	name = strings.ToLower(name)
+	if !ValidName(name) {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(args), true
+}
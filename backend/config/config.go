@@ -1,10 +1,28 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+	"github.com/RatneshMaurya/not-whatsapp/backend/protocol"
+	"github.com/RatneshMaurya/not-whatsapp/backend/ratelimit"
 )
 
+// OIDCProviderConfig configures a generic OpenID Connect identity provider
+type OIDCProviderConfig struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+}
+
 type Config struct {
 	DBHost         string
 	DBPort         string
@@ -14,21 +32,366 @@ type Config struct {
 	GoogleClientID string
 	GoogleSecret   string
 	ServerPort     string
+	// Environment is "development" or anything else, e.g. "production",
+	// which is the default. Insecure defaults are only accepted in
+	// development, so it has to be asked for.
+	Environment string
+	// JWTSecret signs single-purpose tokens such as login links. Access
+	// tokens are signed with rotating JWTSigningAlg keys: each key signs for
+	// JWTKeyRotation and is published JWTKeyOverlap before and after.
 	JWTSecret      string
+	JWTSigningAlg  string
+	JWTKeyRotation time.Duration
+	JWTKeyOverlap  time.Duration
+	// PublicURL is where browsers and identity providers reach the backend,
+	// FrontendURL is the web app. AllowedReturnURLs lists other frontends a
+	// login may return to, such as a desktop app.
+	PublicURL         string
+	FrontendURL       string
+	AllowedReturnURLs []string
+	// TrustedProxies lists the reverse proxies, as IPs or CIDRs, whose
+	// X-Forwarded-For header is believed. Without any, the client IP is the
+	// address of the connection.
+	TrustedProxies []string
+	// AccessTokenTTL is how long an access token is accepted; RefreshTokenTTL
+	// is how long a session can be kept alive with refresh tokens
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// SessionCookies returns tokens to browsers in HttpOnly cookies instead
+	// of the response body
+	SessionCookies bool
+	// KeyLogSigningKey is the base64 Ed25519 seed key log tree heads are signed with
+	KeyLogSigningKey string
+	// AttachmentsDir is where encrypted attachment blobs are stored
+	AttachmentsDir string
+	// MaxAttachmentSize is the largest ciphertext accepted, in bytes
+	MaxAttachmentSize int
+	// MasterKeys lists "id:base64key" master keys for sealing message content
+	// at rest, primary first. MasterKeyFile is read when MasterKeys is empty.
+	MasterKeys    string
+	MasterKeyFile string
+	// OIDCProviders are read from OIDC_PROVIDERS, a comma separated list of
+	// names, and OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, _DISPLAY_NAME
+	// and _SCOPES for each
+	OIDCProviders []OIDCProviderConfig
+	// MailDriver selects how email is sent: "smtp", "file" (one .eml file per
+	// message in MailDir) or "log"
+	MailDriver   string
+	MailFrom     string
+	MailDir      string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	// EmailLoginTTL is how long an emailed login link works.
+	// EmailLoginPerEmail and EmailLoginPerIP cap link requests per hour.
+	EmailLoginTTL      time.Duration
+	EmailLoginPerEmail int
+	EmailLoginPerIP    int
+	// TOTPIssuer names this server in authenticator apps
+	TOTPIssuer string
+	// RequireTwoFactor makes every user set up TOTP before they can sign in,
+	// whatever the admin setting
+	RequireTwoFactor bool
+	// WebhookTimeout bounds each webhook request; a delivery is given up
+	// after WebhookMaxAttempts failed attempts
+	WebhookTimeout     time.Duration
+	WebhookMaxAttempts int
+	// EgressAllowlist holds internal networks webhooks and bots may be
+	// reached at anyway, e.g. 127.0.0.1 for a bot running locally in
+	// development. Other loopback, private and link-local addresses are
+	// refused.
+	EgressAllowlist []string
+	// CommandTimeout bounds how long a bot gets to answer a slash command
+	CommandTimeout time.Duration
+	// Backplane selects how WebSocket traffic reaches clients connected to
+	// other nodes: "local" for a single node, "postgres" or "redis". NodeID
+	// names this node and must be unique within the deployment.
+	Backplane string
+	NodeID    string
+	// RedisURL is the Redis server of the redis backplane, which also keeps
+	// presence. Nodes send a heartbeat every PresenceHeartbeat.
+	RedisURL          string
+	PresenceHeartbeat time.Duration
+	// ShutdownTimeout bounds a graceful shutdown. WebSocket clients are told
+	// to reconnect after ReconnectDelay, plus jitter.
+	ShutdownTimeout time.Duration
+	ReconnectDelay  time.Duration
+	// RateLimits holds the rate of each budget by role, and
+	// RateLimitBotOverrides "<bot id>:<budget>=<rate>" entries replacing the
+	// bot role's rates for single bots. A WebSocket connection is closed
+	// after RateLimitMaxViolations rejected frames within a minute.
+	RateLimits             map[string]map[string]ratelimit.Rate
+	RateLimitBotOverrides  []string
+	RateLimitMaxViolations int
+	// WSReadBufferSize and WSWriteBufferSize size the I/O buffers of each
+	// WebSocket connection, in bytes. With WSWriteBufferPool write buffers
+	// are shared and only held while a frame is written.
+	WSReadBufferSize  int
+	WSWriteBufferSize int
+	WSWriteBufferPool bool
+	// WSReadLimits caps the size of each frame type clients send, in bytes
+	WSReadLimits map[string]int
+	// WSCompression negotiates permessage-deflate at WSCompressionLevel.
+	// Frames smaller than WSCompressionThreshold bytes are sent uncompressed.
+	WSCompression          bool
+	WSCompressionLevel     int
+	WSCompressionThreshold int
+	// WSSendQueueSize bounds the frames queued for each client. A client
+	// whose queue fills up with frames that can't be dropped is disconnected.
+	WSSendQueueSize int
+	// MetricsAddr is where expvar metrics are served, off if empty
+	MetricsAddr string
 }
 
 func LoadConfig() *Config {
 	return &Config{
-		DBHost:         getEnv("DB_HOST", "localhost"),
-		DBPort:         getEnv("DB_PORT", "5432"),
-		DBUser:         getEnv("DB_USER", "postgres"),
-		DBPassword:     getEnv("DB_PASSWORD", "postgres"),
-		DBName:         getEnv("DB_NAME", "notwhatsapp"),
-		GoogleClientID: getEnv("GOOGLE_CLIENT_ID", ""),
-		GoogleSecret:   getEnv("GOOGLE_SECRET", ""),
-		ServerPort:     getEnv("SERVER_PORT", "8080"),
-		JWTSecret:      getEnv("JWT_SECRET", "your-secret-key"),
+		DBHost:             getEnv("DB_HOST", "localhost"),
+		DBPort:             getEnv("DB_PORT", "5432"),
+		DBUser:             getEnv("DB_USER", "postgres"),
+		DBPassword:         getEnv("DB_PASSWORD", "postgres"),
+		DBName:             getEnv("DB_NAME", "notwhatsapp"),
+		GoogleClientID:     getEnv("GOOGLE_CLIENT_ID", ""),
+		GoogleSecret:       getEnv("GOOGLE_SECRET", ""),
+		ServerPort:         getEnv("SERVER_PORT", "8080"),
+		Environment:        getEnv("APP_ENV", "production"),
+		JWTSecret:          getEnv("JWT_SECRET", defaultJWTSecret),
+		JWTSigningAlg:      getEnv("JWT_SIGNING_ALG", "EdDSA"),
+		JWTKeyRotation:     getEnvDuration("JWT_KEY_ROTATION", 30*24*time.Hour),
+		JWTKeyOverlap:      getEnvDuration("JWT_KEY_OVERLAP", 24*time.Hour),
+		PublicURL:          getEnv("PUBLIC_URL", "http://localhost:8080"),
+		FrontendURL:        getEnv("FRONTEND_URL", "http://localhost:3000"),
+		AllowedReturnURLs:  getEnvList("ALLOWED_RETURN_URLS"),
+		TrustedProxies:     getEnvList("TRUSTED_PROXIES"),
+		AccessTokenTTL:     getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL:    getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		KeyLogSigningKey:   getEnv("KEY_LOG_SIGNING_KEY", ""),
+		AttachmentsDir:     getEnv("ATTACHMENTS_DIR", "data/attachments"),
+		MaxAttachmentSize:  getEnvInt("MAX_ATTACHMENT_SIZE", 100*1024*1024),
+		MasterKeys:         getEnv("MASTER_KEYS", ""),
+		MasterKeyFile:      getEnv("MASTER_KEY_FILE", ""),
+		OIDCProviders:      loadOIDCProviders(),
+		MailDriver:         getEnv("MAIL_DRIVER", "log"),
+		MailFrom:           getEnv("MAIL_FROM", "not-whatsapp <no-reply@localhost>"),
+		MailDir:            getEnv("MAIL_DIR", "data/mail"),
+		SMTPHost:           getEnv("SMTP_HOST", "localhost"),
+		SMTPPort:           getEnvInt("SMTP_PORT", 1025),
+		SMTPUsername:       getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:       getEnv("SMTP_PASSWORD", ""),
+		EmailLoginTTL:      getEnvDuration("EMAIL_LOGIN_TTL", 15*time.Minute),
+		EmailLoginPerEmail: getEnvInt("EMAIL_LOGIN_PER_EMAIL", 5),
+		EmailLoginPerIP:    getEnvInt("EMAIL_LOGIN_PER_IP", 20),
+		TOTPIssuer:         getEnv("TOTP_ISSUER", "not-whatsapp"),
+		RequireTwoFactor:   getEnvBool("REQUIRE_TWO_FACTOR", false),
+		SessionCookies:     getEnvBool("SESSION_COOKIES", false),
+		WebhookTimeout:     getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		WebhookMaxAttempts: getEnvInt("WEBHOOK_MAX_ATTEMPTS", 10),
+		EgressAllowlist:    getEnvList("EGRESS_ALLOWLIST"),
+		CommandTimeout:     getEnvDuration("COMMAND_TIMEOUT", 5*time.Second),
+		Backplane:          getEnv("BACKPLANE", "local"),
+		NodeID:             getEnv("NODE_ID", defaultNodeID()),
+		RedisURL:           getEnv("REDIS_URL", "redis://localhost:6379/0"),
+		PresenceHeartbeat:  getEnvDuration("PRESENCE_HEARTBEAT", 10*time.Second),
+		ShutdownTimeout:    getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		ReconnectDelay:     getEnvDuration("RECONNECT_DELAY", time.Second),
+		RateLimits: map[string]map[string]ratelimit.Rate{
+			ratelimit.RoleUser: {
+				ratelimit.BudgetMessages: getEnvRate("RATE_LIMIT_USER_MESSAGES", ratelimit.Rate{Burst: 20, Interval: 10 * time.Second}),
+				ratelimit.BudgetTyping:   getEnvRate("RATE_LIMIT_USER_TYPING", ratelimit.Rate{Burst: 10, Interval: 10 * time.Second}),
+				ratelimit.BudgetAPI:      getEnvRate("RATE_LIMIT_USER_API", ratelimit.Rate{Burst: 120, Interval: time.Minute}),
+			},
+			ratelimit.RoleBot: {
+				ratelimit.BudgetMessages: getEnvRate("RATE_LIMIT_BOT_MESSAGES", ratelimit.Rate{Burst: 30, Interval: 10 * time.Second}),
+				ratelimit.BudgetTyping:   getEnvRate("RATE_LIMIT_BOT_TYPING", ratelimit.Rate{Burst: 5, Interval: 10 * time.Second}),
+				ratelimit.BudgetAPI:      getEnvRate("RATE_LIMIT_BOT_API", ratelimit.Rate{Burst: 300, Interval: time.Minute}),
+			},
+		},
+		RateLimitBotOverrides:  getEnvList("RATE_LIMIT_BOT_OVERRIDES"),
+		RateLimitMaxViolations: getEnvInt("RATE_LIMIT_MAX_VIOLATIONS", 10),
+		WSReadBufferSize:       getEnvInt("WS_READ_BUFFER_SIZE", 1024),
+		WSWriteBufferSize:      getEnvInt("WS_WRITE_BUFFER_SIZE", 1024),
+		WSWriteBufferPool:      getEnvBool("WS_WRITE_BUFFER_POOL", true),
+		WSReadLimits: map[string]int{
+			protocol.TypePing:    getEnvInt("WS_READ_LIMIT_PING", 512),
+			protocol.TypeTyping:  getEnvInt("WS_READ_LIMIT_TYPING", 512),
+			protocol.TypeMessage: getEnvInt("WS_READ_LIMIT_MESSAGE", 4096),
+		},
+		WSCompression:          getEnvBool("WS_COMPRESSION", true),
+		WSCompressionLevel:     getEnvInt("WS_COMPRESSION_LEVEL", 1),
+		WSCompressionThreshold: getEnvInt("WS_COMPRESSION_THRESHOLD", 1024),
+		WSSendQueueSize:        getEnvInt("WS_SEND_QUEUE_SIZE", 256),
+		MetricsAddr:            getEnv("METRICS_ADDR", ""),
+	}
+}
+
+func loadOIDCProviders() []OIDCProviderConfig {
+	var providers []OIDCProviderConfig
+	for _, name := range strings.Split(getEnv("OIDC_PROVIDERS", ""), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + envName(name) + "_"
+		providers = append(providers, OIDCProviderConfig{
+			Name:         name,
+			DisplayName:  getEnv(prefix+"DISPLAY_NAME", name),
+			Issuer:       getEnv(prefix+"ISSUER", ""),
+			ClientID:     getEnv(prefix+"CLIENT_ID", ""),
+			ClientSecret: getEnv(prefix+"CLIENT_SECRET", ""),
+			Scopes:       strings.FieldsFunc(getEnv(prefix+"SCOPES", ""), func(r rune) bool { return r == ',' || r == ' ' }),
+		})
+	}
+	return providers
+}
+
+// defaultJWTSecret is the placeholder secret that is refused outside
+// development
+const defaultJWTSecret = "your-secret-key"
+
+// IsDevelopment reports whether the server runs in development mode
+func (c *Config) IsDevelopment() bool {
+	return c.Environment == "development"
+}
+
+// SecureCookies reports whether cookies should be limited to HTTPS
+func (c *Config) SecureCookies() bool {
+	return strings.HasPrefix(c.PublicURL, "https://")
+}
+
+// Validate reports configuration that would stop the server from working
+func (c *Config) Validate() error {
+	if c.JWTSecret == "" {
+		return fmt.Errorf("JWT_SECRET must be set")
+	}
+	if !c.IsDevelopment() && (c.JWTSecret == defaultJWTSecret || len(c.JWTSecret) < 32) {
+		return fmt.Errorf("JWT_SECRET must be changed from the default and be at least 32 characters when APP_ENV is %q", c.Environment)
+	}
+	// Tree heads signed by a temporary key can't be checked after a restart
+	if !c.IsDevelopment() && c.KeyLogSigningKey == "" {
+		return fmt.Errorf("KEY_LOG_SIGNING_KEY must be set when APP_ENV is %q", c.Environment)
+	}
+	if c.JWTSigningAlg != "EdDSA" && c.JWTSigningAlg != "RS256" {
+		return fmt.Errorf("JWT_SIGNING_ALG %q must be EdDSA or RS256", c.JWTSigningAlg)
+	}
+	if c.JWTKeyOverlap < c.AccessTokenTTL {
+		return fmt.Errorf("JWT_KEY_OVERLAP (%s) must be at least ACCESS_TOKEN_TTL (%s) so tokens outlive their key", c.JWTKeyOverlap, c.AccessTokenTTL)
+	}
+	if c.JWTKeyRotation <= c.JWTKeyOverlap {
+		return fmt.Errorf("JWT_KEY_ROTATION (%s) must be longer than JWT_KEY_OVERLAP (%s)", c.JWTKeyRotation, c.JWTKeyOverlap)
+	}
+
+	if err := validateBaseURL("PUBLIC_URL", c.PublicURL); err != nil {
+		return err
+	}
+	if err := validateBaseURL("FRONTEND_URL", c.FrontendURL); err != nil {
+		return err
+	}
+	for _, returnURL := range c.AllowedReturnURLs {
+		if err := validateBaseURL("ALLOWED_RETURN_URLS entry", returnURL); err != nil {
+			return err
+		}
+	}
+
+	seen := map[string]bool{"google": c.GoogleClientID != "", "email": true}
+	for _, p := range c.OIDCProviders {
+		if !validProviderName.MatchString(p.Name) {
+			return fmt.Errorf("OIDC provider name %q must be lowercase letters, digits and dashes", p.Name)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("OIDC provider name %q is reserved or already in use", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Issuer == "" || p.ClientID == "" {
+			return fmt.Errorf("OIDC provider %s needs OIDC_%s_ISSUER and OIDC_%s_CLIENT_ID", p.Name, envName(p.Name), envName(p.Name))
+		}
+		if err := validateBaseURL("OIDC_"+envName(p.Name)+"_ISSUER", p.Issuer); err != nil {
+			return err
+		}
+	}
+
+	switch c.MailDriver {
+	case "smtp", "file", "log":
+	default:
+		return fmt.Errorf("MAIL_DRIVER %q must be smtp, file or log", c.MailDriver)
+	}
+
+	if c.WebhookTimeout <= 0 {
+		return fmt.Errorf("WEBHOOK_TIMEOUT must be positive")
+	}
+	if c.WebhookMaxAttempts < 1 {
+		return fmt.Errorf("WEBHOOK_MAX_ATTEMPTS must be at least 1")
+	}
+	if _, err := egress.ParseNetworks(c.TrustedProxies); err != nil {
+		return fmt.Errorf("TRUSTED_PROXIES: %v", err)
+	}
+	if _, err := egress.ParseNetworks(c.EgressAllowlist); err != nil {
+		return fmt.Errorf("EGRESS_ALLOWLIST: %v", err)
+	}
+	if c.CommandTimeout <= 0 {
+		return fmt.Errorf("COMMAND_TIMEOUT must be positive")
+	}
+
+	switch c.Backplane {
+	case "local", "postgres", "redis":
+	default:
+		return fmt.Errorf("BACKPLANE %q must be local, postgres or redis", c.Backplane)
 	}
+	if c.NodeID == "" {
+		return fmt.Errorf("NODE_ID must not be empty")
+	}
+	if c.PresenceHeartbeat <= 0 {
+		return fmt.Errorf("PRESENCE_HEARTBEAT must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("SHUTDOWN_TIMEOUT must be positive")
+	}
+	if c.ReconnectDelay < 0 {
+		return fmt.Errorf("RECONNECT_DELAY must not be negative")
+	}
+	if _, err := ratelimit.ParseOverrides(c.RateLimitBotOverrides); err != nil {
+		return fmt.Errorf("RATE_LIMIT_BOT_OVERRIDES: %v", err)
+	}
+	if c.RateLimitMaxViolations < 1 {
+		return fmt.Errorf("RATE_LIMIT_MAX_VIOLATIONS must be at least 1")
+	}
+	if c.WSReadBufferSize < 1 || c.WSWriteBufferSize < 1 {
+		return fmt.Errorf("WS_READ_BUFFER_SIZE and WS_WRITE_BUFFER_SIZE must be at least 1")
+	}
+	for frameType, limit := range c.WSReadLimits {
+		if limit < 1 {
+			return fmt.Errorf("WS_READ_LIMIT_%s must be at least 1", strings.ToUpper(frameType))
+		}
+	}
+	// permessage-deflate accepts flate levels from -2 (Huffman only) to 9
+	if c.WSCompressionLevel < -2 || c.WSCompressionLevel > 9 {
+		return fmt.Errorf("WS_COMPRESSION_LEVEL must be between -2 and 9")
+	}
+	if c.WSCompressionThreshold < 0 {
+		return fmt.Errorf("WS_COMPRESSION_THRESHOLD must not be negative")
+	}
+	if c.WSSendQueueSize < 1 {
+		return fmt.Errorf("WS_SEND_QUEUE_SIZE must be at least 1")
+	}
+
+	return nil
+}
+
+// validProviderName restricts provider names to what is safe in a URL path
+var validProviderName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// defaultNodeID names the node after its host and process, which is unique
+// for containers and for several servers started on one machine
+func defaultNodeID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "node"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// envName is the provider name as used in environment variable names
+func envName(provider string) string {
+	return strings.ToUpper(strings.ReplaceAll(provider, "-", "_"))
 }
 
 func getEnv(key, defaultValue string) string {
@@ -46,3 +409,41 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value, exists := os.LookupEnv(key); exists {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvRate reads a rate such as "20/10s", see ratelimit.ParseRate
+func getEnvRate(key string, defaultValue ratelimit.Rate) ratelimit.Rate {
+	if value, exists := os.LookupEnv(key); exists {
+		if rate, err := ratelimit.ParseRate(value); err == nil {
+			return rate
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		if durationValue, err := time.ParseDuration(value); err == nil {
+			return durationValue
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// setProduction sets up the environment of a valid production deployment
+func setProduction(t *testing.T) {
+	t.Helper()
+	t.Setenv("APP_ENV", "production")
+	t.Setenv("JWT_SECRET", strings.Repeat("s", 32))
+	t.Setenv("KEY_LOG_SIGNING_KEY", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+}
+
+// unsetenv unsets key for the rest of the test
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+func TestValidateProduction(t *testing.T) {
+	setProduction(t)
+	if err := LoadConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateRequiresKeyLogSigningKey(t *testing.T) {
+	setProduction(t)
+	t.Setenv("KEY_LOG_SIGNING_KEY", "")
+	err := LoadConfig().Validate()
+	if err == nil || !strings.Contains(err.Error(), "KEY_LOG_SIGNING_KEY") {
+		t.Fatalf("err = %v, want KEY_LOG_SIGNING_KEY to be required", err)
+	}
+
+	t.Setenv("APP_ENV", "development")
+	t.Setenv("JWT_SECRET", defaultJWTSecret)
+	if err := LoadConfig().Validate(); err != nil {
+		t.Errorf("development: %v", err)
+	}
+}
+
+func TestDefaultSecretRefusedUnlessDevelopment(t *testing.T) {
+	// An unset APP_ENV means production
+	unsetenv(t, "APP_ENV")
+	unsetenv(t, "JWT_SECRET")
+	t.Setenv("KEY_LOG_SIGNING_KEY", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	cfg := LoadConfig()
+	if cfg.IsDevelopment() {
+		t.Fatal("development mode is on without APP_ENV")
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "JWT_SECRET") {
+		t.Fatalf("err = %v, want the default JWT_SECRET to be refused", err)
+	}
+
+	t.Setenv("JWT_SECRET", "too-short")
+	if err := LoadConfig().Validate(); err == nil || !strings.Contains(err.Error(), "JWT_SECRET") {
+		t.Fatalf("err = %v, want a short JWT_SECRET to be refused", err)
+	}
+
+	t.Setenv("APP_ENV", "development")
+	unsetenv(t, "JWT_SECRET")
+	if err := LoadConfig().Validate(); err != nil {
+		t.Fatalf("development: %v", err)
+	}
+}
+
+func TestValidateEgressAllowlist(t *testing.T) {
+	setProduction(t)
+	t.Setenv("EGRESS_ALLOWLIST", "127.0.0.1, 172.16.0.0/12")
+	cfg := LoadConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.EgressAllowlist) != 2 {
+		t.Fatalf("EgressAllowlist = %v", cfg.EgressAllowlist)
+	}
+
+	t.Setenv("EGRESS_ALLOWLIST", "localhost")
+	if err := LoadConfig().Validate(); err == nil || !strings.Contains(err.Error(), "EGRESS_ALLOWLIST") {
+		t.Fatalf("err = %v, want the allowlist to be rejected", err)
+	}
+}
+
+func TestValidateTrustedProxies(t *testing.T) {
+	setProduction(t)
+	if cfg := LoadConfig(); len(cfg.TrustedProxies) != 0 {
+		t.Fatalf("TrustedProxies = %v, want none by default", cfg.TrustedProxies)
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.5, 172.16.0.0/12")
+	cfg := LoadConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.TrustedProxies) != 2 {
+		t.Fatalf("TrustedProxies = %v", cfg.TrustedProxies)
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "proxy.internal")
+	if err := LoadConfig().Validate(); err == nil || !strings.Contains(err.Error(), "TRUSTED_PROXIES") {
+		t.Fatalf("err = %v, want the proxies to be rejected", err)
+	}
+}
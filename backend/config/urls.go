@@ -0,0 +1,102 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrReturnToNotAllowed is returned for return_to URLs outside
+// AllowedReturnURLs
+var ErrReturnToNotAllowed = errors.New("return_to is not an allowed frontend URL")
+
+// APIURL returns the absolute URL of a backend path, e.g.
+// APIURL("/api/v1/auth/google/callback")
+func (c *Config) APIURL(path string) string {
+	return strings.TrimRight(c.PublicURL, "/") + path
+}
+
+// FrontendPage returns the absolute URL of a frontend path, e.g.
+// FrontendPage("/auth/error")
+func (c *Config) FrontendPage(path string) string {
+	return strings.TrimRight(c.FrontendURL, "/") + path
+}
+
+// ResolveReturnTo validates a return_to URL from a login request. Paths are
+// resolved against FrontendURL; absolute URLs must fall under FrontendURL or
+// one of AllowedReturnURLs. An empty return_to resolves to the default
+// callback page.
+func (c *Config) ResolveReturnTo(returnTo string) (string, error) {
+	if returnTo == "" {
+		return c.FrontendPage("/auth/callback"), nil
+	}
+
+	// Reject protocol-relative and backslash tricks before resolving
+	if strings.HasPrefix(returnTo, "//") || strings.Contains(returnTo, "\\") {
+		return "", ErrReturnToNotAllowed
+	}
+	if strings.HasPrefix(returnTo, "/") {
+		returnTo = c.FrontendPage(returnTo)
+	}
+
+	target, err := url.Parse(returnTo)
+	if err != nil || target.User != nil || target.Fragment != "" {
+		return "", ErrReturnToNotAllowed
+	}
+
+	for _, allowed := range append([]string{c.FrontendURL}, c.AllowedReturnURLs...) {
+		base, err := url.Parse(allowed)
+		if err != nil {
+			continue
+		}
+		if underBase(target, base) {
+			return target.String(), nil
+		}
+	}
+	return "", ErrReturnToNotAllowed
+}
+
+// FrontendOrigins returns the origins of FrontendURL and AllowedReturnURLs,
+// the pages that may use the session cookie
+func (c *Config) FrontendOrigins() []string {
+	var origins []string
+	for _, allowed := range append([]string{c.FrontendURL}, c.AllowedReturnURLs...) {
+		u, err := url.Parse(allowed)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		origins = append(origins, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+	return origins
+}
+
+// underBase reports whether target has the same origin as base and a path
+// at or below base's path
+func underBase(target, base *url.URL) bool {
+	if !strings.EqualFold(target.Scheme, base.Scheme) || !strings.EqualFold(target.Host, base.Host) {
+		return false
+	}
+	basePath := strings.TrimRight(base.Path, "/")
+	return target.Path == basePath || strings.HasPrefix(target.Path, basePath+"/") ||
+		(basePath == "" && target.Path == "")
+}
+
+// validateBaseURL checks that a configured URL is an absolute http(s) URL
+// without a query or fragment
+func validateBaseURL(name, value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%s %q is not a valid URL: %v", name, value, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s %q must start with http:// or https://", name, value)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s %q has no host", name, value)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%s %q must not contain credentials, a query or a fragment", name, value)
+	}
+	return nil
+}
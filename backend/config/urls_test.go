@@ -0,0 +1,88 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testURLConfig() *Config {
+	return &Config{
+		PublicURL:         "https://api.example.com/",
+		FrontendURL:       "https://chat.example.com",
+		AllowedReturnURLs: []string{"https://desktop.example.com/app", "http://localhost:3000"},
+	}
+}
+
+func TestAPIURLAndFrontendPage(t *testing.T) {
+	cfg := testURLConfig()
+	if got := cfg.APIURL("/api/v1/auth/google/callback"); got != "https://api.example.com/api/v1/auth/google/callback" {
+		t.Errorf("APIURL = %q", got)
+	}
+	if got := cfg.FrontendPage("/auth/error"); got != "https://chat.example.com/auth/error" {
+		t.Errorf("FrontendPage = %q", got)
+	}
+}
+
+func TestFrontendOrigins(t *testing.T) {
+	got := testURLConfig().FrontendOrigins()
+	want := []string{"https://chat.example.com", "https://desktop.example.com", "http://localhost:3000"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("FrontendOrigins = %v, want %v", got, want)
+	}
+}
+
+func TestResolveReturnTo(t *testing.T) {
+	cfg := testURLConfig()
+	allowed := map[string]string{
+		"":                                     "https://chat.example.com/auth/callback",
+		"/chats?id=1":                          "https://chat.example.com/chats?id=1",
+		"https://chat.example.com":             "https://chat.example.com",
+		"https://CHAT.example.com/x":           "https://CHAT.example.com/x",
+		"https://desktop.example.com/app":      "https://desktop.example.com/app",
+		"https://desktop.example.com/app/done": "https://desktop.example.com/app/done",
+		"http://localhost:3000/auth/callback":  "http://localhost:3000/auth/callback",
+	}
+	for returnTo, want := range allowed {
+		got, err := cfg.ResolveReturnTo(returnTo)
+		if err != nil || got != want {
+			t.Errorf("ResolveReturnTo(%q) = %q, %v, want %q", returnTo, got, err, want)
+		}
+	}
+
+	for _, returnTo := range []string{
+		"https://evil.example.com/",
+		"http://chat.example.com/",
+		"https://chat.example.com.evil.com/",
+		"https://chat.example.com:8443/",
+		"https://desktop.example.com/application",
+		"https://desktop.example.com/",
+		"//evil.example.com/",
+		"/\\evil.example.com",
+		"https://user@chat.example.com/",
+		"https://chat.example.com/#fragment",
+		"javascript:alert(1)",
+		"http://localhost:3001/",
+	} {
+		if got, err := cfg.ResolveReturnTo(returnTo); !errors.Is(err, ErrReturnToNotAllowed) {
+			t.Errorf("ResolveReturnTo(%q) = %q, %v, want ErrReturnToNotAllowed", returnTo, got, err)
+		}
+	}
+}
+
+func TestValidateRejectsBadURLs(t *testing.T) {
+	for env, value := range map[string]string{
+		"PUBLIC_URL":          "api.example.com",
+		"FRONTEND_URL":        "https://chat.example.com/?x=1",
+		"ALLOWED_RETURN_URLS": "https://desktop.example.com,ftp://files.example.com",
+	} {
+		t.Run(env, func(t *testing.T) {
+			setProduction(t)
+			t.Setenv(env, value)
+			err := LoadConfig().Validate()
+			if err == nil || !strings.Contains(err.Error(), env) {
+				t.Fatalf("err = %v, want %s to be rejected", err, env)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/backplane"
+	"github.com/RatneshMaurya/not-whatsapp/backend/protocol"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// maxAnnouncementLength caps the text of an announcement, in bytes
+const maxAnnouncementLength = 4096
+
+// sessionsTimeout bounds how long the admin API waits for other nodes to
+// list their connections
+const sessionsTimeout = 2 * time.Second
+
+// SessionInfo describes a live connection for the admin API
+type SessionInfo struct {
+	// ID identifies the connection; SessionID is its login session, or
+	// "apitoken:<id>" for bots
+	ID string `json:"id"`
+	// Node is the node the connection is to, set by the admin API
+	Node      string `json:"node,omitempty"`
+	SessionID string `json:"session_id"`
+	UserID    string `json:"user_id"`
+	UserName  string `json:"user_name"`
+	Bot       bool   `json:"bot"`
+	// Device is the User-Agent the connection was opened with
+	Device    string `json:"device"`
+	IPAddress string `json:"ip_address"`
+	// Transport is websocket, sse or long_poll, and Codec json or msgpack
+	Transport   string    `json:"transport"`
+	Codec       string    `json:"codec"`
+	Version     int       `json:"version"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// QueueDepth is the number of frames waiting to be sent
+	QueueDepth int   `json:"queue_depth"`
+	BytesIn    int64 `json:"bytes_in"`
+	BytesOut   int64 `json:"bytes_out"`
+}
+
+// Sessions lists the connections to this node, oldest first
+func (wc *WebSocketController) Sessions() []SessionInfo {
+	wc.mu.Lock()
+	clients := make([]*WebSocketClient, 0, len(wc.connections))
+	for _, client := range wc.connections {
+		clients = append(clients, client)
+	}
+	wc.mu.Unlock()
+
+	sessions := make([]SessionInfo, len(clients))
+	for i, client := range clients {
+		sessions[i] = SessionInfo{
+			ID:          client.id,
+			SessionID:   client.sessionID,
+			UserID:      client.userID,
+			UserName:    client.userName,
+			Bot:         client.apiToken != nil,
+			Device:      client.userAgent,
+			IPAddress:   client.ip,
+			Transport:   client.transport.name(),
+			Codec:       client.codec.Name(),
+			Version:     client.version,
+			ConnectedAt: client.connectedAt,
+			QueueDepth:  client.send.depth(),
+			BytesIn:     client.bytesIn.Load(),
+			BytesOut:    client.bytesOut.Load(),
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt)
+	})
+	return sessions
+}
+
+// sessionsRequest collects the answers of other nodes to a session list
+// request
+type sessionsRequest struct {
+	mu      sync.Mutex
+	replies map[string][]SessionInfo
+	// answered is signalled when a reply arrives
+	answered chan struct{}
+}
+
+// answeredBy reports whether every node in expected has answered. It is
+// false for nil expected, when the nodes aren't known.
+func (r *sessionsRequest) answeredBy(expected []string) bool {
+	if expected == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, node := range expected {
+		if _, ok := r.replies[node]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *sessionsRequest) result() map[string][]SessionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	replies := make(map[string][]SessionInfo, len(r.replies))
+	for node, sessions := range r.replies {
+		replies[node] = sessions
+	}
+	return replies
+}
+
+// RemoteSessions asks the other nodes for their connections and returns
+// them by node. It waits until every node in expected has answered, or for
+// ctx if expected is nil, and returns the answers so far once ctx is done.
+func (wc *WebSocketController) RemoteSessions(ctx context.Context, expected []string) map[string][]SessionInfo {
+	requestID := uuid.New().String()
+	request := &sessionsRequest{
+		replies:  make(map[string][]SessionInfo),
+		answered: make(chan struct{}, 1),
+	}
+	wc.sessionRequestsMu.Lock()
+	wc.sessionRequests[requestID] = request
+	wc.sessionRequestsMu.Unlock()
+	defer func() {
+		wc.sessionRequestsMu.Lock()
+		delete(wc.sessionRequests, requestID)
+		wc.sessionRequestsMu.Unlock()
+	}()
+
+	wc.publish(backplane.Event{
+		Kind:      backplane.KindListSessions,
+		RequestID: requestID,
+	})
+	for !request.answeredBy(expected) {
+		select {
+		case <-request.answered:
+		case <-ctx.Done():
+			return request.result()
+		}
+	}
+	return request.result()
+}
+
+// answerSessions sends the connections to this node to the node that asked
+// for them
+func (wc *WebSocketController) answerSessions(requestID string) {
+	payload, err := json.Marshal(wc.Sessions())
+	if err != nil {
+		log.Printf("Failed to encode sessions: %v", err)
+		return
+	}
+	wc.publish(backplane.Event{
+		Kind:      backplane.KindSessions,
+		RequestID: requestID,
+		Payload:   payload,
+	})
+}
+
+// collectSessions records another node's answer to a session list request
+// of this node. Answers to the requests of other nodes are ignored.
+func (wc *WebSocketController) collectSessions(event backplane.Event) {
+	wc.sessionRequestsMu.Lock()
+	request := wc.sessionRequests[event.RequestID]
+	wc.sessionRequestsMu.Unlock()
+	if request == nil {
+		return
+	}
+
+	var sessions []SessionInfo
+	if err := json.Unmarshal(event.Payload, &sessions); err != nil {
+		log.Printf("Invalid sessions from node %s: %v", event.Node, err)
+		return
+	}
+	request.mu.Lock()
+	request.replies[event.Node] = sessions
+	request.mu.Unlock()
+	select {
+	case request.answered <- struct{}{}:
+	default:
+	}
+}
+
+// ForceDisconnect closes every connection of the given sessions with
+// CloseDisconnectedByAdmin, on every node
+func (wc *WebSocketController) ForceDisconnect(sessionIDs ...string) {
+	wc.disconnect(CloseDisconnectedByAdmin, sessionIDs)
+}
+
+// Announce sends an announcement to the participants of its conversation,
+// or to every connection on every node if it has none
+func (wc *WebSocketController) Announce(frame protocol.Announcement) error {
+	if frame.ConversationID != "" {
+		return wc.SendToConversation(frame.ConversationID, frame)
+	}
+
+	payload := protocol.NewPayload(frame)
+	payloadJSON, err := payload.JSON()
+	if err != nil {
+		return err
+	}
+	select {
+	case wc.broadcast <- payload:
+	case <-wc.quit:
+	}
+	wc.publish(backplane.Event{
+		Kind:    backplane.KindDeliver,
+		Payload: payloadJSON,
+	})
+	return nil
+}
+
+// AdminController lets admins inspect and control live connections and
+// change server settings
+type AdminController struct {
+	wsController        *WebSocketController
+	conversationService *services.ConversationService
+	settingsService     *services.SettingsService
+	// nodeID names this node, and nodes lists the live ones; it is nil if
+	// they aren't known
+	nodeID string
+	nodes  backplane.NodeLister
+}
+
+func NewAdminController(wsController *WebSocketController, conversationService *services.ConversationService, settingsService *services.SettingsService, nodeID string, nodes backplane.NodeLister) *AdminController {
+	return &AdminController{
+		wsController:        wsController,
+		conversationService: conversationService,
+		settingsService:     settingsService,
+		nodeID:              nodeID,
+		nodes:               nodes,
+	}
+}
+
+// GetSessions lists the live connections to every node, only those of
+// ?user_id if given. The other nodes are asked over the backplane. Nodes
+// that don't answer in time are listed in missing, and complete is false
+// if the list may lack some, including when the live nodes aren't known.
+func (c *AdminController) GetSessions(ctx *gin.Context) {
+	byNode := map[string][]SessionInfo{c.nodeID: c.wsController.Sessions()}
+
+	// Without the list of live nodes, wait for whoever answers in time
+	var expected []string
+	if c.nodes != nil {
+		nodes, err := c.nodes.Nodes(ctx.Request.Context())
+		if err != nil {
+			log.Printf("Failed to list nodes: %v", err)
+		} else {
+			expected = make([]string, 0, len(nodes))
+			for _, node := range nodes {
+				if node != c.nodeID {
+					expected = append(expected, node)
+				}
+			}
+		}
+	}
+	if expected == nil || len(expected) > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx.Request.Context(), sessionsTimeout)
+		for node, sessions := range c.wsController.RemoteSessions(waitCtx, expected) {
+			byNode[node] = sessions
+		}
+		cancel()
+	}
+
+	missing := make([]string, 0)
+	for _, node := range expected {
+		if _, ok := byNode[node]; !ok {
+			missing = append(missing, node)
+		}
+	}
+	nodes := make([]string, 0, len(byNode))
+	sessions := make([]SessionInfo, 0)
+	userID := ctx.Query("user_id")
+	for node, nodeSessions := range byNode {
+		nodes = append(nodes, node)
+		for _, session := range nodeSessions {
+			if userID == "" || session.UserID == userID {
+				session.Node = node
+				sessions = append(sessions, session)
+			}
+		}
+	}
+	sort.Strings(nodes)
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt)
+	})
+	ctx.JSON(http.StatusOK, gin.H{
+		"node":     c.nodeID,
+		"nodes":    nodes,
+		"missing":  missing,
+		"complete": expected != nil && len(missing) == 0,
+		"sessions": sessions,
+	})
+}
+
+// DisconnectSession closes the connections of a session on every node. The
+// session is not revoked, so its client may reconnect.
+func (c *AdminController) DisconnectSession(ctx *gin.Context) {
+	sessionID := ctx.Param("id")
+	log.Printf("Admin %s disconnected session %s", ctx.GetString("userID"), sessionID)
+	c.wsController.ForceDisconnect(sessionID)
+	ctx.Status(http.StatusNoContent)
+}
+
+// CreateAnnouncement sends a system announcement to every connected client,
+// or to the connected participants of conversation_id
+func (c *AdminController) CreateAnnouncement(ctx *gin.Context) {
+	var request struct {
+		Text           string `json:"text" binding:"required"`
+		ConversationID string `json:"conversation_id"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	request.Text = strings.TrimSpace(request.Text)
+	if request.Text == "" || len(request.Text) > maxAnnouncementLength {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "text must be 1 to 4096 bytes"})
+		return
+	}
+
+	if request.ConversationID != "" {
+		if _, err := uuid.Parse(request.ConversationID); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conversation_id"})
+			return
+		}
+		conversation, err := c.conversationService.GetConversationByID(request.ConversationID)
+		if err != nil {
+			log.Printf("Failed to get conversation %s: %v", request.ConversationID, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get conversation"})
+			return
+		}
+		if len(conversation.Participants) == 0 {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+			return
+		}
+	}
+
+	frame := protocol.Announcement{
+		Type:           protocol.TypeAnnouncement,
+		ConversationID: request.ConversationID,
+		Text:           request.Text,
+		Timestamp:      time.Now(),
+		ID:             uuid.New().String(),
+	}
+	if err := c.wsController.Announce(frame); err != nil {
+		log.Printf("Failed to send announcement: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send announcement"})
+		return
+	}
+	log.Printf("Admin %s sent announcement %s", ctx.GetString("userID"), frame.ID)
+	ctx.JSON(http.StatusAccepted, frame)
+}
+
+// GetSettings returns the server settings
+func (c *AdminController) GetSettings(ctx *gin.Context) {
+	settings, err := c.settingsService.GetSettings()
+	if err != nil {
+		log.Printf("Failed to get settings: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get settings"})
+		return
+	}
+	ctx.JSON(http.StatusOK, settings)
+}
+
+// UpdateSettings changes the settings present in the request body. Turning
+// on require_two_factor makes every user without an authenticator set one up
+// at their next sign-in; existing sessions are not affected.
+func (c *AdminController) UpdateSettings(ctx *gin.Context) {
+	var request struct {
+		RequireTwoFactor *bool `json:"require_two_factor"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil || request.RequireTwoFactor == nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	adminID := ctx.GetString("userID")
+	settings, err := c.settingsService.SetRequireTwoFactor(adminID, *request.RequireTwoFactor)
+	if err != nil {
+		log.Printf("Failed to update settings: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
+		return
+	}
+	log.Printf("Admin %s set require_two_factor to %t", adminID, *request.RequireTwoFactor)
+	ctx.JSON(http.StatusOK, settings)
+}
@@ -0,0 +1,285 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/backplane"
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/protocol"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+func TestAdminSettings(t *testing.T) {
+	db := dbtest.Open(t)
+	admin := dbtest.CreateUser(t, db, "admin")
+	c := NewAdminController(nil, nil, services.NewSettingsService(db, false), "test", nil)
+	r := newTestRouter()
+	r.GET("/api/v1/admin/settings", c.GetSettings)
+	r.PATCH("/api/v1/admin/settings", c.UpdateSettings)
+
+	var settings models.ServerSettings
+	decodeJSON(t, serve(t, r, http.MethodGet, "/api/v1/admin/settings", admin, nil), &settings)
+	if settings.RequireTwoFactor {
+		t.Fatalf("settings = %+v, want two-factor authentication optional", settings)
+	}
+
+	w := serve(t, r, http.MethodPatch, "/api/v1/admin/settings", admin, gin.H{"require_two_factor": true})
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: status %d: %s", w.Code, w.Body)
+	}
+	decodeJSON(t, serve(t, r, http.MethodGet, "/api/v1/admin/settings", admin, nil), &settings)
+	if !settings.RequireTwoFactor || settings.UpdatedBy != admin {
+		t.Fatalf("settings after update = %+v", settings)
+	}
+}
+
+func TestAdminSettingsRejectsInvalidBody(t *testing.T) {
+	c := NewAdminController(nil, nil, nil, "test", nil)
+	r := newTestRouter()
+	r.PATCH("/api/v1/admin/settings", c.UpdateSettings)
+
+	for name, body := range map[string]interface{}{
+		"empty":    gin.H{},
+		"not bool": gin.H{"require_two_factor": "yes"},
+		"no body":  nil,
+	} {
+		if w := serve(t, r, http.MethodPatch, "/api/v1/admin/settings", "admin", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, w.Code)
+		}
+	}
+}
+
+// newAdminTestServer serves the hub at /ws and the admin API for live
+// connections, on a hub made by newTestWebSocketController
+func newAdminTestServer(t *testing.T, wc *WebSocketController, conversations *services.ConversationService) *httptest.Server {
+	t.Helper()
+	return newAdminNodeServer(t, wc, conversations, "test", wc.presence.(backplane.NodeLister))
+}
+
+// newAdminNodeServer is newAdminTestServer for the hub of node nodeID
+func newAdminNodeServer(t *testing.T, wc *WebSocketController, conversations *services.ConversationService, nodeID string, nodes backplane.NodeLister) *httptest.Server {
+	t.Helper()
+	c := NewAdminController(wc, conversations, nil, nodeID, nodes)
+	r := newTestRouter()
+	r.GET("/ws", wc.HandleWebSocket)
+	r.GET("/api/v1/admin/sessions", c.GetSessions)
+	r.DELETE("/api/v1/admin/sessions/:id", c.DisconnectSession)
+	r.POST("/api/v1/admin/announcements", c.CreateAnnouncement)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// sessionList is the response of the admin session list
+type sessionList struct {
+	Node     string        `json:"node"`
+	Nodes    []string      `json:"nodes"`
+	Missing  []string      `json:"missing"`
+	Complete bool          `json:"complete"`
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+// listSessions lists the live sessions, waiting until there are want of
+// them since clients are registered in the background
+func listSessions(t *testing.T, server *httptest.Server, query string, want int) sessionList {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var list sessionList
+		decodeJSON(t, serve(t, server.Config.Handler, http.MethodGet, "/api/v1/admin/sessions?"+query, "admin", nil), &list)
+		if len(list.Sessions) == want || time.Now().After(deadline) {
+			if len(list.Sessions) != want {
+				t.Fatalf("sessions = %+v, want %d", list.Sessions, want)
+			}
+			return list
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// adminSessions lists the live sessions of a single node
+func adminSessions(t *testing.T, server *httptest.Server, query string, want int) []SessionInfo {
+	t.Helper()
+	list := listSessions(t, server, query, want)
+	if list.Node != "test" || !list.Complete || len(list.Missing) != 0 {
+		t.Errorf("list = %+v, want a complete list of node test", list)
+	}
+	for _, session := range list.Sessions {
+		if session.Node != "test" {
+			t.Errorf("session %s is on node %q, want test", session.ID, session.Node)
+		}
+	}
+	return list.Sessions
+}
+
+// expectAnnouncement reads the next frame from conn and checks it is the
+// announcement
+func expectAnnouncement(t *testing.T, conn *websocket.Conn, want protocol.Announcement) {
+	t.Helper()
+	var frame protocol.Announcement
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != protocol.TypeAnnouncement || frame.ID != want.ID || frame.Text != want.Text || frame.ConversationID != want.ConversationID {
+		t.Errorf("frame = %+v, want %+v", frame, want)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, nil, tokens, testSessions{"s1": true, "s2": true, "s3": true}, nil)
+	server := newAdminTestServer(t, wc, nil)
+
+	first := dialWebSocket(t, server, "token="+accessToken(t, tokens, "u1", "s1"), http.Header{"User-Agent": {"phone"}})
+	adminSessions(t, server, "", 1)
+	second := dialWebSocket(t, server, "token="+accessToken(t, tokens, "u1", "s2"), nil)
+	other := dialWebSocket(t, server, "token="+accessToken(t, tokens, "u2", "s3"), nil)
+
+	sessions := adminSessions(t, server, "", 3)
+	// Oldest first
+	if got := sessions[0]; got.SessionID != "s1" || got.UserID != "u1" || got.Device != "phone" || got.Transport != "websocket" || got.Codec != "json" || got.Bot || got.ID == "" {
+		t.Errorf("first session = %+v", got)
+	}
+	if sessions := adminSessions(t, server, "user_id=u2", 1); sessions[0].SessionID != "s3" {
+		t.Errorf("sessions of u2 = %+v", sessions)
+	}
+	adminSessions(t, server, "user_id=nobody", 0)
+
+	// Disconnecting a session closes only its connection
+	if w := serve(t, server.Config.Handler, http.MethodDelete, "/api/v1/admin/sessions/s1", "admin", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("disconnect: status %d, want 204", w.Code)
+	}
+	expectClose(t, first, CloseDisconnectedByAdmin)
+	expectPong(t, second)
+	expectPong(t, other)
+	if sessions := adminSessions(t, server, "user_id=u1", 1); sessions[0].SessionID != "s2" {
+		t.Errorf("sessions of u1 after disconnect = %+v", sessions)
+	}
+
+	// The session is not revoked, so its client may reconnect
+	dialWebSocket(t, server, "token="+accessToken(t, tokens, "u1", "s1"), nil)
+	adminSessions(t, server, "", 3)
+}
+
+func TestAdminSessionsOfEveryNode(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	sessions := testSessions{"s1": true, "s2": true}
+	memory := backplane.NewMemory(time.Minute)
+	a, b := memory.Node("a"), memory.Node("b")
+	hubA := newTestHub(t, nil, tokens, sessions, a, nil)
+	serverA := newAdminNodeServer(t, hubA, nil, "a", a)
+	serverB := newAdminNodeServer(t, newTestHub(t, nil, tokens, sessions, b, nil), nil, "b", b)
+	dialWebSocket(t, serverA, "token="+accessToken(t, tokens, "u1", "s1"), nil)
+	dialWebSocket(t, serverB, "token="+accessToken(t, tokens, "u2", "s2"), nil)
+
+	list := listSessions(t, serverA, "", 2)
+	if !list.Complete || len(list.Missing) != 0 || strings.Join(list.Nodes, ",") != "a,b" {
+		t.Errorf("list = %+v, want a complete list of nodes a and b", list)
+	}
+	onNode := map[string]string{}
+	for _, session := range list.Sessions {
+		onNode[session.UserID] = session.Node
+	}
+	if onNode["u1"] != "a" || onNode["u2"] != "b" {
+		t.Errorf("users are on nodes %v, want u1 on a and u2 on b", onNode)
+	}
+	if list := listSessions(t, serverB, "user_id=u1", 1); list.Sessions[0].SessionID != "s1" || list.Node != "b" {
+		t.Errorf("sessions of u1 from node b = %+v", list)
+	}
+
+	// A live node that doesn't answer makes the list partial
+	c := memory.Node("c")
+	defer c.Close()
+	list = listSessions(t, serverA, "", 2)
+	if list.Complete || strings.Join(list.Missing, ",") != "c" {
+		t.Errorf("list = %+v, want c missing", list)
+	}
+
+	// So does not knowing the live nodes, as with the Postgres backplane,
+	// but the nodes that answer are listed
+	list = listSessions(t, newAdminNodeServer(t, hubA, nil, "a", nil), "", 2)
+	if list.Complete || len(list.Missing) != 0 || strings.Join(list.Nodes, ",") != "a,b" {
+		t.Errorf("list = %+v, want an incomplete list of nodes a and b", list)
+	}
+}
+
+func TestAdminAnnouncementToEveryone(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, nil, tokens, testSessions{"s1": true, "s2": true}, nil)
+	server := newAdminTestServer(t, wc, nil)
+	conns := []*websocket.Conn{
+		dialWebSocket(t, server, "token="+accessToken(t, tokens, "u1", "s1"), nil),
+		dialWebSocket(t, server, "token="+accessToken(t, tokens, "u2", "s2"), nil),
+	}
+	adminSessions(t, server, "", 2)
+
+	w := serve(t, server.Config.Handler, http.MethodPost, "/api/v1/admin/announcements", "admin", gin.H{"text": "  Maintenance at noon  "})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want 202: %s", w.Code, w.Body)
+	}
+	var announcement protocol.Announcement
+	decodeJSON(t, w, &announcement)
+	if announcement.Text != "Maintenance at noon" || announcement.ID == "" || announcement.ConversationID != "" {
+		t.Errorf("announcement = %+v", announcement)
+	}
+	for _, conn := range conns {
+		expectAnnouncement(t, conn, announcement)
+	}
+}
+
+func TestAdminAnnouncementToConversation(t *testing.T) {
+	db := dbtest.Open(t)
+	f := newConversationFixture(t, db)
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, db, tokens, testSessions{"s1": true, "s2": true}, nil)
+	cipher := services.NewContentCipher(db, nil)
+	webhooks := services.NewWebhookService(db, cipher, egress.NewPolicy(), time.Second, 1)
+	server := newAdminTestServer(t, wc, services.NewConversationService(db, cipher, webhooks))
+	alice := dialWebSocket(t, server, "token="+accessToken(t, tokens, f.alice, "s1"), nil)
+	eve := dialWebSocket(t, server, "token="+accessToken(t, tokens, f.eve, "s2"), nil)
+	adminSessions(t, server, "", 2)
+
+	w := serve(t, server.Config.Handler, http.MethodPost, "/api/v1/admin/announcements", "admin", gin.H{"text": "Read only from Monday", "conversation_id": f.conversation})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want 202: %s", w.Code, w.Body)
+	}
+	var announcement protocol.Announcement
+	decodeJSON(t, w, &announcement)
+	expectAnnouncement(t, alice, announcement)
+
+	// eve is not in the conversation
+	expectPong(t, eve)
+
+	w = serve(t, server.Config.Handler, http.MethodPost, "/api/v1/admin/announcements", "admin", gin.H{"text": "hi", "conversation_id": uuid.New().String()})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown conversation: status %d, want 404", w.Code)
+	}
+}
+
+func TestAdminAnnouncementRejectsInvalidBody(t *testing.T) {
+	c := NewAdminController(nil, nil, nil, "test", nil)
+	r := newTestRouter()
+	r.POST("/api/v1/admin/announcements", c.CreateAnnouncement)
+
+	for name, body := range map[string]interface{}{
+		"no text":          gin.H{"conversation_id": uuid.New().String()},
+		"blank text":       gin.H{"text": "   "},
+		"long text":        gin.H{"text": strings.Repeat("a", maxAnnouncementLength+1)},
+		"bad conversation": gin.H{"text": "hi", "conversation_id": "general"},
+		"no body":          nil,
+	} {
+		if w := serve(t, r, http.MethodPost, "/api/v1/admin/announcements", "admin", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+type AttachmentController struct {
+	attachmentService   *services.AttachmentService
+	conversationService *services.ConversationService
+}
+
+func NewAttachmentController(attachmentService *services.AttachmentService, conversationService *services.ConversationService) *AttachmentController {
+	return &AttachmentController{
+		attachmentService:   attachmentService,
+		conversationService: conversationService,
+	}
+}
+
+// CreateAttachment reserves an upload slot for an encrypted attachment. The
+// client declares the ciphertext size and SHA-256 digest up front.
+func (c *AttachmentController) CreateAttachment(ctx *gin.Context) {
+	var request struct {
+		ConversationID string `json:"conversation_id" binding:"required"`
+		Size           int64  `json:"size" binding:"required"`
+		Digest         []byte `json:"digest" binding:"required"`
+	}
+
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	userID := ctx.GetString("userID")
+	if !c.requireParticipant(ctx, request.ConversationID, userID) {
+		return
+	}
+
+	attachment, err := c.attachmentService.CreateAttachment(request.ConversationID, userID, request.Size, request.Digest)
+	if err != nil {
+		if errors.Is(err, services.ErrAttachmentTooLarge) {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("Failed to create attachment: %v", err)
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Failed to create attachment"})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, attachment)
+}
+
+// UploadAttachment receives the ciphertext as the raw request body
+func (c *AttachmentController) UploadAttachment(ctx *gin.Context) {
+	attachment, ok := c.loadAttachment(ctx)
+	if !ok {
+		return
+	}
+	if attachment.UploaderID != ctx.GetString("userID") {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Only the uploader can upload this attachment"})
+		return
+	}
+
+	err := c.attachmentService.Upload(attachment, ctx.Request.Body)
+	switch {
+	case err == nil:
+		ctx.Status(http.StatusNoContent)
+	case errors.Is(err, services.ErrAttachmentNotPending):
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrAttachmentSizeMismatch), errors.Is(err, services.ErrAttachmentDigestMismatch):
+		ctx.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	default:
+		log.Printf("Failed to upload attachment %s: %v", attachment.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload attachment"})
+	}
+}
+
+// DownloadAttachment streams the ciphertext back to a conversation participant
+func (c *AttachmentController) DownloadAttachment(ctx *gin.Context) {
+	attachment, ok := c.loadAttachment(ctx)
+	if !ok {
+		return
+	}
+
+	file, err := c.attachmentService.Open(attachment)
+	if err != nil {
+		if errors.Is(err, services.ErrAttachmentNotUploaded) {
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("Failed to open attachment %s: %v", attachment.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open attachment"})
+		return
+	}
+	defer file.Close()
+
+	ctx.DataFromReader(http.StatusOK, attachment.Size, "application/octet-stream", file, map[string]string{
+		"X-Attachment-Digest": base64.StdEncoding.EncodeToString(attachment.Digest),
+		"Cache-Control":       "private, max-age=31536000, immutable",
+	})
+}
+
+// loadAttachment fetches the attachment in the path and checks the current
+// user belongs to its conversation
+func (c *AttachmentController) loadAttachment(ctx *gin.Context) (*models.Attachment, bool) {
+	attachment, err := c.attachmentService.GetAttachment(ctx.Param("id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+			return nil, false
+		}
+		log.Printf("Failed to get attachment: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get attachment"})
+		return nil, false
+	}
+
+	if !c.requireParticipant(ctx, attachment.ConversationID, ctx.GetString("userID")) {
+		return nil, false
+	}
+	return attachment, true
+}
+
+func (c *AttachmentController) requireParticipant(ctx *gin.Context, conversationID, userID string) bool {
+	ok, err := c.conversationService.IsParticipant(conversationID, userID)
+	if err != nil {
+		log.Printf("Failed to check conversation membership: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check conversation membership"})
+		return false
+	}
+	if !ok {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Not a participant of this conversation"})
+		return false
+	}
+	return true
+}
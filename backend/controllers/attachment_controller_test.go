@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"net/http"
+	"testing"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+func newAttachmentRouter(t *testing.T, maxSize int64) (*gin.Engine, *conversationFixture) {
+	t.Helper()
+	db := dbtest.Open(t)
+	attachments, err := services.NewAttachmentService(db, t.TempDir(), maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversations := services.NewConversationService(db, services.NewContentCipher(db, nil), nil)
+	controller := NewAttachmentController(attachments, conversations)
+
+	r := newTestRouter()
+	r.POST("/attachments", controller.CreateAttachment)
+	r.PUT("/attachments/:id", controller.UploadAttachment)
+	r.GET("/attachments/:id", controller.DownloadAttachment)
+
+	return r, newConversationFixture(t, db)
+}
+
+func TestAttachmentUploadAndDownload(t *testing.T) {
+	r, f := newAttachmentRouter(t, 1<<20)
+	ciphertext := make([]byte, 1000)
+	rand.Read(ciphertext)
+	digest := sha256.Sum256(ciphertext)
+
+	w := serve(t, r, http.MethodPost, "/attachments", f.alice, gin.H{
+		"conversation_id": f.conversation,
+		"size":            len(ciphertext),
+		"digest":          digest[:],
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var attachment struct {
+		ID string `json:"id"`
+	}
+	decodeJSON(t, w, &attachment)
+	path := "/attachments/" + attachment.ID
+
+	if w := serve(t, r, http.MethodGet, path, f.bob, nil); w.Code != http.StatusConflict {
+		t.Errorf("download before upload: %d, want 409", w.Code)
+	}
+	if w := serve(t, r, http.MethodPut, path, f.bob, bytes.NewReader(ciphertext)); w.Code != http.StatusForbidden {
+		t.Errorf("upload by another participant: %d, want 403", w.Code)
+	}
+	if w := serve(t, r, http.MethodPut, path, f.alice, bytes.NewReader(ciphertext)); w.Code != http.StatusNoContent {
+		t.Fatalf("upload: %d %s", w.Code, w.Body)
+	}
+	if w := serve(t, r, http.MethodPut, path, f.alice, bytes.NewReader(ciphertext)); w.Code != http.StatusConflict {
+		t.Errorf("second upload: %d, want 409", w.Code)
+	}
+
+	w = serve(t, r, http.MethodGet, path, f.bob, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download: %d %s", w.Code, w.Body)
+	}
+	if !bytes.Equal(w.Body.Bytes(), ciphertext) {
+		t.Error("downloaded ciphertext differs from the upload")
+	}
+
+	if w := serve(t, r, http.MethodGet, path, f.eve, nil); w.Code != http.StatusForbidden {
+		t.Errorf("download by an outsider: %d, want 403", w.Code)
+	}
+}
+
+func TestAttachmentUploadIsVerified(t *testing.T) {
+	r, f := newAttachmentRouter(t, 1<<20)
+	ciphertext := make([]byte, 100)
+	rand.Read(ciphertext)
+	digest := sha256.Sum256(ciphertext)
+
+	create := func() string {
+		w := serve(t, r, http.MethodPost, "/attachments", f.alice, gin.H{
+			"conversation_id": f.conversation,
+			"size":            len(ciphertext),
+			"digest":          digest[:],
+		})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create: %d %s", w.Code, w.Body)
+		}
+		var attachment struct {
+			ID string `json:"id"`
+		}
+		decodeJSON(t, w, &attachment)
+		return "/attachments/" + attachment.ID
+	}
+
+	tampered := append([]byte{}, ciphertext...)
+	tampered[0] ^= 1
+	if w := serve(t, r, http.MethodPut, create(), f.alice, bytes.NewReader(tampered)); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("wrong digest: %d, want 422", w.Code)
+	}
+	if w := serve(t, r, http.MethodPut, create(), f.alice, bytes.NewReader(append(ciphertext, 0))); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("too long: %d, want 422", w.Code)
+	}
+	if w := serve(t, r, http.MethodPut, create(), f.alice, bytes.NewReader(ciphertext[:50])); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("too short: %d, want 422", w.Code)
+	}
+}
+
+func TestCreateAttachmentErrors(t *testing.T) {
+	r, f := newAttachmentRouter(t, 1000)
+	digest := sha256.Sum256(nil)
+
+	w := serve(t, r, http.MethodPost, "/attachments", f.eve, gin.H{
+		"conversation_id": f.conversation,
+		"size":            10,
+		"digest":          digest[:],
+	})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("outsider: %d, want 403", w.Code)
+	}
+
+	w = serve(t, r, http.MethodPost, "/attachments", f.alice, gin.H{
+		"conversation_id": f.conversation,
+		"size":            1001,
+		"digest":          digest[:],
+	})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large: %d, want 413", w.Code)
+	}
+
+	w = serve(t, r, http.MethodPost, "/attachments", f.alice, gin.H{
+		"conversation_id": f.conversation,
+		"size":            10,
+		"digest":          []byte("short"),
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad digest: %d, want 400", w.Code)
+	}
+
+	if w := serve(t, r, http.MethodGet, "/attachments/00000000-0000-0000-0000-000000000000", f.alice, nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown attachment: %d, want 404", w.Code)
+	}
+}
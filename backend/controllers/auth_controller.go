@@ -1,133 +1,310 @@
 package controllers
 
 import (
-	"encoding/json"
-	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"net/url"
-	"os"
-	"time"
 
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
 	"github.com/RatneshMaurya/not-whatsapp/backend/services"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/google/uuid"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
+)
+
+// OAuth flow cookies are only sent back to the callback
+const (
+	oauthStateCookie    = "oauth_state"
+	oauthNonceCookie    = "oauth_nonce"
+	oauthVerifierCookie = "oauth_verifier"
+	oauthReturnToCookie = "oauth_return_to"
+	oauthCookiePath     = "/api/v1/auth/"
 )
 
 type AuthController struct {
-	userService *services.UserService
-	oauthConfig *oauth2.Config
+	providers      map[string]auth.Provider
+	providerOrder  []string
+	userService    *services.UserService
+	sessionService *services.SessionService
+	tokens         *auth.TokenManager
+	loginFinisher  *LoginFinisher
+	wsController   *WebSocketController
 }
 
-func NewAuthController(userService *services.UserService) *AuthController {
-	return &AuthController{
-		userService: userService,
-		oauthConfig: &oauth2.Config{
-			ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-			ClientSecret: os.Getenv("GOOGLE_SECRET"),
-			RedirectURL:  "http://localhost:8080/api/v1/auth/google/callback",
-			Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email", "https://www.googleapis.com/auth/userinfo.profile"},
-			Endpoint:     google.Endpoint,
-		},
+func NewAuthController(providers []auth.Provider, userService *services.UserService, sessionService *services.SessionService, tokens *auth.TokenManager, loginFinisher *LoginFinisher, wsController *WebSocketController) *AuthController {
+	c := &AuthController{
+		providers:      make(map[string]auth.Provider, len(providers)),
+		userService:    userService,
+		sessionService: sessionService,
+		tokens:         tokens,
+		loginFinisher:  loginFinisher,
+		wsController:   wsController,
+	}
+	for _, provider := range providers {
+		c.providers[provider.Name()] = provider
+		c.providerOrder = append(c.providerOrder, provider.Name())
 	}
+	return c
 }
 
-func (c *AuthController) HandleGoogleLogin(ctx *gin.Context) {
-	// Generate a random state
-	state := uuid.New().String()
+// GetProviders lists the identity providers users can sign in with
+func (c *AuthController) GetProviders(ctx *gin.Context) {
+	providers := make([]gin.H, 0, len(c.providerOrder))
+	for _, name := range c.providerOrder {
+		providers = append(providers, gin.H{
+			"name":         name,
+			"display_name": c.providers[name].DisplayName(),
+			"login_url":    "/api/v1/auth/" + name + "/login",
+		})
+	}
+	ctx.JSON(http.StatusOK, providers)
+}
 
-	// Store state in cookie
-	ctx.SetCookie("oauth_state", state, 3600, "/", "", false, true)
+// HandleLogin starts a login with an identity provider. The optional
+// return_to query parameter picks the frontend page to finish on.
+func (c *AuthController) HandleLogin(ctx *gin.Context) {
+	provider, ok := c.providers[ctx.Param("provider")]
+	if !ok {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Unknown identity provider"})
+		return
+	}
+
+	returnTo, err := c.loginFinisher.ResolveReturnTo(ctx.Query("return_to"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "return_to is not an allowed URL"})
+		return
+	}
 
-	// Get the redirect URL with state
-	url := c.oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
-	log.Printf("Redirecting to Google OAuth URL: %s", url)
+	// Generate a random state, nonce and PKCE verifier
+	state, err := auth.RandomString()
+	if err != nil {
+		log.Printf("Failed to generate OAuth state: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	nonce, err := auth.RandomString()
+	if err != nil {
+		log.Printf("Failed to generate OAuth nonce: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	authURL, err := provider.AuthCodeURL(ctx.Request.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("Failed to build %s login URL: %v", provider.Name(), err)
+		c.loginFinisher.RedirectError(ctx, "Identity provider unavailable")
+		return
+	}
 
-	ctx.Redirect(http.StatusTemporaryRedirect, url)
+	// Store the flow in cookies for the callback
+	c.setFlowCookie(ctx, oauthStateCookie, state, 600)
+	c.setFlowCookie(ctx, oauthNonceCookie, nonce, 600)
+	c.setFlowCookie(ctx, oauthVerifierCookie, verifier, 600)
+	c.setFlowCookie(ctx, oauthReturnToCookie, returnTo, 600)
+
+	log.Printf("Redirecting to %s for login", provider.Name())
+	ctx.Redirect(http.StatusTemporaryRedirect, authURL)
+}
+
+// setFlowCookie stores part of a login flow for the callback. The cookies are
+// Lax so they are sent on the redirect back from the identity provider, and
+// limited to HTTPS like the session cookies.
+func (c *AuthController) setFlowCookie(ctx *gin.Context, name, value string, maxAge int) {
+	ctx.SetSameSite(http.SameSiteLaxMode)
+	ctx.SetCookie(name, value, maxAge, oauthCookiePath, "", c.loginFinisher.cfg.SecureCookies(), true)
 }
 
-func (c *AuthController) HandleGoogleCallback(ctx *gin.Context) {
+func (c *AuthController) HandleCallback(ctx *gin.Context) {
+	provider, ok := c.providers[ctx.Param("provider")]
+	if !ok {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Unknown identity provider"})
+		return
+	}
+
 	// Verify state
 	state := ctx.Query("state")
-	storedState, _ := ctx.Cookie("oauth_state")
-	if state == "" || state != storedState {
-		log.Printf("Invalid OAuth state, expected %s, got %s", storedState, state)
-		ctx.Redirect(http.StatusTemporaryRedirect, "http://localhost:3000/auth/error?error=Invalid+OAuth+state")
+	storedState, _ := ctx.Cookie(oauthStateCookie)
+	nonce, _ := ctx.Cookie(oauthNonceCookie)
+	verifier, _ := ctx.Cookie(oauthVerifierCookie)
+	storedReturnTo, _ := ctx.Cookie(oauthReturnToCookie)
+
+	// The flow cookies are single use
+	for _, name := range []string{oauthStateCookie, oauthNonceCookie, oauthVerifierCookie, oauthReturnToCookie} {
+		c.setFlowCookie(ctx, name, "", -1)
+	}
+
+	if state == "" || state != storedState || verifier == "" {
+		log.Printf("Invalid OAuth state in %s callback", provider.Name())
+		c.loginFinisher.RedirectError(ctx, "Invalid OAuth state")
+		return
+	}
+
+	if providerError := ctx.Query("error"); providerError != "" {
+		log.Printf("%s returned error: %s", provider.Name(), providerError)
+		c.loginFinisher.RedirectError(ctx, "Login was not completed")
 		return
 	}
 
+	// Check return_to again in case the allowlist changed during the login
+	returnTo, err := c.loginFinisher.ResolveReturnTo(storedReturnTo)
+	if err != nil {
+		log.Printf("Dropping return_to %q that is no longer allowed", storedReturnTo)
+		returnTo, _ = c.loginFinisher.ResolveReturnTo("")
+	}
+
 	code := ctx.Query("code")
 	if code == "" {
 		log.Printf("No code in callback")
-		ctx.Redirect(http.StatusTemporaryRedirect, "http://localhost:3000/auth/error?error=No+authorization+code")
+		c.loginFinisher.RedirectError(ctx, "No authorization code")
 		return
 	}
 
-	token, err := c.oauthConfig.Exchange(ctx, code)
+	identity, err := provider.Exchange(ctx.Request.Context(), code, nonce, verifier)
 	if err != nil {
-		log.Printf("Token exchange error: %v", err)
-		ctx.Redirect(http.StatusTemporaryRedirect, "http://localhost:3000/auth/error?error=Failed+to+exchange+token")
+		log.Printf("%s login failed: %v", provider.Name(), err)
+		c.loginFinisher.RedirectError(ctx, "Failed to sign in")
 		return
 	}
 
-	client := c.oauthConfig.Client(ctx, token)
-	resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
+	log.Printf("Received %s identity: Subject=%s, Email=%s, Name=%s", identity.Provider, identity.Subject, identity.Email, identity.Name)
+
+	user, err := c.userService.LoginWithIdentity(identity)
+	if err == services.ErrIdentityEmailUnverified || err == services.ErrIdentityEmailRequired {
+		log.Printf("Refusing %s login: %v", provider.Name(), err)
+		c.loginFinisher.RedirectError(ctx, err.Error())
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to get user info: %v", err)
-		ctx.Redirect(http.StatusTemporaryRedirect, "http://localhost:3000/auth/error?error=Failed+to+get+user+info")
+		log.Printf("Failed to create/update user: %v", err)
+		c.loginFinisher.RedirectError(ctx, "Failed to create or update user")
 		return
 	}
-	defer resp.Body.Close()
 
-	var userInfo struct {
-		ID        string `json:"id"`
-		Email     string `json:"email"`
-		Name      string `json:"name"`
-		Picture   string `json:"picture"`
-		PublicKey string `json:"public_key"`
+	c.loginFinisher.Complete(ctx, user, returnTo)
+}
+
+// ExchangeLoginCode trades the one-time code a login redirected to the
+// frontend with for a new session, or for a two-factor challenge
+func (c *AuthController) ExchangeLoginCode(ctx *gin.Context) {
+	var request struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	userID, err := c.loginFinisher.loginCodes.RedeemLoginCode(request.Code)
+	if err == services.ErrInvalidLoginCode {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login code"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to redeem login code: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		log.Printf("Failed to decode user info: %v", err)
-		ctx.Redirect(http.StatusTemporaryRedirect, "http://localhost:3000/auth/error?error=Failed+to+decode+user+info")
+	user, err := c.userService.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Failed to get user %s: %v", userID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
 		return
 	}
 
-	log.Printf("Received user info: ID=%s, Email=%s, Name=%s", userInfo.ID, userInfo.Email, userInfo.Name)
+	c.loginFinisher.beginSession(ctx, user)
+}
+
+// RefreshToken exchanges a refresh token for a new access token and refresh
+// token. In cookie session mode the refresh token cookie is used when the
+// body has none.
+func (c *AuthController) RefreshToken(ctx *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil && err != io.EOF {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if request.RefreshToken == "" {
+		request.RefreshToken, _ = ctx.Cookie(auth.RefreshTokenCookie)
+	}
+	if request.RefreshToken == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
 
-	user, err := c.userService.CreateOrUpdateUser(userInfo.ID, userInfo.Email, userInfo.Name, userInfo.Picture, userInfo.PublicKey)
+	session, refreshToken, err := c.sessionService.RotateRefreshToken(request.RefreshToken, ctx.Request.UserAgent(), ctx.ClientIP())
+	if err == services.ErrRefreshTokenReused {
+		log.Printf("Refresh token reuse detected for user %s, revoked session %s", session.UserID, session.ID)
+		c.wsController.DisconnectSessions(session.ID)
+		c.loginFinisher.clearSession(ctx)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has already been used"})
+		return
+	}
+	if err == services.ErrInvalidRefreshToken {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to create/update user: %v", err)
-		ctx.Redirect(http.StatusTemporaryRedirect, "http://localhost:3000/auth/error?error=Failed+to+create+or+update+user")
+		log.Printf("Failed to rotate refresh token: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
 		return
 	}
 
-	// Generate JWT token
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub":        user.ID,
-		"name":       user.Name,
-		"email":      user.Email,
-		"avatar_url": user.AvatarURL,
-		"exp":        time.Now().Add(24 * time.Hour).Unix(),
-	})
+	user, err := c.userService.GetUserByID(session.UserID)
+	if err != nil {
+		log.Printf("Failed to get user %s: %v", session.UserID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return
+	}
 
-	tokenString, err := jwtToken.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	accessToken, expiresAt, err := c.tokens.IssueAccessToken(user, session.ID)
 	if err != nil {
 		log.Printf("Failed to generate token: %v", err)
-		ctx.Redirect(http.StatusTemporaryRedirect, "http://localhost:3000/auth/error?error=Failed+to+generate+token")
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.loginFinisher.respondWithSession(ctx, &sessionTokens{
+		SessionID:    session.ID,
+		AccessToken:  accessToken,
+		ExpiresAt:    expiresAt,
+		RefreshToken: refreshToken,
+	}, nil)
+}
+
+// Logout revokes the current session and closes its connections
+func (c *AuthController) Logout(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
+	sessionID := ctx.GetString("sessionID")
+
+	if err := c.sessionService.RevokeSession(userID, sessionID, services.SessionRevokedLogout); err != nil {
+		log.Printf("Failed to revoke session %s: %v", sessionID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
 		return
 	}
+	c.wsController.DisconnectSessions(sessionID)
+	c.loginFinisher.clearSession(ctx)
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// LogoutAll revokes every session of the current user, logging out all of
+// their devices
+func (c *AuthController) LogoutAll(ctx *gin.Context) {
+	userID := ctx.GetString("userID")
 
-	// Clear the oauth state cookie
-	ctx.SetCookie("oauth_state", "", -1, "/", "", false, true)
+	sessionIDs, err := c.sessionService.RevokeAllSessions(userID, services.SessionRevokedLogoutAll)
+	if err != nil {
+		log.Printf("Failed to revoke sessions of user %s: %v", userID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+	c.wsController.DisconnectSessions(sessionIDs...)
+	c.loginFinisher.clearSession(ctx)
 
-	// Redirect to frontend with token
-	redirectURL := fmt.Sprintf("http://localhost:3000/auth/callback?token=%s", url.QueryEscape(tokenString))
-	log.Printf("Redirecting to frontend: %s", redirectURL)
-	ctx.Redirect(http.StatusTemporaryRedirect, redirectURL)
+	ctx.JSON(http.StatusOK, gin.H{"revoked": len(sessionIDs)})
 }
 
 func (c *AuthController) GetCurrentUser(ctx *gin.Context) {
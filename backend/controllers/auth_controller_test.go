@@ -0,0 +1,458 @@
+package controllers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth/oidctest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/config"
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/ratelimit"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+// authTestServer serves the auth endpoints and the WebSocket hub the way main
+// wires them
+type authTestServer struct {
+	*httptest.Server
+	cfg        *config.Config
+	providers  []auth.Provider
+	tokens     *auth.TokenManager
+	sessions   *services.SessionService
+	loginCodes *services.LoginCodeService
+	twoFactor  *services.TwoFactorService
+	settings   *services.SettingsService
+}
+
+// newAuthTestServer starts the server. configure can change the
+// configuration and add providers; PublicURL is already set to the server's
+// address.
+func newAuthTestServer(t *testing.T, db *sql.DB, configure func(*authTestServer)) *authTestServer {
+	t.Helper()
+	s := &authTestServer{
+		Server:     httptest.NewUnstartedServer(nil),
+		cfg:        config.LoadConfig(),
+		tokens:     newTestTokenManager(t),
+		sessions:   services.NewSessionService(db, time.Hour),
+		loginCodes: services.NewLoginCodeService(db, time.Minute),
+		twoFactor:  services.NewTwoFactorService(db, services.NewContentCipher(db, nil), "test"),
+	}
+	s.cfg.PublicURL = "http://" + s.Listener.Addr().String()
+	if configure != nil {
+		configure(s)
+	}
+	s.settings = services.NewSettingsService(db, s.cfg.RequireTwoFactor)
+	wc := newTestWebSocketController(t, db, s.tokens, s.sessions, nil)
+	userService := services.NewUserService(db)
+	loginFinisher := NewLoginFinisher(s.cfg, s.sessions, s.loginCodes, s.twoFactor, s.settings, s.tokens)
+	c := NewAuthController(s.providers, userService, s.sessions, s.tokens, loginFinisher, wc)
+	twoFactor := NewTwoFactorController(s.twoFactor, userService, s.settings, loginFinisher, ratelimit.NewLimiter(100, time.Minute))
+
+	r := gin.New()
+	r.GET("/ws", wc.HandleWebSocket)
+	r.GET("/api/v1/auth/:provider/login", c.HandleLogin)
+	r.GET("/api/v1/auth/:provider/callback", c.HandleCallback)
+	r.POST("/api/v1/auth/exchange", c.ExchangeLoginCode)
+	r.POST("/api/v1/auth/refresh", c.RefreshToken)
+	r.POST("/api/v1/auth/2fa/enroll", twoFactor.BeginChallengeEnrollment)
+	r.POST("/api/v1/auth/2fa/verify", twoFactor.VerifyChallenge)
+	api := r.Group("/api/v1", auth.Middleware(s.tokens, s.sessions, nil))
+	api.POST("/auth/logout", c.Logout)
+	api.POST("/auth/logout-all", c.LogoutAll)
+	api.POST("/users/me/2fa", twoFactor.BeginEnrollment)
+	api.POST("/users/me/2fa/confirm", twoFactor.ConfirmEnrollment)
+	api.DELETE("/users/me/2fa", twoFactor.Disable)
+
+	s.Config.Handler = r
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// login starts a session for the user and returns its access and refresh
+// token
+func (s *authTestServer) login(t *testing.T, userID string) (string, string) {
+	t.Helper()
+	session, refreshToken, err := s.sessions.CreateSession(userID, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return accessToken(t, s.tokens, userID, session.ID), refreshToken
+}
+
+// post sends a JSON body with an optional access token and cookies
+func (s *authTestServer) post(t *testing.T, path, token string, body interface{}, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	return s.do(t, http.MethodPost, path, token, body, cookies...)
+}
+
+// do is post with another method
+func (s *authTestServer) do(t *testing.T, method, path, token string, body interface{}, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.Config.Handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestRefreshToken(t *testing.T) {
+	db := dbtest.Open(t)
+	s := newAuthTestServer(t, db, nil)
+	alice := dbtest.CreateUser(t, db, "alice")
+	access, first := s.login(t, alice)
+	conn := dialWebSocket(t, s.Server, "token="+access, nil)
+
+	w := s.post(t, "/api/v1/auth/refresh", "", gin.H{"refresh_token": first})
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh: status %d: %s", w.Code, w.Body)
+	}
+	var refreshed struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	decodeJSON(t, w, &refreshed)
+	if refreshed.RefreshToken == "" || refreshed.RefreshToken == first {
+		t.Fatalf("refresh token was not rotated: %+v", refreshed)
+	}
+	claims, err := s.tokens.ParseAccessToken(refreshed.Token)
+	if err != nil || claims.Subject != alice {
+		t.Fatalf("new access token: %+v, %v", claims, err)
+	}
+
+	// Replaying the rotated token revokes the session and drops its socket
+	if w := s.post(t, "/api/v1/auth/refresh", "", gin.H{"refresh_token": first}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("reuse: status %d, want 401", w.Code)
+	}
+	expectClose(t, conn, CloseSessionRevoked)
+	if w := s.post(t, "/api/v1/auth/refresh", "", gin.H{"refresh_token": refreshed.RefreshToken}); w.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after reuse: status %d, want 401", w.Code)
+	}
+
+	if w := s.post(t, "/api/v1/auth/refresh", "", gin.H{"refresh_token": "unknown"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown token: status %d, want 401", w.Code)
+	}
+	if w := s.post(t, "/api/v1/auth/refresh", "", gin.H{}); w.Code != http.StatusBadRequest {
+		t.Errorf("no token: status %d, want 400", w.Code)
+	}
+}
+
+func TestRefreshTokenCookie(t *testing.T) {
+	db := dbtest.Open(t)
+	s := newAuthTestServer(t, db, func(s *authTestServer) { s.cfg.SessionCookies = true })
+	_, refreshToken := s.login(t, dbtest.CreateUser(t, db, "alice"))
+
+	w := s.post(t, "/api/v1/auth/refresh", "", nil, &http.Cookie{Name: auth.RefreshTokenCookie, Value: refreshToken})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var body map[string]interface{}
+	decodeJSON(t, w, &body)
+	if _, ok := body["token"]; ok {
+		t.Error("tokens were returned in the body in cookie session mode")
+	}
+
+	cookies := map[string]string{}
+	for _, cookie := range w.Result().Cookies() {
+		if !cookie.HttpOnly {
+			t.Errorf("cookie %s is not HttpOnly", cookie.Name)
+		}
+		cookies[cookie.Name] = cookie.Value
+	}
+	if cookies[auth.AccessTokenCookie] == "" || cookies[auth.RefreshTokenCookie] == "" || cookies[auth.RefreshTokenCookie] == refreshToken {
+		t.Errorf("cookies = %v, want a new access and refresh token", cookies)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	db := dbtest.Open(t)
+	s := newAuthTestServer(t, db, nil)
+	alice := dbtest.CreateUser(t, db, "alice")
+	phone, phoneRefresh := s.login(t, alice)
+	laptop, _ := s.login(t, alice)
+	phoneConn := dialWebSocket(t, s.Server, "token="+phone, nil)
+	laptopConn := dialWebSocket(t, s.Server, "token="+laptop, nil)
+
+	if w := s.post(t, "/api/v1/auth/logout", phone, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("logout: status %d: %s", w.Code, w.Body)
+	}
+	expectClose(t, phoneConn, CloseSessionRevoked)
+	if w := s.post(t, "/api/v1/auth/logout", phone, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("access token after logout: status %d, want 401", w.Code)
+	}
+	if w := s.post(t, "/api/v1/auth/refresh", "", gin.H{"refresh_token": phoneRefresh}); w.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout: status %d, want 401", w.Code)
+	}
+
+	// The laptop is still signed in until every device is logged out
+	w := s.post(t, "/api/v1/auth/logout-all", laptop, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("logout-all: status %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Revoked int `json:"revoked"`
+	}
+	decodeJSON(t, w, &body)
+	if body.Revoked != 1 {
+		t.Errorf("revoked %d sessions, want 1", body.Revoked)
+	}
+	expectClose(t, laptopConn, CloseSessionRevoked)
+}
+
+func TestWebSocketRejectsRevokedSession(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, nil, tokens, testSessions{"s1": true}, nil)
+	r := gin.New()
+	r.GET("/ws", wc.HandleWebSocket)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	conn := dialWebSocket(t, server, "token="+accessToken(t, tokens, "u1", "s1"), nil)
+	wc.DisconnectSessions("s1")
+	expectClose(t, conn, CloseSessionRevoked)
+
+	for name, token := range map[string]string{
+		"revoked session": accessToken(t, tokens, "u1", "s2"),
+		"invalid token":   "garbage",
+		"no token":        "",
+	} {
+		w := serve(t, r, http.MethodGet, "/ws?token="+token, "", nil)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", name, w.Code)
+		}
+	}
+}
+
+// newTestIdentityProvider starts a fake OpenID Connect provider with the
+// given accounts
+func newTestIdentityProvider(t *testing.T, users ...oidctest.User) *oidctest.Server {
+	t.Helper()
+	idp, err := oidctest.NewServer("", "client", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range users {
+		idp.AddUser(user)
+	}
+	server := httptest.NewUnstartedServer(idp)
+	idp.Issuer = "http://" + server.Listener.Addr().String()
+	server.Start()
+	t.Cleanup(server.Close)
+	return idp
+}
+
+// withIdentityProvider registers idp with the server as "test"
+func withIdentityProvider(idp *oidctest.Server) func(*authTestServer) {
+	return func(s *authTestServer) {
+		s.providers = append(s.providers, auth.NewOIDCProvider("test", "Test", idp.Issuer, idp.ClientID, idp.ClientSecret, s.cfg.APIURL("/api/v1/auth/test/callback"), nil))
+	}
+}
+
+// signIn goes through the login flow of the test provider as the account
+// named by loginHint and returns the frontend page the callback redirected
+// to. tamper, if set, can change the callback's query.
+func (s *authTestServer) signIn(t *testing.T, loginHint string, tamper func(url.Values)) *url.URL {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	redirect := func(target *url.URL) *url.URL {
+		t.Helper()
+		resp, err := client.Get(target.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		location, err := resp.Location()
+		if err != nil {
+			t.Fatalf("GET %s: status %d, want a redirect", target.Path, resp.StatusCode)
+		}
+		return location
+	}
+
+	login, _ := url.Parse(s.URL + "/api/v1/auth/test/login")
+	authorize := redirect(login)
+	query := authorize.Query()
+	query.Set("login_hint", loginHint)
+	authorize.RawQuery = query.Encode()
+
+	callback := redirect(authorize)
+	if tamper != nil {
+		query := callback.Query()
+		tamper(query)
+		callback.RawQuery = query.Encode()
+	}
+	return redirect(callback)
+}
+
+// redeem exchanges the login code a successful sign in redirected with for
+// the user ID
+func (s *authTestServer) redeem(t *testing.T, page *url.URL) string {
+	t.Helper()
+	if page.Path != "/auth/callback" || page.Query().Get("code") == "" {
+		t.Fatalf("login ended on %s, want the callback page with a code", page)
+	}
+	userID, err := s.loginCodes.RedeemLoginCode(page.Query().Get("code"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+func countRows(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestOIDCLogin(t *testing.T) {
+	db := dbtest.Open(t)
+	idp := newTestIdentityProvider(t,
+		oidctest.User{Subject: "alice", Email: "alice@example.com", EmailVerified: true, Name: "Alice"},
+		oidctest.User{Subject: "carol", Email: "carol@example.com", EmailVerified: true, Name: "Carol"},
+	)
+	s := newAuthTestServer(t, db, withIdentityProvider(idp))
+	alice := dbtest.CreateUser(t, db, "alice")
+
+	// A verified email signs in to the existing user with it
+	if userID := s.redeem(t, s.signIn(t, "alice", nil)); userID != alice {
+		t.Errorf("alice signed in as %s, want the existing user %s", userID, alice)
+	}
+	if userID := s.redeem(t, s.signIn(t, "alice", nil)); userID != alice {
+		t.Errorf("second sign in as %s, want %s", userID, alice)
+	}
+
+	carol := s.redeem(t, s.signIn(t, "carol", nil))
+	if n := countRows(t, db, `SELECT COUNT(*) FROM users WHERE id = $1 AND email = 'carol@example.com' AND name = 'Carol'`, carol); n != 1 {
+		t.Errorf("carol's account was not created")
+	}
+}
+
+func TestOIDCLoginStateMismatch(t *testing.T) {
+	db := dbtest.Open(t)
+	idp := newTestIdentityProvider(t, oidctest.User{Subject: "alice", Email: "alice@example.com", EmailVerified: true})
+	s := newAuthTestServer(t, db, withIdentityProvider(idp))
+
+	page := s.signIn(t, "alice", func(query url.Values) { query.Set("state", "forged") })
+	if page.Path != "/auth/error" || page.Query().Get("code") != "" {
+		t.Fatalf("login ended on %s, want the error page", page)
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM users`); n != 0 {
+		t.Errorf("%d users were created", n)
+	}
+}
+
+func TestOIDCLoginUnverifiedEmail(t *testing.T) {
+	db := dbtest.Open(t)
+	idp := newTestIdentityProvider(t,
+		oidctest.User{Subject: "mallory-as-bob", Email: "bob@example.com"},
+		oidctest.User{Subject: "mallory", Email: "mallory@example.com"},
+	)
+	s := newAuthTestServer(t, db, withIdentityProvider(idp))
+	dbtest.CreateUser(t, db, "bob")
+
+	for _, hint := range []string{"mallory-as-bob", "mallory"} {
+		page := s.signIn(t, hint, nil)
+		if page.Path != "/auth/error" || !strings.Contains(page.Query().Get("error"), "not verified") {
+			t.Errorf("%s: login ended on %s, want the error page", hint, page)
+		}
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM user_identities`); n != 0 {
+		t.Errorf("%d identities were linked", n)
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM users`); n != 1 {
+		t.Errorf("%d users exist, want only bob", n)
+	}
+}
+
+func TestLoginReturnTo(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	s := newAuthTestServer(t, nil, func(s *authTestServer) {
+		s.cfg.FrontendURL = "https://chat.example.com"
+		s.cfg.AllowedReturnURLs = []string{"https://desktop.example.com/app"}
+		withIdentityProvider(idp)(s)
+	})
+
+	for returnTo, want := range map[string]string{
+		"":                                "https://chat.example.com/auth/callback",
+		"/chats":                          "https://chat.example.com/chats",
+		"https://desktop.example.com/app": "https://desktop.example.com/app",
+	} {
+		w := serve(t, s.Config.Handler, http.MethodGet, "/api/v1/auth/test/login?return_to="+url.QueryEscape(returnTo), "", nil)
+		if location := redirect(t, w); !strings.HasPrefix(location.String(), idp.Issuer) {
+			t.Errorf("return_to %q: redirected to %s, want the identity provider", returnTo, location)
+		}
+		var stored string
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == oauthReturnToCookie {
+				stored, _ = url.QueryUnescape(cookie.Value)
+			}
+		}
+		if stored != want {
+			t.Errorf("return_to %q: stored %q, want %q", returnTo, stored, want)
+		}
+	}
+
+	for _, returnTo := range []string{"https://evil.example.com/", "//evil.example.com", "https://desktop.example.com/"} {
+		w := serve(t, s.Config.Handler, http.MethodGet, "/api/v1/auth/test/login?return_to="+url.QueryEscape(returnTo), "", nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("return_to %q: status %d, want 400", returnTo, w.Code)
+		}
+	}
+
+	if w := serve(t, s.Config.Handler, http.MethodGet, "/api/v1/auth/unknown/login", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown provider: status %d, want 404", w.Code)
+	}
+}
+
+func TestLoginFlowCookies(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	for publicURL, secure := range map[string]bool{"https://api.example.com": true, "": false} {
+		s := newAuthTestServer(t, nil, func(s *authTestServer) {
+			if publicURL != "" {
+				s.cfg.PublicURL = publicURL
+			}
+			withIdentityProvider(idp)(s)
+		})
+
+		for path, maxAge := range map[string]int{"/api/v1/auth/test/login": 600, "/api/v1/auth/test/callback": -1} {
+			w := serve(t, s.Config.Handler, http.MethodGet, path, "", nil)
+			cookies := w.Result().Cookies()
+			if len(cookies) != 4 {
+				t.Fatalf("%s set %d cookies, want 4", path, len(cookies))
+			}
+			for _, cookie := range cookies {
+				if cookie.Secure != secure || cookie.SameSite != http.SameSiteLaxMode || !cookie.HttpOnly || cookie.Path != oauthCookiePath || cookie.MaxAge != maxAge {
+					t.Errorf("%s with PUBLIC_URL %q set %+v, want secure %v, Lax and HttpOnly", path, s.cfg.PublicURL, cookie, secure)
+				}
+			}
+		}
+	}
+}
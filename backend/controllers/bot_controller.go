@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+// BotController lets users create bot accounts and manage their API tokens
+type BotController struct {
+	botService   *services.BotService
+	wsController *WebSocketController
+}
+
+func NewBotController(botService *services.BotService, wsController *WebSocketController) *BotController {
+	return &BotController{
+		botService:   botService,
+		wsController: wsController,
+	}
+}
+
+// CreateBot creates a bot owned by the current user
+func (c *BotController) CreateBot(ctx *gin.Context) {
+	var request struct {
+		Name      string `json:"name" binding:"required"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil || strings.TrimSpace(request.Name) == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	bot, err := c.botService.CreateBot(ctx.GetString("userID"), strings.TrimSpace(request.Name), request.AvatarURL)
+	if err != nil {
+		log.Printf("Failed to create bot: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create bot"})
+		return
+	}
+	ctx.JSON(http.StatusCreated, bot)
+}
+
+// GetBots lists the current user's bots
+func (c *BotController) GetBots(ctx *gin.Context) {
+	bots, err := c.botService.GetBots(ctx.GetString("userID"))
+	if err != nil {
+		log.Printf("Failed to get bots: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get bots"})
+		return
+	}
+	ctx.JSON(http.StatusOK, bots)
+}
+
+// CreateAPIToken issues an API token for one of the current user's bots. The
+// token itself is only ever returned in this response.
+func (c *BotController) CreateAPIToken(ctx *gin.Context) {
+	var request struct {
+		Name            string     `json:"name" binding:"required"`
+		Scopes          []string   `json:"scopes" binding:"required"`
+		ConversationIDs []string   `json:"conversation_ids" binding:"required"`
+		ExpiresAt       *time.Time `json:"expires_at"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	apiToken, token, err := c.botService.CreateAPIToken(ctx.GetString("userID"), ctx.Param("id"), request.Name, request.Scopes, request.ConversationIDs, request.ExpiresAt)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to create API token")
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusCreated, gin.H{
+		"token":     token,
+		"api_token": apiToken,
+	})
+}
+
+// GetAPITokens lists the API tokens of one of the current user's bots
+func (c *BotController) GetAPITokens(ctx *gin.Context) {
+	tokens, err := c.botService.GetAPITokens(ctx.GetString("userID"), ctx.Param("id"))
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get API tokens")
+		return
+	}
+	ctx.JSON(http.StatusOK, tokens)
+}
+
+// RevokeAPIToken revokes an API token and closes the WebSocket connections
+// made with it
+func (c *BotController) RevokeAPIToken(ctx *gin.Context) {
+	tokenID := ctx.Param("tokenId")
+	if err := c.botService.RevokeAPIToken(ctx.GetString("userID"), ctx.Param("id"), tokenID); err != nil {
+		c.handleError(ctx, err, "Failed to revoke API token")
+		return
+	}
+
+	c.wsController.DisconnectSessions(APITokenSessionID(tokenID))
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *BotController) handleError(ctx *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrBotNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Bot not found"})
+	case errors.Is(err, services.ErrAPITokenNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "API token not found"})
+	case errors.Is(err, services.ErrInvalidScope), errors.Is(err, services.ErrConversationsRequired):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrNotParticipant):
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Not a participant of this conversation"})
+	default:
+		log.Printf("%s: %v", message, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
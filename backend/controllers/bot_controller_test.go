@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// botTestServer serves the bot management routes as the test user and the
+// routes bots call with their API tokens, as main does
+type botTestServer struct {
+	*conversationFixture
+	db     *sql.DB
+	router *gin.Engine
+	api    *gin.Engine
+	ws     *httptest.Server
+}
+
+func newBotTestServer(t *testing.T) *botTestServer {
+	t.Helper()
+	db := dbtest.Open(t)
+	cipher := services.NewContentCipher(db, nil)
+	webhooks := services.NewWebhookService(db, cipher, egress.NewPolicy(), time.Second, 1)
+	bots := services.NewBotService(db, webhooks)
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, db, tokens, testSessions{}, nil)
+	wc.apiTokens = bots
+
+	c := NewBotController(bots, wc)
+	r := newTestRouter()
+	r.POST("/api/v1/bots", c.CreateBot)
+	r.GET("/api/v1/bots", c.GetBots)
+	r.POST("/api/v1/bots/:id/tokens", c.CreateAPIToken)
+	r.GET("/api/v1/bots/:id/tokens", c.GetAPITokens)
+	r.DELETE("/api/v1/bots/:id/tokens/:tokenId", c.RevokeAPIToken)
+
+	conversations := NewConversationController(services.NewConversationService(db, cipher, webhooks),
+		services.NewMessageService(db, cipher, webhooks), services.NewUserService(db), wc)
+	api := gin.New()
+	botAPI := api.Group("/api/v1", auth.Middleware(tokens, testSessions{}, bots))
+	botAPI.GET("/conversations/:id/messages", auth.RequireScope(auth.ScopeRead), conversations.GetConversationMessages)
+	botAPI.POST("/conversations/:id/messages", auth.RequireScope(auth.ScopeSend), conversations.SendMessage)
+
+	ws := gin.New()
+	ws.GET("/ws", wc.HandleWebSocket)
+	server := httptest.NewServer(ws)
+	t.Cleanup(server.Close)
+
+	return &botTestServer{
+		conversationFixture: newConversationFixture(t, db),
+		db:                  db,
+		router:              r,
+		api:                 api,
+		ws:                  server,
+	}
+}
+
+// createBot creates a bot owned by ownerID
+func (s *botTestServer) createBot(t *testing.T, ownerID string) string {
+	t.Helper()
+	w := serve(t, s.router, http.MethodPost, "/api/v1/bots", ownerID, gin.H{"name": "builds"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create bot: status %d: %s", w.Code, w.Body)
+	}
+	var bot models.User
+	decodeJSON(t, w, &bot)
+	if !bot.IsBot || bot.BotOwnerID != ownerID {
+		t.Fatalf("created bot %+v", bot)
+	}
+	return bot.ID
+}
+
+// callAPI makes a request authenticated with an API token
+func (s *botTestServer) callAPI(t *testing.T, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.api.ServeHTTP(w, req)
+	return w
+}
+
+// createAPIToken issues a token for the bot with scopes in the conversation
+func (s *botTestServer) createAPIToken(t *testing.T, ownerID, botID, conversationID string, scopes ...string) (string, models.APIToken) {
+	t.Helper()
+	w := serve(t, s.router, http.MethodPost, "/api/v1/bots/"+botID+"/tokens", ownerID, gin.H{
+		"name":             "ci",
+		"scopes":           scopes,
+		"conversation_ids": []string{conversationID},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create token: status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+	var created struct {
+		Token    string          `json:"token"`
+		APIToken models.APIToken `json:"api_token"`
+	}
+	decodeJSON(t, w, &created)
+	return created.Token, created.APIToken
+}
+
+func TestBotAPIToken(t *testing.T) {
+	s := newBotTestServer(t)
+	botID := s.createBot(t, s.alice)
+	tokensPath := "/api/v1/bots/" + botID + "/tokens"
+
+	token, apiToken := s.createAPIToken(t, s.alice, botID, s.conversation, auth.ScopeSend)
+
+	messagesPath := "/api/v1/conversations/" + s.conversation + "/messages"
+	w := s.callAPI(t, http.MethodPost, messagesPath, token, gin.H{"content": "build passed"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("send: status %d: %s", w.Code, w.Body)
+	}
+	var message models.Message
+	decodeJSON(t, w, &message)
+	if !message.Bot || message.SenderID != botID {
+		t.Errorf("sent message %+v, want it flagged as from the bot", message)
+	}
+
+	// The token only allows sending to its conversation
+	if w := s.callAPI(t, http.MethodGet, messagesPath, token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("read without the scope: status %d, want 403", w.Code)
+	}
+	other := dbtest.CreateConversation(t, s.db, s.alice)
+	if w := s.callAPI(t, http.MethodPost, "/api/v1/conversations/"+other+"/messages", token, gin.H{"content": "hi"}); w.Code != http.StatusForbidden {
+		t.Errorf("send to another conversation: status %d, want 403", w.Code)
+	}
+
+	w = serve(t, s.router, http.MethodDelete, tokensPath+"/"+apiToken.ID, s.alice, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: status %d: %s", w.Code, w.Body)
+	}
+	if w := s.callAPI(t, http.MethodPost, messagesPath, token, gin.H{"content": "still here"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("send with a revoked token: status %d, want 401", w.Code)
+	}
+}
+
+func TestBotAPITokenErrors(t *testing.T) {
+	s := newBotTestServer(t)
+	botID := s.createBot(t, s.alice)
+	tokensPath := "/api/v1/bots/" + botID + "/tokens"
+	outside := dbtest.CreateConversation(t, s.db, s.bob)
+
+	tests := []struct {
+		name   string
+		userID string
+		path   string
+		body   gin.H
+		status int
+	}{
+		{name: "no name", userID: s.alice, path: tokensPath, body: gin.H{"scopes": []string{"read"}, "conversation_ids": []string{s.conversation}}, status: http.StatusBadRequest},
+		{name: "unknown scope", userID: s.alice, path: tokensPath, body: gin.H{"name": "ci", "scopes": []string{"admin"}, "conversation_ids": []string{s.conversation}}, status: http.StatusBadRequest},
+		{name: "no conversations", userID: s.alice, path: tokensPath, body: gin.H{"name": "ci", "scopes": []string{"read"}, "conversation_ids": []string{}}, status: http.StatusBadRequest},
+		{name: "expired", userID: s.alice, path: tokensPath, body: gin.H{"name": "ci", "scopes": []string{"read"}, "conversation_ids": []string{s.conversation}, "expires_at": time.Now().Add(-time.Hour)}, status: http.StatusBadRequest},
+		{name: "owner not a member", userID: s.alice, path: tokensPath, body: gin.H{"name": "ci", "scopes": []string{"read"}, "conversation_ids": []string{outside}}, status: http.StatusForbidden},
+		{name: "someone else's bot", userID: s.bob, path: tokensPath, body: gin.H{"name": "ci", "scopes": []string{"read"}, "conversation_ids": []string{s.conversation}}, status: http.StatusNotFound},
+		{name: "unknown bot", userID: s.alice, path: "/api/v1/bots/" + s.bob + "/tokens", body: gin.H{"name": "ci", "scopes": []string{"read"}, "conversation_ids": []string{s.conversation}}, status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := serve(t, s.router, http.MethodPost, tt.path, tt.userID, tt.body); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	if w := serve(t, s.router, http.MethodGet, tokensPath, s.bob, nil); w.Code != http.StatusNotFound {
+		t.Errorf("list another user's bot tokens: status %d, want 404", w.Code)
+	}
+	if w := serve(t, s.router, http.MethodDelete, tokensPath+"/not-a-token", s.alice, nil); w.Code != http.StatusNotFound {
+		t.Errorf("revoke an unknown token: status %d, want 404", w.Code)
+	}
+	var bots []models.User
+	decodeJSON(t, serve(t, s.router, http.MethodGet, "/api/v1/bots", s.bob, nil), &bots)
+	if len(bots) != 0 {
+		t.Errorf("bob sees alice's bots: %+v", bots)
+	}
+}
+
+func TestBotWebSocket(t *testing.T) {
+	s := newBotTestServer(t)
+	botID := s.createBot(t, s.alice)
+	token, apiToken := s.createAPIToken(t, s.alice, botID, s.conversation, auth.ScopeRead, auth.ScopeSend)
+
+	wsURL := "ws" + strings.TrimPrefix(s.ws.URL, "http") + "/ws"
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + auth.APITokenPrefix + "unknown"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unknown API token: %v, %v, want 401", resp, err)
+	}
+
+	conn := dialWebSocket(t, s.ws, "", http.Header{"Authorization": {"Bearer " + token}})
+
+	// Revoking the token closes its connections
+	if w := serve(t, s.router, http.MethodDelete, "/api/v1/bots/"+botID+"/tokens/"+apiToken.ID, s.alice, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: status %d: %s", w.Code, w.Body)
+	}
+	expectClose(t, conn, CloseSessionRevoked)
+}
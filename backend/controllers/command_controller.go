@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+// CommandController lists the slash commands of a conversation and lets bot
+// owners register commands their bots handle
+type CommandController struct {
+	commandService      *services.CommandService
+	conversationService *services.ConversationService
+}
+
+func NewCommandController(commandService *services.CommandService, conversationService *services.ConversationService) *CommandController {
+	return &CommandController{
+		commandService:      commandService,
+		conversationService: conversationService,
+	}
+}
+
+// GetCommands lists the commands that can be run in the conversation, for
+// clients to autocomplete
+func (c *CommandController) GetCommands(ctx *gin.Context) {
+	conversationID := ctx.Param("id")
+	ok, err := c.conversationService.IsParticipant(conversationID, ctx.GetString("userID"))
+	if err != nil {
+		log.Printf("Failed to check conversation membership: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check conversation membership"})
+		return
+	}
+	if !ok {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Not a participant of this conversation"})
+		return
+	}
+
+	available, err := c.commandService.ListCommands(conversationID)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get commands")
+		return
+	}
+	ctx.JSON(http.StatusOK, available)
+}
+
+// RegisterCommand registers a command in a conversation for one of the
+// current user's bots. The signing secret is only ever returned in this
+// response.
+func (c *CommandController) RegisterCommand(ctx *gin.Context) {
+	var request struct {
+		ConversationID string `json:"conversation_id" binding:"required"`
+		Name           string `json:"name" binding:"required"`
+		Description    string `json:"description"`
+		Usage          string `json:"usage"`
+		URL            string `json:"url" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	command, secret, err := c.commandService.RegisterCommand(ctx.GetString("userID"), ctx.Param("id"), request.ConversationID, request.Name, request.Description, request.Usage, request.URL)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to register command")
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusCreated, gin.H{
+		"secret":  secret,
+		"command": command,
+	})
+}
+
+// GetBotCommands lists the commands registered for one of the current
+// user's bots
+func (c *CommandController) GetBotCommands(ctx *gin.Context) {
+	registered, err := c.commandService.GetBotCommands(ctx.GetString("userID"), ctx.Param("id"))
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get commands")
+		return
+	}
+	ctx.JSON(http.StatusOK, registered)
+}
+
+// DeleteCommand unregisters a command of one of the current user's bots
+func (c *CommandController) DeleteCommand(ctx *gin.Context) {
+	if err := c.commandService.DeleteCommand(ctx.GetString("userID"), ctx.Param("id"), ctx.Param("commandId")); err != nil {
+		c.handleError(ctx, err, "Failed to delete command")
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *CommandController) handleError(ctx *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrBotNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Bot not found"})
+	case errors.Is(err, services.ErrCommandNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Command not found"})
+	case errors.Is(err, services.ErrInvalidCommandName), errors.Is(err, services.ErrInvalidWebhookURL), errors.Is(err, services.ErrForbiddenWebhookURL):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrCommandNameTaken):
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrNotParticipant):
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "The bot and its owner must both be participants of the conversation"})
+	default:
+		log.Printf("%s: %v", message, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
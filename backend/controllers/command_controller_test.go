@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/commands"
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+func TestBotCommandOverREST(t *testing.T) {
+	db := dbtest.Open(t)
+	f := newConversationFixture(t, db)
+	cipher := services.NewContentCipher(db, nil)
+	webhooks := services.NewWebhookService(db, cipher, egress.NewPolicy(), time.Second, 1)
+	bot, err := services.NewBotService(db, webhooks).CreateBot(f.alice, "deployer", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO conversation_participants (conversation_id, user_id) VALUES ($1, $2)`, f.conversation, bot.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	botServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+		io.WriteString(w, `{"text": "Deploying", "response_type": "public"}`)
+	}))
+	defer botServer.Close()
+
+	allowlist, err := egress.ParseNetworks([]string{"127.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commandService := services.NewCommandService(db, cipher, commands.Builtins(), egress.NewPolicy(allowlist...), time.Second)
+	wc := newTestWebSocketController(t, db, newTestTokenManager(t), testSessions{}, nil)
+	wc.commands = commandService
+	conversations := services.NewConversationService(db, cipher, webhooks)
+	commandController := NewCommandController(commandService, conversations)
+	guardedController := NewCommandController(services.NewCommandService(db, cipher, commands.Builtins(), egress.NewPolicy(), time.Second), conversations)
+	conversationController := NewConversationController(conversations, services.NewMessageService(db, cipher, webhooks), services.NewUserService(db), wc)
+
+	r := newTestRouter()
+	r.POST("/bots/:id/commands", commandController.RegisterCommand)
+	r.POST("/guarded/bots/:id/commands", guardedController.RegisterCommand)
+	r.POST("/conversations/:id/messages", conversationController.SendMessage)
+
+	register := gin.H{"conversation_id": f.conversation, "name": "deploy", "url": botServer.URL}
+	if w := serve(t, r, http.MethodPost, "/guarded/bots/"+bot.ID+"/commands", f.alice, register); w.Code != http.StatusBadRequest {
+		t.Errorf("register at a loopback address: status %d, want 400: %s", w.Code, w.Body)
+	}
+	if w := serve(t, r, http.MethodPost, "/bots/"+bot.ID+"/commands", f.bob, register); w.Code != http.StatusNotFound {
+		t.Errorf("register for someone else's bot: status %d, want 404", w.Code)
+	}
+	if w := serve(t, r, http.MethodPost, "/bots/"+bot.ID+"/commands", f.alice, register); w.Code != http.StatusCreated {
+		t.Fatalf("register: status %d: %s", w.Code, w.Body)
+	}
+
+	path := "/conversations/" + f.conversation + "/messages"
+	w := serve(t, r, http.MethodPost, path, f.bob, gin.H{"content": "/deploy staging"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("run: status %d: %s", w.Code, w.Body)
+	}
+	var message models.Message
+	decodeJSON(t, w, &message)
+	if message.Content != "Deploying" || message.SenderID != bot.ID || !message.Bot {
+		t.Fatalf("reply = %+v, want it posted as the bot", message)
+	}
+
+	// A failed request posts nothing, whatever the body says
+	status.Store(http.StatusInternalServerError)
+	if w := serve(t, r, http.MethodPost, path, f.bob, gin.H{"content": "/deploy production"}); w.Code != http.StatusBadGateway {
+		t.Errorf("failing bot: status %d, want 502: %s", w.Code, w.Body)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages WHERE conversation_id = $1`, f.conversation).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("%d messages stored, want only the first reply", count)
+	}
+
+	if w := serve(t, r, http.MethodPost, path, f.bob, gin.H{"content": "/rollback"}); w.Code != http.StatusNotFound {
+		t.Errorf("unknown command: status %d, want 404", w.Code)
+	}
+}
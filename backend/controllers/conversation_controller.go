@@ -1,22 +1,32 @@
 package controllers
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"time"
 
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/commands"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
 	"github.com/RatneshMaurya/not-whatsapp/backend/services"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type ConversationController struct {
 	conversationService *services.ConversationService
 	messageService      *services.MessageService
+	userService         *services.UserService
+	wsController        *WebSocketController
 }
 
-func NewConversationController(conversationService *services.ConversationService, messageService *services.MessageService) *ConversationController {
+func NewConversationController(conversationService *services.ConversationService, messageService *services.MessageService, userService *services.UserService, wsController *WebSocketController) *ConversationController {
 	return &ConversationController{
 		conversationService: conversationService,
 		messageService:      messageService,
+		userService:         userService,
+		wsController:        wsController,
 	}
 }
 
@@ -80,3 +90,106 @@ func (c *ConversationController) GetConversationMessages(ctx *gin.Context) {
 	}
 	ctx.JSON(http.StatusOK, messages)
 }
+
+// SendMessage posts a message to a conversation over REST and delivers it to
+// the participants connected over WebSocket. Bots use it with an API token
+// that grants send in the conversation.
+func (c *ConversationController) SendMessage(ctx *gin.Context) {
+	var request struct {
+		Content     string `json:"content" binding:"required"`
+		Encrypted   bool   `json:"encrypted"`
+		MessageType string `json:"message_type"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if request.MessageType == "" {
+		request.MessageType = "text"
+	}
+	if request.MessageType != "text" && request.MessageType != "image" && request.MessageType != "file" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message type"})
+		return
+	}
+
+	conversationID := ctx.Param("id")
+	userID := ctx.GetString("userID")
+	ok, err := c.conversationService.IsParticipant(conversationID, userID)
+	if err != nil {
+		log.Printf("Failed to check conversation membership: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check conversation membership"})
+		return
+	}
+	if !ok {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Not a participant of this conversation"})
+		return
+	}
+
+	sender, err := c.userService.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Failed to load sender %s: %v", userID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+		return
+	}
+
+	// Slash commands from users are run instead of being stored
+	if auth.APITokenFromContext(ctx) == nil && !request.Encrypted && request.MessageType == "text" {
+		if name, args, ok := commands.Parse(request.Content); ok {
+			c.runCommand(ctx, *sender, conversationID, name, args)
+			return
+		}
+	}
+
+	now := time.Now()
+	message := &models.Message{
+		ID:             uuid.New().String(),
+		ConversationID: conversationID,
+		Content:        request.Content,
+		SenderID:       userID,
+		Encrypted:      request.Encrypted,
+		MessageType:    request.MessageType,
+		Bot:            auth.APITokenFromContext(ctx) != nil,
+		CreatedAt:      now,
+		DeliveredAt:    now,
+	}
+	if err := c.messageService.CreateMessage(message); err != nil {
+		log.Printf("Failed to save message: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+		return
+	}
+
+	message.Sender = *sender
+	if err := c.wsController.DeliverMessage(message); err != nil {
+		log.Printf("Failed to deliver message %s: %v", message.ID, err)
+	}
+
+	ctx.JSON(http.StatusCreated, message)
+}
+
+// runCommand answers a slash command sent over REST with the message a
+// public reply was posted as, or with an ephemeral reply only the sender sees
+func (c *ConversationController) runCommand(ctx *gin.Context, sender models.User, conversationID, name, args string) {
+	result, message, err := c.wsController.RunCommand(ctx.Request.Context(), sender, conversationID, name, args)
+	switch {
+	case errors.Is(err, services.ErrCommandNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": CommandErrorMessage(name, err)})
+		return
+	case errors.Is(err, services.ErrCommandFailed):
+		log.Printf("Command /%s from %s failed: %v", name, sender.ID, err)
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": CommandErrorMessage(name, err)})
+		return
+	case err != nil:
+		log.Printf("Command /%s from %s failed: %v", name, sender.ID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": CommandErrorMessage(name, err)})
+		return
+	}
+
+	if message != nil {
+		ctx.JSON(http.StatusCreated, message)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"ephemeral": true,
+		"content":   result.Text,
+	})
+}
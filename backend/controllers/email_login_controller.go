@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	appmail "github.com/RatneshMaurya/not-whatsapp/backend/mail"
+	"github.com/RatneshMaurya/not-whatsapp/backend/ratelimit"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+// EmailLoginController signs users in with single-use links sent by email
+type EmailLoginController struct {
+	emailLoginService *services.EmailLoginService
+	userService       *services.UserService
+	loginFinisher     *LoginFinisher
+	mailer            appmail.Mailer
+	publicURL         string
+	linkTTL           time.Duration
+	perEmail          *ratelimit.Limiter
+	perIP             *ratelimit.Limiter
+}
+
+func NewEmailLoginController(emailLoginService *services.EmailLoginService, userService *services.UserService, loginFinisher *LoginFinisher, mailer appmail.Mailer, publicURL string, linkTTL time.Duration, perEmail, perIP *ratelimit.Limiter) *EmailLoginController {
+	return &EmailLoginController{
+		emailLoginService: emailLoginService,
+		userService:       userService,
+		loginFinisher:     loginFinisher,
+		mailer:            mailer,
+		publicURL:         publicURL,
+		linkTTL:           linkTTL,
+		perEmail:          perEmail,
+		perIP:             perIP,
+	}
+}
+
+// RequestLoginLink emails a login link. The response is the same whether or
+// not an account exists for the address. The optional return_to picks the
+// frontend page the link finishes on.
+func (c *EmailLoginController) RequestLoginLink(ctx *gin.Context) {
+	var request struct {
+		Email    string `json:"email" binding:"required"`
+		ReturnTo string `json:"return_to"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if _, err := c.loginFinisher.ResolveReturnTo(request.ReturnTo); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "return_to is not an allowed URL"})
+		return
+	}
+
+	address, err := mail.ParseAddress(strings.TrimSpace(request.Email))
+	if err != nil || address.Address != strings.TrimSpace(request.Email) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+		return
+	}
+	email := strings.ToLower(address.Address)
+
+	if ok, retryAfter := c.perIP.Allow(ctx.ClientIP()); !ok {
+		tooManyRequests(ctx, retryAfter)
+		return
+	}
+	if ok, retryAfter := c.perEmail.Allow(email); !ok {
+		tooManyRequests(ctx, retryAfter)
+		return
+	}
+
+	token, err := c.emailLoginService.CreateLoginToken(email, ctx.ClientIP())
+	if err != nil {
+		log.Printf("Failed to create login link: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create login link"})
+		return
+	}
+
+	params := url.Values{"token": {token}}
+	if request.ReturnTo != "" {
+		params.Set("return_to", request.ReturnTo)
+	}
+	link := strings.TrimRight(c.publicURL, "/") + "/api/v1/auth/email/callback?" + params.Encode()
+	err = c.mailer.Send(ctx, appmail.Message{
+		To:      email,
+		Subject: "Your not-whatsapp login link",
+		Body: fmt.Sprintf("Use this link to sign in to not-whatsapp:\n\n%s\n\n"+
+			"The link works once and expires in %d minutes. If you did not ask to sign in, you can ignore this email.\n",
+			link, int(c.linkTTL.Minutes())),
+	})
+	if err != nil {
+		log.Printf("Failed to send login link: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send login link"})
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{"status": "sent"})
+}
+
+// HandleCallback redeems a login link and signs the user in, creating an
+// account on first use
+func (c *EmailLoginController) HandleCallback(ctx *gin.Context) {
+	// return_to is not covered by the link token, so check it again
+	returnTo, err := c.loginFinisher.ResolveReturnTo(ctx.Query("return_to"))
+	if err != nil {
+		c.loginFinisher.RedirectError(ctx, "Invalid or expired login link")
+		return
+	}
+
+	email, err := c.emailLoginService.RedeemLoginToken(ctx.Query("token"))
+	if err == services.ErrInvalidLoginLink {
+		c.loginFinisher.RedirectError(ctx, "Invalid or expired login link")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to redeem login link: %v", err)
+		c.loginFinisher.RedirectError(ctx, "Failed to sign in")
+		return
+	}
+
+	// The email address was verified by receiving the link
+	user, err := c.userService.LoginWithIdentity(&auth.Identity{
+		Provider:      "email",
+		Subject:       email,
+		Email:         email,
+		EmailVerified: true,
+	})
+	if err != nil {
+		log.Printf("Failed to create/update user: %v", err)
+		c.loginFinisher.RedirectError(ctx, "Failed to create or update user")
+		return
+	}
+
+	c.loginFinisher.Complete(ctx, user, returnTo)
+}
+
+// tooManyRequests rejects a rate limited request with a Retry-After hint
+func tooManyRequests(ctx *gin.Context, retryAfter time.Duration) {
+	ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	ctx.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, try again later"})
+}
@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/config"
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	appmail "github.com/RatneshMaurya/not-whatsapp/backend/mail"
+	"github.com/RatneshMaurya/not-whatsapp/backend/ratelimit"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+// testMailer keeps the messages it is asked to send
+type testMailer struct {
+	mu       sync.Mutex
+	messages []appmail.Message
+}
+
+func (m *testMailer) Send(ctx context.Context, msg appmail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+var linkPattern = regexp.MustCompile(`https?://\S+`)
+
+// lastLink returns the path and query of the link in the last message sent
+// to the address
+func (m *testMailer) lastLink(t *testing.T, to string) string {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].To != to {
+			continue
+		}
+		link, err := url.Parse(linkPattern.FindString(m.messages[i].Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link.RequestURI()
+	}
+	t.Fatalf("no message was sent to %s", to)
+	return ""
+}
+
+type emailLoginFixture struct {
+	router     *gin.Engine
+	cfg        *config.Config
+	mailer     *testMailer
+	loginCodes *services.LoginCodeService
+}
+
+func newEmailLoginFixture(t *testing.T, db *sql.DB, perEmail, perIP *ratelimit.Limiter) *emailLoginFixture {
+	t.Helper()
+	f := &emailLoginFixture{
+		cfg:        config.LoadConfig(),
+		mailer:     &testMailer{},
+		loginCodes: services.NewLoginCodeService(db, time.Minute),
+	}
+	tokens := newTestTokenManager(t)
+	sessions := services.NewSessionService(db, time.Hour)
+	twoFactor := services.NewTwoFactorService(db, services.NewContentCipher(db, nil), "test")
+	loginFinisher := NewLoginFinisher(f.cfg, sessions, f.loginCodes, twoFactor, services.NewSettingsService(db, false), tokens)
+	c := NewEmailLoginController(services.NewEmailLoginService(db, tokens, time.Minute), services.NewUserService(db), loginFinisher, f.mailer, f.cfg.PublicURL, time.Minute, perEmail, perIP)
+
+	f.router = gin.New()
+	// As in main, X-Forwarded-For is only believed from trusted proxies
+	if err := f.router.SetTrustedProxies(f.cfg.TrustedProxies); err != nil {
+		t.Fatal(err)
+	}
+	f.router.POST("/api/v1/auth/email/request", c.RequestLoginLink)
+	f.router.GET("/api/v1/auth/email/callback", c.HandleCallback)
+	return f
+}
+
+// redirect returns where a response redirected to
+func redirect(t *testing.T, w *httptest.ResponseRecorder) *url.URL {
+	t.Helper()
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || location.String() == "" {
+		t.Fatalf("no redirect, status %d: %s", w.Code, w.Body)
+	}
+	return location
+}
+
+func TestEmailLogin(t *testing.T) {
+	db := dbtest.Open(t)
+	f := newEmailLoginFixture(t, db, ratelimit.NewLimiter(5, time.Hour), ratelimit.NewLimiter(5, time.Hour))
+
+	w := serve(t, f.router, http.MethodPost, "/api/v1/auth/email/request", "", gin.H{"email": "Alice@Example.com", "return_to": "/chats"})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("request: status %d: %s", w.Code, w.Body)
+	}
+	link := f.mailer.lastLink(t, "alice@example.com")
+
+	w = serve(t, f.router, http.MethodGet, link, "", nil)
+	page := redirect(t, w)
+	if !strings.HasPrefix(page.String(), f.cfg.FrontendURL+"/chats?") || page.Query().Get("code") == "" {
+		t.Fatalf("login ended on %s, want /chats with a code", page)
+	}
+	userID, err := f.loginCodes.RedeemLoginCode(page.Query().Get("code"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM users WHERE id = $1 AND email = 'alice@example.com'`, userID); n != 1 {
+		t.Error("no account was created for alice@example.com")
+	}
+
+	// Links work once
+	w = serve(t, f.router, http.MethodGet, link, "", nil)
+	if page := redirect(t, w); page.Path != "/auth/error" {
+		t.Errorf("second use ended on %s, want the error page", page)
+	}
+}
+
+func TestEmailLoginRequestErrors(t *testing.T) {
+	f := newEmailLoginFixture(t, nil, ratelimit.NewLimiter(5, time.Hour), ratelimit.NewLimiter(0, time.Hour))
+
+	tests := []struct {
+		name   string
+		body   interface{}
+		status int
+	}{
+		{"no email", gin.H{}, http.StatusBadRequest},
+		{"invalid email", gin.H{"email": "not an address"}, http.StatusBadRequest},
+		{"display name", gin.H{"email": "Alice <alice@example.com>"}, http.StatusBadRequest},
+		{"foreign return_to", gin.H{"email": "alice@example.com", "return_to": "https://evil.example.com/"}, http.StatusBadRequest},
+		{"rate limited", gin.H{"email": "alice@example.com"}, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		w := serve(t, f.router, http.MethodPost, "/api/v1/auth/email/request", "", tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if tt.status == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After", tt.name)
+		}
+	}
+	if len(f.mailer.messages) != 0 {
+		t.Errorf("%d messages were sent", len(f.mailer.messages))
+	}
+}
+
+func TestEmailLoginIgnoresForgedForwardedFor(t *testing.T) {
+	perIP := ratelimit.NewLimiter(1, time.Hour)
+	// Every request that gets past the per-IP limit is refused per address,
+	// before it reaches the database
+	f := newEmailLoginFixture(t, nil, ratelimit.NewLimiter(0, time.Hour), perIP)
+
+	for _, forwardedFor := range []string{"203.0.113.1", "203.0.113.2"} {
+		body, _ := json.Marshal(gin.H{"email": "alice@example.com"})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/email/request", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		f.router.ServeHTTP(w, req)
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("status %d, want 429", w.Code)
+		}
+	}
+
+	// Both requests spent the budget of the connection's address
+	if ok, _ := perIP.Allow("192.0.2.1"); ok {
+		t.Error("requests with a forged X-Forwarded-For did not spend the budget of their address")
+	}
+	if ok, _ := perIP.Allow("203.0.113.2"); !ok {
+		t.Error("a forged X-Forwarded-For address was rate limited")
+	}
+}
+
+func TestEmailLoginCallbackErrors(t *testing.T) {
+	f := newEmailLoginFixture(t, nil, ratelimit.NewLimiter(5, time.Hour), ratelimit.NewLimiter(5, time.Hour))
+	// Signed with another server's secret
+	other := auth.NewTokenManager(auth.NewKeyring(), "", strings.Repeat("x", 32), time.Minute)
+	forged, err := other.IssueEmailLoginToken("alice@example.com", "t1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, query := range map[string]url.Values{
+		"no token":          {},
+		"forged token":      {"token": {forged}},
+		"foreign return_to": {"token": {forged}, "return_to": {"https://evil.example.com/"}},
+	} {
+		w := serve(t, f.router, http.MethodGet, "/api/v1/auth/email/callback?"+query.Encode(), "", nil)
+		page := redirect(t, w)
+		if page.Path != "/auth/error" || page.Host != "localhost:3000" {
+			t.Errorf("%s: redirected to %s, want the frontend's error page", name, page)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/backplane"
+	"github.com/RatneshMaurya/not-whatsapp/backend/commands"
+	"github.com/RatneshMaurya/not-whatsapp/backend/config"
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/ratelimit"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testUserHeader names the user a test request is made as, standing in for
+// auth.Middleware
+const testUserHeader = "X-Test-User"
+
+func newTestRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(func(ctx *gin.Context) {
+		if userID := ctx.GetHeader(testUserHeader); userID != "" {
+			ctx.Set("userID", userID)
+		}
+	})
+	return r
+}
+
+// serve sends a request as userID. A body that is not an io.Reader is sent
+// as JSON.
+func serve(t *testing.T, handler http.Handler, method, path, userID string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	if userID != "" {
+		req.Header.Set(testUserHeader, userID)
+	}
+	if _, ok := body.(io.Reader); !ok && body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// decodeJSON decodes a response body into v
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode response %q: %v", w.Body.String(), err)
+	}
+}
+
+// conversationFixture is a conversation between alice and bob, and eve, who
+// is not in it
+type conversationFixture struct {
+	alice, bob, eve string
+	conversation    string
+}
+
+func newConversationFixture(t *testing.T, db *sql.DB) *conversationFixture {
+	t.Helper()
+	f := &conversationFixture{
+		alice: dbtest.CreateUser(t, db, "alice"),
+		bob:   dbtest.CreateUser(t, db, "bob"),
+		eve:   dbtest.CreateUser(t, db, "eve"),
+	}
+	f.conversation = dbtest.CreateConversation(t, db, f.alice, f.bob)
+	return f
+}
+
+// newTestTokenManager returns a token manager with a single active EdDSA key
+func newTestTokenManager(t *testing.T) *auth.TokenManager {
+	t.Helper()
+	key, err := auth.GenerateSigningKey(auth.AlgorithmEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := auth.NewKeyring()
+	keyring.SetKeys([]auth.SigningKey{{ID: "k1", Algorithm: auth.AlgorithmEdDSA, PrivateKey: key, ActivatesAt: time.Now().Add(-time.Minute)}})
+	return auth.NewTokenManager(keyring, "http://localhost:8080", strings.Repeat("s", 32), time.Minute)
+}
+
+// testSessions is a SessionValidator over a fixed set of active sessions,
+// for tests without a database
+type testSessions map[string]bool
+
+func (s testSessions) IsSessionActive(sessionID string) (bool, error) {
+	return s[sessionID], nil
+}
+
+// accessToken issues an access token for the user's session
+func accessToken(t *testing.T, tokens *auth.TokenManager, userID, sessionID string) string {
+	t.Helper()
+	token, _, err := tokens.IssueAccessToken(&models.User{ID: userID, Name: userID}, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// newTestWebSocketController returns a hub on a single in-memory node named
+// test with the default configuration, adjusted by configure if it is set.
+// db may be nil for tests that only connect and disconnect.
+func newTestWebSocketController(t *testing.T, db *sql.DB, tokens *auth.TokenManager, sessions auth.SessionValidator, configure func(*SocketOptions)) *WebSocketController {
+	t.Helper()
+	return newTestHub(t, db, tokens, sessions, backplane.NewMemory(time.Minute).Node("test"), configure)
+}
+
+// newTestHub returns a hub on node, like newTestWebSocketController
+func newTestHub(t *testing.T, db *sql.DB, tokens *auth.TokenManager, sessions auth.SessionValidator, node *backplane.MemoryNode, configure func(*SocketOptions)) *WebSocketController {
+	t.Helper()
+	cfg := config.LoadConfig()
+	cipher := services.NewContentCipher(db, nil)
+	webhooks := services.NewWebhookService(db, cipher, egress.NewPolicy(), time.Second, 1)
+	t.Cleanup(func() { node.Close() })
+
+	socket := SocketOptions{
+		ReadBufferSize:       cfg.WSReadBufferSize,
+		WriteBufferSize:      cfg.WSWriteBufferSize,
+		ReadLimits:           cfg.WSReadLimits,
+		Compression:          cfg.WSCompression,
+		CompressionLevel:     cfg.WSCompressionLevel,
+		CompressionThreshold: cfg.WSCompressionThreshold,
+		SendQueueSize:        cfg.WSSendQueueSize,
+		AllowedOrigins:       cfg.FrontendOrigins(),
+	}
+	if configure != nil {
+		configure(&socket)
+	}
+
+	wc, err := NewWebSocketController(db,
+		services.NewMessageService(db, cipher, webhooks),
+		services.NewCommandService(db, cipher, commands.Builtins(), egress.NewPolicy(), time.Second),
+		tokens, sessions, nil, node, node,
+		ratelimit.NewPolicy(cfg.RateLimits, nil), cfg.RateLimitMaxViolations, socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		wc.Stop(ctx)
+	})
+	return wc
+}
+
+// dialWebSocket connects to the hub served at server's /ws with header and
+// reads the connected frame
+func dialWebSocket(t *testing.T, server *httptest.Server, query string, header http.Header) *websocket.Conn {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?"+query, header)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dial: %v (status %d)", err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var connected map[string]interface{}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&connected); err != nil {
+		t.Fatal(err)
+	}
+	if connected["type"] != "connected" {
+		t.Fatalf("first frame = %v, want connected", connected)
+	}
+	return conn
+}
+
+// expectClose reads from conn until it is closed and checks the close code
+func expectClose(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("read: %v, want close %d", err, code)
+		}
+		if closeErr.Code != code {
+			t.Fatalf("close code = %d, want %d", closeErr.Code, code)
+		}
+		return
+	}
+}
@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/ratelimit"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Limits on what an integration can post in one message
+const (
+	maxIncomingWebhookBody        = 64 * 1024
+	maxIncomingWebhookText        = 4000
+	maxIncomingWebhookDisplayName = 80
+	maxIncomingWebhookAttachments = 10
+)
+
+// IntegrationMessageType is the message type of integration messages with
+// attachments. Their content is the JSON of an integrationContent.
+const IntegrationMessageType = "integration"
+
+// integrationAttachment is a link with a title and description shown under
+// an integration message, such as a build result
+type integrationAttachment struct {
+	Title string `json:"title,omitempty"`
+	URL   string `json:"url,omitempty"`
+	Text  string `json:"text,omitempty"`
+}
+
+type integrationContent struct {
+	Text        string                  `json:"text"`
+	Attachments []integrationAttachment `json:"attachments"`
+}
+
+// IncomingWebhookController lets conversation participants create incoming
+// webhooks, and lets integrations such as CI systems post through them
+// without a WebSocket connection
+type IncomingWebhookController struct {
+	incomingWebhookService *services.IncomingWebhookService
+	conversationService    *services.ConversationService
+	messageService         *services.MessageService
+	userService            *services.UserService
+	wsController           *WebSocketController
+	publicURL              string
+	perWebhook             *ratelimit.Limiter
+}
+
+func NewIncomingWebhookController(incomingWebhookService *services.IncomingWebhookService, conversationService *services.ConversationService, messageService *services.MessageService, userService *services.UserService, wsController *WebSocketController, publicURL string, perWebhook *ratelimit.Limiter) *IncomingWebhookController {
+	return &IncomingWebhookController{
+		incomingWebhookService: incomingWebhookService,
+		conversationService:    conversationService,
+		messageService:         messageService,
+		userService:            userService,
+		wsController:           wsController,
+		publicURL:              publicURL,
+		perWebhook:             perWebhook,
+	}
+}
+
+// CreateIncomingWebhook creates an incoming webhook for the conversation.
+// The URL with its token is only ever returned in this response.
+func (c *IncomingWebhookController) CreateIncomingWebhook(ctx *gin.Context) {
+	var request struct {
+		Name      string `json:"name" binding:"required"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil || strings.TrimSpace(request.Name) == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	conversationID := ctx.Param("id")
+	userID := ctx.GetString("userID")
+	if !c.requireParticipant(ctx, conversationID, userID) {
+		return
+	}
+
+	webhook, token, err := c.incomingWebhookService.CreateIncomingWebhook(conversationID, userID, strings.TrimSpace(request.Name), request.AvatarURL)
+	if err != nil {
+		log.Printf("Failed to create incoming webhook: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create incoming webhook"})
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusCreated, gin.H{
+		"url":     strings.TrimRight(c.publicURL, "/") + "/api/v1/hooks/" + webhook.ID + "?" + url.Values{"token": {token}}.Encode(),
+		"token":   token,
+		"webhook": webhook,
+	})
+}
+
+// GetIncomingWebhooks lists the incoming webhooks of the conversation
+func (c *IncomingWebhookController) GetIncomingWebhooks(ctx *gin.Context) {
+	conversationID := ctx.Param("id")
+	if !c.requireParticipant(ctx, conversationID, ctx.GetString("userID")) {
+		return
+	}
+
+	webhooks, err := c.incomingWebhookService.GetIncomingWebhooks(conversationID)
+	if err != nil {
+		log.Printf("Failed to get incoming webhooks: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get incoming webhooks"})
+		return
+	}
+	ctx.JSON(http.StatusOK, webhooks)
+}
+
+// DeleteIncomingWebhook stops an incoming webhook from accepting messages
+func (c *IncomingWebhookController) DeleteIncomingWebhook(ctx *gin.Context) {
+	conversationID := ctx.Param("id")
+	if !c.requireParticipant(ctx, conversationID, ctx.GetString("userID")) {
+		return
+	}
+
+	err := c.incomingWebhookService.DeleteIncomingWebhook(conversationID, ctx.Param("webhookId"))
+	if errors.Is(err, services.ErrIncomingWebhookNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Incoming webhook not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete incoming webhook: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete incoming webhook"})
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// PostMessage posts a message through an incoming webhook. The token comes
+// from the Authorization header or the token query parameter. The message is
+// sent as the webhook's integration user, optionally under another display
+// name, and delivered live like a message sent over the WebSocket.
+func (c *IncomingWebhookController) PostMessage(ctx *gin.Context) {
+	webhookID := ctx.Param("id")
+	token := ctx.Query("token")
+	if authHeader := ctx.GetHeader("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		token = strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	if token == "" {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
+		return
+	}
+
+	webhook, err := c.incomingWebhookService.AuthenticateIncomingWebhook(webhookID, token)
+	if err != nil {
+		log.Printf("Failed to check incoming webhook: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check incoming webhook"})
+		return
+	}
+	if webhook == nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+	if ok, retryAfter := c.perWebhook.Allow(webhook.ID); !ok {
+		tooManyRequests(ctx, retryAfter)
+		return
+	}
+
+	var request struct {
+		Text        string                  `json:"text"`
+		DisplayName string                  `json:"display_name"`
+		Attachments []integrationAttachment `json:"attachments"`
+	}
+	ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxIncomingWebhookBody)
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if message := validateIntegrationMessage(request.Text, request.DisplayName, request.Attachments); message != "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": message})
+		return
+	}
+
+	sender, err := c.userService.GetUserByID(webhook.UserID)
+	if err != nil {
+		log.Printf("Failed to load integration user %s: %v", webhook.UserID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to post message"})
+		return
+	}
+
+	content, messageType := request.Text, "text"
+	if len(request.Attachments) > 0 {
+		body, err := json.Marshal(integrationContent{Text: request.Text, Attachments: request.Attachments})
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to post message"})
+			return
+		}
+		content, messageType = string(body), IntegrationMessageType
+	}
+
+	now := time.Now()
+	message := &models.Message{
+		ID:             uuid.New().String(),
+		ConversationID: webhook.ConversationID,
+		Content:        content,
+		SenderID:       webhook.UserID,
+		MessageType:    messageType,
+		Bot:            true,
+		DisplayName:    strings.TrimSpace(request.DisplayName),
+		CreatedAt:      now,
+		DeliveredAt:    now,
+		Sender:         *sender,
+	}
+	if err := c.messageService.CreateMessage(message); err != nil {
+		log.Printf("Failed to save incoming webhook message: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to post message"})
+		return
+	}
+
+	if err := c.wsController.DeliverMessage(message); err != nil {
+		log.Printf("Failed to deliver message %s: %v", message.ID, err)
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{"id": message.ID})
+}
+
+// validateIntegrationMessage returns why a message posted by an integration
+// is rejected, or "" if it is fine
+func validateIntegrationMessage(text, displayName string, attachments []integrationAttachment) string {
+	if strings.TrimSpace(text) == "" && len(attachments) == 0 {
+		return "text or attachments are required"
+	}
+	if utf8.RuneCountInString(text) > maxIncomingWebhookText {
+		return "text is too long"
+	}
+	if utf8.RuneCountInString(displayName) > maxIncomingWebhookDisplayName {
+		return "display_name is too long"
+	}
+	if len(attachments) > maxIncomingWebhookAttachments {
+		return "too many attachments"
+	}
+	for _, attachment := range attachments {
+		if attachment.Title == "" && attachment.Text == "" && attachment.URL == "" {
+			return "attachments must not be empty"
+		}
+		if attachment.URL != "" {
+			parsed, err := url.Parse(attachment.URL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return "attachment url must be an http or https URL"
+			}
+		}
+	}
+	return ""
+}
+
+func (c *IncomingWebhookController) requireParticipant(ctx *gin.Context, conversationID, userID string) bool {
+	ok, err := c.conversationService.IsParticipant(conversationID, userID)
+	if err != nil {
+		log.Printf("Failed to check conversation membership: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check conversation membership"})
+		return false
+	}
+	if !ok {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Not a participant of this conversation"})
+		return false
+	}
+	return true
+}
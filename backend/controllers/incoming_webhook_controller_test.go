@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/ratelimit"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+// incomingWebhookFixture is an incoming webhook alice created in the
+// conversation, served with each webhook allowed perMinute posts a minute
+type incomingWebhookFixture struct {
+	*conversationFixture
+	router  *gin.Engine
+	webhook models.IncomingWebhook
+	hookURL string
+	token   string
+	// stored returns the type and content of a saved message
+	stored func(id string) (string, string)
+}
+
+func newIncomingWebhookFixture(t *testing.T, perMinute int) *incomingWebhookFixture {
+	t.Helper()
+	db := dbtest.Open(t)
+	cipher := services.NewContentCipher(db, nil)
+	webhooks := services.NewWebhookService(db, cipher, egress.NewPolicy(), time.Second, 1)
+	wc := newTestWebSocketController(t, db, newTestTokenManager(t), testSessions{}, nil)
+	c := NewIncomingWebhookController(services.NewIncomingWebhookService(db, webhooks),
+		services.NewConversationService(db, cipher, webhooks), services.NewMessageService(db, cipher, webhooks),
+		services.NewUserService(db), wc, "https://chat.example.com", ratelimit.NewLimiter(perMinute, time.Minute))
+
+	r := newTestRouter()
+	r.POST("/api/v1/conversations/:id/incoming-webhooks", c.CreateIncomingWebhook)
+	r.GET("/api/v1/conversations/:id/incoming-webhooks", c.GetIncomingWebhooks)
+	r.DELETE("/api/v1/conversations/:id/incoming-webhooks/:webhookId", c.DeleteIncomingWebhook)
+	r.POST("/api/v1/hooks/:id", c.PostMessage)
+
+	f := &incomingWebhookFixture{
+		conversationFixture: newConversationFixture(t, db),
+		router:              r,
+		stored: func(id string) (string, string) {
+			t.Helper()
+			var messageType, content string
+			if err := db.QueryRow(`SELECT message_type, content FROM messages WHERE id = $1`, id).Scan(&messageType, &content); err != nil {
+				t.Fatal(err)
+			}
+			return messageType, content
+		},
+	}
+
+	w := serve(t, r, http.MethodPost, "/api/v1/conversations/"+f.conversation+"/incoming-webhooks", f.alice, gin.H{"name": "CI"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	var created struct {
+		URL     string                 `json:"url"`
+		Token   string                 `json:"token"`
+		Webhook models.IncomingWebhook `json:"webhook"`
+	}
+	decodeJSON(t, w, &created)
+	f.webhook, f.hookURL, f.token = created.Webhook, created.URL, created.Token
+	return f
+}
+
+// post posts body to the webhook with token in the query string
+func (f *incomingWebhookFixture) post(t *testing.T, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(t, f.router, http.MethodPost, "/api/v1/hooks/"+f.webhook.ID+"?"+url.Values{"token": {token}}.Encode(), "", body)
+}
+
+func TestIncomingWebhookPostsAttachments(t *testing.T) {
+	f := newIncomingWebhookFixture(t, 60)
+	if want := "https://chat.example.com/api/v1/hooks/" + f.webhook.ID + "?token="; !strings.HasPrefix(f.hookURL, want) {
+		t.Errorf("url = %q, want it to start with %q", f.hookURL, want)
+	}
+
+	w := f.post(t, f.token, gin.H{"text": "Build passed"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("post text: status %d: %s", w.Code, w.Body)
+	}
+	var posted struct {
+		ID string `json:"id"`
+	}
+	decodeJSON(t, w, &posted)
+	if messageType, content := f.stored(posted.ID); messageType != "text" || content != "Build passed" {
+		t.Errorf("stored %s message %q", messageType, content)
+	}
+
+	attachments := []gin.H{{"title": "#42", "url": "https://ci.example.com/42", "text": "All tests passed"}}
+	w = f.post(t, f.token, gin.H{"text": "Build passed", "display_name": "Jenkins", "attachments": attachments})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("post attachments: status %d: %s", w.Code, w.Body)
+	}
+	decodeJSON(t, w, &posted)
+	messageType, content := f.stored(posted.ID)
+	if messageType != IntegrationMessageType {
+		t.Fatalf("message type = %q, want %q", messageType, IntegrationMessageType)
+	}
+	var stored integrationContent
+	if err := json.Unmarshal([]byte(content), &stored); err != nil {
+		t.Fatalf("content %q: %v", content, err)
+	}
+	if stored.Text != "Build passed" || len(stored.Attachments) != 1 || stored.Attachments[0].URL != "https://ci.example.com/42" {
+		t.Errorf("content = %+v", stored)
+	}
+
+	// The token can be sent as a bearer token instead
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/hooks/"+f.webhook.ID, strings.NewReader(`{"text": "Deployed"}`))
+	req.Header.Set("Authorization", "Bearer "+f.token)
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Errorf("post with a bearer token: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestIncomingWebhookRejectsInvalidPosts(t *testing.T) {
+	f := newIncomingWebhookFixture(t, 60)
+	tooMany := make([]gin.H, maxIncomingWebhookAttachments+1)
+	for i := range tooMany {
+		tooMany[i] = gin.H{"title": "x"}
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		body   interface{}
+		status int
+	}{
+		{name: "no token", body: gin.H{"text": "hi"}, status: http.StatusUnauthorized},
+		{name: "wrong token", token: "nwh_wrong", body: gin.H{"text": "hi"}, status: http.StatusUnauthorized},
+		{name: "not JSON", token: f.token, body: strings.NewReader("hi"), status: http.StatusBadRequest},
+		{name: "empty", token: f.token, body: gin.H{"text": " "}, status: http.StatusBadRequest},
+		{name: "text too long", token: f.token, body: gin.H{"text": strings.Repeat("a", maxIncomingWebhookText+1)}, status: http.StatusBadRequest},
+		{name: "display name too long", token: f.token, body: gin.H{"text": "hi", "display_name": strings.Repeat("a", maxIncomingWebhookDisplayName+1)}, status: http.StatusBadRequest},
+		{name: "too many attachments", token: f.token, body: gin.H{"attachments": tooMany}, status: http.StatusBadRequest},
+		{name: "empty attachment", token: f.token, body: gin.H{"attachments": []gin.H{{}}}, status: http.StatusBadRequest},
+		{name: "attachment not http", token: f.token, body: gin.H{"attachments": []gin.H{{"url": "javascript:alert(1)"}}}, status: http.StatusBadRequest},
+		{name: "body too large", token: f.token, body: gin.H{"text": strings.Repeat("a", maxIncomingWebhookBody)}, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := f.post(t, tt.token, tt.body); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+}
+
+func TestIncomingWebhookRateLimitAndDelete(t *testing.T) {
+	f := newIncomingWebhookFixture(t, 1)
+	if w := f.post(t, f.token, gin.H{"text": "one"}); w.Code != http.StatusCreated {
+		t.Fatalf("first post: status %d: %s", w.Code, w.Body)
+	}
+	w := f.post(t, f.token, gin.H{"text": "two"})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("second post: status %d, Retry-After %q, want 429", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	path := "/api/v1/conversations/" + f.conversation + "/incoming-webhooks"
+	if w := serve(t, f.router, http.MethodGet, path, f.eve, nil); w.Code != http.StatusForbidden {
+		t.Errorf("list by an outsider: status %d, want 403", w.Code)
+	}
+	var listed []models.IncomingWebhook
+	decodeJSON(t, serve(t, f.router, http.MethodGet, path, f.bob, nil), &listed)
+	if len(listed) != 1 || listed[0].ID != f.webhook.ID {
+		t.Fatalf("incoming webhooks = %+v", listed)
+	}
+
+	if w := serve(t, f.router, http.MethodDelete, path+"/"+f.webhook.ID, f.bob, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, f.router, http.MethodDelete, path+"/"+f.webhook.ID, f.bob, nil); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: status %d, want 404", w.Code)
+	}
+	if w := f.post(t, f.token, gin.H{"text": "three"}); w.Code != http.StatusUnauthorized {
+		t.Errorf("post to a deleted webhook: status %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,25 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// JWKSController publishes the public keys access tokens are signed with, so
+// other services can verify tokens without sharing a secret
+type JWKSController struct {
+	keyring *auth.Keyring
+}
+
+func NewJWKSController(keyring *auth.Keyring) *JWKSController {
+	return &JWKSController{keyring: keyring}
+}
+
+// GetJWKS serves the current and upcoming signing keys as a JSON Web Key Set
+func (c *JWKSController) GetJWKS(ctx *gin.Context) {
+	// Keys are published well before they are used, so a short cache is safe
+	ctx.Header("Cache-Control", "public, max-age=300")
+	ctx.JSON(http.StatusOK, c.keyring.JWKS())
+}
@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+)
+
+func TestGetJWKS(t *testing.T) {
+	signingKey := func(id, algorithm string, activatesAt, retiresAt time.Time) auth.SigningKey {
+		privateKey, err := auth.GenerateSigningKey(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return auth.SigningKey{ID: id, Algorithm: algorithm, PrivateKey: privateKey, ActivatesAt: activatesAt, RetiresAt: retiresAt}
+	}
+	now := time.Now()
+	keyring := auth.NewKeyring()
+	keyring.SetKeys([]auth.SigningKey{
+		signingKey("retired", auth.AlgorithmEdDSA, now.Add(-2*time.Hour), now.Add(-time.Minute)),
+		signingKey("current", auth.AlgorithmEdDSA, now.Add(-time.Hour), now.Add(time.Hour)),
+		signingKey("next", auth.AlgorithmRS256, now.Add(time.Minute), time.Time{}),
+	})
+	r := newTestRouter()
+	r.GET("/.well-known/jwks.json", NewJWKSController(keyring).GetJWKS)
+
+	w := serve(t, r, http.MethodGet, "/.well-known/jwks.json", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=300" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	var set auth.JWKS
+	decodeJSON(t, w, &set)
+	keys := make(map[string]auth.JWK)
+	for _, key := range set.Keys {
+		keys[key.KeyID] = key
+	}
+	if _, ok := keys["retired"]; ok || len(keys) != 2 {
+		t.Fatalf("published keys %v, want current and next", set.Keys)
+	}
+	if key := keys["current"]; key.KeyType != "OKP" || key.Curve != "Ed25519" || key.X == "" || key.Use != "sig" {
+		t.Errorf("current key = %+v", key)
+	}
+	if key := keys["next"]; key.KeyType != "RSA" || key.Algorithm != auth.AlgorithmRS256 || key.N == "" || key.E != "AQAB" {
+		t.Errorf("upcoming key = %+v", key)
+	}
+}
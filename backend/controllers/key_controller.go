@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/crypto"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+type KeyController struct {
+	keyService   *services.KeyService
+	wsController *WebSocketController
+}
+
+func NewKeyController(keyService *services.KeyService, wsController *WebSocketController) *KeyController {
+	return &KeyController{
+		keyService:   keyService,
+		wsController: wsController,
+	}
+}
+
+// UpdatePublicKey registers or rotates the current user's identity key
+func (c *KeyController) UpdatePublicKey(ctx *gin.Context) {
+	var request struct {
+		PublicKey string `json:"public_key" binding:"required"`
+	}
+
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	userID := ctx.GetString("userID")
+	notices, err := c.keyService.UpdatePublicKey(userID, request.PublicKey)
+	if err != nil {
+		if errors.Is(err, crypto.ErrEmptyPublicKey) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Public key is required"})
+			return
+		}
+		log.Printf("Failed to update public key for %s: %v", userID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update public key"})
+		return
+	}
+
+	// Let everyone in the user's conversations know the key changed
+	for i := range notices {
+		notice := &notices[i]
+		if err := c.wsController.DeliverMessage(notice); err != nil {
+			log.Printf("Failed to deliver key change notice to %s: %v", notice.ConversationID, err)
+		}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"changed": len(notices) > 0})
+}
+
+// GetSafetyNumber returns the safety number shared with a contact
+func (c *KeyController) GetSafetyNumber(ctx *gin.Context) {
+	result, err := c.keyService.GetSafetyNumber(ctx.GetString("userID"), ctx.Param("id"))
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get safety number")
+		return
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+// VerifyContact marks the contact's key as verified. The safety number the
+// user compared must match the current one, so a stale screen can't verify a
+// new key.
+func (c *KeyController) VerifyContact(ctx *gin.Context) {
+	var request struct {
+		SafetyNumber string `json:"safety_number" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	userID := ctx.GetString("userID")
+	contactID := ctx.Param("id")
+	current, err := c.keyService.GetSafetyNumber(userID, contactID)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to verify contact")
+		return
+	}
+	if current.SafetyNumber != request.SafetyNumber {
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Safety number does not match"})
+		return
+	}
+
+	result, err := c.keyService.MarkVerified(userID, contactID, current.ContactFingerprint)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to verify contact")
+		return
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+// UnverifyContact clears the verification of a contact
+func (c *KeyController) UnverifyContact(ctx *gin.Context) {
+	if err := c.keyService.ClearVerification(ctx.GetString("userID"), ctx.Param("id")); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear verification"})
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *KeyController) handleError(ctx *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, services.ErrKeyNotRegistered):
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Identity key not registered"})
+	case errors.Is(err, services.ErrKeyChanged):
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Safety number does not match"})
+	default:
+		log.Printf("%s: %v", message, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
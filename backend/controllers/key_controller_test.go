@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"testing"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+// testPublicKey returns a fresh PEM encoded identity key
+func testPublicKey(t *testing.T) string {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestVerifyContact(t *testing.T) {
+	db := dbtest.Open(t)
+	f := newConversationFixture(t, db)
+	_, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := services.NewKeyService(db, services.NewKeyLogService(db, signingKey), services.NewContentCipher(db, nil))
+	for _, userID := range []string{f.alice, f.bob} {
+		if _, err := keys.UpdatePublicKey(userID, testPublicKey(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewKeyController(keys, nil)
+	r := newTestRouter()
+	r.GET("/users/:id/safety-number", c.GetSafetyNumber)
+	r.PUT("/users/:id/verification", c.VerifyContact)
+
+	var compared models.SafetyNumber
+	decodeJSON(t, serve(t, r, http.MethodGet, "/users/"+f.bob+"/safety-number", f.alice, nil), &compared)
+
+	// A stale screen can't verify a key the user never compared
+	if _, err := keys.UpdatePublicKey(f.bob, testPublicKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(t, r, http.MethodPut, "/users/"+f.bob+"/verification", f.alice, gin.H{"safety_number": compared.SafetyNumber}); w.Code != http.StatusConflict {
+		t.Errorf("stale safety number: status %d, want 409", w.Code)
+	}
+
+	decodeJSON(t, serve(t, r, http.MethodGet, "/users/"+f.bob+"/safety-number", f.alice, nil), &compared)
+	w := serve(t, r, http.MethodPut, "/users/"+f.bob+"/verification", f.alice, gin.H{"safety_number": compared.SafetyNumber})
+	if w.Code != http.StatusOK {
+		t.Fatalf("verify: status %d: %s", w.Code, w.Body)
+	}
+	var verified models.SafetyNumber
+	decodeJSON(t, w, &verified)
+	if !verified.Verified || verified.ContactFingerprint != compared.ContactFingerprint {
+		t.Errorf("verified = %+v, want the compared key verified", verified)
+	}
+}
+
+func TestVerifyContactRequiresSafetyNumber(t *testing.T) {
+	c := NewKeyController(nil, nil)
+	r := newTestRouter()
+	r.PUT("/users/:id/verification", c.VerifyContact)
+
+	for name, body := range map[string]interface{}{
+		"empty":   gin.H{},
+		"blank":   gin.H{"safety_number": ""},
+		"no body": nil,
+	} {
+		if w := serve(t, r, http.MethodPut, "/users/bob/verification", "alice", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, w.Code)
+		}
+	}
+}
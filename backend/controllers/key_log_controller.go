@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/RatneshMaurya/not-whatsapp/backend/transparency"
+	"github.com/gin-gonic/gin"
+)
+
+type KeyLogController struct {
+	keyLogService *services.KeyLogService
+}
+
+func NewKeyLogController(keyLogService *services.KeyLogService) *KeyLogController {
+	return &KeyLogController{
+		keyLogService: keyLogService,
+	}
+}
+
+// GetPublicKey returns the key tree heads are signed with
+func (c *KeyLogController) GetPublicKey(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"algorithm":  "Ed25519",
+		"public_key": []byte(c.keyLogService.PublicKey()),
+	})
+}
+
+// GetTreeHead returns the latest signed tree head, or the one for tree_size
+func (c *KeyLogController) GetTreeHead(ctx *gin.Context) {
+	if ctx.Query("tree_size") == "" {
+		sth, err := c.keyLogService.LatestTreeHead()
+		if err != nil {
+			c.handleError(ctx, err, "Failed to get tree head")
+			return
+		}
+		ctx.JSON(http.StatusOK, sth)
+		return
+	}
+
+	treeSize, ok := queryUint(ctx, "tree_size")
+	if !ok {
+		return
+	}
+	sth, err := c.keyLogService.TreeHead(treeSize)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get tree head")
+		return
+	}
+	ctx.JSON(http.StatusOK, sth)
+}
+
+// GetEntries returns log entries in [start, end)
+func (c *KeyLogController) GetEntries(ctx *gin.Context) {
+	start, ok := queryUint(ctx, "start")
+	if !ok {
+		return
+	}
+	end, ok := queryUint(ctx, "end")
+	if !ok {
+		return
+	}
+
+	entries, err := c.keyLogService.Entries(start, end)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get entries")
+		return
+	}
+	ctx.JSON(http.StatusOK, entries)
+}
+
+// GetInclusionProof proves an entry is part of a tree head
+func (c *KeyLogController) GetInclusionProof(ctx *gin.Context) {
+	leafIndex, ok := queryUint(ctx, "leaf_index")
+	if !ok {
+		return
+	}
+	treeSize, ok := queryUint(ctx, "tree_size")
+	if !ok {
+		return
+	}
+
+	proof, err := c.keyLogService.InclusionProof(leafIndex, treeSize)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get inclusion proof")
+		return
+	}
+	ctx.JSON(http.StatusOK, proof)
+}
+
+// GetConsistencyProof proves one tree head extends another
+func (c *KeyLogController) GetConsistencyProof(ctx *gin.Context) {
+	first, ok := queryUint(ctx, "first")
+	if !ok {
+		return
+	}
+	second, ok := queryUint(ctx, "second")
+	if !ok {
+		return
+	}
+
+	proof, err := c.keyLogService.ConsistencyProof(first, second)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get consistency proof")
+		return
+	}
+	ctx.JSON(http.StatusOK, proof)
+}
+
+// GetUserEntry returns the entry for a user's current key along with its
+// inclusion proof against the latest tree head
+func (c *KeyLogController) GetUserEntry(ctx *gin.Context) {
+	entry, err := c.keyLogService.LatestEntryForUser(ctx.Param("id"))
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get key log entry")
+		return
+	}
+
+	sth, err := c.keyLogService.LatestTreeHead()
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get tree head")
+		return
+	}
+
+	proof, err := c.keyLogService.InclusionProof(entry.LeafIndex, sth.TreeSize)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get inclusion proof")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"entry":     entry,
+		"tree_head": sth,
+		"proof":     proof,
+	})
+}
+
+func (c *KeyLogController) handleError(ctx *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	case errors.Is(err, services.ErrTreeSizeUnknown), errors.Is(err, transparency.ErrInvalidRange):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Printf("%s: %v", message, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
+
+// queryUint parses a required unsigned query parameter, writing a 400 when it
+// is missing or malformed
+func queryUint(ctx *gin.Context, name string) (uint64, bool) {
+	value, err := strconv.ParseUint(ctx.Query(name), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name})
+		return 0, false
+	}
+	return value, true
+}
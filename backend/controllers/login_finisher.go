@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/config"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+// LoginFinisher completes a sign-in once a provider has established who the
+// user is. The browser is sent back to the frontend with a one-time code,
+// which keeps tokens out of URLs and logs. Exchanging the code starts a
+// session, unless the user has two-factor authentication or is required to
+// set it up, in which case it returns a challenge for the second step.
+type LoginFinisher struct {
+	cfg              *config.Config
+	sessionService   *services.SessionService
+	loginCodes       *services.LoginCodeService
+	twoFactorService *services.TwoFactorService
+	settings         *services.SettingsService
+	tokens           *auth.TokenManager
+}
+
+func NewLoginFinisher(cfg *config.Config, sessionService *services.SessionService, loginCodes *services.LoginCodeService, twoFactorService *services.TwoFactorService, settings *services.SettingsService, tokens *auth.TokenManager) *LoginFinisher {
+	return &LoginFinisher{
+		cfg:              cfg,
+		sessionService:   sessionService,
+		loginCodes:       loginCodes,
+		twoFactorService: twoFactorService,
+		settings:         settings,
+		tokens:           tokens,
+	}
+}
+
+// Complete redirects to the frontend with a login code. returnTo must
+// already have been checked with ResolveReturnTo; the code is added to its
+// query.
+func (f *LoginFinisher) Complete(ctx *gin.Context, user *models.User, returnTo string) {
+	code, err := f.loginCodes.CreateLoginCode(user.ID)
+	if err != nil {
+		log.Printf("Failed to create login code: %v", err)
+		f.RedirectError(ctx, "Failed to create session")
+		return
+	}
+
+	// Redirect to frontend, which exchanges the code for tokens
+	redirectURL := withQuery(returnTo, url.Values{"code": {code}})
+	log.Printf("Redirecting to frontend for user %s", user.ID)
+	ctx.Redirect(http.StatusTemporaryRedirect, redirectURL)
+}
+
+// beginSession answers an exchanged login code. Users who need a second
+// factor get a single-use challenge to send with their code to the
+// two-factor endpoints; enroll tells the frontend to set up an authenticator
+// first. Everyone else gets a new session.
+func (f *LoginFinisher) beginSession(ctx *gin.Context, user *models.User) {
+	required, err := f.settings.RequireTwoFactor()
+	if err != nil {
+		log.Printf("Failed to get two-factor requirement: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
+	if user.TwoFactorEnabled || required {
+		challenge, err := f.twoFactorService.CreateChallenge(user.ID)
+		if err != nil {
+			log.Printf("Failed to create two-factor challenge: %v", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+			return
+		}
+		log.Printf("Started two-factor step for user %s", user.ID)
+		ctx.Header("Cache-Control", "no-store")
+		ctx.JSON(http.StatusOK, gin.H{
+			"two_factor_required": true,
+			"challenge":           challenge,
+			"enroll":              !user.TwoFactorEnabled,
+		})
+		return
+	}
+
+	tokens, err := f.startSession(ctx, user)
+	if err != nil {
+		log.Printf("Failed to start session: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+	log.Printf("Started session %s for user %s", tokens.SessionID, user.ID)
+
+	f.respondWithSession(ctx, tokens, nil)
+}
+
+// ResolveReturnTo checks a return_to parameter against the allowed frontend
+// URLs, falling back to the default callback page when it is empty
+func (f *LoginFinisher) ResolveReturnTo(returnTo string) (string, error) {
+	return f.cfg.ResolveReturnTo(returnTo)
+}
+
+// RedirectError sends the browser to the frontend's login error page
+func (f *LoginFinisher) RedirectError(ctx *gin.Context, message string) {
+	ctx.Redirect(http.StatusTemporaryRedirect, withQuery(f.cfg.FrontendPage("/auth/error"), url.Values{
+		"error": {message},
+	}))
+}
+
+// withQuery adds params to the query of rawURL, keeping any it already has
+func withQuery(rawURL string, params url.Values) string {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+// sessionTokens are the credentials of a newly started session
+type sessionTokens struct {
+	SessionID    string
+	AccessToken  string
+	ExpiresAt    time.Time
+	RefreshToken string
+}
+
+// startSession creates a session with its first access and refresh token
+func (f *LoginFinisher) startSession(ctx *gin.Context, user *models.User) (*sessionTokens, error) {
+	session, refreshToken, err := f.sessionService.CreateSession(user.ID, ctx.Request.UserAgent(), ctx.ClientIP())
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, expiresAt, err := f.tokens.IssueAccessToken(user, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionTokens{
+		SessionID:    session.ID,
+		AccessToken:  accessToken,
+		ExpiresAt:    expiresAt,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// respondWithSession returns a new session's tokens along with any extra
+// fields. In cookie session mode the tokens are set as HttpOnly cookies and
+// left out of the body.
+func (f *LoginFinisher) respondWithSession(ctx *gin.Context, tokens *sessionTokens, extra gin.H) {
+	response := gin.H{"expires_at": tokens.ExpiresAt}
+	if f.cfg.SessionCookies {
+		auth.SetSessionCookies(ctx, tokens.AccessToken, tokens.ExpiresAt, tokens.RefreshToken, f.cfg.RefreshTokenTTL, f.cfg.SecureCookies())
+	} else {
+		response["token"] = tokens.AccessToken
+		response["refresh_token"] = tokens.RefreshToken
+	}
+	for key, value := range extra {
+		response[key] = value
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, response)
+}
+
+// clearSession removes the session cookies in cookie session mode
+func (f *LoginFinisher) clearSession(ctx *gin.Context) {
+	if f.cfg.SessionCookies {
+		auth.ClearSessionCookies(ctx, f.cfg.SecureCookies())
+	}
+}
@@ -0,0 +1,25 @@
+package controllers
+
+import (
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitAPI spends an API call from the authenticated user's budget, or
+// rejects the request with 429 and Retry-After when it is used up. It must
+// run after auth.Middleware.
+func RateLimitAPI(limits *ratelimit.Policy) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		role := ratelimit.RoleUser
+		if auth.APITokenFromContext(ctx) != nil {
+			role = ratelimit.RoleBot
+		}
+		if ok, retryAfter := limits.Allow(role, ctx.GetString("userID"), ratelimit.BudgetAPI); !ok {
+			tooManyRequests(ctx, retryAfter)
+			ctx.Abort()
+			return
+		}
+		ctx.Next()
+	}
+}
@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/protocol"
+	"github.com/RatneshMaurya/not-whatsapp/backend/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimitAPI(t *testing.T) {
+	limits := ratelimit.NewPolicy(map[string]map[string]ratelimit.Rate{
+		ratelimit.RoleUser: {ratelimit.BudgetAPI: {Burst: 2, Interval: time.Minute}},
+		ratelimit.RoleBot:  {ratelimit.BudgetAPI: {Burst: 1, Interval: time.Minute}},
+	}, nil)
+	r := newTestRouter()
+	r.Use(func(ctx *gin.Context) {
+		if ctx.GetHeader("X-Test-Bot") != "" {
+			ctx.Set("apiToken", &auth.APIToken{BotID: ctx.GetString("userID")})
+		}
+	}, RateLimitAPI(limits))
+	r.GET("/ping", func(ctx *gin.Context) { ctx.Status(http.StatusNoContent) })
+
+	for i := 0; i < 2; i++ {
+		if w := serve(t, r, http.MethodGet, "/ping", "alice", nil); w.Code != http.StatusNoContent {
+			t.Fatalf("request %d: status %d, want 204", i+1, w.Code)
+		}
+	}
+	w := serve(t, r, http.MethodGet, "/ping", "alice", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", w.Code)
+	}
+	// A call is refilled every 30 seconds
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	if w := serve(t, r, http.MethodGet, "/ping", "bob", nil); w.Code != http.StatusNoContent {
+		t.Errorf("other user: status %d, want 204", w.Code)
+	}
+
+	// Requests made with an API token spend the bot budget
+	bot := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.Header.Set(testUserHeader, "bot1")
+		req.Header.Set("X-Test-Bot", "1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := bot(); code != http.StatusNoContent {
+		t.Fatalf("bot: status %d, want 204", code)
+	}
+	if code := bot(); code != http.StatusTooManyRequests {
+		t.Errorf("bot: status %d, want 429", code)
+	}
+}
+
+func TestRateLimitFrames(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, nil, tokens, testSessions{"s1": true}, nil)
+	wc.limits = ratelimit.NewPolicy(map[string]map[string]ratelimit.Rate{
+		ratelimit.RoleUser: {ratelimit.BudgetTyping: {Burst: 1, Interval: time.Hour}},
+	}, nil)
+	wc.violations = ratelimit.NewLimiter(2, time.Minute)
+	r := gin.New()
+	r.GET("/ws", wc.HandleWebSocket)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	conn := dialWebSocket(t, server, "token="+accessToken(t, tokens, "u1", "s1"), nil)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	typing := func(tempID string) protocol.Error {
+		t.Helper()
+		// Without a conversation the frame is rejected after spending the
+		// budget, before it reaches the database
+		if err := conn.WriteJSON(map[string]string{"type": protocol.TypeTyping, "temp_id": tempID}); err != nil {
+			t.Fatal(err)
+		}
+		var frame protocol.Error
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+
+	if frame := typing("t1"); frame.Code != protocol.ErrorInvalidFrame {
+		t.Fatalf("first frame = %+v, want invalid_frame", frame)
+	}
+	for _, tempID := range []string{"t2", "t3"} {
+		frame := typing(tempID)
+		if frame.Code != protocol.ErrorRateLimited || frame.Budget != ratelimit.BudgetTyping || frame.TempID != tempID {
+			t.Fatalf("frame = %+v, want rate_limited for typing", frame)
+		}
+		if frame.RetryAfterMS <= 0 {
+			t.Errorf("retry_after_ms = %d, want positive", frame.RetryAfterMS)
+		}
+	}
+
+	// A connection that keeps sending after being told to wait is closed
+	if err := conn.WriteJSON(map[string]string{"type": protocol.TypeTyping}); err != nil {
+		t.Fatal(err)
+	}
+	expectClose(t, conn, CloseRateLimited)
+
+	// Frames without a budget are not limited
+	conn = dialWebSocket(t, server, "token="+accessToken(t, tokens, "u1", "s1"), nil)
+	for i := 0; i < 3; i++ {
+		if err := conn.WriteJSON(map[string]string{"type": protocol.TypePing}); err != nil {
+			t.Fatal(err)
+		}
+		var pong map[string]interface{}
+		if err := conn.ReadJSON(&pong); err != nil {
+			t.Fatal(err)
+		}
+		if pong["type"] != protocol.TypePong {
+			t.Fatalf("frame = %v, want pong", pong)
+		}
+	}
+}
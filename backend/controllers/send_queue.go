@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/protocol"
+)
+
+// CloseSlowConsumer is sent when a connection is closed because its client
+// didn't read its frames fast enough. Frames may have been lost, so the
+// client should reconnect and fetch what it missed.
+const CloseSlowConsumer = 4008
+
+// queueMetrics counts what happens to the frames queued for clients. It is
+// published with expvar:
+//
+//   - queued: frames queued
+//   - coalesced: ephemeral frames that replaced a queued one with the same key
+//   - dropped: ephemeral frames dropped, or evicted for a frame that must be
+//     delivered, because the queue was full
+//   - slow_consumers: clients disconnected with CloseSlowConsumer
+var queueMetrics = expvar.NewMap("websocket_send_queue")
+
+// pushResult is what happened to a frame offered to a sendQueue
+type pushResult int
+
+const (
+	pushQueued pushResult = iota
+	pushCoalesced
+	pushDropped
+	// pushOverflow is returned for the frame that found the queue full of
+	// frames that must be delivered. The client is a slow consumer and
+	// nothing more is queued for it.
+	pushOverflow
+	pushClosed
+)
+
+// queuedFrame is an ephemeral frame waiting in a sendQueue
+type queuedFrame struct {
+	payload *protocol.Payload
+	// key is the frame's coalesce key
+	key string
+}
+
+// sendQueue holds the frames waiting to be written to a client in two lanes.
+// Frames that must be delivered, such as messages and errors, wait in order
+// in the first lane, which the writer drains before the second. Ephemeral
+// frames, such as typing indicators, wait in the second, so a burst of them
+// never delays a message. An ephemeral frame can thus arrive after a
+// message queued after it.
+//
+// The queue is bounded: an ephemeral frame replaces the queued frame with
+// the same key, and when the queue is full ephemeral frames are dropped to
+// make room for frames that must be delivered. A client whose queue is full
+// of those is a slow consumer.
+type sendQueue struct {
+	mu         sync.Mutex
+	frames     []*protocol.Payload
+	ephemeral  []queuedFrame
+	size       int
+	closed     bool
+	overflowed bool
+	// ready is signalled when frames are queued or the queue is closed
+	ready chan struct{}
+}
+
+func newSendQueue(size int) *sendQueue {
+	return &sendQueue{size: size, ready: make(chan struct{}, 1)}
+}
+
+// push queues a payload without waiting
+func (q *sendQueue) push(payload *protocol.Payload) pushResult {
+	key := payload.CoalesceKey()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.overflowed {
+		return pushClosed
+	}
+
+	if key != "" {
+		for i := range q.ephemeral {
+			if q.ephemeral[i].key == key {
+				q.ephemeral[i].payload = payload
+				queueMetrics.Add("coalesced", 1)
+				return pushCoalesced
+			}
+		}
+	}
+	if len(q.frames)+len(q.ephemeral) >= q.size {
+		switch {
+		case key != "":
+			queueMetrics.Add("dropped", 1)
+			return pushDropped
+		case !q.evictEphemeral():
+			q.overflowed = true
+			queueMetrics.Add("slow_consumers", 1)
+			return pushOverflow
+		}
+	}
+
+	if key != "" {
+		q.ephemeral = append(q.ephemeral, queuedFrame{payload: payload, key: key})
+	} else {
+		q.frames = append(q.frames, payload)
+	}
+	queueMetrics.Add("queued", 1)
+	q.signal()
+	return pushQueued
+}
+
+// evictEphemeral drops the oldest queued ephemeral frame. It returns false if
+// there is none. The caller must hold q.mu.
+func (q *sendQueue) evictEphemeral() bool {
+	if len(q.ephemeral) == 0 {
+		return false
+	}
+	q.ephemeral = append(q.ephemeral[:0], q.ephemeral[1:]...)
+	queueMetrics.Add("dropped", 1)
+	return true
+}
+
+// take removes up to max queued payloads, or all of them if max is 0, the
+// frames that must be delivered first. closed reports that the queue was
+// closed and nothing is left in it, like a receive from a closed channel.
+func (q *sendQueue) take(max int) (payloads []*protocol.Payload, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := len(q.frames)
+	if max > 0 && n > max {
+		n = max
+	}
+	payloads = append(payloads, q.frames[:n]...)
+	q.frames = append(q.frames[:0], q.frames[n:]...)
+
+	n = len(q.ephemeral)
+	if max > 0 && n > max-len(payloads) {
+		n = max - len(payloads)
+	}
+	for _, frame := range q.ephemeral[:n] {
+		payloads = append(payloads, frame.payload)
+	}
+	q.ephemeral = append(q.ephemeral[:0], q.ephemeral[n:]...)
+
+	left := len(q.frames) + len(q.ephemeral)
+	if left > 0 {
+		q.signal()
+	}
+	return payloads, q.closed && left == 0
+}
+
+// close stops the queue from taking frames. Frames already queued can still
+// be taken. It is safe to close a queue more than once.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+// depth is the number of queued frames
+func (q *sendQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.frames) + len(q.ephemeral)
+}
+
+// signal wakes the writer. The caller must hold q.mu.
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
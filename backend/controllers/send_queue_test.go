@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/protocol"
+)
+
+func typingPayload(userID string) *protocol.Payload {
+	return protocol.NewPayload(protocol.UserTyping{Type: protocol.TypeTyping, ConversationID: "c1", UserID: userID})
+}
+
+func messagePayload(id string) *protocol.Payload {
+	return protocol.NewPayload(protocol.Message{Type: protocol.TypeMessage, ID: id})
+}
+
+func expectPayloads(t *testing.T, got []*protocol.Payload, want ...*protocol.Payload) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("took %d frames, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			data, _ := got[i].JSON()
+			t.Errorf("frame %d is %s", i, data)
+		}
+	}
+}
+
+func TestSendQueueSendsMessagesFirst(t *testing.T) {
+	q := newSendQueue(10)
+	typingA, typingB := typingPayload("a"), typingPayload("b")
+	first, second := messagePayload("m1"), messagePayload("m2")
+	for _, payload := range []*protocol.Payload{typingA, first, typingB, second} {
+		if result := q.push(payload); result != pushQueued {
+			t.Fatalf("push = %v, want queued", result)
+		}
+	}
+	if q.depth() != 4 {
+		t.Errorf("depth = %d, want 4", q.depth())
+	}
+
+	// A newer typing frame of the same user replaces the queued one in place
+	newerA := typingPayload("a")
+	if result := q.push(newerA); result != pushCoalesced {
+		t.Errorf("push = %v, want coalesced", result)
+	}
+
+	payloads, closed := q.take(3)
+	if closed {
+		t.Error("open queue reported closed")
+	}
+	expectPayloads(t, payloads, first, second, newerA)
+	payloads, _ = q.take(0)
+	expectPayloads(t, payloads, typingB)
+
+	select {
+	case <-q.ready:
+	default:
+		t.Error("queue did not signal the writer")
+	}
+}
+
+func TestSendQueueWhenFull(t *testing.T) {
+	q := newSendQueue(3)
+	typingA, typingB := typingPayload("a"), typingPayload("b")
+	first, second, third := messagePayload("m1"), messagePayload("m2"), messagePayload("m3")
+	q.push(typingA)
+	q.push(first)
+	q.push(typingB)
+
+	// Ephemeral frames are dropped when the queue is full
+	if result := q.push(typingPayload("c")); result != pushDropped {
+		t.Errorf("push = %v, want dropped", result)
+	}
+	// and evicted, oldest first, to make room for frames that must be
+	// delivered
+	if result := q.push(second); result != pushQueued {
+		t.Errorf("push = %v, want queued", result)
+	}
+	if result := q.push(third); result != pushQueued {
+		t.Errorf("push = %v, want queued", result)
+	}
+	if result := q.push(messagePayload("m4")); result != pushOverflow {
+		t.Errorf("push = %v, want overflow", result)
+	}
+	// Nothing more is queued for a slow consumer
+	if result := q.push(typingPayload("d")); result != pushClosed {
+		t.Errorf("push = %v, want closed", result)
+	}
+
+	payloads, _ := q.take(0)
+	expectPayloads(t, payloads, first, second, third)
+}
+
+func TestSendQueueClose(t *testing.T) {
+	q := newSendQueue(10)
+	message := messagePayload("m1")
+	q.push(message)
+	q.close()
+	q.close()
+
+	if result := q.push(messagePayload("m2")); result != pushClosed {
+		t.Errorf("push = %v, want closed", result)
+	}
+	// Frames queued before the queue was closed are still taken
+	payloads, closed := q.take(0)
+	expectPayloads(t, payloads, message)
+	if !closed {
+		t.Error("empty closed queue was not reported closed")
+	}
+}
+
+func TestEnqueueDisconnectsSlowConsumers(t *testing.T) {
+	stream := newStreamTransport("long_poll")
+	client := &WebSocketClient{userID: "u1", sessionID: "s1", transport: stream, send: newSendQueue(1)}
+
+	if !client.enqueue(messagePayload("m1")) {
+		t.Fatal("first frame was not queued")
+	}
+	if client.enqueue(typingPayload("a")) {
+		t.Error("typing frame was queued in a full queue")
+	}
+	if client.enqueue(messagePayload("m2")) {
+		t.Error("message was queued in a queue full of messages")
+	}
+
+	select {
+	case <-stream.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow consumer was not disconnected")
+	}
+	if stream.code != CloseSlowConsumer {
+		t.Errorf("close code = %d, want %d", stream.code, CloseSlowConsumer)
+	}
+}
@@ -0,0 +1,430 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/protocol"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// sseKeepAlive is how often an idle event stream gets a comment, so
+	// proxies don't time it out
+	sseKeepAlive = 25 * time.Second
+	// pollWait is how long a long poll waits for a frame
+	pollWait = 25 * time.Second
+	// pollExpiry is how long a long polling stream is kept without a poll
+	pollExpiry = time.Minute
+	// maxPollFrames caps the frames returned by one poll
+	maxPollFrames = 100
+)
+
+// streamTransport is the transport of clients that read their frames with
+// Server-Sent Events or long polling, and send frames with PostFrame
+type streamTransport struct {
+	// kind is "sse" or "long_poll"
+	kind string
+	// done is closed when the connection is closed; code and text tell the
+	// client why, code is 0 if it was aborted
+	done chan struct{}
+	once sync.Once
+	code int
+	text string
+	// polling is held by the long poll waiting on the stream, and polled
+	// is signalled by every poll to keep the stream alive
+	polling sync.Mutex
+	polled  chan struct{}
+}
+
+func newStreamTransport(kind string) *streamTransport {
+	return &streamTransport{
+		kind:   kind,
+		done:   make(chan struct{}),
+		polled: make(chan struct{}, 1),
+	}
+}
+
+func (t *streamTransport) name() string { return t.kind }
+
+func (t *streamTransport) close(code int, text string) {
+	t.once.Do(func() {
+		t.code, t.text = code, text
+		close(t.done)
+	})
+}
+
+func (t *streamTransport) abort() {
+	t.close(0, "")
+}
+
+// closeFrame is the last frame of a stream closed with code, or nil if the
+// stream was aborted
+func closeFrame(code int, text string) []byte {
+	if code == 0 {
+		return nil
+	}
+	frame, _ := json.Marshal(protocol.Close{Type: protocol.TypeClose, Code: code, Reason: text})
+	return frame
+}
+
+// hubCloseFrame is the last frame of a stream whose send queue the hub
+// closed. A stream that was closed first, which detaches it from the hub,
+// keeps its own code.
+func hubCloseFrame(client *WebSocketClient) []byte {
+	if stream, ok := client.streamTransport(); ok {
+		select {
+		case <-stream.done:
+			return closeFrame(stream.code, stream.text)
+		default:
+		}
+	}
+	if code := int(client.closeCode.Load()); code != 0 {
+		return closeFrame(code, "server restarting")
+	}
+	return closeFrame(websocket.CloseNormalClosure, "")
+}
+
+// newStreamClient authenticates a request opening an event stream or long
+// polling stream of kind, or writes the error response
+func (wc *WebSocketController) newStreamClient(c *gin.Context, kind string) (*WebSocketClient, bool) {
+	client, ok := wc.authenticate(c)
+	if !ok {
+		return nil, false
+	}
+	version, ok := protocol.Negotiate(c.Query("version"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":    "Unsupported protocol version",
+			"versions": protocol.SupportedVersions,
+		})
+		return nil, false
+	}
+	client.codec, client.version = protocol.JSON, version
+	client.transport = newStreamTransport(kind)
+	return client, true
+}
+
+// findStream returns the stream with the ?stream_id of a request if it
+// belongs to the requester's session, or writes the error response
+func (wc *WebSocketController) findStream(c *gin.Context) (*WebSocketClient, *streamTransport, bool) {
+	requester, ok := wc.authenticate(c)
+	if !ok {
+		return nil, nil, false
+	}
+
+	wc.mu.Lock()
+	client, ok := wc.connections[c.Query("stream_id")]
+	wc.mu.Unlock()
+	stream, isStream := client.streamTransport()
+	if !ok || !isStream || client.userID != requester.userID || client.sessionID != requester.sessionID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return nil, nil, false
+	}
+	return client, stream, true
+}
+
+// streamTransport returns the client's transport if it is a stream
+func (c *WebSocketClient) streamTransport() (*streamTransport, bool) {
+	if c == nil {
+		return nil, false
+	}
+	stream, ok := c.transport.(*streamTransport)
+	return stream, ok
+}
+
+// connectedFrame is the first frame sent to a client
+func connectedFrame(client *WebSocketClient) protocol.Connected {
+	frame := protocol.Connected{
+		Type:      protocol.TypeConnected,
+		Version:   client.version,
+		Timestamp: time.Now(),
+		ID:        uuid.New().String(),
+	}
+	if _, ok := client.streamTransport(); ok {
+		frame.StreamID = client.id
+	}
+	return frame
+}
+
+// HandleEvents streams a client's frames as Server-Sent Events, for clients
+// that can't use WebSockets. The data of each event is a JSON frame, the same
+// as over a WebSocket. The client sends frames with PostFrame, using the
+// stream_id of the connected frame.
+func (wc *WebSocketController) HandleEvents(c *gin.Context) {
+	client, ok := wc.newStreamClient(c, "sse")
+	if !ok {
+		return
+	}
+	stream, _ := client.streamTransport()
+
+	if !wc.beginWriter() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return
+	}
+	defer wc.writers.Done()
+	if !wc.attach(c.Request.Context(), client) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return
+	}
+	defer wc.detach(client)
+	log.Printf("Event stream established for %s (%s)", client.userID, client.userName)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// Keep nginx from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	connected, _ := json.Marshal(connectedFrame(client))
+	if err := client.writeEvent(c.Writer, connected); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-client.send.ready:
+			frames, closed := takeFrames(client, 0)
+			for _, frame := range frames {
+				if err := client.writeEvent(c.Writer, frame); err != nil {
+					log.Printf("Error writing event: %v", err)
+					return
+				}
+			}
+			if closed {
+				client.writeEvent(c.Writer, hubCloseFrame(client))
+				return
+			}
+
+		case <-stream.done:
+			// Frames queued before the stream was closed are still sent
+			frames, _ := takeFrames(client, 0)
+			for _, frame := range frames {
+				client.writeEvent(c.Writer, frame)
+			}
+			client.writeEvent(c.Writer, closeFrame(stream.code, stream.text))
+			return
+
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent writes a frame as a Server-Sent Event. Frames are single line
+// JSON, so they fit in one data field.
+func (c *WebSocketClient) writeEvent(w gin.ResponseWriter, frame []byte) error {
+	if frame == nil {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", frame); err != nil {
+		return err
+	}
+	w.Flush()
+	c.bytesOut.Add(int64(len(frame)))
+	return nil
+}
+
+// takeFrames takes up to max frames queued for a client, or all of them if
+// max is 0, without waiting. closed reports that the hub closed the queue and
+// it is empty.
+func takeFrames(client *WebSocketClient, max int) (frames [][]byte, closed bool) {
+	payloads, closed := client.send.take(max)
+	for _, payload := range payloads {
+		frame, err := payload.Encode(client.codec)
+		if err != nil {
+			log.Printf("Failed to encode frame for client %s: %v", client.userID, err)
+			continue
+		}
+		frames = append(frames, frame)
+	}
+	return frames, closed
+}
+
+// pollResponse is the body of a long poll
+type pollResponse struct {
+	Frames []json.RawMessage `json:"frames"`
+}
+
+// HandlePoll is the long polling transport. A poll without ?stream_id opens
+// a stream and returns its connected frame. Polls with the stream_id wait up
+// to pollWait for frames and return every frame queued by then. A stream
+// that isn't polled for pollExpiry is closed.
+func (wc *WebSocketController) HandlePoll(c *gin.Context) {
+	if c.Query("stream_id") == "" {
+		wc.openPoll(c)
+		return
+	}
+
+	client, stream, ok := wc.findStream(c)
+	if !ok {
+		return
+	}
+	if !stream.polling.TryLock() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Stream is already being polled"})
+		return
+	}
+	defer stream.polling.Unlock()
+	select {
+	case stream.polled <- struct{}{}:
+	default:
+	}
+
+	var frames [][]byte
+	closed := false
+	wait := time.NewTimer(pollWait)
+	defer wait.Stop()
+wait:
+	for {
+		if frames, closed = takeFrames(client, maxPollFrames); len(frames) > 0 || closed {
+			break
+		}
+		select {
+		case <-client.send.ready:
+		case <-stream.done:
+			break wait
+		case <-wait.C:
+			break wait
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+
+	if closed {
+		frames = append(frames, hubCloseFrame(client))
+	} else {
+		select {
+		case <-stream.done:
+			// The stream won't be polled again, so everything left is sent
+			more, _ := takeFrames(client, 0)
+			frames = append(frames, more...)
+			if frame := closeFrame(stream.code, stream.text); frame != nil {
+				frames = append(frames, frame)
+			}
+		default:
+		}
+	}
+
+	response := pollResponse{Frames: make([]json.RawMessage, len(frames))}
+	for i, frame := range frames {
+		response.Frames[i] = frame
+		client.bytesOut.Add(int64(len(frame)))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// openPoll opens a long polling stream
+func (wc *WebSocketController) openPoll(c *gin.Context) {
+	client, ok := wc.newStreamClient(c, "long_poll")
+	if !ok {
+		return
+	}
+	stream, _ := client.streamTransport()
+
+	wc.mu.Lock()
+	draining := wc.draining
+	wc.mu.Unlock()
+	// The stream outlives the request that opened it
+	if draining || !wc.attach(context.Background(), client) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return
+	}
+	log.Printf("Long polling stream established for %s (%s)", client.userID, client.userName)
+	go wc.expirePoll(client, stream)
+
+	connected, _ := json.Marshal(connectedFrame(client))
+	client.bytesOut.Add(int64(len(connected)))
+	c.JSON(http.StatusOK, pollResponse{Frames: []json.RawMessage{connected}})
+}
+
+// expirePoll detaches a long polling client once its stream is closed or
+// hasn't been polled for pollExpiry
+func (wc *WebSocketController) expirePoll(client *WebSocketClient, stream *streamTransport) {
+	lastPoll := time.Now()
+	ticker := time.NewTicker(pollExpiry / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stream.polled:
+			lastPoll = time.Now()
+		case <-stream.done:
+			wc.detach(client)
+			return
+		case <-ticker.C:
+			if time.Since(lastPoll) < pollExpiry {
+				continue
+			}
+			log.Printf("Long polling stream %s of %s expired", client.id, client.userID)
+			stream.abort()
+			wc.detach(client)
+			return
+		}
+	}
+}
+
+// PostFrame handles a frame sent by a Server-Sent Events or long polling
+// client, with the stream_id of its stream, exactly like a frame received
+// over a WebSocket. Replies such as pongs, errors and the sender's copy of
+// a message arrive on the stream.
+func (wc *WebSocketController) PostFrame(c *gin.Context) {
+	client, _, ok := wc.findStream(c)
+	if !ok {
+		return
+	}
+
+	message, err := io.ReadAll(io.LimitReader(c.Request.Body, int64(wc.readLimit)+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if len(message) > wc.readLimit {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Frame is too large"})
+		return
+	}
+	client.bytesIn.Add(int64(len(message)))
+
+	if !wc.beginFrame() {
+		// Tell the client to send the frame again after reconnecting
+		wc.sendError(client, protocol.ErrorShuttingDown, "Server is shutting down, reconnect and send again", client.codec.Header(message).TempID)
+	} else {
+		client.handleFrame(wc, message)
+		wc.inflight.Done()
+	}
+	c.Status(http.StatusAccepted)
+}
+
+// EndStreams sends every Server-Sent Events and long polling client a
+// reconnect frame and closes its stream with CloseServiceRestart. The HTTP
+// server waits for these requests when shutting down, unlike upgraded
+// WebSockets, so they are ended as soon as shutdown starts.
+func (wc *WebSocketController) EndStreams(retryAfter time.Duration) {
+	wc.mu.Lock()
+	var clients []*WebSocketClient
+	for _, client := range wc.connections {
+		if _, ok := client.streamTransport(); ok {
+			clients = append(clients, client)
+		}
+	}
+	wc.mu.Unlock()
+
+	for _, client := range clients {
+		wc.sendToClient(client, reconnectFrame(retryAfter))
+		client.transport.close(websocket.CloseServiceRestart, "server restarting")
+	}
+}
@@ -0,0 +1,267 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/protocol"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// streamTestServer serves the Server-Sent Events and long polling transports
+type streamTestServer struct {
+	t      *testing.T
+	wc     *WebSocketController
+	tokens *auth.TokenManager
+	server *httptest.Server
+}
+
+func newStreamTestServer(t *testing.T) *streamTestServer {
+	t.Helper()
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, nil, tokens, testSessions{"s1": true, "s2": true}, func(socket *SocketOptions) {
+		socket.ReadLimits = map[string]int{protocol.TypePing: 512, protocol.TypeMessage: 1024}
+	})
+	r := gin.New()
+	r.GET("/api/v1/stream/events", wc.HandleEvents)
+	r.GET("/api/v1/stream/poll", wc.HandlePoll)
+	r.POST("/api/v1/stream/frames", wc.PostFrame)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return &streamTestServer{t: t, wc: wc, tokens: tokens, server: server}
+}
+
+// do sends a request as the session and returns the response
+func (s *streamTestServer) do(method, path, sessionID, body string) *http.Response {
+	s.t.Helper()
+	req, err := http.NewRequest(method, s.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken(s.t, s.tokens, "u1", sessionID))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// postFrame sends a frame to a stream and checks it was accepted
+func (s *streamTestServer) postFrame(streamID, frame string) {
+	s.t.Helper()
+	resp := s.do(http.MethodPost, "/api/v1/stream/frames?stream_id="+streamID, "s1", frame)
+	if resp.StatusCode != http.StatusAccepted {
+		s.t.Fatalf("post frame: status %d, want 202", resp.StatusCode)
+	}
+}
+
+// poll long polls a stream and returns its frames
+func (s *streamTestServer) poll(query string) []map[string]interface{} {
+	s.t.Helper()
+	resp := s.do(http.MethodGet, "/api/v1/stream/poll?"+query, "s1", "")
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("poll: status %d, want 200", resp.StatusCode)
+	}
+	var body struct {
+		Frames []map[string]interface{} `json:"frames"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		s.t.Fatal(err)
+	}
+	return body.Frames
+}
+
+// readEvent reads the next Server-Sent Event, skipping keepalive comments
+func readEvent(t *testing.T, events *bufio.Reader) map[string]interface{} {
+	t.Helper()
+	for {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		data, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "data: ")
+		if !ok {
+			continue
+		}
+		var frame map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &frame); err != nil {
+			t.Fatalf("decode event %q: %v", data, err)
+		}
+		return frame
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	s := newStreamTestServer(t)
+
+	resp := s.do(http.MethodGet, "/api/v1/stream/events", "s1", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	events := bufio.NewReader(resp.Body)
+	connected := readEvent(t, events)
+	streamID, _ := connected["stream_id"].(string)
+	if connected["type"] != protocol.TypeConnected || streamID == "" {
+		t.Fatalf("first event = %v, want connected with a stream_id", connected)
+	}
+
+	// Replies to posted frames arrive on the stream
+	s.postFrame(streamID, `{"type":"ping"}`)
+	if frame := readEvent(t, events); frame["type"] != protocol.TypePong {
+		t.Errorf("event = %v, want pong", frame)
+	}
+	s.postFrame(streamID, `{"type":"reaction","temp_id":"t1"}`)
+	if frame := readEvent(t, events); frame["code"] != protocol.ErrorInvalidFrame || frame["temp_id"] != "t1" {
+		t.Errorf("event = %v, want invalid_frame for t1", frame)
+	}
+
+	// Other sessions, even of the same user, can't use the stream
+	if resp := s.do(http.MethodPost, "/api/v1/stream/frames?stream_id="+streamID, "s2", `{"type":"ping"}`); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("other session: status %d, want 404", resp.StatusCode)
+	}
+	if resp := s.do(http.MethodPost, "/api/v1/stream/frames?stream_id="+streamID, "s1", `{"type":"message","content":"`+strings.Repeat("a", 2048)+`"}`); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("large frame: status %d, want 413", resp.StatusCode)
+	}
+
+	s.wc.EndStreams(time.Second)
+	if frame := readEvent(t, events); frame["type"] != protocol.TypeReconnect {
+		t.Errorf("event = %v, want reconnect", frame)
+	}
+	if frame := readEvent(t, events); frame["type"] != protocol.TypeClose || frame["code"] != float64(websocket.CloseServiceRestart) {
+		t.Errorf("event = %v, want close with %d", frame, websocket.CloseServiceRestart)
+	}
+	// The stream ends after the close frame
+	if rest, err := io.ReadAll(events); err != nil || strings.TrimSpace(string(rest)) != "" {
+		t.Errorf("stream continued with %q (%v)", rest, err)
+	}
+}
+
+func TestLongPolling(t *testing.T) {
+	s := newStreamTestServer(t)
+
+	frames := s.poll("")
+	if len(frames) != 1 || frames[0]["type"] != protocol.TypeConnected {
+		t.Fatalf("frames = %v, want connected", frames)
+	}
+	streamID, _ := frames[0]["stream_id"].(string)
+	if streamID == "" {
+		t.Fatal("connected frame has no stream_id")
+	}
+
+	s.postFrame(streamID, `{"type":"ping"}`)
+	s.postFrame(streamID, `{"type":"ping"}`)
+	frames = s.poll("stream_id=" + streamID)
+	if len(frames) != 2 || frames[0]["type"] != protocol.TypePong || frames[1]["type"] != protocol.TypePong {
+		t.Errorf("frames = %v, want two pongs", frames)
+	}
+
+	s.wc.mu.Lock()
+	stream, _ := s.wc.connections[streamID].streamTransport()
+	s.wc.mu.Unlock()
+
+	// A waiting poll returns as soon as a frame is queued
+	polled := s.startPoll(stream, streamID)
+	s.postFrame(streamID, `{"type":"ping"}`)
+	if frames := receivePoll(t, polled); len(frames) != 1 || frames[0]["type"] != protocol.TypePong {
+		t.Errorf("frames = %v, want a pong", frames)
+	}
+
+	// Only one poll can wait on a stream at a time
+	stream.polling.Lock()
+	resp := s.do(http.MethodGet, "/api/v1/stream/poll?stream_id="+streamID, "s1", "")
+	stream.polling.Unlock()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("second poll: status %d, want 409", resp.StatusCode)
+	}
+
+	if resp := s.do(http.MethodGet, "/api/v1/stream/poll?stream_id=unknown", "s1", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown stream: status %d, want 404", resp.StatusCode)
+	}
+	if resp := s.do(http.MethodGet, "/api/v1/stream/poll?stream_id="+streamID, "s2", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("other session: status %d, want 404", resp.StatusCode)
+	}
+
+	// Ending the stream hands the waiting poll the reconnect and close frames
+	polled = s.startPoll(stream, streamID)
+	s.wc.EndStreams(time.Second)
+	frames = receivePoll(t, polled)
+	if len(frames) != 2 || frames[0]["type"] != protocol.TypeReconnect || frames[1]["type"] != protocol.TypeClose {
+		t.Fatalf("frames = %v, want reconnect and close", frames)
+	}
+	if frames[1]["code"] != float64(websocket.CloseServiceRestart) {
+		t.Errorf("close code = %v, want %d", frames[1]["code"], websocket.CloseServiceRestart)
+	}
+}
+
+// startPoll starts a long poll of the stream in the background and returns
+// once it is waiting for frames. The poll's frames, or nil if it failed, are
+// sent on the returned channel.
+func (s *streamTestServer) startPoll(stream *streamTransport, streamID string) <-chan []map[string]interface{} {
+	s.t.Helper()
+	token := accessToken(s.t, s.tokens, "u1", "s1")
+	polled := make(chan []map[string]interface{}, 1)
+	go func() {
+		defer close(polled)
+		for {
+			req, _ := http.NewRequest(http.MethodGet, s.server.URL+"/api/v1/stream/poll?stream_id="+streamID, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				s.t.Errorf("poll: %v", err)
+				return
+			}
+			var body struct {
+				Frames []map[string]interface{} `json:"frames"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+			// Lost the stream to the check below
+			if resp.StatusCode == http.StatusConflict {
+				continue
+			}
+			if resp.StatusCode != http.StatusOK || err != nil {
+				s.t.Errorf("poll: status %d (%v)", resp.StatusCode, err)
+				return
+			}
+			polled <- body.Frames
+			return
+		}
+	}()
+
+	// The poll holds the stream while it waits
+	deadline := time.Now().Add(5 * time.Second)
+	for stream.polling.TryLock() {
+		stream.polling.Unlock()
+		if time.Now().After(deadline) {
+			s.t.Fatal("poll did not start waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return polled
+}
+
+func receivePoll(t *testing.T, polled <-chan []map[string]interface{}) []map[string]interface{} {
+	t.Helper()
+	select {
+	case frames, ok := <-polled:
+		if !ok {
+			t.FailNow()
+		}
+		return frames
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting poll did not return")
+		return nil
+	}
+}
@@ -0,0 +1,319 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/ratelimit"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+// TwoFactorController manages TOTP enrollment and handles the second login
+// step
+type TwoFactorController struct {
+	twoFactorService *services.TwoFactorService
+	userService      *services.UserService
+	settings         *services.SettingsService
+	loginFinisher    *LoginFinisher
+	// attempts limits code guesses per user, on top of the attempts each
+	// login challenge allows
+	attempts *ratelimit.Limiter
+}
+
+func NewTwoFactorController(twoFactorService *services.TwoFactorService, userService *services.UserService, settings *services.SettingsService, loginFinisher *LoginFinisher, attempts *ratelimit.Limiter) *TwoFactorController {
+	return &TwoFactorController{
+		twoFactorService: twoFactorService,
+		userService:      userService,
+		settings:         settings,
+		loginFinisher:    loginFinisher,
+		attempts:         attempts,
+	}
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type twoFactorChallengeRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+	Code      string `json:"code"`
+}
+
+// challengeUser resolves the user of a two-factor challenge. With attempt
+// set the lookup counts as one of the challenge's code guesses.
+func (c *TwoFactorController) challengeUser(ctx *gin.Context, challenge string, attempt bool) (*models.User, bool) {
+	lookup := c.twoFactorService.ChallengeUser
+	if attempt {
+		lookup = c.twoFactorService.AttemptChallenge
+	}
+	userID, err := lookup(challenge)
+	if err == services.ErrInvalidTwoFactorChallenge {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to check two-factor challenge: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check challenge"})
+		return nil, false
+	}
+
+	user, err := c.userService.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Failed to get user %s: %v", userID, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return nil, false
+	}
+	return user, true
+}
+
+// allowAttempt applies the per-user limit on code guesses
+func (c *TwoFactorController) allowAttempt(ctx *gin.Context, userID string) bool {
+	if ok, retryAfter := c.attempts.Allow(userID); !ok {
+		tooManyRequests(ctx, retryAfter)
+		return false
+	}
+	return true
+}
+
+// writeCodeError maps a failed code check to a response
+func writeCodeError(ctx *gin.Context, err error) {
+	switch err {
+	case services.ErrInvalidTwoFactorCode:
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+	case services.ErrTwoFactorNotEnrolling:
+		ctx.JSON(http.StatusConflict, gin.H{"error": "No two-factor enrollment in progress"})
+	case services.ErrTwoFactorNotEnabled:
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+	default:
+		log.Printf("Failed to check two-factor code: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check code"})
+	}
+}
+
+// BeginChallengeEnrollment starts enrollment during login for a user who
+// is required to set up two-factor authentication
+func (c *TwoFactorController) BeginChallengeEnrollment(ctx *gin.Context) {
+	var request twoFactorChallengeRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	user, ok := c.challengeUser(ctx, request.Challenge, false)
+	if !ok {
+		return
+	}
+	if user.TwoFactorEnabled {
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	enrollment, err := c.twoFactorService.BeginEnrollment(user.ID, user.Email)
+	if err != nil {
+		log.Printf("Failed to begin two-factor enrollment: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin enrollment"})
+		return
+	}
+	ctx.JSON(http.StatusOK, enrollment)
+}
+
+// VerifyChallenge completes login with a TOTP or recovery code. Users who
+// are enrolling during login confirm their new authenticator and receive
+// their recovery codes. A challenge is used up once a code is accepted or
+// after too many wrong ones.
+func (c *TwoFactorController) VerifyChallenge(ctx *gin.Context) {
+	var request twoFactorChallengeRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil || request.Code == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	user, ok := c.challengeUser(ctx, request.Challenge, true)
+	if !ok {
+		return
+	}
+	if !c.allowAttempt(ctx, user.ID) {
+		return
+	}
+
+	var recoveryCodes []string
+	var err error
+	if user.TwoFactorEnabled {
+		err = c.twoFactorService.Verify(user.ID, request.Code)
+	} else {
+		recoveryCodes, err = c.twoFactorService.ConfirmEnrollment(user.ID, request.Code)
+	}
+	if err != nil {
+		writeCodeError(ctx, err)
+		return
+	}
+	if err := c.twoFactorService.CompleteChallenge(request.Challenge); err == services.ErrInvalidTwoFactorChallenge {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	} else if err != nil {
+		log.Printf("Failed to complete two-factor challenge: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
+	tokens, err := c.loginFinisher.startSession(ctx, user)
+	if err != nil {
+		log.Printf("Failed to start session: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
+	extra := gin.H{}
+	if recoveryCodes != nil {
+		extra["recovery_codes"] = recoveryCodes
+	}
+	c.loginFinisher.respondWithSession(ctx, tokens, extra)
+}
+
+// GetStatus reports the current user's two-factor settings
+func (c *TwoFactorController) GetStatus(ctx *gin.Context) {
+	status, err := c.twoFactorService.Status(ctx.GetString("userID"))
+	if err != nil {
+		log.Printf("Failed to get two-factor status: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get two-factor status"})
+		return
+	}
+	status.Required, err = c.settings.RequireTwoFactor()
+	if err != nil {
+		log.Printf("Failed to get two-factor requirement: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get two-factor status"})
+		return
+	}
+	ctx.JSON(http.StatusOK, status)
+}
+
+// BeginEnrollment generates a new TOTP secret for the current user
+func (c *TwoFactorController) BeginEnrollment(ctx *gin.Context) {
+	user, err := c.userService.GetUserByID(ctx.GetString("userID"))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return
+	}
+
+	enrollment, err := c.twoFactorService.BeginEnrollment(user.ID, user.Email)
+	if err == services.ErrTwoFactorAlreadyEnabled {
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to begin two-factor enrollment: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin enrollment"})
+		return
+	}
+	ctx.JSON(http.StatusOK, enrollment)
+}
+
+// GetEnrollmentQRCode serves the QR code of the enrollment in progress
+func (c *TwoFactorController) GetEnrollmentQRCode(ctx *gin.Context) {
+	user, err := c.userService.GetUserByID(ctx.GetString("userID"))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return
+	}
+
+	qrCode, err := c.twoFactorService.EnrollmentQRCode(user.ID, user.Email)
+	if err == services.ErrTwoFactorNotEnrolling {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "No two-factor enrollment in progress"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to render two-factor QR code: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render QR code"})
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Data(http.StatusOK, "image/png", qrCode)
+}
+
+// ConfirmEnrollment enables two-factor authentication for the current user
+// and returns their recovery codes
+func (c *TwoFactorController) ConfirmEnrollment(ctx *gin.Context) {
+	var request twoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	userID := ctx.GetString("userID")
+	if !c.allowAttempt(ctx, userID) {
+		return
+	}
+
+	recoveryCodes, err := c.twoFactorService.ConfirmEnrollment(userID, request.Code)
+	if err != nil {
+		writeCodeError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"recovery_codes": recoveryCodes})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes
+func (c *TwoFactorController) RegenerateRecoveryCodes(ctx *gin.Context) {
+	var request twoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	userID := ctx.GetString("userID")
+	if !c.allowAttempt(ctx, userID) {
+		return
+	}
+	if err := c.twoFactorService.Verify(userID, request.Code); err != nil {
+		writeCodeError(ctx, err)
+		return
+	}
+
+	recoveryCodes, err := c.twoFactorService.RegenerateRecoveryCodes(userID)
+	if err != nil {
+		log.Printf("Failed to regenerate recovery codes: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to regenerate recovery codes"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"recovery_codes": recoveryCodes})
+}
+
+// Disable turns off two-factor authentication for the current user, unless
+// it is required on this server
+func (c *TwoFactorController) Disable(ctx *gin.Context) {
+	required, err := c.settings.RequireTwoFactor()
+	if err != nil {
+		log.Printf("Failed to get two-factor requirement: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	if required {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required on this server"})
+		return
+	}
+
+	var request twoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	userID := ctx.GetString("userID")
+	if !c.allowAttempt(ctx, userID) {
+		return
+	}
+	if err := c.twoFactorService.Verify(userID, request.Code); err != nil {
+		writeCodeError(ctx, err)
+		return
+	}
+
+	if err := c.twoFactorService.Disable(userID); err != nil {
+		log.Printf("Failed to disable two-factor authentication: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// totpCode returns the code of secret for the time step offset steps from now
+func totpCode(t *testing.T, secret string, offset int) string {
+	t.Helper()
+	code, err := totp.GenerateCodeCustom(secret, time.Now().Add(time.Duration(offset)*30*time.Second), totp.ValidateOpts{
+		Period:    30,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// enroll turns on two-factor authentication for the user and returns the
+// TOTP secret
+func (s *authTestServer) enroll(t *testing.T, userID string) string {
+	t.Helper()
+	token, _ := s.login(t, userID)
+	w := s.post(t, "/api/v1/users/me/2fa", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("enroll: status %d: %s", w.Code, w.Body)
+	}
+	var enrollment models.TwoFactorEnrollment
+	decodeJSON(t, w, &enrollment)
+	if w := s.post(t, "/api/v1/users/me/2fa/confirm", token, gin.H{"code": totpCode(t, enrollment.Secret, -1)}); w.Code != http.StatusOK {
+		t.Fatalf("confirm: status %d: %s", w.Code, w.Body)
+	}
+	return enrollment.Secret
+}
+
+// twoFactorStep is the response to exchanging a login code of a user who
+// needs a second factor
+type twoFactorStep struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	Challenge         string `json:"challenge"`
+	Enroll            bool   `json:"enroll"`
+	Token             string `json:"token"`
+}
+
+// exchange signs the user in as far as the login code exchange
+func (s *authTestServer) exchange(t *testing.T, userID string) twoFactorStep {
+	t.Helper()
+	code, err := s.loginCodes.CreateLoginCode(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := s.post(t, "/api/v1/auth/exchange", "", gin.H{"code": code})
+	if w.Code != http.StatusOK {
+		t.Fatalf("exchange: status %d: %s", w.Code, w.Body)
+	}
+	var step twoFactorStep
+	decodeJSON(t, w, &step)
+	return step
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	db := dbtest.Open(t)
+	s := newAuthTestServer(t, db, nil)
+	alice := dbtest.CreateUser(t, db, "alice")
+
+	if step := s.exchange(t, alice); step.TwoFactorRequired || step.Token == "" {
+		t.Fatalf("without two-factor authentication the exchange returned %+v, want a session", step)
+	}
+
+	secret := s.enroll(t, alice)
+	step := s.exchange(t, alice)
+	if !step.TwoFactorRequired || step.Challenge == "" || step.Enroll || step.Token != "" {
+		t.Fatalf("exchange returned %+v, want a challenge and no session", step)
+	}
+
+	if w := s.post(t, "/api/v1/auth/2fa/verify", "", gin.H{"challenge": step.Challenge, "code": "000000"}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong code: status %d, want 401", w.Code)
+	}
+	w := s.post(t, "/api/v1/auth/2fa/verify", "", gin.H{"challenge": step.Challenge, "code": totpCode(t, secret, 0)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("verify: status %d: %s", w.Code, w.Body)
+	}
+	var session struct {
+		Token string `json:"token"`
+	}
+	decodeJSON(t, w, &session)
+	if claims, err := s.tokens.ParseAccessToken(session.Token); err != nil || claims.Subject != alice {
+		t.Fatalf("access token: %+v, %v", claims, err)
+	}
+
+	// The challenge is used up, even with another valid code
+	if w := s.post(t, "/api/v1/auth/2fa/verify", "", gin.H{"challenge": step.Challenge, "code": totpCode(t, secret, 1)}); w.Code != http.StatusUnauthorized {
+		t.Errorf("reused challenge: status %d, want 401", w.Code)
+	}
+	if w := s.post(t, "/api/v1/auth/2fa/verify", "", gin.H{"challenge": "forged", "code": totpCode(t, secret, 1)}); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown challenge: status %d, want 401", w.Code)
+	}
+}
+
+func TestTwoFactorChallengeAttempts(t *testing.T) {
+	db := dbtest.Open(t)
+	s := newAuthTestServer(t, db, nil)
+	alice := dbtest.CreateUser(t, db, "alice")
+	secret := s.enroll(t, alice)
+
+	step := s.exchange(t, alice)
+	for i := 0; i < 5; i++ {
+		if w := s.post(t, "/api/v1/auth/2fa/verify", "", gin.H{"challenge": step.Challenge, "code": "000000"}); w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: status %d, want 401", i+1, w.Code)
+		}
+	}
+	w := s.post(t, "/api/v1/auth/2fa/verify", "", gin.H{"challenge": step.Challenge, "code": totpCode(t, secret, 0)})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("right code after too many guesses: status %d, want 401", w.Code)
+	}
+	if n := countRows(t, db, `SELECT COUNT(*) FROM sessions WHERE user_id = $1`, alice); n != 1 {
+		t.Errorf("%d sessions exist, want only the one enrollment used", n)
+	}
+
+	// Signing in again starts a new challenge
+	step = s.exchange(t, alice)
+	if w := s.post(t, "/api/v1/auth/2fa/verify", "", gin.H{"challenge": step.Challenge, "code": totpCode(t, secret, 0)}); w.Code != http.StatusOK {
+		t.Fatalf("new challenge: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTwoFactorRequiredByAdmin(t *testing.T) {
+	db := dbtest.Open(t)
+	s := newAuthTestServer(t, db, nil)
+	admin := dbtest.CreateUser(t, db, "admin")
+	bob := dbtest.CreateUser(t, db, "bob")
+	if _, err := s.settings.SetRequireTwoFactor(admin, true); err != nil {
+		t.Fatal(err)
+	}
+
+	step := s.exchange(t, bob)
+	if !step.TwoFactorRequired || !step.Enroll || step.Token != "" {
+		t.Fatalf("exchange returned %+v, want a challenge to enroll", step)
+	}
+	w := s.post(t, "/api/v1/auth/2fa/enroll", "", gin.H{"challenge": step.Challenge})
+	if w.Code != http.StatusOK {
+		t.Fatalf("enroll: status %d: %s", w.Code, w.Body)
+	}
+	var enrollment models.TwoFactorEnrollment
+	decodeJSON(t, w, &enrollment)
+
+	w = s.post(t, "/api/v1/auth/2fa/verify", "", gin.H{"challenge": step.Challenge, "code": totpCode(t, enrollment.Secret, 0)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("verify: status %d: %s", w.Code, w.Body)
+	}
+	var session struct {
+		Token         string   `json:"token"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	decodeJSON(t, w, &session)
+	if session.Token == "" || len(session.RecoveryCodes) != 10 {
+		t.Fatalf("verify returned %+v, want a session and recovery codes", session)
+	}
+
+	// Required two-factor authentication can't be turned off
+	w = s.do(t, http.MethodDelete, "/api/v1/users/me/2fa", session.Token, gin.H{"code": session.RecoveryCodes[0]})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("disable: status %d, want 403", w.Code)
+	}
+}
@@ -41,3 +41,28 @@ func (c *UserController) GetCurrentUser(ctx *gin.Context) {
 
 	ctx.JSON(http.StatusOK, user)
 }
+
+// GetIdentities lists the identity provider accounts linked to the current user
+func (c *UserController) GetIdentities(ctx *gin.Context) {
+	identities, err := c.userService.GetIdentities(ctx.GetString("userID"))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get identities"})
+		return
+	}
+	ctx.JSON(http.StatusOK, identities)
+}
+
+// UnlinkIdentity removes one of the current user's identity provider accounts
+func (c *UserController) UnlinkIdentity(ctx *gin.Context) {
+	err := c.userService.UnlinkIdentity(ctx.GetString("userID"), ctx.Param("provider"), ctx.Param("subject"))
+	switch err {
+	case nil:
+		ctx.Status(http.StatusNoContent)
+	case services.ErrIdentityNotFound:
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Identity not found"})
+	case services.ErrLastIdentity:
+		ctx.JSON(http.StatusConflict, gin.H{"error": "Cannot unlink the only sign-in method"})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink identity"})
+	}
+}
@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+// WebhookController lets conversation participants subscribe HTTP endpoints
+// to conversation events and inspect their deliveries
+type WebhookController struct {
+	webhookService      *services.WebhookService
+	conversationService *services.ConversationService
+}
+
+func NewWebhookController(webhookService *services.WebhookService, conversationService *services.ConversationService) *WebhookController {
+	return &WebhookController{
+		webhookService:      webhookService,
+		conversationService: conversationService,
+	}
+}
+
+// CreateWebhook subscribes a URL to events in the conversation. The signing
+// secret is only ever returned in this response.
+func (c *WebhookController) CreateWebhook(ctx *gin.Context) {
+	var request struct {
+		URL    string   `json:"url" binding:"required"`
+		Events []string `json:"events" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	conversationID := ctx.Param("id")
+	userID := ctx.GetString("userID")
+	if !c.requireParticipant(ctx, conversationID, userID) {
+		return
+	}
+
+	webhook, secret, err := c.webhookService.CreateWebhook(conversationID, userID, request.URL, request.Events)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to create webhook")
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusCreated, gin.H{
+		"secret":  secret,
+		"webhook": webhook,
+	})
+}
+
+// GetWebhooks lists the webhooks of the conversation
+func (c *WebhookController) GetWebhooks(ctx *gin.Context) {
+	conversationID := ctx.Param("id")
+	if !c.requireParticipant(ctx, conversationID, ctx.GetString("userID")) {
+		return
+	}
+
+	webhooks, err := c.webhookService.GetWebhooks(conversationID)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get webhooks")
+		return
+	}
+	ctx.JSON(http.StatusOK, webhooks)
+}
+
+// DeleteWebhook unsubscribes a webhook and drops its queued deliveries
+func (c *WebhookController) DeleteWebhook(ctx *gin.Context) {
+	conversationID := ctx.Param("id")
+	if !c.requireParticipant(ctx, conversationID, ctx.GetString("userID")) {
+		return
+	}
+
+	if err := c.webhookService.DeleteWebhook(conversationID, ctx.Param("webhookId")); err != nil {
+		c.handleError(ctx, err, "Failed to delete webhook")
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// GetDeliveries returns the latest deliveries of a webhook, newest first, for
+// debugging an integration. ?limit defaults to 50 and is capped at 200.
+func (c *WebhookController) GetDeliveries(ctx *gin.Context) {
+	conversationID := ctx.Param("id")
+	if !c.requireParticipant(ctx, conversationID, ctx.GetString("userID")) {
+		return
+	}
+
+	limit := 50
+	if value := ctx.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(parsed, 200)
+	}
+
+	deliveries, err := c.webhookService.GetDeliveries(conversationID, ctx.Param("webhookId"), limit)
+	if err != nil {
+		c.handleError(ctx, err, "Failed to get webhook deliveries")
+		return
+	}
+	ctx.JSON(http.StatusOK, deliveries)
+}
+
+func (c *WebhookController) requireParticipant(ctx *gin.Context, conversationID, userID string) bool {
+	ok, err := c.conversationService.IsParticipant(conversationID, userID)
+	if err != nil {
+		log.Printf("Failed to check conversation membership: %v", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check conversation membership"})
+		return false
+	}
+	if !ok {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "Not a participant of this conversation"})
+		return false
+	}
+	return true
+}
+
+func (c *WebhookController) handleError(ctx *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrWebhookNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+	case errors.Is(err, services.ErrInvalidWebhookURL), errors.Is(err, services.ErrForbiddenWebhookURL), errors.Is(err, services.ErrInvalidWebhookEvent), errors.Is(err, services.ErrReservedWebhookEvent):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Printf("%s: %v", message, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/gin-gonic/gin"
+)
+
+func TestWebhooks(t *testing.T) {
+	db := dbtest.Open(t)
+	f := newConversationFixture(t, db)
+	cipher := services.NewContentCipher(db, nil)
+	webhooks := services.NewWebhookService(db, cipher, egress.NewPolicy(), time.Second, 1)
+	c := NewWebhookController(webhooks, services.NewConversationService(db, cipher, webhooks))
+	r := newTestRouter()
+	r.POST("/conversations/:id/webhooks", c.CreateWebhook)
+	r.GET("/conversations/:id/webhooks", c.GetWebhooks)
+	r.DELETE("/conversations/:id/webhooks/:webhookId", c.DeleteWebhook)
+	r.GET("/conversations/:id/webhooks/:webhookId/deliveries", c.GetDeliveries)
+	path := "/conversations/" + f.conversation + "/webhooks"
+
+	for name, body := range map[string]gin.H{
+		"no events":       {"url": "https://93.184.216.34/hook"},
+		"unknown event":   {"url": "https://93.184.216.34/hook", "events": []string{"message.deleted"}},
+		"reserved event":  {"url": "https://93.184.216.34/hook", "events": []string{"message.created", "message.edited"}},
+		"not http":        {"url": "file:///etc/passwd", "events": []string{"message.created"}},
+		"loopback":        {"url": "http://127.0.0.1:6379/", "events": []string{"message.created"}},
+		"metadata server": {"url": "http://169.254.169.254/latest/meta-data", "events": []string{"message.created"}},
+	} {
+		if w := serve(t, r, http.MethodPost, path, f.alice, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400: %s", name, w.Code, w.Body)
+		}
+	}
+	if w := serve(t, r, http.MethodPost, path, f.eve, gin.H{"url": "https://93.184.216.34/hook", "events": []string{"message.created"}}); w.Code != http.StatusForbidden {
+		t.Errorf("create by an outsider: status %d, want 403", w.Code)
+	}
+
+	w := serve(t, r, http.MethodPost, path, f.alice, gin.H{"url": "https://93.184.216.34/hook", "events": []string{"message.created"}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+	var created struct {
+		Secret  string         `json:"secret"`
+		Webhook models.Webhook `json:"webhook"`
+	}
+	decodeJSON(t, w, &created)
+
+	var listed []models.Webhook
+	decodeJSON(t, serve(t, r, http.MethodGet, path, f.bob, nil), &listed)
+	if len(listed) != 1 || listed[0].ID != created.Webhook.ID {
+		t.Fatalf("webhooks = %+v", listed)
+	}
+	if w := serve(t, r, http.MethodGet, path+"/"+created.Webhook.ID+"/deliveries?limit=0", f.bob, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("limit 0: status %d, want 400", w.Code)
+	}
+	if w := serve(t, r, http.MethodGet, path+"/"+created.Webhook.ID+"/deliveries", f.eve, nil); w.Code != http.StatusForbidden {
+		t.Errorf("deliveries for an outsider: status %d, want 403", w.Code)
+	}
+
+	if w := serve(t, r, http.MethodDelete, path+"/"+created.Webhook.ID, f.bob, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+	if w := serve(t, r, http.MethodDelete, path+"/"+created.Webhook.ID, f.bob, nil); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: status %d, want 404", w.Code)
+	}
+}
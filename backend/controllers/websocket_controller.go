@@ -1,138 +1,304 @@
 package controllers
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/backplane"
+	"github.com/RatneshMaurya/not-whatsapp/backend/commands"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/protocol"
+	"github.com/RatneshMaurya/not-whatsapp/backend/ratelimit"
+	"github.com/RatneshMaurya/not-whatsapp/backend/services"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+// CloseSessionRevoked is sent when a connection is closed because its login
+// session was revoked
+const CloseSessionRevoked = 4001
+
+// CloseDisconnectedByAdmin is sent when an admin disconnects a session. The
+// session stays valid, so the client may reconnect.
+const CloseDisconnectedByAdmin = 4003
+
+// CloseRateLimited is sent when a connection is closed because it kept
+// sending frames over its rate limit
+const CloseRateLimited = 4029
+
+// closeReasons are the close texts of the codes connections are closed with
+// by DisconnectSessions and ForceDisconnect
+var closeReasons = map[int]string{
+	CloseSessionRevoked:      "session revoked",
+	CloseDisconnectedByAdmin: "disconnected by an admin",
+}
+
+// frameBudgets maps the frame types that are rate limited to their budget
+var frameBudgets = map[string]string{
+	protocol.TypeMessage: ratelimit.BudgetMessages,
+	protocol.TypeTyping:  ratelimit.BudgetTyping,
+}
+
+// SocketOptions tunes WebSocket connections
+type SocketOptions struct {
+	ReadBufferSize  int
+	WriteBufferSize int
+	// WriteBufferPool shares write buffers between connections, so idle
+	// connections don't each hold one
+	WriteBufferPool bool
+	// ReadLimits caps the size of each frame type clients send, in bytes
+	ReadLimits map[string]int
+	// Compression negotiates permessage-deflate at CompressionLevel. Frames
+	// smaller than CompressionThreshold bytes are sent uncompressed, as
+	// compressing them costs more than it saves.
+	Compression          bool
+	CompressionLevel     int
+	CompressionThreshold int
+	// SendQueueSize bounds the frames queued for each client
+	SendQueueSize int
+	// AllowedOrigins are the frontend origins that may connect with the
+	// session cookie, e.g. "https://chat.example.com"
+	AllowedOrigins []string
+}
+
+// maxReconnectJitter caps the random delay added to the reconnect hint so
+// the clients of a stopping node don't all reconnect at once
+const maxReconnectJitter = 5 * time.Second
+
 // WebSocketClient represents a connected client
 type WebSocketClient struct {
+	// id identifies the connection in the presence store
+	id string
+	// conn is the client's WebSocket, nil for other transports
 	conn      *websocket.Conn
+	transport transport
 	userID    string
+	sessionID string
 	userName  string
-	send      chan []byte
+	send      *sendQueue
 	avatarURL string
+	// apiToken is set for bots connected with an API token
+	apiToken *auth.APIToken
+	// version is the protocol version negotiated on connect, and codec
+	// encodes the frames sent to the client and decodes the ones it sends
+	version int
+	codec   protocol.Codec
+	// closeCode is sent when the hub closes send, if set
+	closeCode atomic.Int32
+	// compressionThreshold is the size from which frames are compressed,
+	// if the connection negotiated compression
+	compressionThreshold int
+	// ip and userAgent are those of the request that opened the connection
+	ip          string
+	userAgent   string
+	connectedAt time.Time
+	// bytesIn and bytesOut count the bytes of the frames received and sent,
+	// before compression
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// transport carries the frames of a client. Clients that can't use
+// WebSockets read the same send queue over Server-Sent Events or long
+// polling instead.
+type transport interface {
+	// name is the transport's name in the admin API
+	name() string
+	// close tells the client why its connection is closed, as a WebSocket
+	// close code, and closes it
+	close(code int, text string)
+	// abort closes the connection without telling the client
+	abort()
+}
+
+// wsTransport is a WebSocket connection
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+func (t wsTransport) name() string { return "websocket" }
+
+func (t wsTransport) close(code int, text string) {
+	err := t.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text),
+		time.Now().Add(time.Second),
+	)
+	if err != nil {
+		log.Printf("Error sending close message: %v", err)
+	}
+	t.conn.Close()
+}
+
+func (t wsTransport) abort() {
+	t.conn.Close()
+}
+
+// canRead reports whether the client may receive messages of the
+// conversation. Bots only see the conversations their token grants read in.
+func (c *WebSocketClient) canRead(conversationID string) bool {
+	return c.apiToken == nil || c.apiToken.Allows(auth.ScopeRead, conversationID)
 }
 
 // WebSocketController handles WebSocket connections
 type WebSocketController struct {
-	db         *sql.DB
-	clients    map[string]*WebSocketClient
-	register   chan *WebSocketClient
-	unregister chan *WebSocketClient
-	broadcast  chan []byte
-	mu         sync.Mutex
+	db             *sql.DB
+	messageService *services.MessageService
+	commands       *services.CommandService
+	tokens         *auth.TokenManager
+	sessions       auth.SessionValidator
+	apiTokens      auth.APITokenValidator
+	// backplane carries deliveries and disconnects to the other nodes,
+	// which serve the clients connected to them
+	backplane backplane.Backplane
+	presence  backplane.Presence
+	// limits rate limits frames per user; violations counts the frames each
+	// connection had rejected, and connections that run out are closed
+	limits     *ratelimit.Policy
+	violations *ratelimit.Limiter
+	upgrader   websocket.Upgrader
+	socket     SocketOptions
+	// readLimit is the largest frame of any type. Larger frames close the
+	// connection with 1009.
+	readLimit int
+	// clients holds every connection of a user keyed by session ID, and
+	// connections every connection by its ID
+	clients     map[string]map[string]*WebSocketClient
+	connections map[string]*WebSocketClient
+	register    chan *WebSocketClient
+	unregister  chan *WebSocketClient
+	// broadcast carries announcements to every client on this node
+	broadcast chan *protocol.Payload
+	mu        sync.Mutex
+	// sessionRequests collects the answers to the session lists this node
+	// asked the others for, by request ID
+	sessionRequests   map[string]*sessionsRequest
+	sessionRequestsMu sync.Mutex
+	// draining is set once shutdown starts; no connections or frames are
+	// accepted afterwards. inflight counts frames being handled and writers
+	// the running write pumps. quit stops the hub, and stopped is set once it
+	// is closed.
+	draining bool
+	stopped  bool
+	inflight sync.WaitGroup
+	writers  sync.WaitGroup
+	quit     chan struct{}
 }
 
 // NewWebSocketController creates a new WebSocket controller
-func NewWebSocketController(db *sql.DB) *WebSocketController {
+func NewWebSocketController(db *sql.DB, messageService *services.MessageService, commandService *services.CommandService, tokens *auth.TokenManager, sessions auth.SessionValidator, apiTokens auth.APITokenValidator, bp backplane.Backplane, presence backplane.Presence, limits *ratelimit.Policy, maxViolations int, socket SocketOptions) (*WebSocketController, error) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    socket.ReadBufferSize,
+		WriteBufferSize:   socket.WriteBufferSize,
+		EnableCompression: socket.Compression,
+		// Tokens in the query or a header can't be sent by another site, so
+		// any origin may connect with one. Connections authenticated by the
+		// session cookie are checked in authenticate.
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	if socket.WriteBufferPool {
+		upgrader.WriteBufferPool = &sync.Pool{}
+	}
+	readLimit := 0
+	for _, limit := range socket.ReadLimits {
+		readLimit = max(readLimit, limit)
+	}
+
 	controller := &WebSocketController{
-		db:         db,
-		clients:    make(map[string]*WebSocketClient),
-		register:   make(chan *WebSocketClient),
-		unregister: make(chan *WebSocketClient),
-		broadcast:  make(chan []byte),
+		db:              db,
+		messageService:  messageService,
+		commands:        commandService,
+		tokens:          tokens,
+		sessions:        sessions,
+		apiTokens:       apiTokens,
+		backplane:       bp,
+		presence:        presence,
+		limits:          limits,
+		violations:      ratelimit.NewLimiter(maxViolations, time.Minute),
+		upgrader:        upgrader,
+		socket:          socket,
+		readLimit:       readLimit,
+		clients:         make(map[string]map[string]*WebSocketClient),
+		connections:     make(map[string]*WebSocketClient),
+		register:        make(chan *WebSocketClient),
+		unregister:      make(chan *WebSocketClient),
+		broadcast:       make(chan *protocol.Payload),
+		sessionRequests: make(map[string]*sessionsRequest),
+		quit:            make(chan struct{}),
 	}
 
 	// Start listening for channel events
 	go controller.run()
 
-	return controller
-}
-
-// Most basic upgrader with minimal configuration
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins
-	},
+	if err := bp.Subscribe(controller.receive); err != nil {
+		return nil, err
+	}
+	return controller, nil
 }
 
 // run processes websocket events
 func (wc *WebSocketController) run() {
 	for {
 		select {
+		case <-wc.quit:
+			return
+
 		case client := <-wc.register:
 			wc.mu.Lock()
-			// Check if a client with the same userID already exists
-			if existingClient, ok := wc.clients[client.userID]; ok {
-				log.Printf("Closing existing connection for user %s", client.userID)
-				existingClient.conn.Close()
-				delete(wc.clients, client.userID)
+			userClients, ok := wc.clients[client.userID]
+			if !ok {
+				userClients = make(map[string]*WebSocketClient)
+				wc.clients[client.userID] = userClients
+			}
+			// A reconnect from the same session replaces the old connection,
+			// other devices of the user stay connected
+			if existingClient, ok := userClients[client.sessionID]; ok {
+				log.Printf("Closing existing connection for user %s session %s", client.userID, client.sessionID)
+				existingClient.transport.abort()
+				existingClient.send.close()
+				delete(wc.connections, existingClient.id)
 			}
 
-			wc.clients[client.userID] = client
+			userClients[client.sessionID] = client
+			wc.connections[client.id] = client
 			wc.mu.Unlock()
-			log.Printf("Client registered: %s (%s)", client.userID, client.userName)
+			log.Printf("Client registered: %s (%s) session %s", client.userID, client.userName, client.sessionID)
 
 		case client := <-wc.unregister:
 			wc.mu.Lock()
-			if _, ok := wc.clients[client.userID]; ok {
-				log.Printf("Unregistering client: %s", client.userID)
-				delete(wc.clients, client.userID)
-				wc.mu.Unlock()
-
-				func() {
-					defer func() {
-						if r := recover(); r != nil {
-							log.Printf("Recovered from panic when closing channel: %v", r)
-						}
-					}()
-					close(client.send)
-				}()
-			} else {
-				wc.mu.Unlock()
+			if wc.removeClient(client) {
+				log.Printf("Unregistering client: %s session %s", client.userID, client.sessionID)
+				client.send.close()
 			}
+			wc.mu.Unlock()
 
-		case message := <-wc.broadcast:
+		case payload := <-wc.broadcast:
 			wc.mu.Lock()
-			clients := make(map[string]*WebSocketClient, len(wc.clients))
-			for userID, client := range wc.clients {
-				clients[userID] = client
+			clients := make([]*WebSocketClient, 0, len(wc.clients))
+			for _, userClients := range wc.clients {
+				for _, client := range userClients {
+					clients = append(clients, client)
+				}
 			}
 			wc.mu.Unlock()
 
 			// Broadcast to all clients (without holding the mutex)
-			for userID, client := range clients {
-				func(userID string, client *WebSocketClient) {
-					defer func() {
-						if r := recover(); r != nil {
-							log.Printf("Recovered from panic in broadcast: %v", r)
-						}
-					}()
-
-					select {
-					case client.send <- message:
-						// Message sent successfully
-					default:
-						// Failed to send, clean up client
-						log.Printf("Failed to send message to client %s, unregistering", userID)
-						client.conn.Close()
-
-						wc.mu.Lock()
-						delete(wc.clients, userID)
-						wc.mu.Unlock()
-
-						func() {
-							defer func() {
-								if r := recover(); r != nil {
-									log.Printf("Recovered from panic closing channel: %v", r)
-								}
-							}()
-							close(client.send)
-						}()
-					}
-				}(userID, client)
+			for _, client := range clients {
+				client.enqueue(payload)
 			}
 		}
 	}
@@ -142,92 +308,283 @@ func (wc *WebSocketController) run() {
 func (wc *WebSocketController) HandleWebSocket(c *gin.Context) {
 	log.Printf("WebSocket connection request from %s", c.ClientIP())
 
-	// Get token from query parameters
+	client, ok := wc.authenticate(c)
+	if !ok {
+		return
+	}
+	wc.connect(c, client)
+}
+
+// authenticate checks the token of a request to connect and returns the
+// client it connects as, or writes the error response. The token comes from
+// the token query parameter, as browsers can't set headers on WebSocket and
+// EventSource requests, the Authorization header or, in cookie session mode,
+// the cookie. Browsers send the cookie with requests from any site, so it is
+// only accepted from AllowedOrigins.
+func (wc *WebSocketController) authenticate(c *gin.Context) (*WebSocketClient, bool) {
 	tokenString := c.Query("token")
+	if tokenString == "" {
+		tokenString = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if tokenString == "" {
+		tokenString, _ = c.Cookie(auth.AccessTokenCookie)
+		if tokenString != "" && !wc.cookieOriginAllowed(c.Request) {
+			log.Printf("Rejected session cookie from origin %q", c.GetHeader("Origin"))
+			c.JSON(http.StatusForbidden, gin.H{"error": "Origin not allowed"})
+			return nil, false
+		}
+	}
 	if tokenString == "" {
 		log.Printf("No token provided")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
-		return
+		return nil, false
 	}
 
-	// Parse token with no validation (just extract claims)
-	token, _ := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Always return the secret - we just want to extract claims
-		return []byte("your-secret-key"), nil
-	})
+	if auth.IsAPIToken(tokenString) {
+		return wc.authenticateBot(c, tokenString)
+	}
 
-	// Extract claims directly without validation
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		log.Printf("Invalid token format")
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token format"})
-		return
+	claims, err := wc.tokens.ParseAccessToken(tokenString)
+	if err != nil {
+		log.Printf("Invalid token: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return nil, false
 	}
 
-	// Extract user info from claims
-	userID, _ := claims["sub"].(string)
-	if userID == "" {
-		log.Printf("No user ID in token")
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "No user ID in token"})
-		return
+	active, err := wc.sessions.IsSessionActive(claims.SessionID)
+	if err != nil {
+		log.Printf("Failed to check session %s: %v", claims.SessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session"})
+		return nil, false
+	}
+	if !active {
+		log.Printf("Session %s has been revoked", claims.SessionID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+		return nil, false
 	}
 
-	userName, _ := claims["name"].(string)
+	// Extract user info from claims
+	userID := claims.Subject
+	userName := claims.Name
 	if userName == "" {
 		userName = "Anonymous"
 	}
 
-	avatarURL, _ := claims["avatar_url"].(string)
+	avatarURL := claims.AvatarURL
+
+	return &WebSocketClient{
+		userID:    userID,
+		sessionID: claims.SessionID,
+		userName:  userName,
+		avatarURL: avatarURL,
+		ip:        c.ClientIP(),
+		userAgent: c.Request.UserAgent(),
+	}, true
+}
+
+// cookieOriginAllowed reports whether a request carrying the session cookie
+// comes from one of AllowedOrigins. Requests without an Origin header are
+// only accepted when the browser marks them same-origin, as same-origin GETs
+// such as an EventSource on the API's own origin don't send one.
+func (wc *WebSocketController) cookieOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return r.Header.Get("Sec-Fetch-Site") == "same-origin"
+	}
+	for _, allowed := range wc.socket.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
 
-	log.Printf("Upgrading connection for user: %s (%s)", userID, userName)
+// authenticateBot authenticates a bot connecting with an API token. The
+// connection is tracked under the token's ID so revoking the token can
+// disconnect it.
+func (wc *WebSocketController) authenticateBot(c *gin.Context, tokenString string) (*WebSocketClient, bool) {
+	if wc.apiTokens == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API tokens are not accepted here"})
+		return nil, false
+	}
+	apiToken, err := wc.apiTokens.AuthenticateAPIToken(tokenString)
+	if err != nil {
+		log.Printf("Failed to check API token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API token"})
+		return nil, false
+	}
+	if apiToken == nil {
+		log.Printf("Invalid API token")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return nil, false
+	}
 
-	// Upgrade the HTTP connection to a websocket connection - minimal configuration
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	var userName, avatarURL string
+	err = wc.db.QueryRow(`
+		SELECT name, COALESCE(avatar_url, '')
+		FROM users
+		WHERE id = $1
+	`, apiToken.BotID).Scan(&userName, &avatarURL)
+	if err != nil {
+		log.Printf("Failed to load bot %s: %v", apiToken.BotID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load bot"})
+		return nil, false
+	}
+
+	return &WebSocketClient{
+		userID:    apiToken.BotID,
+		sessionID: APITokenSessionID(apiToken.ID),
+		userName:  userName,
+		avatarURL: avatarURL,
+		apiToken:  apiToken,
+		ip:        c.ClientIP(),
+		userAgent: c.Request.UserAgent(),
+	}, true
+}
+
+// APITokenSessionID is the session ID connections made with an API token are
+// tracked under, for use with DisconnectSessions
+func APITokenSessionID(tokenID string) string {
+	return "apitoken:" + tokenID
+}
+
+// connect upgrades an authenticated request and starts serving the client
+func (wc *WebSocketController) connect(c *gin.Context, client *WebSocketClient) {
+	log.Printf("Upgrading connection for user: %s (%s)", client.userID, client.userName)
+
+	// Clients either offer subprotocols, which carry the codec and version,
+	// or list the protocol versions they speak as ?version=2,1 and get JSON
+	var responseHeader http.Header
+	if offered := websocket.Subprotocols(c.Request); len(offered) > 0 {
+		subprotocol, ok := protocol.SelectSubprotocol(offered)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":        "Unsupported subprotocol",
+				"subprotocols": protocol.SubprotocolNames(),
+			})
+			return
+		}
+		client.codec, client.version = subprotocol.Codec, subprotocol.Version
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {subprotocol.Name}}
+	} else {
+		version, ok := protocol.Negotiate(c.Query("version"))
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":    "Unsupported protocol version",
+				"versions": protocol.SupportedVersions,
+			})
+			return
+		}
+		client.codec, client.version = protocol.JSON, version
+	}
+
+	if !wc.beginWriter() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return
+	}
+
+	// Upgrade the HTTP connection to a websocket connection
+	conn, err := wc.upgrader.Upgrade(c.Writer, c.Request, responseHeader)
 	if err != nil {
 		log.Printf("Failed to upgrade connection: %v", err)
+		wc.writers.Done()
 		return
 	}
 
 	// Connection succeeded
-	log.Printf("WebSocket connection established for %s (%s)", userID, userName)
+	log.Printf("WebSocket connection established for %s (%s)", client.userID, client.userName)
 
-	// Create a new client
-	client := &WebSocketClient{
-		conn:      conn,
-		userID:    userID,
-		userName:  userName,
-		send:      make(chan []byte, 256),
-		avatarURL: avatarURL,
+	client.conn = conn
+	client.transport = wsTransport{conn: conn}
+	client.compressionThreshold = wc.socket.CompressionThreshold
+	if err := conn.SetCompressionLevel(wc.socket.CompressionLevel); err != nil {
+		log.Printf("Invalid compression level: %v", err)
 	}
 
-	// Register the client
-	wc.register <- client
+	if !wc.attach(c.Request.Context(), client) {
+		conn.Close()
+		wc.writers.Done()
+		return
+	}
 
 	// Send welcome message directly (don't use channel to avoid potential deadlock)
-	welcomeMsg := map[string]interface{}{
-		"type":      "connected",
-		"timestamp": time.Now(),
-		"id":        uuid.New().String(),
+	welcome, _ := client.codec.Encode(connectedFrame(client))
+	if client.writeFrame(welcome) == nil {
+		client.bytesOut.Add(int64(len(welcome)))
 	}
 
-	welcomeJSON, _ := json.Marshal(welcomeMsg)
-	conn.WriteMessage(websocket.TextMessage, welcomeJSON)
-
 	// Start read/write routines
-	go client.writePump()
+	go func() {
+		defer wc.writers.Done()
+		client.writePump()
+	}()
 	go client.readPump(wc)
 }
 
+// beginWriter counts a connection's writer as running unless the server is
+// shutting down. The caller marks it done with wc.writers.Done.
+func (wc *WebSocketController) beginWriter() bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if wc.draining {
+		return false
+	}
+	wc.writers.Add(1)
+	return true
+}
+
+// attach registers a connected client with the hub and records its
+// presence. It returns false if the hub has stopped.
+func (wc *WebSocketController) attach(ctx context.Context, client *WebSocketClient) bool {
+	client.id = uuid.New().String()
+	client.send = newSendQueue(wc.socket.SendQueueSize)
+	client.connectedAt = time.Now()
+
+	if err := wc.presence.Connect(ctx, client.userID, client.id); err != nil {
+		log.Printf("Failed to record presence of %s: %v", client.userID, err)
+	}
+
+	// Register the client
+	select {
+	case wc.register <- client:
+		return true
+	case <-wc.quit:
+		wc.clearPresence(client)
+		return false
+	}
+}
+
+// detach unregisters a client whose connection ended and clears its presence
+func (wc *WebSocketController) detach(client *WebSocketClient) {
+	log.Printf("Client %s disconnected, cleaning up", client.userID)
+	select {
+	case wc.unregister <- client:
+	case <-wc.quit:
+	}
+	wc.clearPresence(client)
+}
+
+func (wc *WebSocketController) clearPresence(client *WebSocketClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := wc.presence.Disconnect(ctx, client.userID, client.id); err != nil {
+		log.Printf("Failed to clear presence of %s: %v", client.userID, err)
+	}
+}
+
 // writePump pumps messages from the hub to the websocket connection
 func (c *WebSocketClient) writePump() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer func() {
 		ticker.Stop()
 		// Attempt to close connection gracefully
+		closeCode, closeText := websocket.CloseNormalClosure, ""
+		if code := int(c.closeCode.Load()); code != 0 {
+			closeCode, closeText = code, "server restarting"
+		}
 		err := c.conn.WriteControl(
 			websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			websocket.FormatCloseMessage(closeCode, closeText),
 			time.Now().Add(time.Second),
 		)
 		if err != nil {
@@ -238,19 +595,28 @@ func (c *WebSocketClient) writePump() {
 
 	for {
 		select {
-		case message, ok := <-c.send:
-			if !ok {
-				// Channel was closed, exit
-				log.Printf("Send channel closed for client %s", c.userID)
-				return
-			}
+		case <-c.send.ready:
+			payloads, closed := c.send.take(0)
+			for _, payload := range payloads {
+				message, err := payload.Encode(c.codec)
+				if err != nil {
+					log.Printf("Failed to encode frame for client %s: %v", c.userID, err)
+					continue
+				}
 
-			// Set a write deadline
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				// Set a write deadline
+				c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 
-			// Try to write the message
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Printf("Error writing message: %v", err)
+				// Try to write the message
+				if err := c.writeFrame(message); err != nil {
+					log.Printf("Error writing message: %v", err)
+					return
+				}
+				c.bytesOut.Add(int64(len(message)))
+			}
+			if closed {
+				// Queue was closed, exit
+				log.Printf("Send queue closed for client %s", c.userID)
 				return
 			}
 
@@ -265,15 +631,46 @@ func (c *WebSocketClient) writePump() {
 	}
 }
 
+// writeFrame writes an encoded frame in the message type of the client's
+// codec, compressed if it is large enough and compression was negotiated
+func (c *WebSocketClient) writeFrame(frame []byte) error {
+	messageType := websocket.TextMessage
+	if c.codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+	c.conn.EnableWriteCompression(len(frame) >= c.compressionThreshold)
+	return c.conn.WriteMessage(messageType, frame)
+}
+
+// errMessageTooBig is returned by readMessage for messages over the limit
+var errMessageTooBig = errors.New("message over the read limit")
+
+// readMessage reads the next message, failing with errMessageTooBig once it
+// has more than limit bytes. The connection's own read limit only counts the
+// bytes on the wire, which permessage-deflate lets a client inflate many
+// times over, so the inflated message is limited here.
+func (c *WebSocketClient) readMessage(limit int) ([]byte, error) {
+	_, r, err := c.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	message, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(message) > limit {
+		return nil, errMessageTooBig
+	}
+	return message, nil
+}
+
 // readPump pumps messages from the websocket connection to the hub
 func (c *WebSocketClient) readPump(wc *WebSocketController) {
-	defer func() {
-		log.Printf("Client %s disconnected, cleaning up", c.userID)
-		wc.unregister <- c
-	}()
+	defer wc.detach(c)
 
-	// Set read parameters
-	c.conn.SetReadLimit(4096)
+	// Set read parameters. The read limit refuses frames that are too large
+	// even compressed before they are inflated.
+	c.conn.SetReadLimit(int64(wc.readLimit))
 	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.conn.SetPongHandler(func(string) error {
 		log.Printf("Received pong from client %s", c.userID)
@@ -289,7 +686,12 @@ func (c *WebSocketClient) readPump(wc *WebSocketController) {
 
 	for {
 		// Read message
-		_, message, err := c.conn.ReadMessage()
+		message, err := c.readMessage(wc.readLimit)
+		if errors.Is(err, errMessageTooBig) {
+			log.Printf("Closing connection of %s for a frame over %d bytes", c.userID, wc.readLimit)
+			c.transport.close(websocket.CloseMessageTooBig, "frame too large")
+			break
+		}
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				log.Printf("WebSocket read error: %v", err)
@@ -298,159 +700,733 @@ func (c *WebSocketClient) readPump(wc *WebSocketController) {
 			}
 			break
 		}
+		c.bytesIn.Add(int64(len(message)))
 
-		log.Printf("Received message from %s: %s", c.userID, string(message))
-
-		// Process message
-		var data map[string]interface{}
-		if err := json.Unmarshal(message, &data); err != nil {
-			log.Printf("Invalid JSON received: %v", err)
+		if !wc.beginFrame() {
+			// Tell the client to send the frame again after reconnecting
+			wc.sendError(c, protocol.ErrorShuttingDown, "Server is shutting down, reconnect and send again", c.codec.Header(message).TempID)
 			continue
 		}
+		c.handleFrame(wc, message)
+		wc.inflight.Done()
+	}
+}
 
-		// Handle different message types
-		messageType, _ := data["type"].(string)
-		if messageType == "" {
-			log.Printf("Message has no type field")
-			continue
+// allowFrame spends a frame from the client's budget. Rejected frames are
+// answered with a rate_limited error, and a connection that keeps sending
+// them is closed.
+func (wc *WebSocketController) allowFrame(c *WebSocketClient, budget, tempID string) bool {
+	role := ratelimit.RoleUser
+	if c.apiToken != nil {
+		role = ratelimit.RoleBot
+	}
+	ok, retryAfter := wc.limits.Allow(role, c.userID, budget)
+	if ok {
+		return true
+	}
+
+	if ok, _ := wc.violations.Allow(c.id); !ok {
+		log.Printf("Closing connection of %s session %s for exceeding its rate limit", c.userID, c.sessionID)
+		c.transport.close(CloseRateLimited, "rate limit exceeded")
+		return false
+	}
+
+	wc.sendToClient(c, protocol.Error{
+		Type:         protocol.TypeError,
+		Code:         protocol.ErrorRateLimited,
+		Budget:       budget,
+		Message:      "Rate limit exceeded, try again later",
+		RetryAfterMS: retryAfter.Milliseconds(),
+		TempID:       tempID,
+		ID:           uuid.New().String(),
+	})
+	return false
+}
+
+// beginFrame counts a frame as in flight unless the server is shutting down.
+// The caller marks it done with wc.inflight.Done.
+func (wc *WebSocketController) beginFrame() bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if wc.draining {
+		return false
+	}
+	wc.inflight.Add(1)
+	return true
+}
+
+// handleFrame processes one frame received from the client
+func (c *WebSocketClient) handleFrame(wc *WebSocketController, message []byte) {
+	log.Printf("Received %d byte frame from %s", len(message), c.userID)
+
+	header := c.codec.Header(message)
+	if limit, ok := wc.socket.ReadLimits[header.Type]; ok && len(message) > limit {
+		log.Printf("Rejected %d byte %s frame from %s", len(message), header.Type, c.userID)
+		wc.sendError(c, protocol.ErrorFrameTooLarge, fmt.Sprintf("%s frames can be at most %d bytes", header.Type, limit), header.TempID)
+		return
+	}
+	if budget, ok := frameBudgets[header.Type]; ok && !wc.allowFrame(c, budget, header.TempID) {
+		return
+	}
+
+	frame, err := c.codec.Decode(message)
+	if err != nil {
+		log.Printf("Invalid frame from %s: %v", c.userID, err)
+		wc.sendError(c, protocol.ErrorInvalidFrame, err.Error(), header.TempID)
+		return
+	}
+
+	switch frame := frame.(type) {
+	case *protocol.Ping:
+		// Handle ping-pong for keepalive
+		log.Printf("Ping received from %s", c.userID)
+		wc.sendToClient(c, protocol.Pong{
+			Type:      protocol.TypePong,
+			Timestamp: time.Now(),
+			ID:        uuid.New().String(),
+		})
+
+	case *protocol.Typing:
+		wc.handleTyping(c, frame)
+
+	case *protocol.SendMessage:
+		wc.handleMessage(c, frame)
+	}
+}
+
+// handleTyping relays a typing indicator to the conversation. Typing
+// indicators are not stored.
+func (wc *WebSocketController) handleTyping(c *WebSocketClient, frame *protocol.Typing) {
+	if frame.ConversationID == "" {
+		wc.sendError(c, protocol.ErrorInvalidFrame, "conversation_id is required", "")
+		return
+	}
+	if c.apiToken != nil && !c.apiToken.Allows(auth.ScopeSend, frame.ConversationID) {
+		return
+	}
+	var member bool
+	err := wc.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM conversation_participants
+			WHERE conversation_id = $1 AND user_id = $2
+		)
+	`, frame.ConversationID, c.userID).Scan(&member)
+	if err != nil {
+		log.Printf("Failed to check conversation membership: %v", err)
+		return
+	}
+	if !member {
+		return
+	}
+
+	typing := protocol.UserTyping{
+		Type:           protocol.TypeTyping,
+		ConversationID: frame.ConversationID,
+		UserID:         c.userID,
+		Name:           c.userName,
+		Timestamp:      time.Now(),
+		ID:             uuid.New().String(),
+	}
+	if err := wc.SendToConversation(frame.ConversationID, typing); err != nil {
+		log.Printf("Failed to send typing indicator: %v", err)
+	}
+}
+
+// handleMessage stores a chat message and delivers it. Only the sender's
+// connection gets the temp_id back; the other participants get the message
+// as the server stored it, never fields copied from the frame.
+func (wc *WebSocketController) handleMessage(c *WebSocketClient, frame *protocol.SendMessage) {
+	log.Printf("Message received from %s", c.userID)
+
+	content := frame.Content
+	conversationID := frame.ConversationID
+	recipientID := frame.RecipientID
+	tempID := frame.TempID
+	encrypted := frame.Encrypted
+
+	// Attachments are sent as image/file messages whose encrypted
+	// body carries the attachment pointer
+	contentType := frame.MessageType
+	if contentType == "" {
+		contentType = "text"
+	}
+
+	if content == "" || (conversationID == "" && recipientID == "") {
+		log.Printf("Invalid message data: missing required fields")
+		wc.sendError(c, protocol.ErrorInvalidFrame, "content and conversation_id or recipient_id are required", tempID)
+		return
+	}
+	// Bots may only post to conversations their token allows
+	if c.apiToken != nil && !c.apiToken.Allows(auth.ScopeSend, conversationID) {
+		log.Printf("API token %s does not allow sending to conversation %q", c.apiToken.ID, conversationID)
+		wc.sendError(c, protocol.ErrorForbidden, "API token does not allow send in this conversation", tempID)
+		return
+	}
+	if contentType != "text" && contentType != "image" && contentType != "file" {
+		log.Printf("Invalid message type: %s", contentType)
+		wc.sendError(c, protocol.ErrorInvalidFrame, "message_type must be text, image or file", tempID)
+		return
+	}
+
+	// Slash commands from users are run instead of being stored.
+	// End-to-end encrypted messages can't be read, so they are
+	// never commands.
+	if c.apiToken == nil && !encrypted && contentType == "text" && conversationID != "" {
+		if name, args, ok := commands.Parse(content); ok {
+			wc.inflight.Add(1)
+			go func() {
+				defer wc.inflight.Done()
+				wc.handleCommand(c, conversationID, tempID, name, args)
+			}()
+			return
 		}
+	}
 
-		switch messageType {
-		case "ping":
-			// Handle ping-pong for keepalive
-			log.Printf("Ping received from %s", c.userID)
-			pongResp := map[string]interface{}{
-				"type":      "pong",
-				"timestamp": time.Now(),
-				"id":        uuid.New().String(),
-			}
-			pongJSON, _ := json.Marshal(pongResp)
-			c.send <- pongJSON
+	// Create database message
+	// First ensure we have a valid conversation ID
+	if conversationID == "" && recipientID != "" {
+		// Create consistent conversation ID for direct messages
+		conversationID = createConversationID(c.userID, recipientID)
+		log.Printf("Created conversation ID %s for users %s and %s",
+			conversationID, c.userID, recipientID)
+	}
 
-		case "message":
-			// Handle regular message
-			log.Printf("Message received from %s", c.userID)
+	// Save message to database
+	currentTime := time.Now()
+	stored := &models.Message{
+		ID:             uuid.New().String(),
+		ConversationID: conversationID,
+		SenderID:       c.userID,
+		Content:        content,
+		Encrypted:      encrypted,
+		MessageType:    contentType,
+		Bot:            c.apiToken != nil,
+		CreatedAt:      currentTime,
+		DeliveredAt:    currentTime,
+		Sender:         models.User{ID: c.userID, Name: c.userName, AvatarURL: c.avatarURL},
+	}
+	if err := wc.messageService.CreateMessage(stored); err != nil {
+		log.Printf("Failed to save message to database: %v", err)
+		wc.sendError(c, protocol.ErrorInternal, "Failed to save message", tempID)
+		return
+	}
 
-			// Extract message data
-			content, _ := data["content"].(string)
-			conversationID, _ := data["conversation_id"].(string)
-			recipientID, _ := data["recipient_id"].(string)
-			tempID, _ := data["temp_id"].(string)
+	messageID := stored.ID
+	log.Printf("Message saved to database with ID: %s", messageID)
 
-			if content == "" || (conversationID == "" && recipientID == "") {
-				log.Printf("Invalid message data: missing required fields")
-				continue
+	outbound := messageFrame(stored)
+	payload := protocol.NewPayload(outbound)
+	payloadJSON, err := payload.JSON()
+	if err != nil {
+		log.Printf("Failed to encode message %s: %v", messageID, err)
+		return
+	}
+	confirmation := outbound
+	confirmation.TempID = tempID
+
+	// Directly send the message to the relevant clients
+	// instead of broadcasting to all clients
+	if recipientID != "" {
+		// Send to the recipient if they're connected
+		wc.mu.Lock()
+		sentToRecipient := false
+		if recipients, ok := wc.clients[recipientID]; ok {
+			log.Printf("Sending message directly to recipient: %s", recipientID)
+			for _, recipient := range recipients {
+				if !recipient.canRead(conversationID) {
+					continue
+				}
+				if recipient.enqueue(payload) {
+					log.Printf("Message sent to recipient %s session %s successfully", recipientID, recipient.sessionID)
+					sentToRecipient = true
+				}
 			}
+		} else {
+			log.Printf("Recipient %s is not currently connected, message will be delivered when they connect", recipientID)
+		}
 
-			// Generate a new message ID
-			messageID := uuid.New().String()
+		// Store message delivery status in database
+		_, err := wc.db.Exec(`
+			UPDATE messages 
+			SET delivered = $1, delivered_at = $2
+			WHERE id = $3
+		`, sentToRecipient, currentTime, messageID)
 
-			// Create database message
-			// First ensure we have a valid conversation ID
-			if conversationID == "" && recipientID != "" {
-				// Create consistent conversation ID for direct messages
-				conversationID = createConversationID(c.userID, recipientID)
-				log.Printf("Created conversation ID %s for users %s and %s",
-					conversationID, c.userID, recipientID)
-			}
+		if err != nil {
+			log.Printf("Failed to update message delivery status: %v", err)
+		}
 
-			// Save message to database
-			currentTime := time.Now()
-			_, err := wc.db.Exec(`
-				INSERT INTO messages (
-					id, conversation_id, sender_id, content, 
-					created_at, delivered_at, message_type, encrypted
-				)
-				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-			`,
-				messageID, conversationID, c.userID, content,
-				currentTime, currentTime, "text", false,
-			)
-
-			if err != nil {
-				log.Printf("Failed to save message to database: %v", err)
-				// Send error response to client
-				errorResp := map[string]interface{}{
-					"type":    "error",
-					"message": "Failed to save message",
-					"temp_id": tempID,
-					"id":      uuid.New().String(),
-				}
-				errorJSON, _ := json.Marshal(errorResp)
-				c.send <- errorJSON
+		wc.mu.Unlock()
+
+		// Recipients connected to other nodes get the message
+		// through the backplane; delivered only reflects this node
+		wc.publish(backplane.Event{
+			Kind:           backplane.KindDeliver,
+			ConversationID: conversationID,
+			UserIDs:        []string{recipientID},
+			Payload:        payloadJSON,
+		})
+
+		// Always send confirmation back to the sender
+		wc.sendToClient(c, confirmation)
+	} else {
+		// If no specific recipient (group chat), send to the other
+		// connected participants and confirm to the sender
+		wc.sendToClient(c, confirmation)
+		participantIDs, err := wc.participantIDs(conversationID)
+		if err != nil {
+			log.Printf("Failed to get participants of %s: %v", conversationID, err)
+			return
+		}
+		wc.deliverLocal(conversationID, participantIDs, payload, c)
+		wc.publish(backplane.Event{
+			Kind:           backplane.KindDeliver,
+			ConversationID: conversationID,
+			UserIDs:        participantIDs,
+			Payload:        payloadJSON,
+		})
+	}
+}
+
+// handleCommand runs a slash command sent over the WebSocket. Public replies
+// are delivered to the conversation, ephemeral replies and errors only to
+// the connection that sent the command.
+func (wc *WebSocketController) handleCommand(c *WebSocketClient, conversationID, tempID, name, args string) {
+	sender := models.User{ID: c.userID, Name: c.userName, AvatarURL: c.avatarURL}
+	result, message, err := wc.RunCommand(context.Background(), sender, conversationID, name, args)
+	if err != nil {
+		log.Printf("Command /%s from %s failed: %v", name, c.userID, err)
+		wc.sendError(c, protocol.ErrorCommandFailed, CommandErrorMessage(name, err), tempID)
+		return
+	}
+	if message != nil || result.Text == "" {
+		return
+	}
+
+	frame := protocol.Message{
+		Type:           protocol.TypeMessage,
+		ID:             uuid.New().String(),
+		TempID:         tempID,
+		ConversationID: conversationID,
+		Content:        result.Text,
+		MessageType:    "text",
+		Ephemeral:      true,
+		Bot:            result.Bot != nil,
+		Timestamp:      time.Now(),
+	}
+	if result.Bot != nil {
+		frame.Sender = &protocol.Sender{
+			ID:        result.Bot.ID,
+			Name:      result.Bot.Name,
+			AvatarURL: result.Bot.AvatarURL,
+		}
+	}
+	wc.sendToClient(c, frame)
+}
+
+// RunCommand runs a slash command for the sender. A public reply is stored
+// and delivered to the conversation, as the bot that handled the command or
+// otherwise as the sender, and returned as message. An ephemeral reply is
+// only returned in result, for the caller to show to the sender.
+func (wc *WebSocketController) RunCommand(ctx context.Context, sender models.User, conversationID, name, args string) (result *services.CommandResult, message *models.Message, err error) {
+	result, err = wc.commands.Execute(ctx, commands.Invocation{
+		Name:           name,
+		Args:           args,
+		ConversationID: conversationID,
+		UserID:         sender.ID,
+		UserName:       sender.Name,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.Visibility != commands.Public || result.Text == "" {
+		return result, nil, nil
+	}
+
+	if result.Bot != nil {
+		sender = *result.Bot
+	}
+	now := time.Now()
+	message = &models.Message{
+		ID:             uuid.New().String(),
+		ConversationID: conversationID,
+		SenderID:       sender.ID,
+		Content:        result.Text,
+		MessageType:    "text",
+		Bot:            result.Bot != nil,
+		CreatedAt:      now,
+		DeliveredAt:    now,
+		Sender:         sender,
+	}
+	if err := wc.messageService.CreateMessage(message); err != nil {
+		return nil, nil, err
+	}
+	if err := wc.DeliverMessage(message); err != nil {
+		log.Printf("Failed to deliver message %s: %v", message.ID, err)
+	}
+	return result, message, nil
+}
+
+// CommandErrorMessage is what the user who ran a command is told when it
+// fails
+func CommandErrorMessage(name string, err error) string {
+	switch {
+	case errors.Is(err, services.ErrCommandNotFound):
+		return "Unknown command /" + name + ". Send /help to see the commands you can use here."
+	case errors.Is(err, services.ErrNotParticipant):
+		return "Not a participant of this conversation"
+	case errors.Is(err, services.ErrCommandFailed):
+		return "/" + name + " did not respond. Try again later."
+	default:
+		return "Failed to run /" + name
+	}
+}
+
+// sendError sends an error frame to one connection
+func (wc *WebSocketController) sendError(client *WebSocketClient, code, message, tempID string) {
+	wc.sendToClient(client, protocol.Error{
+		Type:    protocol.TypeError,
+		Code:    code,
+		Message: message,
+		TempID:  tempID,
+		ID:      uuid.New().String(),
+	})
+}
+
+// sendToClient sends a frame to one connection if it is still connected
+func (wc *WebSocketController) sendToClient(client *WebSocketClient, frame any) {
+	payload := protocol.NewPayload(frame)
+
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if wc.clients[client.userID][client.sessionID] != client {
+		return
+	}
+	client.enqueue(payload)
+}
+
+// enqueue queues a payload for the client. A client whose queue fills up
+// with frames that must be delivered is disconnected with CloseSlowConsumer,
+// so it knows to catch up rather than assume it got everything. It returns
+// false if the payload won't be delivered.
+func (c *WebSocketClient) enqueue(payload *protocol.Payload) bool {
+	switch c.send.push(payload) {
+	case pushQueued, pushCoalesced:
+		return true
+	case pushOverflow:
+		log.Printf("Closing connection of %s session %s: too many frames waiting to be sent", c.userID, c.sessionID)
+		// Closing a WebSocket waits for the close frame to be written,
+		// which the client is not reading
+		go c.transport.close(CloseSlowConsumer, "slow consumer")
+	}
+	return false
+}
+
+// SendToConversation delivers a frame to every participant of a conversation
+// that is currently connected
+func (wc *WebSocketController) SendToConversation(conversationID string, frame any) error {
+	payload := protocol.NewPayload(frame)
+	payloadJSON, err := payload.JSON()
+	if err != nil {
+		return err
+	}
+
+	participantIDs, err := wc.participantIDs(conversationID)
+	if err != nil {
+		return err
+	}
+
+	wc.deliverLocal(conversationID, participantIDs, payload, nil)
+	wc.publish(backplane.Event{
+		Kind:           backplane.KindDeliver,
+		ConversationID: conversationID,
+		UserIDs:        participantIDs,
+		Payload:        payloadJSON,
+	})
+	return nil
+}
+
+// participantIDs returns the users in a conversation
+func (wc *WebSocketController) participantIDs(conversationID string) ([]string, error) {
+	rows, err := wc.db.Query(`
+		SELECT user_id
+		FROM conversation_participants
+		WHERE conversation_id = $1
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var participantIDs []string
+	for rows.Next() {
+		var participantID string
+		if err := rows.Scan(&participantID); err != nil {
+			return nil, err
+		}
+		participantIDs = append(participantIDs, participantID)
+	}
+	return participantIDs, rows.Err()
+}
+
+// deliverLocal sends a payload to the clients of the users connected to this
+// node that can read the conversation, except skip
+func (wc *WebSocketController) deliverLocal(conversationID string, userIDs []string, payload *protocol.Payload, skip *WebSocketClient) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	for _, userID := range userIDs {
+		for _, client := range wc.clients[userID] {
+			if client == skip || !client.canRead(conversationID) {
 				continue
 			}
+			client.enqueue(payload)
+		}
+	}
+}
 
-			log.Printf("Message saved to database with ID: %s", messageID)
+// publish hands an event to the other nodes
+func (wc *WebSocketController) publish(event backplane.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := wc.backplane.Publish(ctx, event); err != nil {
+		log.Printf("Failed to publish %s event to other nodes: %v", event.Kind, err)
+	}
+}
 
-			// Add metadata
-			data["id"] = messageID
-			data["timestamp"] = currentTime
-			data["sender"] = map[string]interface{}{
-				"id":        c.userID,
-				"name":      c.userName,
-				"avatarUrl": c.avatarURL,
+// receive applies an event published by another node to the clients
+// connected to this one
+func (wc *WebSocketController) receive(event backplane.Event) {
+	switch event.Kind {
+	case backplane.KindDeliver:
+		// Frames are sent between nodes as JSON and only re-encoded for
+		// clients using another codec
+		payload := protocol.RawPayload(event.Payload)
+		// Only announcements to everyone are sent without recipients
+		if len(event.UserIDs) == 0 {
+			select {
+			case wc.broadcast <- payload:
+			case <-wc.quit:
 			}
-			data["conversation_id"] = conversationID
-
-			respJSON, _ := json.Marshal(data)
-
-			// Directly send the message to the relevant clients
-			// instead of broadcasting to all clients
-			if recipientID != "" {
-				// Send to the recipient if they're connected
-				wc.mu.Lock()
-				sentToRecipient := false
-				if recipient, ok := wc.clients[recipientID]; ok {
-					log.Printf("Sending message directly to recipient: %s", recipientID)
-					select {
-					case recipient.send <- respJSON:
-						log.Printf("Message sent to recipient %s successfully", recipientID)
-						sentToRecipient = true
-					default:
-						log.Printf("Failed to send message to recipient %s, channel might be full", recipientID)
-					}
-				} else {
-					log.Printf("Recipient %s is not currently connected, message will be delivered when they connect", recipientID)
-				}
+			return
+		}
+		wc.deliverLocal(event.ConversationID, event.UserIDs, payload, nil)
+	case backplane.KindDisconnect:
+		// Nodes that predate close codes only sent revocations
+		code := event.CloseCode
+		if code == 0 {
+			code = CloseSessionRevoked
+		}
+		wc.disconnectLocal(code, event.SessionIDs)
+	case backplane.KindListSessions:
+		wc.answerSessions(event.RequestID)
+	case backplane.KindSessions:
+		wc.collectSessions(event)
+	default:
+		log.Printf("Unknown backplane event kind: %s", event.Kind)
+	}
+}
 
-				// Debug info about current connections
-				connectedClients := make([]string, 0, len(wc.clients))
-				for clientID := range wc.clients {
-					connectedClients = append(connectedClients, clientID)
-				}
-				log.Printf("Current connected clients: %v", connectedClients)
+// DeliverMessage sends a message stored outside the WebSocket, such as one
+// posted over REST, to the connected participants of its conversation in the
+// same shape as messages sent over the WebSocket
+func (wc *WebSocketController) DeliverMessage(message *models.Message) error {
+	return wc.SendToConversation(message.ConversationID, messageFrame(message))
+}
 
-				// Store message delivery status in database
-				_, err = wc.db.Exec(`
-					UPDATE messages 
-					SET delivered = $1, delivered_at = $2
-					WHERE id = $3
-				`, sentToRecipient, currentTime, messageID)
+// messageFrame is the frame a stored message is delivered in
+func messageFrame(message *models.Message) protocol.Message {
+	return protocol.Message{
+		Type:           protocol.TypeMessage,
+		ID:             message.ID,
+		ConversationID: message.ConversationID,
+		Content:        message.Content,
+		Encrypted:      message.Encrypted,
+		MessageType:    message.MessageType,
+		Bot:            message.Bot,
+		DisplayName:    message.DisplayName,
+		Sender: &protocol.Sender{
+			ID:        message.Sender.ID,
+			Name:      message.Sender.Name,
+			AvatarURL: message.Sender.AvatarURL,
+		},
+		Timestamp: message.CreatedAt,
+	}
+}
 
-				if err != nil {
-					log.Printf("Failed to update message delivery status: %v", err)
-				}
+// DisconnectSessions closes every connection belonging to the given sessions
+// with CloseSessionRevoked, on every node. The read pumps unregister the
+// clients once the connections are closed.
+func (wc *WebSocketController) DisconnectSessions(sessionIDs ...string) {
+	wc.disconnect(CloseSessionRevoked, sessionIDs)
+}
 
-				wc.mu.Unlock()
+// disconnect closes the connections of the sessions with code on every node
+func (wc *WebSocketController) disconnect(code int, sessionIDs []string) {
+	wc.disconnectLocal(code, sessionIDs)
+	wc.publish(backplane.Event{
+		Kind:       backplane.KindDisconnect,
+		SessionIDs: sessionIDs,
+		CloseCode:  code,
+	})
+}
 
-				// Always send confirmation back to the sender
-				select {
-				case c.send <- respJSON:
-					log.Printf("Message confirmation sent to sender %s", c.userID)
-				default:
-					log.Printf("Failed to send confirmation to sender %s", c.userID)
-				}
-			} else {
-				// If no specific recipient (group chat), broadcast to all
-				log.Printf("Broadcasting message to all clients (group chat)")
-				wc.broadcast <- respJSON
+// disconnectLocal closes the connections of the sessions on this node
+func (wc *WebSocketController) disconnectLocal(code int, sessionIDs []string) {
+	revoked := make(map[string]bool, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		revoked[sessionID] = true
+	}
+
+	wc.mu.Lock()
+	var clients []*WebSocketClient
+	for _, userClients := range wc.clients {
+		for sessionID, client := range userClients {
+			if revoked[sessionID] {
+				clients = append(clients, client)
 			}
+		}
+	}
+	wc.mu.Unlock()
+
+	for _, client := range clients {
+		log.Printf("Closing connection for session %s of user %s: %s", client.sessionID, client.userID, closeReasons[code])
+		client.transport.close(code, closeReasons[code])
+	}
+}
+
+// maxPresenceUsers caps how many users one presence request can ask about
+const maxPresenceUsers = 100
+
+// GetPresence reports which of the comma separated ?user_ids are connected
+// to any node
+func (wc *WebSocketController) GetPresence(c *gin.Context) {
+	var userIDs []string
+	for _, userID := range strings.Split(c.Query("user_ids"), ",") {
+		if userID = strings.TrimSpace(userID); userID != "" {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	if len(userIDs) == 0 || len(userIDs) > maxPresenceUsers {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_ids must list 1 to 100 user IDs"})
+		return
+	}
+
+	online, err := wc.presence.Online(c.Request.Context(), userIDs)
+	if err != nil {
+		log.Printf("Failed to get presence: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get presence"})
+		return
+	}
+	c.JSON(http.StatusOK, online)
+}
+
+// GetProtocolSchema serves the JSON Schema of the WebSocket protocol
+func (wc *WebSocketController) GetProtocolSchema(c *gin.Context) {
+	c.JSON(http.StatusOK, protocol.Schema())
+}
+
+// Drain prepares the hub for shutdown. New connections and frames are
+// refused, every client is sent a reconnect frame telling it to reconnect
+// after retryAfter plus some jitter, presumably to another node, and Drain
+// waits until the frames already being handled have been stored.
+func (wc *WebSocketController) Drain(ctx context.Context, retryAfter time.Duration) error {
+	wc.mu.Lock()
+	wc.draining = true
+	var clients []*WebSocketClient
+	for _, userClients := range wc.clients {
+		for _, client := range userClients {
+			clients = append(clients, client)
+		}
+	}
+	wc.mu.Unlock()
+
+	log.Printf("Draining %d WebSocket connections", len(clients))
+	for _, client := range clients {
+		wc.sendToClient(client, reconnectFrame(retryAfter))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wc.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-		default:
-			log.Printf("Unknown message type: %s", messageType)
+// reconnectFrame tells a client to reconnect after retryAfter plus jitter
+func reconnectFrame(retryAfter time.Duration) protocol.Reconnect {
+	delay := retryAfter + time.Duration(rand.Int63n(int64(maxReconnectJitter)))
+	return protocol.Reconnect{
+		Type:         protocol.TypeReconnect,
+		RetryAfterMS: delay.Milliseconds(),
+		Timestamp:    time.Now(),
+		ID:           uuid.New().String(),
+	}
+}
+
+// Stop closes every connection with CloseServiceRestart once its queued
+// frames are written and stops the hub. Connections still open when ctx is
+// done are cut. Stopping a stopped hub does nothing.
+func (wc *WebSocketController) Stop(ctx context.Context) error {
+	wc.mu.Lock()
+	if wc.stopped {
+		wc.mu.Unlock()
+		return nil
+	}
+	wc.stopped = true
+	wc.draining = true
+	var clients []*WebSocketClient
+	for _, userClients := range wc.clients {
+		for _, client := range userClients {
+			clients = append(clients, client)
 		}
 	}
+	for _, client := range clients {
+		wc.removeClient(client)
+	}
+	wc.mu.Unlock()
+	close(wc.quit)
+
+	for _, client := range clients {
+		client.closeCode.Store(websocket.CloseServiceRestart)
+		client.send.close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wc.writers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, client := range clients {
+			client.transport.abort()
+		}
+		return ctx.Err()
+	}
+}
+
+// removeClient drops a client from the connection map if it is still the
+// registered connection for its session. The caller must hold wc.mu.
+func (wc *WebSocketController) removeClient(client *WebSocketClient) bool {
+	userClients, ok := wc.clients[client.userID]
+	if !ok || userClients[client.sessionID] != client {
+		return false
+	}
+	delete(userClients, client.sessionID)
+	delete(wc.connections, client.id)
+	if len(userClients) == 0 {
+		delete(wc.clients, client.userID)
+	}
+	return true
 }
 
 // Helper function to create consistent conversation IDs for direct messages
@@ -0,0 +1,415 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/backplane"
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/protocol"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func TestSessionCookieRequiresFrontendOrigin(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, nil, tokens, testSessions{"s1": true}, func(socket *SocketOptions) {
+		socket.AllowedOrigins = []string{"https://chat.example.com"}
+	})
+	r := gin.New()
+	r.GET("/ws", wc.HandleWebSocket)
+	r.GET("/api/v1/stream/events", wc.HandleEvents)
+	r.GET("/api/v1/stream/poll", wc.HandlePoll)
+	r.POST("/api/v1/stream/frames", wc.PostFrame)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	token := accessToken(t, tokens, "u1", "s1")
+	cookie := (&http.Cookie{Name: auth.AccessTokenCookie, Value: token}).String()
+
+	conn := dialWebSocket(t, server, "", http.Header{"Cookie": {cookie}, "Origin": {"https://chat.example.com"}})
+	conn.Close()
+	conn = dialWebSocket(t, server, "", http.Header{"Cookie": {cookie}, "Sec-Fetch-Site": {"same-origin"}})
+	conn.Close()
+
+	// Another site can't borrow the cookie, but a token it was given works
+	// from anywhere
+	for name, header := range map[string]http.Header{
+		"other origin":  {"Cookie": {cookie}, "Origin": {"https://evil.example.com"}},
+		"no origin":     {"Cookie": {cookie}},
+		"cross-site":    {"Cookie": {cookie}, "Sec-Fetch-Site": {"cross-site"}},
+		"origin prefix": {"Cookie": {cookie}, "Origin": {"https://chat.example.com.evil.com"}},
+	} {
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", header)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: WebSocket was not refused with 403 (%v)", name, err)
+		}
+	}
+	conn = dialWebSocket(t, server, "token="+token, http.Header{"Origin": {"https://evil.example.com"}})
+	conn.Close()
+
+	for _, target := range []struct{ method, path string }{
+		{http.MethodGet, "/api/v1/stream/events"},
+		{http.MethodGet, "/api/v1/stream/poll"},
+		{http.MethodPost, "/api/v1/stream/frames"},
+	} {
+		req := httptest.NewRequest(target.method, target.path, nil)
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set("Origin", "https://evil.example.com")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s from another origin: status %d, want 403", target.method, target.path, w.Code)
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, nil, tokens, testSessions{"s1": true, "s2": true}, nil)
+	r := gin.New()
+	r.GET("/ws", wc.HandleWebSocket)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	conn := dialWebSocket(t, server, "token="+accessToken(t, tokens, "u1", "s1"), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := wc.Drain(ctx, time.Second); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+
+	var reconnect protocol.Reconnect
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&reconnect); err != nil {
+		t.Fatal(err)
+	}
+	if reconnect.Type != protocol.TypeReconnect {
+		t.Fatalf("frame type = %q, want reconnect", reconnect.Type)
+	}
+	// The hint is the delay plus up to maxReconnectJitter
+	if reconnect.RetryAfterMS < 1000 || reconnect.RetryAfterMS >= 1000+maxReconnectJitter.Milliseconds() {
+		t.Errorf("retry_after_ms = %d, want within the jitter of 1000", reconnect.RetryAfterMS)
+	}
+
+	// Frames sent while draining are refused so the client sends them again
+	if err := conn.WriteJSON(map[string]string{"type": protocol.TypePing, "temp_id": "t1"}); err != nil {
+		t.Fatal(err)
+	}
+	var refused protocol.Error
+	if err := conn.ReadJSON(&refused); err != nil {
+		t.Fatal(err)
+	}
+	if refused.Code != protocol.ErrorShuttingDown || refused.TempID != "t1" {
+		t.Errorf("frame = %+v, want a shutting_down error for t1", refused)
+	}
+
+	// So are new connections
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?token="+accessToken(t, tokens, "u1", "s2"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("connection while draining was not refused with 503 (%v)", err)
+	}
+
+	if err := wc.Stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	expectClose(t, conn, websocket.CloseServiceRestart)
+	// Stopping again does nothing
+	if err := wc.Stop(ctx); err != nil {
+		t.Errorf("second stop: %v", err)
+	}
+}
+
+func TestDrainWaitsForFramesInFlight(t *testing.T) {
+	wc := newTestWebSocketController(t, nil, newTestTokenManager(t), testSessions{}, nil)
+	if !wc.beginFrame() {
+		t.Fatal("frame refused before draining")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := wc.Drain(ctx, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("drain with a frame in flight = %v, want deadline exceeded", err)
+	}
+	if wc.beginFrame() {
+		t.Error("frame accepted while draining")
+	}
+
+	wc.inflight.Done()
+	if err := wc.Drain(context.Background(), 0); err != nil {
+		t.Errorf("drain: %v", err)
+	}
+}
+
+func TestProtocolVersionAndFrames(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, nil, tokens, testSessions{"s1": true}, nil)
+	r := gin.New()
+	r.GET("/ws", wc.HandleWebSocket)
+	r.GET("/api/v1/protocol/schema", wc.GetProtocolSchema)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	token := accessToken(t, tokens, "u1", "s1")
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?version=99&token="+token, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unsupported version was not refused with 400 (%v)", err)
+	}
+
+	conn := dialWebSocket(t, server, "version=99,1&token="+token, nil)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Pings have no temp_id field
+	for _, frame := range []string{
+		`{"type":"ping","temp_id":"t1"}`,
+		`{"type":"message","temp_id":"t2","content":"hi","contnet":"typo"}`,
+		`{"type":"reaction","temp_id":"t3"}`,
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		var refused protocol.Error
+		if err := conn.ReadJSON(&refused); err != nil {
+			t.Fatal(err)
+		}
+		header := protocol.ReadHeader([]byte(frame))
+		if refused.Type != protocol.TypeError || refused.Code != protocol.ErrorInvalidFrame || refused.TempID != header.TempID {
+			t.Errorf("%s: frame = %+v, want invalid_frame for %s", frame, refused, header.TempID)
+		}
+	}
+
+	w := serve(t, r, http.MethodGet, "/api/v1/protocol/schema", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("schema: status %d, want 200", w.Code)
+	}
+	var schema map[string]interface{}
+	decodeJSON(t, w, &schema)
+	if schema["version"] != float64(protocol.CurrentVersion) {
+		t.Errorf("schema version = %v, want %d", schema["version"], protocol.CurrentVersion)
+	}
+}
+
+func TestSubprotocols(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, nil, tokens, testSessions{"s1": true}, nil)
+	r := gin.New()
+	r.GET("/ws", wc.HandleWebSocket)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?token=" + accessToken(t, tokens, "u1", "s1")
+
+	dialer := websocket.Dialer{Subprotocols: []string{"nwa.json.v2"}}
+	if _, resp, err := dialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unsupported subprotocol was not refused with 400 (%v)", err)
+	}
+
+	dialer = websocket.Dialer{Subprotocols: []string{"chat", "nwa.msgpack.v1", "nwa.json.v1"}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "nwa.msgpack.v1" {
+		t.Fatalf("subprotocol = %q, want nwa.msgpack.v1", conn.Subprotocol())
+	}
+
+	// Frames go both ways as MessagePack binary messages
+	read := func() protocol.Header {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != websocket.BinaryMessage {
+			t.Fatalf("message kind = %d, want binary", kind)
+		}
+		return protocol.MessagePack.Header(data)
+	}
+	if header := read(); header.Type != protocol.TypeConnected {
+		t.Fatalf("first frame = %+v, want connected", header)
+	}
+	ping, err := protocol.MessagePack.Encode(protocol.Ping{Type: protocol.TypePing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, ping); err != nil {
+		t.Fatal(err)
+	}
+	if header := read(); header.Type != protocol.TypePong {
+		t.Errorf("frame = %+v, want pong", header)
+	}
+}
+
+func TestReadLimitAppliesToInflatedFrames(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, nil, tokens, testSessions{"s1": true}, func(socket *SocketOptions) {
+		socket.Compression = true
+		socket.ReadLimits = map[string]int{protocol.TypePing: 64, protocol.TypeMessage: 4096}
+	})
+	r := gin.New()
+	r.GET("/ws", wc.HandleWebSocket)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?token=" + accessToken(t, tokens, "u1", "s1")
+
+	dial := func(compression bool) *websocket.Conn {
+		t.Helper()
+		dialer := websocket.Dialer{EnableCompression: compression}
+		conn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var connected protocol.Connected
+		if err := conn.ReadJSON(&connected); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// Frames over their type's limit but within the largest are answered
+	conn := dial(true)
+	ping := `{"type":"ping","timestamp":"` + time.Now().Format(time.RFC3339Nano) + `"}` + strings.Repeat(" ", 100)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(ping)); err != nil {
+		t.Fatal(err)
+	}
+	var refused protocol.Error
+	if err := conn.ReadJSON(&refused); err != nil {
+		t.Fatal(err)
+	}
+	if refused.Code != protocol.ErrorFrameTooLarge {
+		t.Errorf("frame = %+v, want frame_too_large", refused)
+	}
+
+	// A frame that compresses far below the limit is still measured inflated.
+	// The server closes the connection without reading the rest of a frame
+	// that is too big, so writing it may fail.
+	conn.EnableWriteCompression(true)
+	bomb := `{"type":"message","content":"` + strings.Repeat("a", 1<<20) + `"}`
+	go conn.WriteMessage(websocket.TextMessage, []byte(bomb))
+	expectClose(t, conn, websocket.CloseMessageTooBig)
+
+	conn = dial(false)
+	go conn.WriteMessage(websocket.TextMessage, []byte(bomb))
+	expectClose(t, conn, websocket.CloseMessageTooBig)
+}
+
+// expectPong pings conn and checks the next frame is the pong, so no other
+// frame was queued before it
+func expectPong(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	if err := conn.WriteJSON(map[string]string{"type": protocol.TypePing}); err != nil {
+		t.Fatal(err)
+	}
+	var frame map[string]interface{}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame["type"] != protocol.TypePong {
+		t.Errorf("frame = %v, want pong", frame)
+	}
+}
+
+func TestGroupMessagesReachOnlyParticipants(t *testing.T) {
+	db := dbtest.Open(t)
+	f := newConversationFixture(t, db)
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, db, tokens, testSessions{"s1": true, "s2": true, "s3": true}, nil)
+	r := gin.New()
+	r.GET("/ws", wc.HandleWebSocket)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	published := &recordingBackplane{Backplane: wc.backplane, events: make(chan backplane.Event, 1)}
+	wc.backplane = published
+	alice := dialWebSocket(t, server, "token="+accessToken(t, tokens, f.alice, "s1"), nil)
+	bob := dialWebSocket(t, server, "token="+accessToken(t, tokens, f.bob, "s2"), nil)
+	eve := dialWebSocket(t, server, "token="+accessToken(t, tokens, f.eve, "s3"), nil)
+
+	if err := alice.WriteJSON(protocol.SendMessage{Type: protocol.TypeMessage, ConversationID: f.conversation, Content: "hi", TempID: "t1"}); err != nil {
+		t.Fatal(err)
+	}
+	var confirmation protocol.Message
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := alice.ReadJSON(&confirmation); err != nil {
+		t.Fatal(err)
+	}
+	if confirmation.Type != protocol.TypeMessage || confirmation.TempID != "t1" {
+		t.Fatalf("sender got %+v, want the confirmation of t1", confirmation)
+	}
+	// The sender's own connection only gets the confirmation
+	expectPong(t, alice)
+
+	var message protocol.Message
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := bob.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message.ID != confirmation.ID || message.Content != "hi" || message.TempID != "" {
+		t.Errorf("participant got %+v, want the message", message)
+	}
+	expectPong(t, eve)
+
+	// Other nodes are told who the recipients are
+	select {
+	case event := <-published.events:
+		if len(event.UserIDs) != 2 || event.ConversationID != f.conversation {
+			t.Errorf("published %+v, want the message for alice and bob", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not published to other nodes")
+	}
+}
+
+// recordingBackplane passes events on to Backplane and to events
+type recordingBackplane struct {
+	backplane.Backplane
+	events chan backplane.Event
+}
+
+func (b *recordingBackplane) Publish(ctx context.Context, event backplane.Event) error {
+	select {
+	case b.events <- event:
+	default:
+	}
+	return b.Backplane.Publish(ctx, event)
+}
+
+func TestReceiveDeliversToRecipients(t *testing.T) {
+	tokens := newTestTokenManager(t)
+	wc := newTestWebSocketController(t, nil, tokens, testSessions{"s1": true, "s2": true}, nil)
+	r := gin.New()
+	r.GET("/ws", wc.HandleWebSocket)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	recipient := dialWebSocket(t, server, "token="+accessToken(t, tokens, "u1", "s1"), nil)
+	other := dialWebSocket(t, server, "token="+accessToken(t, tokens, "u2", "s2"), nil)
+	for len(wc.Sessions()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	wc.receive(backplane.Event{
+		Kind:           backplane.KindDeliver,
+		ConversationID: "c1",
+		UserIDs:        []string{"u1"},
+		Payload:        []byte(`{"type":"message","id":"m1","conversation_id":"c1","content":"hi"}`),
+	})
+	var message protocol.Message
+	recipient.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := recipient.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message.ID != "m1" {
+		t.Errorf("recipient got %+v, want m1", message)
+	}
+	expectPong(t, other)
+}
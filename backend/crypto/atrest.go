@@ -0,0 +1,218 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Message content that is not end-to-end encrypted is sealed at rest with a
+// per-conversation data encryption key (DEK). DEKs are stored wrapped by a
+// master key, so rotating the master key only rewraps DEKs and never touches
+// message rows. Sealed content is stored as
+//
+//	nwa:v1:base64(nonce || AES-256-GCM ciphertext)
+//
+// with the conversation and message IDs as additional data, so ciphertext
+// can't be moved between rows. The prefix only versions the format: plaintext
+// can start with it too, so whether a value is sealed is stored alongside it.
+const (
+	sealedContentPrefix = "nwa:v1:"
+	// DataKeySize is the size of a data encryption key
+	DataKeySize = 32
+	// MasterKeySize is the size of a master key
+	MasterKeySize = 32
+)
+
+var (
+	// ErrUnknownMasterKey is returned when a DEK was wrapped by a master key
+	// that is not in the keyring
+	ErrUnknownMasterKey = errors.New("unknown master key")
+	// ErrContentCorrupt is returned when sealed content fails authentication
+	ErrContentCorrupt = errors.New("sealed content is corrupt")
+)
+
+// MasterKey is a named key used to wrap data encryption keys
+type MasterKey struct {
+	ID  string
+	Key []byte
+}
+
+// Keyring holds every master key that may still wrap a DEK. The first key is
+// the primary and is used for all new wraps.
+type Keyring struct {
+	keys []MasterKey
+}
+
+// ParseKeyring parses master keys in the form "id:base64key", separated by
+// commas or newlines. The first key is the primary.
+func ParseKeyring(spec string) (*Keyring, error) {
+	keyring := &Keyring{}
+	seen := make(map[string]bool)
+
+	fields := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(field, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("master key %q must be in the form id:base64key", field)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("master key %s is not valid base64: %v", id, err)
+		}
+		if len(key) != MasterKeySize {
+			return nil, fmt.Errorf("master key %s must be %d bytes", id, MasterKeySize)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("master key %s is defined twice", id)
+		}
+		seen[id] = true
+
+		keyring.keys = append(keyring.keys, MasterKey{ID: id, Key: key})
+	}
+
+	if len(keyring.keys) == 0 {
+		return nil, errors.New("no master keys configured")
+	}
+	return keyring, nil
+}
+
+// LoadKeyring reads master keys from spec, or from keyFile when spec is empty.
+// It returns nil when neither is set.
+func LoadKeyring(spec, keyFile string) (*Keyring, error) {
+	if spec == "" && keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading master key file: %v", err)
+		}
+		spec = string(data)
+	}
+	if spec == "" {
+		return nil, nil
+	}
+	return ParseKeyring(spec)
+}
+
+// Primary returns the master key new DEKs are wrapped with
+func (k *Keyring) Primary() MasterKey {
+	return k.keys[0]
+}
+
+// Len returns the number of master keys in the keyring
+func (k *Keyring) Len() int {
+	return len(k.keys)
+}
+
+func (k *Keyring) lookup(id string) (MasterKey, error) {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return MasterKey{}, fmt.Errorf("%w: %s", ErrUnknownMasterKey, id)
+}
+
+// NewDataKey returns a fresh random data encryption key
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapDataKey encrypts a DEK under the primary master key. The context binds
+// the wrapped key to its owner, e.g. a conversation ID.
+func (k *Keyring) WrapDataKey(dek []byte, context string) (string, []byte, error) {
+	primary := k.Primary()
+	wrapped, err := seal(primary.Key, dek, []byte("dek:"+context))
+	if err != nil {
+		return "", nil, err
+	}
+	return primary.ID, wrapped, nil
+}
+
+// UnwrapDataKey decrypts a DEK wrapped by the named master key
+func (k *Keyring) UnwrapDataKey(masterKeyID string, wrapped []byte, context string) ([]byte, error) {
+	master, err := k.lookup(masterKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return open(master.Key, wrapped, []byte("dek:"+context))
+}
+
+// SealContent encrypts message content with a DEK
+func SealContent(dek []byte, plaintext, context string) (string, error) {
+	sealed, err := seal(dek, []byte(plaintext), []byte(context))
+	if err != nil {
+		return "", err
+	}
+	return sealedContentPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenContent decrypts content produced by SealContent
+func OpenContent(dek []byte, content, context string) (string, error) {
+	encoded, ok := strings.CutPrefix(content, sealedContentPrefix)
+	if !ok {
+		return "", ErrContentCorrupt
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrContentCorrupt
+	}
+	plaintext, err := open(dek, sealed, []byte(context))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrContentCorrupt
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, ErrContentCorrupt
+	}
+	return plaintext, nil
+}
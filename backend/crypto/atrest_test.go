@@ -0,0 +1,73 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSealContent(t *testing.T) {
+	dek, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := SealContent(dek, "hello", "c1/m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, sealedContentPrefix) || strings.Contains(sealed, "hello") {
+		t.Fatalf("sealed content = %q", sealed)
+	}
+	if got, err := OpenContent(dek, sealed, "c1/m1"); err != nil || got != "hello" {
+		t.Fatalf("OpenContent = %q, %v", got, err)
+	}
+
+	if _, err := OpenContent(dek, sealed, "c1/m2"); !errors.Is(err, ErrContentCorrupt) {
+		t.Errorf("moved to another message: err = %v, want ErrContentCorrupt", err)
+	}
+	for _, content := range []string{"hello", sealedContentPrefix + "not base64!", sealedContentPrefix} {
+		if _, err := OpenContent(dek, content, "c1/m1"); !errors.Is(err, ErrContentCorrupt) {
+			t.Errorf("OpenContent(%q): err = %v, want ErrContentCorrupt", content, err)
+		}
+	}
+}
+
+func TestKeyringWrapsDataKeys(t *testing.T) {
+	key := func(b byte) string {
+		return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), MasterKeySize)))
+	}
+	old, err := ParseKeyring("old:" + key('o'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dek, _ := NewDataKey()
+	masterKeyID, wrapped, err := old.WrapDataKey(dek, "c1")
+	if err != nil || masterKeyID != "old" {
+		t.Fatalf("WrapDataKey = %q, %v", masterKeyID, err)
+	}
+
+	rotated, err := ParseKeyring("new:" + key('n') + ",old:" + key('o'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Primary().ID != "new" {
+		t.Errorf("primary = %q, want new", rotated.Primary().ID)
+	}
+	if got, err := rotated.UnwrapDataKey(masterKeyID, wrapped, "c1"); err != nil || string(got) != string(dek) {
+		t.Fatalf("UnwrapDataKey after rotation = %v", err)
+	}
+	if _, err := rotated.UnwrapDataKey(masterKeyID, wrapped, "c2"); !errors.Is(err, ErrContentCorrupt) {
+		t.Errorf("unwrap for another conversation: err = %v, want ErrContentCorrupt", err)
+	}
+	if _, err := rotated.UnwrapDataKey("gone", wrapped, "c1"); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("unknown master key: err = %v, want ErrUnknownMasterKey", err)
+	}
+
+	for _, spec := range []string{"", "nokey", "short:" + base64.StdEncoding.EncodeToString([]byte("x")), "a:" + key('a') + ",a:" + key('b')} {
+		if _, err := ParseKeyring(spec); err == nil {
+			t.Errorf("ParseKeyring(%q) accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+// Attachments are encrypted on the client with a random per-file key before
+// upload, so the server only ever stores ciphertext. The ciphertext is split
+// into segments that are sealed independently with AES-256-GCM, which lets
+// both sides stream files of any size:
+//
+//	header:  version (1 byte) || nonce prefix (7 bytes)
+//	segment: AES-GCM(key, nonce, plaintext chunk), at most 64 KiB of plaintext
+//	nonce:   nonce prefix || segment counter (4 bytes) || last segment flag (1 byte)
+//
+// The last segment flag stops an attacker from truncating the file at a
+// segment boundary. The SHA-256 of the whole ciphertext is the attachment
+// digest; the key and digest travel inside the encrypted message body and the
+// server verifies the digest and size on upload without learning the content.
+const (
+	// AttachmentKeySize is the size of a per-file attachment key
+	AttachmentKeySize = 32
+	// AttachmentSegmentSize is the amount of plaintext sealed per segment
+	AttachmentSegmentSize = 64 * 1024
+
+	attachmentVersion     = 1
+	attachmentNoncePrefix = 7
+	attachmentHeaderSize  = 1 + attachmentNoncePrefix
+	attachmentTagSize     = 16
+)
+
+var (
+	// ErrInvalidAttachmentKey is returned for keys of the wrong size
+	ErrInvalidAttachmentKey = errors.New("attachment key must be 32 bytes")
+	// ErrAttachmentCorrupt is returned when ciphertext fails authentication
+	ErrAttachmentCorrupt = errors.New("attachment ciphertext is corrupt or truncated")
+)
+
+// NewAttachmentKey returns a fresh random attachment key
+func NewAttachmentKey() ([]byte, error) {
+	key := make([]byte, AttachmentKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// AttachmentCiphertextSize returns the encrypted size of a plaintext of the
+// given size
+func AttachmentCiphertextSize(plaintextSize int64) int64 {
+	segments := plaintextSize / AttachmentSegmentSize
+	if plaintextSize%AttachmentSegmentSize != 0 || plaintextSize == 0 {
+		segments++
+	}
+	return attachmentHeaderSize + plaintextSize + segments*attachmentTagSize
+}
+
+func newAttachmentAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != AttachmentKeySize {
+		return nil, ErrInvalidAttachmentKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// attachmentWriter encrypts everything written to it
+type attachmentWriter struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+// NewAttachmentWriter returns a writer that encrypts to dst. Close must be
+// called to seal the final segment.
+func NewAttachmentWriter(dst io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newAttachmentAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, attachmentHeaderSize)
+	header[0] = attachmentVersion
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &attachmentWriter{
+		dst:    dst,
+		aead:   aead,
+		prefix: header[1:],
+		buf:    make([]byte, 0, AttachmentSegmentSize),
+	}, nil
+}
+
+func (w *attachmentWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed attachment writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// Only flush a full segment once more data arrives, so the final
+		// segment is always sealed by Close with the last flag set
+		if len(w.buf) == AttachmentSegmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.buf[len(w.buf):AttachmentSegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *attachmentWriter) seal(last bool) error {
+	if w.counter == ^uint32(0) {
+		return errors.New("attachment too large")
+	}
+
+	sealed := w.aead.Seal(nil, segmentNonce(w.prefix, w.counter, last), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+
+	_, err := w.dst.Write(sealed)
+	return err
+}
+
+func (w *attachmentWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+// attachmentReader decrypts a ciphertext stream
+type attachmentReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	// next holds ciphertext read ahead to find out whether the current
+	// segment is the last one
+	next  []byte
+	plain []byte
+	done  bool
+}
+
+// NewAttachmentReader returns a reader that decrypts src. Reads fail with
+// ErrAttachmentCorrupt if the ciphertext was modified or truncated.
+func NewAttachmentReader(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAttachmentAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, attachmentHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, ErrAttachmentCorrupt
+	}
+	if header[0] != attachmentVersion {
+		return nil, errors.New("unsupported attachment version")
+	}
+
+	r := &attachmentReader{
+		src:    src,
+		aead:   aead,
+		prefix: header[1:],
+	}
+	if err := r.fill(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// fill reads the next full ciphertext segment into r.next
+func (r *attachmentReader) fill() error {
+	buf := make([]byte, AttachmentSegmentSize+attachmentTagSize)
+	n, err := io.ReadFull(r.src, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	r.next = buf[:n]
+	return nil
+}
+
+func (r *attachmentReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		segment := r.next
+		if len(segment) < attachmentTagSize {
+			return 0, ErrAttachmentCorrupt
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+		last := len(r.next) == 0
+
+		plain, err := r.aead.Open(nil, segmentNonce(r.prefix, r.counter, last), segment, nil)
+		if err != nil {
+			return 0, ErrAttachmentCorrupt
+		}
+		r.counter++
+		r.plain = plain
+		r.done = last
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// EncryptAttachment encrypts src into dst and returns the ciphertext size and
+// its SHA-256 digest
+func EncryptAttachment(dst io.Writer, src io.Reader, key []byte) (int64, []byte, error) {
+	digest := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(dst, digest)}
+
+	w, err := NewAttachmentWriter(counter, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return 0, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, nil, err
+	}
+	return counter.n, digest.Sum(nil), nil
+}
+
+// DecryptAttachment decrypts src into dst. Every segment is authenticated as
+// it is decrypted and the ciphertext digest is checked once the stream ends,
+// so callers should discard dst on error.
+func DecryptAttachment(dst io.Writer, src io.Reader, key, expectedDigest []byte) error {
+	digest := sha256.New()
+	r, err := NewAttachmentReader(io.TeeReader(src, digest), key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		return err
+	}
+	return checkDigest(digest, expectedDigest)
+}
+
+func checkDigest(h hash.Hash, expected []byte) error {
+	if subtle.ConstantTimeCompare(h.Sum(nil), expected) != 1 {
+		return ErrAttachmentCorrupt
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func encryptTestAttachment(t *testing.T, plaintext, key []byte) ([]byte, []byte) {
+	t.Helper()
+	var ciphertext bytes.Buffer
+	size, digest, err := EncryptAttachment(&ciphertext, bytes.NewReader(plaintext), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(ciphertext.Len()) {
+		t.Fatalf("reported size %d, wrote %d bytes", size, ciphertext.Len())
+	}
+	return ciphertext.Bytes(), digest
+}
+
+func TestAttachmentRoundTrip(t *testing.T) {
+	key, err := NewAttachmentKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, AttachmentSegmentSize - 1, AttachmentSegmentSize, AttachmentSegmentSize + 1, 3*AttachmentSegmentSize + 17} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		ciphertext, digest := encryptTestAttachment(t, plaintext, key)
+		if want := AttachmentCiphertextSize(int64(size)); int64(len(ciphertext)) != want {
+			t.Errorf("size %d: ciphertext is %d bytes, AttachmentCiphertextSize says %d", size, len(ciphertext), want)
+		}
+
+		var decrypted bytes.Buffer
+		if err := DecryptAttachment(&decrypted, bytes.NewReader(ciphertext), key, digest); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Fatalf("size %d: decrypted content differs", size)
+		}
+	}
+}
+
+func TestAttachmentTampering(t *testing.T) {
+	key, _ := NewAttachmentKey()
+	plaintext := make([]byte, 2*AttachmentSegmentSize+100)
+	rand.Read(plaintext)
+	ciphertext, digest := encryptTestAttachment(t, plaintext, key)
+
+	decrypt := func(ciphertext, key, digest []byte) error {
+		return DecryptAttachment(io.Discard, bytes.NewReader(ciphertext), key, digest)
+	}
+
+	flipped := append([]byte{}, ciphertext...)
+	flipped[attachmentHeaderSize+10] ^= 1
+	if err := decrypt(flipped, key, digest); !errors.Is(err, ErrAttachmentCorrupt) {
+		t.Errorf("flipped bit: err = %v, want ErrAttachmentCorrupt", err)
+	}
+
+	// Dropping the last segment leaves a valid but unterminated stream
+	segment := AttachmentSegmentSize + attachmentTagSize
+	truncated := ciphertext[:attachmentHeaderSize+2*segment]
+	if err := decrypt(truncated, key, digest); !errors.Is(err, ErrAttachmentCorrupt) {
+		t.Errorf("truncated at a segment boundary: err = %v, want ErrAttachmentCorrupt", err)
+	}
+
+	otherKey, _ := NewAttachmentKey()
+	if err := decrypt(ciphertext, otherKey, digest); !errors.Is(err, ErrAttachmentCorrupt) {
+		t.Errorf("wrong key: err = %v, want ErrAttachmentCorrupt", err)
+	}
+
+	wrongDigest := append([]byte{}, digest...)
+	wrongDigest[0] ^= 1
+	if err := decrypt(ciphertext, key, wrongDigest); !errors.Is(err, ErrAttachmentCorrupt) {
+		t.Errorf("wrong digest: err = %v, want ErrAttachmentCorrupt", err)
+	}
+}
+
+func TestAttachmentKeySize(t *testing.T) {
+	if _, _, err := EncryptAttachment(io.Discard, bytes.NewReader(nil), make([]byte, 16)); !errors.Is(err, ErrInvalidAttachmentKey) {
+		t.Errorf("err = %v, want ErrInvalidAttachmentKey", err)
+	}
+}
@@ -0,0 +1,105 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// safetyNumberVersion is mixed into every fingerprint so the scheme can
+	// change later without old and new numbers ever colliding
+	safetyNumberVersion = 0
+	// safetyNumberIterations makes brute-forcing a colliding key expensive
+	safetyNumberIterations = 5200
+)
+
+// ErrEmptyPublicKey is returned when a fingerprint is requested for a user
+// that has not registered an identity key yet
+var ErrEmptyPublicKey = errors.New("public key is empty")
+
+// identityKeyBytes returns the raw key material of a PEM encoded public key.
+// Keys that are not PEM encoded are used as-is.
+func identityKeyBytes(publicKey string) ([]byte, error) {
+	publicKey = strings.TrimSpace(publicKey)
+	if publicKey == "" {
+		return nil, ErrEmptyPublicKey
+	}
+
+	if block, _ := pem.Decode([]byte(publicKey)); block != nil {
+		return block.Bytes, nil
+	}
+	return []byte(publicKey), nil
+}
+
+// KeyFingerprint returns the hex encoded SHA-256 fingerprint of an identity key
+func KeyFingerprint(publicKey string) (string, error) {
+	key, err := identityKeyBytes(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// displayableFingerprint derives the 30 digit half of a safety number that
+// belongs to one party
+func displayableFingerprint(userID string, key []byte) string {
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, safetyNumberVersion)
+
+	h := sha512.New()
+	h.Write(version)
+	h.Write(key)
+	h.Write([]byte(userID))
+	digest := h.Sum(nil)
+
+	for i := 0; i < safetyNumberIterations; i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(key)
+		digest = h.Sum(nil)
+	}
+
+	var sb strings.Builder
+	for i := 0; i < 30; i += 5 {
+		chunk := uint64(digest[i])<<32 | uint64(digest[i+1])<<24 |
+			uint64(digest[i+2])<<16 | uint64(digest[i+3])<<8 | uint64(digest[i+4])
+		fmt.Fprintf(&sb, "%05d", chunk%100000)
+	}
+	return sb.String()
+}
+
+// SafetyNumber derives the 60 digit safety number shared by two users from
+// their identity keys. Both parties get the same number regardless of who
+// asks, so they can compare it out of band. The result is grouped in blocks
+// of five digits.
+func SafetyNumber(userIDA, publicKeyA, userIDB, publicKeyB string) (string, error) {
+	keyA, err := identityKeyBytes(publicKeyA)
+	if err != nil {
+		return "", err
+	}
+	keyB, err := identityKeyBytes(publicKeyB)
+	if err != nil {
+		return "", err
+	}
+
+	first := displayableFingerprint(userIDA, keyA)
+	second := displayableFingerprint(userIDB, keyB)
+	if first > second {
+		first, second = second, first
+	}
+
+	digits := first + second
+	groups := make([]string, 0, len(digits)/5)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+	return strings.Join(groups, " "), nil
+}
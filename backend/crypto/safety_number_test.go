@@ -0,0 +1,110 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func pemPublicKey(t *testing.T) (string, []byte) {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), der
+}
+
+func TestKeyFingerprintHashesPEMContents(t *testing.T) {
+	key, der := pemPublicKey(t)
+
+	got, err := KeyFingerprint(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(der)
+	if want := hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("fingerprint = %s, want %s", got, want)
+	}
+
+	// Surrounding whitespace is not part of the key
+	padded, err := KeyFingerprint("\n" + key + "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if padded != got {
+		t.Errorf("fingerprint of padded key = %s, want %s", padded, got)
+	}
+}
+
+func TestKeyFingerprintEmpty(t *testing.T) {
+	if _, err := KeyFingerprint("  "); !errors.Is(err, ErrEmptyPublicKey) {
+		t.Errorf("err = %v, want ErrEmptyPublicKey", err)
+	}
+}
+
+func TestSafetyNumberIsSymmetric(t *testing.T) {
+	keyA, _ := pemPublicKey(t)
+	keyB, _ := pemPublicKey(t)
+
+	ab, err := SafetyNumber("alice", keyA, "bob", keyB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba, err := SafetyNumber("bob", keyB, "alice", keyA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ab != ba {
+		t.Errorf("safety numbers differ by caller: %q and %q", ab, ba)
+	}
+	if !regexp.MustCompile(`^\d{5}( \d{5}){11}$`).MatchString(ab) {
+		t.Errorf("safety number %q is not 12 groups of 5 digits", ab)
+	}
+}
+
+func TestSafetyNumberChangesWithKeys(t *testing.T) {
+	keyA, _ := pemPublicKey(t)
+	keyB, _ := pemPublicKey(t)
+	rotated, _ := pemPublicKey(t)
+
+	before, err := SafetyNumber("alice", keyA, "bob", keyB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := SafetyNumber("alice", keyA, "bob", rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Error("safety number did not change when a key was rotated")
+	}
+
+	// The same key under another user is another fingerprint
+	other, err := SafetyNumber("alice", keyA, "carol", keyB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == before {
+		t.Error("safety number does not depend on the user IDs")
+	}
+}
+
+func TestSafetyNumberNeedsBothKeys(t *testing.T) {
+	key, _ := pemPublicKey(t)
+	if _, err := SafetyNumber("alice", key, "bob", ""); !errors.Is(err, ErrEmptyPublicKey) {
+		t.Errorf("err = %v, want ErrEmptyPublicKey", err)
+	}
+	if _, err := SafetyNumber("alice", "", "bob", key); !errors.Is(err, ErrEmptyPublicKey) {
+		t.Errorf("err = %v, want ErrEmptyPublicKey", err)
+	}
+}
@@ -0,0 +1,160 @@
+// Package egress guards the HTTP requests the server makes to URLs users
+// give it, such as webhooks, from reaching loopback, private and other
+// internal addresses.
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned when a host resolves to an address the
+// policy does not allow
+var ErrForbiddenAddress = errors.New("address is not allowed")
+
+// reservedNetworks are not routable on the internet but are not covered by
+// the net.IP predicates
+var reservedNetworks = mustParseNetworks(
+	"0.0.0.0/8",     // "this" network
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"240.0.0.0/4",   // reserved, including broadcast
+)
+
+// Policy decides which addresses outgoing requests may connect to. Loopback,
+// private, link-local, multicast, unspecified and reserved addresses are
+// refused unless they are in one of the allowed networks.
+type Policy struct {
+	allowed []*net.IPNet
+}
+
+// NewPolicy refuses internal addresses except those in allowed, which is
+// meant for development, e.g. a bot running on localhost
+func NewPolicy(allowed ...*net.IPNet) *Policy {
+	return &Policy{allowed: allowed}
+}
+
+// ParseNetworks parses CIDRs such as "10.0.0.0/8". A bare IP address is a
+// network of just that address.
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func mustParseNetworks(values ...string) []*net.IPNet {
+	networks, err := ParseNetworks(values)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// Allows reports whether requests may connect to ip
+func (p *Policy) Allows(ip net.IP) bool {
+	for _, network := range p.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckHost resolves host and returns ErrForbiddenAddress if any of its
+// addresses is not allowed. It gives early feedback when a URL is saved;
+// the client from Client checks again on every connection, as DNS answers
+// can change.
+func (p *Policy) CheckHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !p.Allows(ip) {
+			return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !p.Allows(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrForbiddenAddress, host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// Client returns an HTTP client that only connects to allowed addresses.
+// The address is checked after DNS resolution, right before connecting, so
+// a host that resolves to a public address when it is saved and an internal
+// one later is still refused. Proxies from the environment are not used, as
+// the connection would then be to the proxy, and redirects are returned
+// rather than followed.
+func (p *Policy) Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: p.control,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// control runs once the address to connect to is resolved
+func (p *Policy) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	// Addresses with a zone, such as fe80::1%eth0, don't parse and are
+	// refused along with everything else that isn't a plain IP
+	ip := net.ParseIP(host)
+	if ip == nil || !p.Allows(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAllows(t *testing.T) {
+	allowlist, err := ParseNetworks([]string{"10.1.0.0/16", "127.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := NewPolicy(allowlist...)
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		// The allowlist wins
+		{"10.1.2.3", true},
+		{"127.0.0.2", true},
+	}
+	for _, tt := range tests {
+		if got := policy.Allows(net.ParseIP(tt.ip)); got != tt.allowed {
+			t.Errorf("Allows(%s) = %v, want %v", tt.ip, got, tt.allowed)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	for _, value := range []string{"localhost", "10.0.0.0/33", "1.2.3"} {
+		if _, err := ParseNetworks([]string{value}); err == nil {
+			t.Errorf("ParseNetworks(%q) succeeded", value)
+		}
+	}
+	networks, err := ParseNetworks([]string{" ::1 ", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if networks[0].String() != "::1/128" || networks[1].String() != "192.168.0.0/16" {
+		t.Errorf("networks = %v", networks)
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	ctx := context.Background()
+	policy := NewPolicy()
+	for _, host := range []string{"127.0.0.1", "169.254.169.254", "::1", "localhost"} {
+		if err := policy.CheckHost(ctx, host); !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("CheckHost(%q) = %v, want ErrForbiddenAddress", host, err)
+		}
+	}
+	if err := policy.CheckHost(ctx, "93.184.216.34"); err != nil {
+		t.Errorf("CheckHost of a public address: %v", err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	// The loopback server is refused whether it is named by address or by a
+	// host name resolving to it
+	client := NewPolicy().Client(time.Second)
+	for _, url := range []string{server.URL, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)} {
+		if _, err := client.Get(url); !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("GET %s: err = %v, want ErrForbiddenAddress", url, err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("%d requests reached the server", n)
+	}
+
+	allowlist, _ := ParseNetworks([]string{"127.0.0.0/8", "::1"})
+	client = NewPolicy(allowlist...).Client(time.Second)
+	resp, err := client.Get(server.URL + "/redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("redirect: status %d, want it returned rather than followed", resp.StatusCode)
+	}
+}
@@ -1,16 +1,30 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"database/sql"
+	"expvar"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/backplane"
+	"github.com/RatneshMaurya/not-whatsapp/backend/commands"
+	"github.com/RatneshMaurya/not-whatsapp/backend/config"
 	"github.com/RatneshMaurya/not-whatsapp/backend/controllers"
+	"github.com/RatneshMaurya/not-whatsapp/backend/crypto"
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+	"github.com/RatneshMaurya/not-whatsapp/backend/mail"
 	"github.com/RatneshMaurya/not-whatsapp/backend/migrations"
+	"github.com/RatneshMaurya/not-whatsapp/backend/ratelimit"
 	"github.com/RatneshMaurya/not-whatsapp/backend/services"
+	"github.com/RatneshMaurya/not-whatsapp/backend/transparency"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -22,6 +36,10 @@ func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Printf("Warning: .env file not found, using environment variables")
 	}
+	cfg := config.LoadConfig()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	// Initialize database connection
 	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
@@ -42,16 +60,168 @@ func main() {
 	}
 	log.Println("Database migrations completed")
 
+	// Load the key used to sign key log tree heads
+	var keyLogSigningKey ed25519.PrivateKey
+	if cfg.KeyLogSigningKey != "" {
+		keyLogSigningKey, err = transparency.ParseSigningKey(cfg.KeyLogSigningKey)
+		if err != nil {
+			log.Fatalf("Invalid KEY_LOG_SIGNING_KEY: %v", err)
+		}
+	} else {
+		// Only allowed in development; see Config.Validate
+		log.Printf("Warning: KEY_LOG_SIGNING_KEY not set, signing key log tree heads with a temporary key that changes on every restart")
+		_, keyLogSigningKey, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatalf("Failed to generate key log signing key: %v", err)
+		}
+	}
+
+	// Load the master keys message content is sealed at rest with
+	keyring, err := crypto.LoadKeyring(cfg.MasterKeys, cfg.MasterKeyFile)
+	if err != nil {
+		log.Fatalf("Invalid master key configuration: %v", err)
+	}
+	if keyring == nil {
+		log.Printf("Warning: MASTER_KEYS not set, message content is stored unencrypted at rest")
+	}
+
 	// Initialize services
+	contentCipher := services.NewContentCipher(db, keyring)
 	userService := services.NewUserService(db)
-	messageService := services.NewMessageService(db)
-	conversationService := services.NewConversationService(db)
+	sessionService := services.NewSessionService(db, cfg.RefreshTokenTTL)
+	signingKeys := auth.NewKeyring()
+	signingKeyService := services.NewSigningKeyService(db, keyring, signingKeys, cfg.JWTSigningAlg, cfg.JWTKeyRotation, cfg.JWTKeyOverlap)
+	tokenManager := auth.NewTokenManager(signingKeys, cfg.PublicURL, cfg.JWTSecret, cfg.AccessTokenTTL)
+	emailLoginService := services.NewEmailLoginService(db, tokenManager, cfg.EmailLoginTTL)
+	loginCodeService := services.NewLoginCodeService(db, time.Minute)
+	twoFactorService := services.NewTwoFactorService(db, contentCipher, cfg.TOTPIssuer)
+	settingsService := services.NewSettingsService(db, cfg.RequireTwoFactor)
+	egressAllowlist, err := egress.ParseNetworks(cfg.EgressAllowlist)
+	if err != nil {
+		log.Fatalf("Invalid egress allowlist: %v", err)
+	}
+	egressPolicy := egress.NewPolicy(egressAllowlist...)
+	webhookService := services.NewWebhookService(db, contentCipher, egressPolicy, cfg.WebhookTimeout, cfg.WebhookMaxAttempts)
+	messageService := services.NewMessageService(db, contentCipher, webhookService)
+	conversationService := services.NewConversationService(db, contentCipher, webhookService)
+	botService := services.NewBotService(db, webhookService)
+	incomingWebhookService := services.NewIncomingWebhookService(db, webhookService)
+	commandService := services.NewCommandService(db, contentCipher, commands.Builtins(), egressPolicy, cfg.CommandTimeout)
+	keyLogService := services.NewKeyLogService(db, keyLogSigningKey)
+	keyService := services.NewKeyService(db, keyLogService, contentCipher)
+	attachmentService, err := services.NewAttachmentService(db, cfg.AttachmentsDir, int64(cfg.MaxAttachmentSize))
+	if err != nil {
+		log.Fatalf("Error initializing attachment storage: %v", err)
+	}
+
+	// Load the access token signing keys, creating the first one if needed,
+	// and keep them rotating
+	if err := signingKeyService.Rotate(); err != nil {
+		log.Fatalf("Error loading signing keys: %v", err)
+	}
+	signingKeyService.Start()
+
+	if _, err := keyLogService.Backfill(); err != nil {
+		log.Fatalf("Error backfilling key log: %v", err)
+	}
+
+	// Move conversation keys off retired master keys without downtime
+	contentCipher.StartRewrapping()
+
+	// Deliver queued webhook events, including any left from before a restart
+	webhookService.Start()
+
+	// Set up the identity providers users can sign in with
+	var providers []auth.Provider
+	if cfg.GoogleClientID != "" {
+		providers = append(providers, auth.NewGoogleProvider(cfg.GoogleClientID, cfg.GoogleSecret, cfg.APIURL(oauthCallbackPath("google"))))
+	}
+	for _, p := range cfg.OIDCProviders {
+		providers = append(providers, auth.NewOIDCProvider(p.Name, p.DisplayName, p.Issuer, p.ClientID, p.ClientSecret, cfg.APIURL(oauthCallbackPath(p.Name)), p.Scopes))
+	}
+
+	// Set up outgoing email for login links
+	var mailer mail.Mailer
+	switch cfg.MailDriver {
+	case "smtp":
+		mailer = &mail.SMTPMailer{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.MailFrom,
+		}
+	case "file":
+		mailer = &mail.FileMailer{Dir: cfg.MailDir, From: cfg.MailFrom}
+	case "log":
+		mailer = mail.LogMailer{}
+	}
+
+	// Set up fan-out to the clients connected to other nodes, and presence.
+	// Without Redis, presence only covers the clients of this node. nodes
+	// lists the live nodes when they are known, so the admin API knows which
+	// nodes to wait for.
+	var hubBackplane backplane.Backplane
+	var presence backplane.Presence
+	var nodes backplane.NodeLister
+	switch cfg.Backplane {
+	case "redis":
+		redisBackplane, err := backplane.NewRedis(cfg.RedisURL, cfg.NodeID, cfg.PresenceHeartbeat)
+		if err != nil {
+			log.Fatalf("Error connecting to Redis: %v", err)
+		}
+		hubBackplane, presence, nodes = redisBackplane, redisBackplane, redisBackplane
+	case "postgres":
+		localPresence := backplane.NewMemory(cfg.PresenceHeartbeat).Node(cfg.NodeID)
+		defer localPresence.Close()
+		hubBackplane, presence = backplane.NewPostgres(db, os.Getenv("DATABASE_URL"), cfg.NodeID), localPresence
+	case "local":
+		localNode := backplane.NewMemory(cfg.PresenceHeartbeat).Node(cfg.NodeID)
+		hubBackplane, presence, nodes = localNode, localNode, localNode
+	}
+	defer hubBackplane.Close()
+
+	// Rate limits for frames and API calls, by role
+	rateLimitOverrides, err := ratelimit.ParseOverrides(cfg.RateLimitBotOverrides)
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_BOT_OVERRIDES: %v", err)
+	}
+	rateLimits := ratelimit.NewPolicy(cfg.RateLimits, rateLimitOverrides)
 
 	// Initialize controllers
-	authController := controllers.NewAuthController(userService)
+	wsController, err := controllers.NewWebSocketController(db, messageService, commandService, tokenManager, sessionService, botService, hubBackplane, presence, rateLimits, cfg.RateLimitMaxViolations, controllers.SocketOptions{
+		ReadBufferSize:       cfg.WSReadBufferSize,
+		WriteBufferSize:      cfg.WSWriteBufferSize,
+		WriteBufferPool:      cfg.WSWriteBufferPool,
+		ReadLimits:           cfg.WSReadLimits,
+		Compression:          cfg.WSCompression,
+		CompressionLevel:     cfg.WSCompressionLevel,
+		CompressionThreshold: cfg.WSCompressionThreshold,
+		SendQueueSize:        cfg.WSSendQueueSize,
+		AllowedOrigins:       cfg.FrontendOrigins(),
+	})
+	if err != nil {
+		log.Fatalf("Error subscribing to the backplane: %v", err)
+	}
+	loginFinisher := controllers.NewLoginFinisher(cfg, sessionService, loginCodeService, twoFactorService, settingsService, tokenManager)
+	jwksController := controllers.NewJWKSController(signingKeys)
+	authController := controllers.NewAuthController(providers, userService, sessionService, tokenManager, loginFinisher, wsController)
+	emailLoginController := controllers.NewEmailLoginController(emailLoginService, userService, loginFinisher, mailer, cfg.PublicURL, cfg.EmailLoginTTL,
+		ratelimit.NewLimiter(cfg.EmailLoginPerEmail, time.Hour),
+		ratelimit.NewLimiter(cfg.EmailLoginPerIP, time.Hour))
+	twoFactorController := controllers.NewTwoFactorController(twoFactorService, userService, settingsService, loginFinisher,
+		ratelimit.NewLimiter(5, 5*time.Minute))
 	userController := controllers.NewUserController(userService)
-	conversationController := controllers.NewConversationController(conversationService, messageService)
-	wsController := controllers.NewWebSocketController(db)
+	conversationController := controllers.NewConversationController(conversationService, messageService, userService, wsController)
+	botController := controllers.NewBotController(botService, wsController)
+	webhookController := controllers.NewWebhookController(webhookService, conversationService)
+	incomingWebhookController := controllers.NewIncomingWebhookController(incomingWebhookService, conversationService, messageService, userService, wsController, cfg.PublicURL,
+		ratelimit.NewLimiter(60, time.Minute))
+	commandController := controllers.NewCommandController(commandService, conversationService)
+	keyController := controllers.NewKeyController(keyService, wsController)
+	keyLogController := controllers.NewKeyLogController(keyLogService)
+	attachmentController := controllers.NewAttachmentController(attachmentService, conversationService)
+	adminController := controllers.NewAdminController(wsController, conversationService, settingsService, cfg.NodeID, nodes)
 
 	// Set Gin mode based on environment
 	if os.Getenv("GIN_MODE") != "" {
@@ -62,10 +232,15 @@ func main() {
 
 	// Initialize Gin router
 	r := gin.New()
-	r.Use(gin.Logger())
+	// Only believe X-Forwarded-For from our own proxies, since client IPs
+	// key rate limits and are recorded with sessions
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 	r.Use(gin.Recovery())
 
-	// Simple request logging middleware
+	// Simple request logging middleware. It leaves out the query string, which
+	// can carry login codes and WebSocket tokens.
 	r.Use(func(c *gin.Context) {
 		start := time.Now()
 		path := c.Request.URL.Path
@@ -102,22 +277,100 @@ func main() {
 	})
 
 	// Public routes
-	r.GET("/api/v1/auth/google/login", authController.HandleGoogleLogin)
-	r.GET("/api/v1/auth/google/callback", authController.HandleGoogleCallback)
+	r.GET("/.well-known/jwks.json", jwksController.GetJWKS)
+	r.GET("/api/v1/auth/providers", authController.GetProviders)
+	r.POST("/api/v1/auth/email/request", emailLoginController.RequestLoginLink)
+	r.GET("/api/v1/auth/email/callback", emailLoginController.HandleCallback)
+	r.POST("/api/v1/auth/2fa/enroll", twoFactorController.BeginChallengeEnrollment)
+	r.POST("/api/v1/auth/2fa/verify", twoFactorController.VerifyChallenge)
+	r.GET("/api/v1/auth/:provider/login", authController.HandleLogin)
+	r.GET("/api/v1/auth/:provider/callback", authController.HandleCallback)
+	r.POST("/api/v1/auth/exchange", authController.ExchangeLoginCode)
+	r.POST("/api/v1/auth/refresh", authController.RefreshToken)
+
+	// Incoming webhooks authenticate with their own token
+	r.POST("/api/v1/hooks/:id", incomingWebhookController.PostMessage)
+
+	// Key transparency log is public so anyone can audit it
+	r.GET("/api/v1/keylog/public-key", keyLogController.GetPublicKey)
+	r.GET("/api/v1/keylog/tree-head", keyLogController.GetTreeHead)
+	r.GET("/api/v1/keylog/entries", keyLogController.GetEntries)
+	r.GET("/api/v1/keylog/proof/inclusion", keyLogController.GetInclusionProof)
+	r.GET("/api/v1/keylog/proof/consistency", keyLogController.GetConsistencyProof)
+	r.GET("/api/v1/keylog/users/:id", keyLogController.GetUserEntry)
 
 	// WebSocket route
 	r.GET("/ws", wsController.HandleWebSocket)
+	r.GET("/api/v1/protocol/schema.json", wsController.GetProtocolSchema)
+
+	// Fallback transports for clients that can't use WebSockets. They
+	// authenticate like /ws, so EventSource can pass ?token.
+	r.GET("/api/v1/stream/events", wsController.HandleEvents)
+	r.GET("/api/v1/stream/poll", wsController.HandlePoll)
+	r.POST("/api/v1/stream/frames", wsController.PostFrame)
 
 	// Protected routes
 	api := r.Group("/api/v1")
-	api.Use(auth.AuthMiddleware)
+	api.Use(auth.Middleware(tokenManager, sessionService, nil), controllers.RateLimitAPI(rateLimits))
 	{
+		api.POST("/auth/logout", authController.Logout)
+		api.POST("/auth/logout-all", authController.LogoutAll)
 		api.GET("/users/me", userController.GetCurrentUser)
 		api.GET("/users", userController.GetUsers)
+		api.GET("/presence", wsController.GetPresence)
+		api.GET("/users/me/identities", userController.GetIdentities)
+		api.DELETE("/users/me/identities/:provider/:subject", userController.UnlinkIdentity)
+		api.GET("/users/me/2fa", twoFactorController.GetStatus)
+		api.POST("/users/me/2fa", twoFactorController.BeginEnrollment)
+		api.GET("/users/me/2fa/qr.png", twoFactorController.GetEnrollmentQRCode)
+		api.POST("/users/me/2fa/confirm", twoFactorController.ConfirmEnrollment)
+		api.POST("/users/me/2fa/recovery-codes", twoFactorController.RegenerateRecoveryCodes)
+		api.DELETE("/users/me/2fa", twoFactorController.Disable)
+		api.PUT("/users/me/public-key", keyController.UpdatePublicKey)
+		api.GET("/users/:id/safety-number", keyController.GetSafetyNumber)
+		api.PUT("/users/:id/verification", keyController.VerifyContact)
+		api.DELETE("/users/:id/verification", keyController.UnverifyContact)
 		api.GET("/conversations", conversationController.GetConversations)
 		api.POST("/conversations", conversationController.CreateConversation)
 		api.GET("/conversations/:id", conversationController.GetConversation)
-		api.GET("/conversations/:id/messages", conversationController.GetConversationMessages)
+		api.POST("/conversations/:id/webhooks", webhookController.CreateWebhook)
+		api.GET("/conversations/:id/webhooks", webhookController.GetWebhooks)
+		api.DELETE("/conversations/:id/webhooks/:webhookId", webhookController.DeleteWebhook)
+		api.GET("/conversations/:id/webhooks/:webhookId/deliveries", webhookController.GetDeliveries)
+		api.POST("/conversations/:id/incoming-webhooks", incomingWebhookController.CreateIncomingWebhook)
+		api.GET("/conversations/:id/incoming-webhooks", incomingWebhookController.GetIncomingWebhooks)
+		api.DELETE("/conversations/:id/incoming-webhooks/:webhookId", incomingWebhookController.DeleteIncomingWebhook)
+		api.GET("/conversations/:id/commands", commandController.GetCommands)
+		api.POST("/attachments", attachmentController.CreateAttachment)
+		api.PUT("/attachments/:id", attachmentController.UploadAttachment)
+		api.GET("/attachments/:id", attachmentController.DownloadAttachment)
+		api.POST("/bots", botController.CreateBot)
+		api.GET("/bots", botController.GetBots)
+		api.POST("/bots/:id/tokens", botController.CreateAPIToken)
+		api.GET("/bots/:id/tokens", botController.GetAPITokens)
+		api.DELETE("/bots/:id/tokens/:tokenId", botController.RevokeAPIToken)
+		api.POST("/bots/:id/commands", commandController.RegisterCommand)
+		api.GET("/bots/:id/commands", commandController.GetBotCommands)
+		api.DELETE("/bots/:id/commands/:commandId", commandController.DeleteCommand)
+	}
+
+	// Routes for admins, to inspect and control live connections
+	admin := r.Group("/api/v1/admin")
+	admin.Use(auth.Middleware(tokenManager, sessionService, nil), auth.RequireAdmin(userService), controllers.RateLimitAPI(rateLimits))
+	{
+		admin.GET("/sessions", adminController.GetSessions)
+		admin.DELETE("/sessions/:id", adminController.DisconnectSession)
+		admin.POST("/announcements", adminController.CreateAnnouncement)
+		admin.GET("/settings", adminController.GetSettings)
+		admin.PATCH("/settings", adminController.UpdateSettings)
+	}
+
+	// Routes bots can also call with an API token, within its scopes
+	botAPI := r.Group("/api/v1")
+	botAPI.Use(auth.Middleware(tokenManager, sessionService, botService), controllers.RateLimitAPI(rateLimits))
+	{
+		botAPI.GET("/conversations/:id/messages", auth.RequireScope(auth.ScopeRead), conversationController.GetConversationMessages)
+		botAPI.POST("/conversations/:id/messages", auth.RequireScope(auth.ScopeSend), conversationController.SendMessage)
 	}
 
 	// Start server
@@ -126,8 +379,59 @@ func main() {
 		port = "8080"
 	}
 
-	log.Printf("Server starting on port %s", port)
-	if err := http.ListenAndServe(":"+port, r); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: r,
+	}
+	// Event streams and long polls would hold up shutdown until they end
+	srv.RegisterOnShutdown(func() {
+		wsController.EndStreams(cfg.ReconnectDelay)
+	})
+	go func() {
+		log.Printf("Server starting on port %s", port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+
+	// Metrics, such as the WebSocket send queue counters, are served apart
+	// from the API so they can be kept off the public network
+	if cfg.MetricsAddr != "" {
+		go func() {
+			log.Printf("Serving metrics on %s", cfg.MetricsAddr)
+			if err := http.ListenAndServe(cfg.MetricsAddr, expvar.Handler()); err != nil {
+				log.Printf("Metrics server failed: %v", err)
+			}
+		}()
+	}
+
+	// Shut down gracefully on SIGTERM, e.g. during a deploy
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop()
+
+	log.Printf("Shutting down, waiting up to %s", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections and let REST requests finish. Upgraded
+	// WebSocket connections are not tracked by the server; event streams and
+	// long polls are ended by EndStreams.
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+	if err := wsController.Drain(shutdownCtx, cfg.ReconnectDelay); err != nil {
+		log.Printf("Timed out waiting for WebSocket messages to be saved: %v", err)
 	}
+	if err := wsController.Stop(shutdownCtx); err != nil {
+		log.Printf("Timed out closing WebSocket connections: %v", err)
+	}
+	log.Printf("Server stopped")
+}
+
+// oauthCallbackPath is the path of the callback registered with an identity
+// provider
+func oauthCallbackPath(provider string) string {
+	return "/api/v1/auth/" + provider + "/callback"
 }
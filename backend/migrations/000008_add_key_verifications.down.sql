@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_key_verifications_contact_id;
+DROP TABLE IF EXISTS key_verifications;
+
+DELETE FROM messages WHERE message_type = 'system';
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_message_type_check;
+ALTER TABLE messages ADD CONSTRAINT messages_message_type_check
+    CHECK (message_type IN ('text', 'image', 'file'));
@@ -0,0 +1,15 @@
+-- Allow system notices (e.g. safety number changes) in conversations
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_message_type_check;
+ALTER TABLE messages ADD CONSTRAINT messages_message_type_check
+    CHECK (message_type IN ('text', 'image', 'file', 'system'));
+
+-- Contacts a user has verified, pinned to the key fingerprint they verified
+CREATE TABLE IF NOT EXISTS key_verifications (
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    contact_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    contact_key_fingerprint TEXT NOT NULL,
+    verified_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, contact_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_key_verifications_contact_id ON key_verifications(contact_id);
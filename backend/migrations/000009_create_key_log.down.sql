@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS key_log_tree_heads_append_only ON key_log_tree_heads;
+DROP TRIGGER IF EXISTS key_log_entries_append_only ON key_log_entries;
+DROP FUNCTION IF EXISTS key_log_append_only();
+
+DROP INDEX IF EXISTS idx_key_log_entries_user_id;
+DROP TABLE IF EXISTS key_log_tree_heads;
+DROP TABLE IF EXISTS key_log_entries;
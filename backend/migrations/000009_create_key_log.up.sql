@@ -0,0 +1,37 @@
+-- Append-only log of identity key registrations and rotations
+CREATE TABLE IF NOT EXISTS key_log_entries (
+    leaf_index BIGINT PRIMARY KEY,
+    user_id UUID NOT NULL,
+    public_key TEXT NOT NULL,
+    event TEXT NOT NULL CHECK (event IN ('register', 'rotate')),
+    leaf_data BYTEA NOT NULL,
+    leaf_hash BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_key_log_entries_user_id ON key_log_entries(user_id, leaf_index DESC);
+
+-- Every tree head the log has signed
+CREATE TABLE IF NOT EXISTS key_log_tree_heads (
+    tree_size BIGINT PRIMARY KEY,
+    root_hash BYTEA NOT NULL,
+    timestamp BIGINT NOT NULL,
+    signature BYTEA NOT NULL
+);
+
+-- The log must never be rewritten
+CREATE OR REPLACE FUNCTION key_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'key log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS key_log_entries_append_only ON key_log_entries;
+CREATE TRIGGER key_log_entries_append_only
+    BEFORE UPDATE OR DELETE ON key_log_entries
+    FOR EACH ROW EXECUTE FUNCTION key_log_append_only();
+
+DROP TRIGGER IF EXISTS key_log_tree_heads_append_only ON key_log_tree_heads;
+CREATE TRIGGER key_log_tree_heads_append_only
+    BEFORE UPDATE OR DELETE ON key_log_tree_heads
+    FOR EACH ROW EXECUTE FUNCTION key_log_append_only();
@@ -0,0 +1,4 @@
+-- WARNING: content sealed with these keys becomes unreadable once they are dropped.
+-- Run the reencrypt command with -unseal first.
+DROP INDEX IF EXISTS idx_conversation_keys_master_key_id;
+DROP TABLE IF EXISTS conversation_keys;
@@ -0,0 +1,10 @@
+-- Per-conversation data encryption keys, wrapped by a master key
+CREATE TABLE IF NOT EXISTS conversation_keys (
+    conversation_id UUID PRIMARY KEY REFERENCES conversations(id) ON DELETE CASCADE,
+    master_key_id TEXT NOT NULL,
+    wrapped_key BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    rewrapped_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversation_keys_master_key_id ON conversation_keys(master_key_id);
@@ -0,0 +1,13 @@
+-- Only Google identities can be moved back; users without one keep a NULL
+-- google_id
+ALTER TABLE users ADD COLUMN IF NOT EXISTS google_id TEXT UNIQUE;
+
+UPDATE users u
+SET google_id = i.subject
+FROM user_identities i
+WHERE i.user_id = u.id AND i.provider = 'google';
+
+CREATE INDEX IF NOT EXISTS idx_users_google_id ON users(google_id);
+
+DROP INDEX IF EXISTS idx_user_identities_user_id;
+DROP TABLE IF EXISTS user_identities;
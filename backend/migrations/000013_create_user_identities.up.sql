@@ -0,0 +1,22 @@
+-- Accounts at external identity providers; a user can link several
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_login_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
+
+-- Move existing Google accounts over
+INSERT INTO user_identities (provider, subject, user_id, email, created_at, last_login_at)
+SELECT 'google', google_id, id, email, created_at, last_seen
+FROM users
+WHERE google_id IS NOT NULL
+ON CONFLICT (provider, subject) DO NOTHING;
+
+DROP INDEX IF EXISTS idx_users_google_id;
+ALTER TABLE users DROP COLUMN IF EXISTS google_id;
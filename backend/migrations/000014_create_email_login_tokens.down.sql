@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_email_login_tokens_expires_at;
+DROP TABLE IF EXISTS email_login_tokens;
@@ -0,0 +1,12 @@
+-- Issued email login links. The link itself is a signed token; this table
+-- makes it single use.
+CREATE TABLE IF NOT EXISTS email_login_tokens (
+    id UUID PRIMARY KEY,
+    email TEXT NOT NULL,
+    ip_address TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_login_tokens_expires_at ON email_login_tokens(expires_at);
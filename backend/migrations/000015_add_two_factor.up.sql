@@ -0,0 +1,19 @@
+-- TOTP second factor. The secret is unconfirmed until the user proves they
+-- have set up their authenticator app.
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    confirmed_at TIMESTAMP WITH TIME ZONE,
+    -- Last accepted time step, so a code cannot be used twice
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- Single-use recovery codes, stored hashed
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    used_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (user_id, code_hash)
+);
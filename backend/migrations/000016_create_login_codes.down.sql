@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_login_codes_expires_at;
+DROP TABLE IF EXISTS login_codes;
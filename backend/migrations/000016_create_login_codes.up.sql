@@ -0,0 +1,10 @@
+-- One-time codes the login callback hands to the frontend, which exchanges
+-- them for tokens. Stored hashed and deleted once redeemed.
+CREATE TABLE IF NOT EXISTS login_codes (
+    code_hash BYTEA PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_codes_expires_at ON login_codes(expires_at);
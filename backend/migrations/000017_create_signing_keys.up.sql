@@ -0,0 +1,12 @@
+-- Keys access tokens are signed with. A key is published in the JWKS as soon
+-- as it is created, signs from activates_at until the next key activates, and
+-- is deleted once the tokens it signed have expired. Private keys are sealed
+-- with a master key when master_key_id is set.
+CREATE TABLE IF NOT EXISTS signing_keys (
+    id TEXT PRIMARY KEY,
+    algorithm TEXT NOT NULL,
+    private_key BYTEA NOT NULL,
+    master_key_id TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    activates_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS api_token_conversations;
+DROP TABLE IF EXISTS api_tokens;
+ALTER TABLE messages DROP COLUMN IF EXISTS bot;
+DROP INDEX IF EXISTS idx_users_bot_owner_id;
+ALTER TABLE users DROP COLUMN IF EXISTS bot_owner_id;
+ALTER TABLE users DROP COLUMN IF EXISTS is_bot;
@@ -0,0 +1,31 @@
+-- Bots are users without a login that belong to the user who created them
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bot_owner_id UUID REFERENCES users(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_users_bot_owner_id ON users(bot_owner_id);
+
+-- Messages sent by a bot are flagged so clients can badge them
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS bot BOOLEAN NOT NULL DEFAULT false;
+
+-- Long-lived API tokens bots authenticate with, stored hashed. Scopes are
+-- "read" and "send"; a token only works in the conversations listed in
+-- api_token_conversations.
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    bot_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    token_hash BYTEA NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_tokens_bot_id ON api_tokens(bot_id);
+
+CREATE TABLE IF NOT EXISTS api_token_conversations (
+    token_id UUID NOT NULL REFERENCES api_tokens(id) ON DELETE CASCADE,
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    PRIMARY KEY (token_id, conversation_id)
+);
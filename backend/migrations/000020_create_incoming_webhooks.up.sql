@@ -0,0 +1,18 @@
+-- Lets integrations show a name other than their user's on each message
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS display_name TEXT;
+
+-- URLs integrations post messages to a conversation through. Messages are
+-- sent as user_id, an integration user created with the webhook. Only a hash
+-- of the token is stored.
+CREATE TABLE IF NOT EXISTS incoming_webhooks (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    created_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    token_hash BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_incoming_webhooks_conversation_id ON incoming_webhooks(conversation_id);
@@ -0,0 +1,16 @@
+-- Slash commands bots handle in a conversation. Invocations are POSTed to
+-- url, signed with secret, which is sealed like message content.
+CREATE TABLE IF NOT EXISTS slash_commands (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    bot_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    usage TEXT NOT NULL DEFAULT '',
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    UNIQUE (conversation_id, name)
+);
+
+CREATE INDEX IF NOT EXISTS idx_slash_commands_bot_id ON slash_commands(bot_id);
@@ -0,0 +1,10 @@
+-- Events too large for a NOTIFY payload, published by one backend node for
+-- the others to fetch by ID. Rows are only needed for a few seconds, so the
+-- table is unlogged and pruned by the publishers.
+CREATE UNLOGGED TABLE IF NOT EXISTS backplane_events (
+    id BIGSERIAL PRIMARY KEY,
+    payload BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_backplane_events_created_at ON backplane_events(created_at);
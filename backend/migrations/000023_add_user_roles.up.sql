@@ -0,0 +1,3 @@
+-- Admins can inspect and control live connections through the admin API
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user'
+    CHECK (role IN ('user', 'admin'));
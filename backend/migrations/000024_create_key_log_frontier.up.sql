@@ -0,0 +1,8 @@
+-- The frontier of the key log's Merkle tree, so appends don't have to read
+-- every leaf. It has a single row, built from key_log_entries on the first
+-- append after this migration.
+CREATE TABLE IF NOT EXISTS key_log_frontier (
+    id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    tree_size BIGINT NOT NULL,
+    nodes BYTEA[] NOT NULL
+);
@@ -0,0 +1,4 @@
+ALTER TABLE slash_commands DROP COLUMN IF EXISTS secret_sealed;
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS payload_sealed;
+ALTER TABLE webhooks DROP COLUMN IF EXISTS secret_sealed;
+ALTER TABLE messages DROP COLUMN IF EXISTS sealed;
@@ -0,0 +1,15 @@
+-- Whether a value is sealed at rest is stored next to it instead of being
+-- guessed from the nwa:v1: prefix, which plaintext can start with too. Values
+-- written before this migration are sealed if they have the prefix, except
+-- end-to-end encrypted messages, which are never sealed.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS sealed BOOLEAN NOT NULL DEFAULT false;
+UPDATE messages SET sealed = true WHERE NOT encrypted AND content LIKE 'nwa:v1:%';
+
+ALTER TABLE webhooks ADD COLUMN IF NOT EXISTS secret_sealed BOOLEAN NOT NULL DEFAULT false;
+UPDATE webhooks SET secret_sealed = true WHERE secret LIKE 'nwa:v1:%';
+
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS payload_sealed BOOLEAN NOT NULL DEFAULT false;
+UPDATE webhook_deliveries SET payload_sealed = true WHERE payload LIKE 'nwa:v1:%';
+
+ALTER TABLE slash_commands ADD COLUMN IF NOT EXISTS secret_sealed BOOLEAN NOT NULL DEFAULT false;
+UPDATE slash_commands SET secret_sealed = true WHERE secret LIKE 'nwa:v1:%';
@@ -0,0 +1,4 @@
+-- Sealed secrets can't be converted back; unseal them first with
+-- cmd/reencrypt -unseal
+ALTER TABLE user_totp DROP COLUMN IF EXISTS master_key_id;
+ALTER TABLE user_totp ALTER COLUMN secret TYPE TEXT USING convert_from(secret, 'UTF8');
@@ -0,0 +1,5 @@
+-- TOTP secrets are sealed with a master key when master_key_id is set, like
+-- signing keys. Secrets stored before this migration stay plaintext until
+-- cmd/reencrypt seals them.
+ALTER TABLE user_totp ALTER COLUMN secret TYPE BYTEA USING convert_to(secret, 'UTF8');
+ALTER TABLE user_totp ADD COLUMN IF NOT EXISTS master_key_id TEXT;
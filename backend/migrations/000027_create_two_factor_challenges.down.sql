@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_two_factor_challenges_expires_at;
+DROP TABLE IF EXISTS two_factor_challenges;
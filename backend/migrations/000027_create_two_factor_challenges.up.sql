@@ -0,0 +1,12 @@
+-- Second login steps in progress. A challenge is handed out in place of a
+-- session, stored hashed, deleted once a code is accepted, and allows only a
+-- few wrong codes.
+CREATE TABLE IF NOT EXISTS two_factor_challenges (
+    challenge_hash BYTEA PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_two_factor_challenges_expires_at ON two_factor_challenges(expires_at);
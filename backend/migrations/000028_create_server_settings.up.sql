@@ -0,0 +1,10 @@
+-- Settings admins can change while the server is running. It has a single
+-- row.
+CREATE TABLE IF NOT EXISTS server_settings (
+    id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    require_two_factor BOOLEAN NOT NULL DEFAULT false,
+    updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO server_settings (id) VALUES (true) ON CONFLICT (id) DO NOTHING;
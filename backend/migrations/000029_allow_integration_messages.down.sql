@@ -0,0 +1,5 @@
+-- Integration messages are kept as text, showing their JSON content
+UPDATE messages SET message_type = 'text' WHERE message_type = 'integration';
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_message_type_check;
+ALTER TABLE messages ADD CONSTRAINT messages_message_type_check
+    CHECK (message_type IN ('text', 'image', 'file', 'system'));
@@ -0,0 +1,4 @@
+-- Allow integration messages, which carry attachments as JSON content
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_message_type_check;
+ALTER TABLE messages ADD CONSTRAINT messages_message_type_check
+    CHECK (message_type IN ('text', 'image', 'file', 'system', 'integration'));
@@ -12,10 +12,16 @@ import (
 )
 
 func RunMigrations(db *sql.DB) error {
+	return RunMigrationsFrom(db, "migrations")
+}
+
+// RunMigrationsFrom applies the migrations in dir that have not been applied
+// yet
+func RunMigrationsFrom(db *sql.DB, dir string) error {
 	log.Println("Starting migrations...")
 
 	// Get the absolute path to the migrations directory
-	migrationsDir, err := filepath.Abs("migrations")
+	migrationsDir, err := filepath.Abs(dir)
 	if err != nil {
 		return fmt.Errorf("error getting migrations directory path: %v", err)
 	}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+)
+
+// Attachment is the server's record of an uploaded blob. The server only ever
+// sees ciphertext, so nothing here reveals the file's content or type.
+type Attachment struct {
+	ID             string     `json:"id"`
+	ConversationID string     `json:"conversation_id"`
+	UploaderID     string     `json:"uploader_id"`
+	Size           int64      `json:"size"`
+	Digest         []byte     `json:"digest"`
+	Status         string     `json:"status"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UploadedAt     *time.Time `json:"uploaded_at,omitempty"`
+}
+
+// AttachmentPointer is what a client puts inside an end-to-end encrypted
+// message body to reference an attachment. It never reaches the server in
+// the clear.
+type AttachmentPointer struct {
+	ID          string `json:"id"`
+	Key         []byte `json:"key"`
+	Digest      []byte `json:"digest"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	FileName    string `json:"file_name,omitempty"`
+}
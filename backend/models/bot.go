@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+// APIToken is a long-lived token a bot authenticates with. The token itself
+// is only shown once, when it is created.
+type APIToken struct {
+	ID              string     `json:"id"`
+	BotID           string     `json:"bot_id"`
+	Name            string     `json:"name"`
+	Scopes          []string   `json:"scopes"`
+	ConversationIDs []string   `json:"conversation_ids"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastUsedAt      *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	RevokedAt       *time.Time `json:"revoked_at,omitempty"`
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+)
+
+// KeyLogLeaf is the content committed to by a key log leaf. Its JSON encoding
+// is hashed into the tree, so auditors should always decode leaf data rather
+// than trust the other fields of KeyLogEntry.
+type KeyLogLeaf struct {
+	UserID    string    `json:"user_id"`
+	PublicKey string    `json:"public_key"`
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type KeyLogEntry struct {
+	LeafIndex uint64    `json:"leaf_index"`
+	UserID    string    `json:"user_id"`
+	PublicKey string    `json:"public_key"`
+	Event     string    `json:"event"`
+	LeafData  []byte    `json:"leaf_data"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// KeyLogProof is the audit path for a single entry
+type KeyLogProof struct {
+	LeafIndex uint64   `json:"leaf_index"`
+	TreeSize  uint64   `json:"tree_size"`
+	AuditPath [][]byte `json:"audit_path"`
+}
+
+// KeyLogConsistency proves that one tree head extends another
+type KeyLogConsistency struct {
+	First  uint64   `json:"first"`
+	Second uint64   `json:"second"`
+	Proof  [][]byte `json:"proof"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// SafetyNumber describes the verification state between a user and one of
+// their contacts
+type SafetyNumber struct {
+	ContactID          string     `json:"contactId"`
+	SafetyNumber       string     `json:"safetyNumber"`
+	Fingerprint        string     `json:"fingerprint"`
+	ContactFingerprint string     `json:"contactFingerprint"`
+	Verified           bool       `json:"verified"`
+	VerifiedAt         *time.Time `json:"verifiedAt,omitempty"`
+}
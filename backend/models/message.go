@@ -5,16 +5,21 @@ import (
 )
 
 type Message struct {
-	ID             string    `json:"id"`
-	ConversationID string    `json:"conversation_id"`
-	Content        string    `json:"content"`
-	SenderID       string    `json:"sender_id"`
-	Encrypted      bool      `json:"encrypted"`
-	MessageType    string    `json:"message_type"`
-	CreatedAt      time.Time `json:"created_at"`
-	DeliveredAt    time.Time `json:"delivered_at"`
-	ReadAt         time.Time `json:"read_at"`
-	Sender         User      `json:"sender"`
+	ID             string `json:"id"`
+	ConversationID string `json:"conversation_id"`
+	Content        string `json:"content"`
+	SenderID       string `json:"sender_id"`
+	Encrypted      bool   `json:"encrypted"`
+	MessageType    string `json:"message_type"`
+	// Bot is set on messages sent by a bot account
+	Bot bool `json:"bot"`
+	// DisplayName replaces the sender's name on messages posted by an
+	// integration
+	DisplayName string    `json:"display_name,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	DeliveredAt time.Time `json:"delivered_at"`
+	ReadAt      time.Time `json:"read_at"`
+	Sender      User      `json:"sender"`
 }
 
 func (db *DB) CreateMessage(message *Message) error {
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// ServerSettings are the settings admins can change while the server is
+// running
+type ServerSettings struct {
+	// RequireTwoFactor makes every user set up TOTP before they can sign in
+	RequireTwoFactor bool `json:"require_two_factor"`
+	// RequireTwoFactorByConfig is set when REQUIRE_TWO_FACTOR turns the
+	// requirement on regardless of RequireTwoFactor
+	RequireTwoFactorByConfig bool      `json:"require_two_factor_by_config"`
+	UpdatedBy                string    `json:"updated_by,omitempty"`
+	UpdatedAt                time.Time `json:"updated_at"`
+}
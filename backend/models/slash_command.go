@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+// SlashCommand is a command that can be run in a conversation. Built-in
+// commands have no ID or bot; the others are handled by a bot's endpoint.
+type SlashCommand struct {
+	ID             string     `json:"id,omitempty"`
+	ConversationID string     `json:"conversation_id,omitempty"`
+	BotID          string     `json:"bot_id,omitempty"`
+	Name           string     `json:"name"`
+	Description    string     `json:"description"`
+	Usage          string     `json:"usage"`
+	URL            string     `json:"url,omitempty"`
+	Builtin        bool       `json:"builtin"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+}
@@ -0,0 +1,16 @@
+package models
+
+// TwoFactorEnrollment is a TOTP secret the user is setting up
+type TwoFactorEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauthUri"`
+	// QRCode is a data: URL of a PNG encoding OTPAuthURI
+	QRCode string `json:"qrCode"`
+}
+
+// TwoFactorStatus describes a user's second factor
+type TwoFactorStatus struct {
+	Enabled                bool `json:"enabled"`
+	Required               bool `json:"required"`
+	RecoveryCodesRemaining int  `json:"recoveryCodesRemaining"`
+}
@@ -7,32 +7,71 @@ import (
 
 type User struct {
 	ID        string    `json:"id"`
-	GoogleID  string    `json:"googleId"`
 	Email     string    `json:"email"`
 	Name      string    `json:"name"`
 	AvatarURL string    `json:"avatarUrl"`
 	PublicKey string    `json:"publicKey"`
 	CreatedAt time.Time `json:"createdAt"`
 	LastSeen  time.Time `json:"lastSeen"`
+	// TwoFactorEnabled is only filled in for the signed in user
+	TwoFactorEnabled bool `json:"twoFactorEnabled"`
+	// IsBot marks bot accounts, which belong to BotOwnerID
+	IsBot      bool   `json:"isBot"`
+	BotOwnerID string `json:"botOwnerId,omitempty"`
+	// Role is RoleUser or RoleAdmin, only filled in for the signed in user
+	Role string `json:"role,omitempty"`
 }
 
+// Roles of users
+const (
+	RoleUser = "user"
+	// RoleAdmin may use the admin API
+	RoleAdmin = "admin"
+)
+
 type DB struct {
 	*sql.DB
 }
 
 func (db *DB) CreateOrUpdateUser(googleID, email, name, avatarURL, publicKey string) (*User, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	query := `
-		INSERT INTO users (google_id, email, name, avatar_url, public_key, last_seen)
-		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)
-		ON CONFLICT (google_id) DO UPDATE
-		SET email = $2, name = $3, avatar_url = $4, public_key = $5, last_seen = CURRENT_TIMESTAMP
-		RETURNING id, google_id, email, name, avatar_url, public_key, created_at, last_seen
+		INSERT INTO users (email, name, avatar_url, public_key, last_seen)
+		SELECT $2, $3, $4, $5, CURRENT_TIMESTAMP
+		WHERE NOT EXISTS (
+			SELECT 1 FROM user_identities WHERE provider = 'google' AND subject = $1
+		)
+		ON CONFLICT (email) DO NOTHING
+	`
+	if _, err := tx.Exec(query, googleID, email, name, avatarURL, publicKey); err != nil {
+		return nil, err
+	}
+
+	query = `
+		INSERT INTO user_identities (provider, subject, user_id, email)
+		SELECT 'google', $1, id, $2 FROM users WHERE email = $2
+		ON CONFLICT (provider, subject) DO UPDATE
+		SET email = $2, last_login_at = CURRENT_TIMESTAMP
+	`
+	if _, err := tx.Exec(query, googleID, email); err != nil {
+		return nil, err
+	}
+
+	query = `
+		UPDATE users
+		SET name = $2, avatar_url = $3, public_key = $4, last_seen = CURRENT_TIMESTAMP
+		WHERE id = (SELECT user_id FROM user_identities WHERE provider = 'google' AND subject = $1)
+		RETURNING id, email, name, avatar_url, public_key, created_at, last_seen
 	`
 
 	user := &User{}
-	err := db.QueryRow(query, googleID, email, name, avatarURL, publicKey).Scan(
+	err = tx.QueryRow(query, googleID, name, avatarURL, publicKey).Scan(
 		&user.ID,
-		&user.GoogleID,
 		&user.Email,
 		&user.Name,
 		&user.AvatarURL,
@@ -45,12 +84,16 @@ func (db *DB) CreateOrUpdateUser(googleID, email, name, avatarURL, publicKey str
 		return nil, err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
 
 func (db *DB) GetUserByID(id string) (*User, error) {
 	query := `
-		SELECT id, google_id, email, name, avatar_url, public_key, created_at, last_seen
+		SELECT id, email, name, avatar_url, public_key, created_at, last_seen
 		FROM users
 		WHERE id = $1
 	`
@@ -58,7 +101,6 @@ func (db *DB) GetUserByID(id string) (*User, error) {
 	user := &User{}
 	err := db.QueryRow(query, id).Scan(
 		&user.ID,
-		&user.GoogleID,
 		&user.Email,
 		&user.Name,
 		&user.AvatarURL,
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// UserIdentity links a user to an account at an identity provider
+type UserIdentity struct {
+	Provider    string    `json:"provider"`
+	Subject     string    `json:"subject"`
+	UserID      string    `json:"userId"`
+	Email       string    `json:"email"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastLoginAt time.Time `json:"lastLoginAt"`
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+)
+
+// Webhook is an HTTP endpoint subscribed to events in a conversation. Its
+// signing secret is only shown once, when it is created.
+type Webhook struct {
+	ID             string    `json:"id"`
+	ConversationID string    `json:"conversation_id"`
+	CreatedBy      string    `json:"created_by"`
+	URL            string    `json:"url"`
+	Events         []string  `json:"events"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event sent, or still to be sent, to a webhook
+type WebhookDelivery struct {
+	ID             string     `json:"id"`
+	WebhookID      string     `json:"webhook_id"`
+	EventID        string     `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	ResponseStatus *int       `json:"response_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// IncomingWebhook is a URL integrations post messages to a conversation
+// through, as the integration user UserID. Its token is only shown once,
+// when it is created.
+type IncomingWebhook struct {
+	ID             string     `json:"id"`
+	ConversationID string     `json:"conversation_id"`
+	CreatedBy      string     `json:"created_by"`
+	UserID         string     `json:"user_id"`
+	Name           string     `json:"name"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+}
@@ -0,0 +1,235 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Codec encodes frames for the clients of a subprotocol and decodes the
+// frames they send
+type Codec interface {
+	// Name is the codec's part of the subprotocol name, such as json
+	Name() string
+	// Binary reports whether frames are sent in binary WebSocket messages
+	Binary() bool
+	Encode(frame any) ([]byte, error)
+	// Decode decodes a frame into the frame of its type as strictly as
+	// the package level Decode
+	Decode(data []byte) (Inbound, error)
+	// Header reads the type and temp_id of a frame leniently
+	Header(data []byte) Header
+}
+
+// Codecs
+var (
+	// JSON sends frames as JSON text messages
+	JSON Codec = jsonCodec{}
+	// MessagePack sends frames as MessagePack binary messages, with the same
+	// field names as JSON. Timestamps use the MessagePack timestamp
+	// extension.
+	MessagePack Codec = msgpackCodec{}
+)
+
+// Subprotocol is a Sec-WebSocket-Protocol the server speaks
+type Subprotocol struct {
+	Name    string
+	Codec   Codec
+	Version int
+}
+
+// Subprotocols lists the subprotocols the server speaks, in the order they
+// are preferred
+var Subprotocols = []Subprotocol{
+	{Name: "nwa.json.v1", Codec: JSON, Version: Version1},
+	{Name: "nwa.msgpack.v1", Codec: MessagePack, Version: Version1},
+}
+
+// SelectSubprotocol picks the first subprotocol offered by a client that the
+// server speaks
+func SelectSubprotocol(offered []string) (Subprotocol, bool) {
+	for _, name := range offered {
+		for _, subprotocol := range Subprotocols {
+			if subprotocol.Name == name {
+				return subprotocol, true
+			}
+		}
+	}
+	return Subprotocol{}, false
+}
+
+// SubprotocolNames lists the names of Subprotocols
+func SubprotocolNames() []string {
+	names := make([]string, len(Subprotocols))
+	for i, subprotocol := range Subprotocols {
+		names[i] = subprotocol.Name
+	}
+	return names
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                        { return "json" }
+func (jsonCodec) Binary() bool                        { return false }
+func (jsonCodec) Encode(frame any) ([]byte, error)    { return json.Marshal(frame) }
+func (jsonCodec) Decode(data []byte) (Inbound, error) { return Decode(data) }
+func (jsonCodec) Header(data []byte) Header           { return ReadHeader(data) }
+
+// msgpackHandle encodes structs by their json tags. Decoding with it fails on
+// unknown fields; msgpackLenientHandle is used to read headers.
+var msgpackHandle, msgpackLenientHandle = newMsgpackHandle(true), newMsgpackHandle(false)
+
+func newMsgpackHandle(strict bool) *codec.MsgpackHandle {
+	handle := &codec.MsgpackHandle{WriteExt: true}
+	handle.RawToString = true
+	handle.ErrorIfNoField = strict
+	return handle
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) Binary() bool { return true }
+
+func (msgpackCodec) Encode(frame any) ([]byte, error) {
+	var data []byte
+	err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(frame)
+	return data, err
+}
+
+func (c msgpackCodec) Decode(data []byte) (Inbound, error) {
+	header := c.Header(data)
+	if header.Type == "" {
+		return nil, fmt.Errorf("%w: missing type", ErrInvalidFrame)
+	}
+	spec, ok := findFrame(inboundFrames, header.Type)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidFrame, header.Type)
+	}
+
+	frame := reflect.New(reflect.TypeOf(spec.frame)).Interface()
+	decoder := codec.NewDecoderBytes(data, msgpackHandle)
+	if err := decoder.Decode(frame); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFrame, err)
+	}
+	if decoder.NumBytesRead() != len(data) {
+		return nil, fmt.Errorf("%w: data after the frame", ErrInvalidFrame)
+	}
+	return frame.(Inbound), nil
+}
+
+func (msgpackCodec) Header(data []byte) Header {
+	var header map[string]any
+	codec.NewDecoderBytes(data, msgpackLenientHandle).Decode(&header)
+	typ, _ := header["type"].(string)
+	tempID, _ := header["temp_id"].(string)
+	return Header{Type: typ, TempID: tempID}
+}
+
+// findFrame looks up a frame type in inboundFrames or outboundFrames
+func findFrame(specs []frameSpec, typ string) (frameSpec, bool) {
+	for _, spec := range specs {
+		if spec.typ == typ {
+			return spec, true
+		}
+	}
+	return frameSpec{}, false
+}
+
+// Payload is an outbound frame that is encoded at most once per codec, no
+// matter how many clients it is sent to
+type Payload struct {
+	mu    sync.Mutex
+	frame any
+	// encoded caches the encoding of the frame by codec
+	encoded map[Codec][]byte
+	// key caches CoalesceKey once keyed is set
+	key   string
+	keyed bool
+}
+
+// NewPayload wraps an outbound frame such as a Message
+func NewPayload(frame any) *Payload {
+	return &Payload{frame: frame, encoded: make(map[Codec][]byte)}
+}
+
+// RawPayload wraps a frame already encoded as JSON, such as one received from
+// another node. It is decoded into its frame type if another codec needs it.
+func RawPayload(data []byte) *Payload {
+	return &Payload{encoded: map[Codec][]byte{JSON: data}}
+}
+
+// Encode returns the frame encoded with codec
+func (p *Payload) Encode(c Codec) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if data, ok := p.encoded[c]; ok {
+		return data, nil
+	}
+	if p.frame == nil {
+		frame, err := decodeOutbound(p.encoded[JSON])
+		if err != nil {
+			return nil, err
+		}
+		p.frame = frame
+	}
+	data, err := c.Encode(p.frame)
+	if err != nil {
+		return nil, err
+	}
+	p.encoded[c] = data
+	return data, nil
+}
+
+// JSON returns the frame encoded as JSON, the encoding sent between nodes
+func (p *Payload) JSON() ([]byte, error) {
+	return p.Encode(JSON)
+}
+
+// CoalesceKey returns the key of an ephemeral frame, such as a typing
+// indicator, that a newer frame with the same key supersedes. It is empty for
+// frames that must all be delivered, such as messages.
+func (p *Payload) CoalesceKey() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keyed {
+		return p.key
+	}
+	p.keyed = true
+	if p.frame == nil {
+		// Only frames of ephemeral types are worth decoding
+		if !ephemeralTypes[ReadHeader(p.encoded[JSON]).Type] {
+			return ""
+		}
+		frame, err := decodeOutbound(p.encoded[JSON])
+		if err != nil {
+			return ""
+		}
+		p.frame = frame
+	}
+	if frame, ok := p.frame.(coalescer); ok {
+		p.key = frame.coalesceKey()
+	}
+	return p.key
+}
+
+// decodeOutbound decodes a JSON frame sent by the server into its frame
+// type, or a map for types it doesn't know
+func decodeOutbound(data []byte) (any, error) {
+	spec, ok := findFrame(outboundFrames, ReadHeader(data).Type)
+	if !ok {
+		var frame map[string]any
+		err := json.Unmarshal(data, &frame)
+		return frame, err
+	}
+	frame := reflect.New(reflect.TypeOf(spec.frame)).Interface()
+	if err := json.Unmarshal(data, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
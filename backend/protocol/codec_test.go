@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var codecs = []Codec{JSON, MessagePack}
+
+// testMessage returns a message like the ones fanned out to clients, with
+// content of the given length
+func testMessage(content int) Message {
+	return Message{
+		Type:           TypeMessage,
+		ID:             "5b0e8c43-7f5b-4d7e-9a57-9f2d0e7c1a10",
+		ConversationID: "0c9d7c1e-9a51-4a55-8b0d-3f1cb9b6c1d2",
+		Content:        strings.Repeat("a", content),
+		MessageType:    "text",
+		Sender: &Sender{
+			ID:        "a8f1d5e0-2c4b-4a7e-8f8a-1b2c3d4e5f60",
+			Name:      "Ada Lovelace",
+			AvatarURL: "https://example.com/avatars/ada.png",
+		},
+		Timestamp: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func testSendMessage() SendMessage {
+	return SendMessage{
+		Type:           TypeMessage,
+		ConversationID: "0c9d7c1e-9a51-4a55-8b0d-3f1cb9b6c1d2",
+		Content:        strings.Repeat("a", 200),
+		TempID:         "temp-1760000000000",
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range codecs {
+		t.Run(codec.Name(), func(t *testing.T) {
+			data, err := codec.Encode(testSendMessage())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header := codec.Header(data); header.Type != TypeMessage || header.TempID != "temp-1760000000000" {
+				t.Errorf("header = %+v", header)
+			}
+			frame, err := codec.Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := frame.(*SendMessage); !ok || *got != testSendMessage() {
+				t.Errorf("decoded %#v, want %#v", frame, testSendMessage())
+			}
+		})
+	}
+}
+
+func TestMessagePackDecodeIsStrict(t *testing.T) {
+	encode := func(frame any) []byte {
+		t.Helper()
+		data, err := MessagePack.Encode(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	for name, data := range map[string][]byte{
+		"missing type":  encode(map[string]any{"content": "hi"}),
+		"unknown type":  encode(map[string]any{"type": "reaction"}),
+		"unknown field": encode(map[string]any{"type": "message", "content": "hi", "contnet": "typo"}),
+		"trailing data": append(encode(map[string]any{"type": "ping"}), encode(map[string]any{"type": "ping"})...),
+	} {
+		if _, err := MessagePack.Decode(data); !errors.Is(err, ErrInvalidFrame) {
+			t.Errorf("%s: error = %v, want ErrInvalidFrame", name, err)
+		}
+	}
+}
+
+func TestSelectSubprotocol(t *testing.T) {
+	subprotocol, ok := SelectSubprotocol([]string{"chat", "nwa.msgpack.v1", "nwa.json.v1"})
+	if !ok || subprotocol.Codec != MessagePack || subprotocol.Version != Version1 {
+		t.Errorf("selected %+v, want nwa.msgpack.v1", subprotocol)
+	}
+	if _, ok := SelectSubprotocol([]string{"nwa.json.v2"}); ok {
+		t.Error("selected a subprotocol the server doesn't speak")
+	}
+	if names := SubprotocolNames(); len(names) != 2 || names[0] != "nwa.json.v1" {
+		t.Errorf("names = %v", names)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	message := testMessage(10)
+	payload := NewPayload(message)
+	first, err := payload.Encode(MessagePack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := payload.Encode(MessagePack)
+	if &first[0] != &second[0] {
+		t.Error("payload was encoded twice for the same codec")
+	}
+	if payload.CoalesceKey() != "" {
+		t.Error("a message has a coalesce key")
+	}
+
+	// Frames from other nodes arrive as JSON and are decoded for other codecs
+	data, _ := json.Marshal(message)
+	raw := RawPayload(data)
+	got, err := raw.Encode(MessagePack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(first) {
+		t.Error("raw payload encodes differently from the frame")
+	}
+
+	typing, _ := json.Marshal(UserTyping{Type: TypeTyping, ConversationID: "c1", UserID: "u1"})
+	if key := RawPayload(typing).CoalesceKey(); key != "typing:c1:u1" {
+		t.Errorf("typing coalesce key = %q", key)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	message := testMessage(200)
+	for _, codec := range codecs {
+		b.Run(codec.Name(), func(b *testing.B) {
+			frame, err := codec.Encode(message)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(frame)))
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.Encode(message); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, codec := range codecs {
+		b.Run(codec.Name(), func(b *testing.B) {
+			frame, err := codec.Encode(testSendMessage())
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(frame)))
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.Decode(frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkFanOut delivers one message to clients split between the codecs,
+// encoding it for every client or once per codec with a Payload
+func BenchmarkFanOut(b *testing.B) {
+	message := testMessage(200)
+	const clients = 1000
+	perClient := make([]Codec, clients)
+	for i := range perClient {
+		perClient[i] = codecs[i%len(codecs)]
+	}
+
+	b.Run(fmt.Sprintf("%d/per-client", clients), func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, codec := range perClient {
+				if _, err := codec.Encode(message); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run(fmt.Sprintf("%d/per-codec", clients), func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			payload := NewPayload(message)
+			for _, codec := range perClient {
+				if _, err := payload.Encode(codec); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
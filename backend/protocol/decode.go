@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	// ErrInvalidFrame is returned for frames that aren't a JSON object with
+	// a known type and known fields
+	ErrInvalidFrame = errors.New("invalid frame")
+)
+
+// Header holds the fields used to answer a frame, read leniently so a frame
+// that fails to decode can still be answered
+type Header struct {
+	Type   string `json:"type"`
+	TempID string `json:"temp_id"`
+}
+
+// ReadHeader reads the type and temp_id of a frame, leaving them empty if
+// the frame isn't a JSON object or they aren't strings
+func ReadHeader(data []byte) Header {
+	var header struct {
+		Type   any `json:"type"`
+		TempID any `json:"temp_id"`
+	}
+	json.NewDecoder(bytes.NewReader(data)).Decode(&header)
+	typ, _ := header.Type.(string)
+	tempID, _ := header.TempID.(string)
+	return Header{Type: typ, TempID: tempID}
+}
+
+// Decode decodes a frame sent by a client into the frame of its type, such
+// as *SendMessage. Unknown types, unknown fields and fields of the wrong type
+// are rejected with an error wrapping ErrInvalidFrame.
+func Decode(data []byte) (Inbound, error) {
+	header := ReadHeader(data)
+	if header.Type == "" {
+		return nil, fmt.Errorf("%w: missing type", ErrInvalidFrame)
+	}
+
+	spec, ok := findFrame(inboundFrames, header.Type)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidFrame, header.Type)
+	}
+
+	frame := reflect.New(reflect.TypeOf(spec.frame)).Interface()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(frame); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFrame, err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("%w: data after the frame", ErrInvalidFrame)
+	}
+	return frame.(Inbound), nil
+}
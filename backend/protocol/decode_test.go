@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	frame, err := Decode([]byte(`{"type":"message","conversation_id":"c1","content":"hi","temp_id":"t1","timestamp":"2026-01-02T03:04:05Z"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, ok := frame.(*SendMessage)
+	if !ok {
+		t.Fatalf("frame is %T, want *SendMessage", frame)
+	}
+	if message.ConversationID != "c1" || message.Content != "hi" || message.TempID != "t1" || message.Timestamp == nil {
+		t.Errorf("message = %+v", message)
+	}
+
+	if frame, err := Decode([]byte(`{"type":"ping"}`)); err != nil {
+		t.Errorf("ping: %v", err)
+	} else if _, ok := frame.(*Ping); !ok {
+		t.Errorf("frame is %T, want *Ping", frame)
+	}
+	if frame, err := Decode([]byte(`{"type":"typing","conversation_id":"c1"}`)); err != nil {
+		t.Errorf("typing: %v", err)
+	} else if typing, ok := frame.(*Typing); !ok || typing.ConversationID != "c1" {
+		t.Errorf("frame = %#v, want typing in c1", frame)
+	}
+}
+
+func TestDecodeRejectsInvalidFrames(t *testing.T) {
+	for name, data := range map[string]string{
+		"not JSON":          `hello`,
+		"not an object":     `["ping"]`,
+		"missing type":      `{"content":"hi"}`,
+		"type not a string": `{"type":1}`,
+		"unknown type":      `{"type":"reaction"}`,
+		// Only the server sends these
+		"outbound type": `{"type":"pong"}`,
+		"unknown field": `{"type":"message","conversation_id":"c1","content":"hi","contnet":"typo"}`,
+		"wrong type":    `{"type":"message","conversation_id":"c1","content":1}`,
+		"trailing data": `{"type":"ping"}{"type":"ping"}`,
+	} {
+		if _, err := Decode([]byte(data)); !errors.Is(err, ErrInvalidFrame) {
+			t.Errorf("%s: error = %v, want ErrInvalidFrame", name, err)
+		}
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	for data, want := range map[string]Header{
+		`{"type":"message","temp_id":"t1","content":1}`: {Type: "message", TempID: "t1"},
+		`{"type":"message","temp_id":5}`:                {Type: "message"},
+		`{"type":["message"],"temp_id":"t1"}`:           {TempID: "t1"},
+		`not JSON`:                                      {},
+	} {
+		if got := ReadHeader([]byte(data)); got != want {
+			t.Errorf("ReadHeader(%s) = %+v, want %+v", data, got, want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package protocol
+
+import "time"
+
+// Inbound is a frame sent by a client
+type Inbound interface {
+	inbound()
+}
+
+// Ping asks the server for a pong, to keep the connection alive
+type Ping struct {
+	Type string `json:"type"`
+	// Timestamp is when the client sent the frame; it is not used
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+// Typing tells the other participants the sender is typing
+type Typing struct {
+	Type           string `json:"type"`
+	ConversationID string `json:"conversation_id"`
+}
+
+// SendMessage sends a chat message to a conversation, or to a user in the
+// direct conversation with them
+type SendMessage struct {
+	Type           string `json:"type"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	RecipientID    string `json:"recipient_id,omitempty"`
+	Content        string `json:"content"`
+	Encrypted      bool   `json:"encrypted,omitempty"`
+	// MessageType is text, image or file, text if empty
+	MessageType string `json:"message_type,omitempty"`
+	// TempID is echoed in the sender's copy of the stored message, or in the
+	// error frame if it couldn't be sent
+	TempID string `json:"temp_id,omitempty"`
+	// Timestamp is when the client sent the frame; it is not used
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+func (*Ping) inbound()        {}
+func (*Typing) inbound()      {}
+func (*SendMessage) inbound() {}
+
+// Connected is the first frame of every connection
+type Connected struct {
+	Type string `json:"type"`
+	// Version is the protocol version used on the connection
+	Version int `json:"version"`
+	// StreamID identifies a Server-Sent Events or long polling connection,
+	// to send frames to and poll it with
+	StreamID  string    `json:"stream_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	ID        string    `json:"id"`
+}
+
+// Pong answers a ping
+type Pong struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	ID        string    `json:"id"`
+}
+
+// Sender is the author of a message
+type Sender struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatarUrl"`
+}
+
+// Message is a stored chat message, or an ephemeral reply to a slash command
+// that only its sender sees
+type Message struct {
+	Type           string `json:"type"`
+	ID             string `json:"id"`
+	ConversationID string `json:"conversation_id"`
+	Content        string `json:"content"`
+	Encrypted      bool   `json:"encrypted"`
+	MessageType    string `json:"message_type"`
+	Bot            bool   `json:"bot"`
+	// DisplayName is the name the message was posted under, if it differs
+	// from the sender's
+	DisplayName string  `json:"display_name,omitempty"`
+	Sender      *Sender `json:"sender,omitempty"`
+	// TempID is only sent to the connection that sent the message
+	TempID    string    `json:"temp_id,omitempty"`
+	Ephemeral bool      `json:"ephemeral,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// UserTyping tells a participant that another one is typing
+type UserTyping struct {
+	Type           string    `json:"type"`
+	ConversationID string    `json:"conversation_id"`
+	UserID         string    `json:"user_id"`
+	Name           string    `json:"name"`
+	Timestamp      time.Time `json:"timestamp"`
+	ID             string    `json:"id"`
+}
+
+// coalesceKey lets a user's newer typing indicator for a conversation replace
+// one still waiting to be sent
+func (f UserTyping) coalesceKey() string {
+	return TypeTyping + ":" + f.ConversationID + ":" + f.UserID
+}
+
+// Error reports a frame the server could not handle
+type Error struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Budget is the rate limit budget that ran out, for rate_limited errors
+	Budget string `json:"budget,omitempty"`
+	// RetryAfterMS is how long to wait before sending again, for
+	// rate_limited errors
+	RetryAfterMS int64 `json:"retry_after_ms,omitempty"`
+	// TempID is the temp_id of the frame that failed
+	TempID string `json:"temp_id,omitempty"`
+	ID     string `json:"id"`
+}
+
+// Reconnect asks the client to reconnect after a delay, because the server
+// is shutting down
+type Reconnect struct {
+	Type         string    `json:"type"`
+	RetryAfterMS int64     `json:"retry_after_ms"`
+	Timestamp    time.Time `json:"timestamp"`
+	ID           string    `json:"id"`
+}
+
+// Announcement is a system announcement sent by an admin to everyone, or to
+// the participants of a conversation. Announcements are not stored.
+type Announcement struct {
+	Type string `json:"type"`
+	// ConversationID is set for announcements to one conversation
+	ConversationID string    `json:"conversation_id,omitempty"`
+	Text           string    `json:"text"`
+	Timestamp      time.Time `json:"timestamp"`
+	ID             string    `json:"id"`
+}
+
+// Close is the last frame of a Server-Sent Events or long polling
+// connection, with the WebSocket close code it would have been closed with
+type Close struct {
+	Type   string `json:"type"`
+	Code   int    `json:"code"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// coalescer is implemented by ephemeral frames, which only matter until a
+// newer one with the same key is sent
+type coalescer interface {
+	coalesceKey() string
+}
+
+// ephemeralTypes are the outbound frame types whose frames implement
+// coalescer
+var ephemeralTypes = map[string]bool{
+	TypeTyping: true,
+}
+
+// frameSpec describes a frame type for decoding and the schema
+type frameSpec struct {
+	typ         string
+	frame       any
+	description string
+}
+
+// inboundFrames are the frames clients may send
+var inboundFrames = []frameSpec{
+	{TypePing, Ping{}, "Asks the server for a pong, to keep the connection alive"},
+	{TypeTyping, Typing{}, "Tells the other participants of a conversation that the sender is typing"},
+	{TypeMessage, SendMessage{}, "Sends a chat message to a conversation, or to a user in the direct conversation with them"},
+}
+
+// outboundFrames are the frames the server sends
+var outboundFrames = []frameSpec{
+	{TypeConnected, Connected{}, "First frame of every connection, with the negotiated protocol version"},
+	{TypePong, Pong{}, "Answers a ping"},
+	{TypeMessage, Message{}, "A stored chat message, or an ephemeral reply to a slash command that only its sender sees"},
+	{TypeTyping, UserTyping{}, "Another participant of a conversation is typing"},
+	{TypeError, Error{}, "A frame could not be handled"},
+	{TypeReconnect, Reconnect{}, "The server is shutting down; reconnect after retry_after_ms"},
+	{TypeAnnouncement, Announcement{}, "A system announcement from an admin, to everyone or to the participants of a conversation"},
+	{TypeClose, Close{}, "Last frame of a Server-Sent Events or long polling connection, with the WebSocket close code it was closed with"},
+}
@@ -0,0 +1,86 @@
+// Package protocol defines the frames exchanged over the WebSocket, how they
+// are decoded and the JSON Schema describing them.
+//
+// Every frame is a JSON object whose "type" field selects its shape. Frames
+// sent by clients are decoded strictly: unknown types and unknown fields are
+// rejected rather than ignored, so clients find out about typos and version
+// mismatches instead of having fields silently dropped.
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Protocol versions the server speaks
+const (
+	Version1 = 1
+	// CurrentVersion is used by clients that don't ask for a version
+	CurrentVersion = Version1
+)
+
+// SupportedVersions lists the versions the server speaks, newest first
+var SupportedVersions = []int{Version1}
+
+// Negotiate picks the newest version the server speaks among the comma
+// separated versions a client offered, such as "2,1". A client that offered
+// none gets CurrentVersion. It returns false if no offered version is
+// supported.
+func Negotiate(offered string) (int, bool) {
+	if strings.TrimSpace(offered) == "" {
+		return CurrentVersion, true
+	}
+
+	accepted := make(map[int]bool)
+	for _, value := range strings.Split(offered, ",") {
+		version, err := strconv.Atoi(strings.TrimSpace(value))
+		if err == nil {
+			accepted[version] = true
+		}
+	}
+	for _, version := range SupportedVersions {
+		if accepted[version] {
+			return version, true
+		}
+	}
+	return 0, false
+}
+
+// Frame types sent by clients
+const (
+	TypePing    = "ping"
+	TypeTyping  = "typing"
+	TypeMessage = "message"
+)
+
+// Frame types sent by the server, besides TypeTyping and TypeMessage
+const (
+	TypeConnected = "connected"
+	TypePong      = "pong"
+	TypeError     = "error"
+	TypeReconnect = "reconnect"
+	// TypeAnnouncement is a system announcement from an admin
+	TypeAnnouncement = "announcement"
+	// TypeClose is only sent over Server-Sent Events and long polling
+	TypeClose = "close"
+)
+
+// Error codes sent in error frames
+const (
+	// ErrorInvalidFrame is sent for frames that can't be decoded or are
+	// missing required fields
+	ErrorInvalidFrame = "invalid_frame"
+	// ErrorFrameTooLarge is sent for frames over the read limit of their type
+	ErrorFrameTooLarge = "frame_too_large"
+	// ErrorRateLimited is sent for frames over the sender's rate limit
+	ErrorRateLimited = "rate_limited"
+	// ErrorForbidden is sent when a bot's token doesn't allow the frame
+	ErrorForbidden = "forbidden"
+	// ErrorShuttingDown is sent for frames received while the server is
+	// shutting down; they should be sent again after reconnecting
+	ErrorShuttingDown = "shutting_down"
+	// ErrorCommandFailed is sent when a slash command could not be run
+	ErrorCommandFailed = "command_failed"
+	// ErrorInternal is sent when the server failed to handle a frame
+	ErrorInternal = "internal"
+)
@@ -0,0 +1,25 @@
+package protocol
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	for offered, want := range map[string]int{
+		"":        CurrentVersion,
+		"  ":      CurrentVersion,
+		"1":       Version1,
+		"2, 1":    Version1,
+		"x,1":     Version1,
+		"1,1,999": Version1,
+	} {
+		version, ok := Negotiate(offered)
+		if !ok || version != want {
+			t.Errorf("Negotiate(%q) = %d, %v; want %d", offered, version, ok, want)
+		}
+	}
+
+	for _, offered := range []string{"2", "0", "x", "2,3"} {
+		if version, ok := Negotiate(offered); ok {
+			t.Errorf("Negotiate(%q) = %d, want no version", offered, version)
+		}
+	}
+}
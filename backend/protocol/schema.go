@@ -0,0 +1,130 @@
+package protocol
+
+//go:generate go run ../cmd/protocolschema -o ../docs/protocol.schema.json
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schemaID identifies the schema document of each protocol version
+const schemaID = "https://github.com/RatneshMaurya/not-whatsapp/protocol/v"
+
+// Schema returns a JSON Schema (draft 2020-12) document describing every
+// frame of the current protocol version. Inbound frames don't allow
+// properties the server doesn't know; outbound frames may gain properties in
+// later versions, which clients should ignore.
+func Schema() map[string]any {
+	defs := make(map[string]any)
+	inbound := make([]any, 0, len(inboundFrames))
+	for _, spec := range inboundFrames {
+		inbound = append(inbound, frameRef(defs, spec, true))
+	}
+	outbound := make([]any, 0, len(outboundFrames))
+	for _, spec := range outboundFrames {
+		outbound = append(outbound, frameRef(defs, spec, false))
+	}
+
+	defs["Inbound"] = map[string]any{
+		"description": "A frame sent by a client",
+		"oneOf":       inbound,
+	}
+	defs["Outbound"] = map[string]any{
+		"description": "A frame sent by the server",
+		"oneOf":       outbound,
+	}
+
+	return map[string]any{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"$id":         schemaID + strconv.Itoa(CurrentVersion) + ".json",
+		"title":       "not-whatsapp WebSocket protocol",
+		"description": "Frames exchanged over the WebSocket at /ws, protocol version " + strconv.Itoa(CurrentVersion),
+		"version":     CurrentVersion,
+		"oneOf": []any{
+			map[string]any{"$ref": "#/$defs/Inbound"},
+			map[string]any{"$ref": "#/$defs/Outbound"},
+		},
+		"$defs": defs,
+	}
+}
+
+// SchemaJSON returns the indented Schema document
+func SchemaJSON() ([]byte, error) {
+	body, err := json.MarshalIndent(Schema(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(body, '\n'), nil
+}
+
+// frameRef adds the schema of a frame to defs and returns a reference to it
+func frameRef(defs map[string]any, spec frameSpec, strict bool) map[string]any {
+	t := reflect.TypeOf(spec.frame)
+	schema := structSchema(defs, t, strict)
+	schema["description"] = spec.description
+	schema["properties"].(map[string]any)["type"] = map[string]any{"const": spec.typ}
+	defs[t.Name()] = schema
+	return map[string]any{"$ref": "#/$defs/" + t.Name()}
+}
+
+// structSchema describes a struct by its JSON fields. Fields without
+// omitempty are required.
+func structSchema(defs map[string]any, t reflect.Type, strict bool) map[string]any {
+	properties := make(map[string]any)
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = typeSchema(defs, field.Type, strict)
+		if options != "omitempty" {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+	if strict {
+		schema["additionalProperties"] = false
+	}
+	return schema
+}
+
+// typeSchema describes a field type. Nested structs are added to defs.
+func typeSchema(defs map[string]any, t reflect.Type, strict bool) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": typeSchema(defs, t.Elem(), strict)}
+	case reflect.Struct:
+		if _, ok := defs[t.Name()]; !ok {
+			defs[t.Name()] = structSchema(defs, t, strict)
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name()}
+	default:
+		return map[string]any{}
+	}
+}
@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// TestSchemaIsPublished fails when docs/protocol.schema.json wasn't
+// regenerated after a frame changed
+func TestSchemaIsPublished(t *testing.T) {
+	schema, err := SchemaJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	published, err := os.ReadFile("../docs/protocol.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(schema, published) {
+		t.Error("docs/protocol.schema.json is out of date, run go generate ./protocol")
+	}
+}
+
+func TestSchema(t *testing.T) {
+	defs := Schema()["$defs"].(map[string]any)
+
+	// Inbound frames reject unknown fields like Decode does
+	message := defs["SendMessage"].(map[string]any)
+	if message["additionalProperties"] != false {
+		t.Error("SendMessage allows additional properties")
+	}
+	if got := message["properties"].(map[string]any)["type"]; got.(map[string]any)["const"] != TypeMessage {
+		t.Errorf("SendMessage type = %v, want const message", got)
+	}
+	required := message["required"].([]string)
+	if len(required) != 2 || required[0] != "type" || required[1] != "content" {
+		t.Errorf("SendMessage requires %v, want [type content]", required)
+	}
+
+	// Outbound frames may gain fields
+	if _, ok := defs["Message"].(map[string]any)["additionalProperties"]; ok {
+		t.Error("Message restricts additional properties")
+	}
+	for _, name := range []string{"Inbound", "Outbound", "Sender", "Ping", "Connected", "Reconnect", "Close"} {
+		if _, ok := defs[name]; !ok {
+			t.Errorf("schema has no %s definition", name)
+		}
+	}
+	if got := len(defs["Inbound"].(map[string]any)["oneOf"].([]any)); got != len(inboundFrames) {
+		t.Errorf("Inbound has %d frames, want %d", got, len(inboundFrames))
+	}
+}
@@ -0,0 +1,83 @@
+// Package ratelimit implements in-memory token bucket rate limiting keyed by
+// arbitrary strings such as user IDs, IPs or email addresses.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter allows up to burst events at once per key, refilled at a steady
+// rate. Idle keys are forgotten once their bucket is full again.
+type Limiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter allows burst events per key and refills one token every
+// interval/burst, so a key can make burst events per interval on average
+func NewLimiter(burst int, interval time.Duration) *Limiter {
+	return &Limiter{
+		rate:      float64(burst) / interval.Seconds(),
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token for the key. When none is left it returns false and how
+// long until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	return l.AllowN(key, 1)
+}
+
+// AllowN takes n tokens for the key at once
+func (l *Limiter) AllowN(key string, n int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		return true, 0
+	}
+
+	missing := float64(n) - b.tokens
+	return false, time.Duration(math.Ceil(missing / l.rate * float64(time.Second)))
+}
+
+// sweep drops buckets that have refilled completely, at most once a minute.
+// The caller must hold l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
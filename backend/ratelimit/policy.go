@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Budgets clients spend separately
+const (
+	// BudgetMessages is spent by every chat message sent
+	BudgetMessages = "messages"
+	// BudgetTyping is spent by typing indicators
+	BudgetTyping = "typing"
+	// BudgetAPI is spent by every authenticated REST request
+	BudgetAPI = "api"
+)
+
+// Roles with their own budgets
+const (
+	RoleUser = "user"
+	RoleBot  = "bot"
+)
+
+// Rate is a token bucket budget of Burst events per Interval
+type Rate struct {
+	Burst    int
+	Interval time.Duration
+}
+
+// ParseRate parses a rate written as "<burst>/<interval>", such as "20/10s"
+func ParseRate(value string) (Rate, error) {
+	burst, interval, ok := strings.Cut(strings.TrimSpace(value), "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("rate %q must look like 20/10s", value)
+	}
+	n, err := strconv.Atoi(burst)
+	if err != nil || n < 1 {
+		return Rate{}, fmt.Errorf("rate %q must allow at least one event", value)
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("rate %q must have a positive interval", value)
+	}
+	return Rate{Burst: n, Interval: d}, nil
+}
+
+// ParseOverrides parses per-bot rates written as "<bot id>:<budget>=<rate>",
+// such as "3f0c...:messages=100/10s", into rates by bot ID and budget
+func ParseOverrides(entries []string) (map[string]map[string]Rate, error) {
+	overrides := make(map[string]map[string]Rate)
+	for _, entry := range entries {
+		botID, rest, ok := strings.Cut(entry, ":")
+		budget, value, ok2 := strings.Cut(rest, "=")
+		if !ok || !ok2 || botID == "" {
+			return nil, fmt.Errorf("override %q must look like <bot id>:messages=100/10s", entry)
+		}
+		switch budget {
+		case BudgetMessages, BudgetTyping, BudgetAPI:
+		default:
+			return nil, fmt.Errorf("override %q must be for messages, typing or api", entry)
+		}
+		rate, err := ParseRate(value)
+		if err != nil {
+			return nil, err
+		}
+		if overrides[botID] == nil {
+			overrides[botID] = make(map[string]Rate)
+		}
+		overrides[botID][budget] = rate
+	}
+	return overrides, nil
+}
+
+// Policy limits each user's budgets according to their role. Bots can have
+// their own rates for some budgets, which replace the bot role's.
+type Policy struct {
+	// limiters holds a limiter per role and budget, keyed by user ID
+	limiters map[string]map[string]*Limiter
+	// overrides holds a limiter per bot and budget, keyed by bot ID
+	overrides map[string]map[string]*Limiter
+}
+
+// NewPolicy creates a policy from rates by role and budget, and rates by bot
+// ID and budget. Budgets without a rate are not limited.
+func NewPolicy(roles map[string]map[string]Rate, overrides map[string]map[string]Rate) *Policy {
+	p := &Policy{
+		limiters:  make(map[string]map[string]*Limiter),
+		overrides: make(map[string]map[string]*Limiter),
+	}
+	for role, rates := range roles {
+		p.limiters[role] = newLimiters(rates)
+	}
+	for botID, rates := range overrides {
+		p.overrides[botID] = newLimiters(rates)
+	}
+	return p
+}
+
+func newLimiters(rates map[string]Rate) map[string]*Limiter {
+	limiters := make(map[string]*Limiter, len(rates))
+	for budget, rate := range rates {
+		limiters[budget] = NewLimiter(rate.Burst, rate.Interval)
+	}
+	return limiters
+}
+
+// Allow spends one event of the user's budget. When the budget is used up
+// it returns false and how long until the next event is allowed.
+func (p *Policy) Allow(role, userID, budget string) (bool, time.Duration) {
+	if role == RoleBot {
+		if limiter, ok := p.overrides[userID][budget]; ok {
+			return limiter.Allow(userID)
+		}
+	}
+	limiter, ok := p.limiters[role][budget]
+	if !ok {
+		return true, 0
+	}
+	return limiter.Allow(userID)
+}
@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	rate, err := ParseRate(" 20/10s ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate.Burst != 20 || rate.Interval != 10*time.Second {
+		t.Errorf("rate = %+v, want 20/10s", rate)
+	}
+
+	for _, value := range []string{"", "20", "0/10s", "-1/10s", "x/10s", "20/", "20/0s", "20/-1s", "20/ten"} {
+		if _, err := ParseRate(value); err == nil {
+			t.Errorf("ParseRate(%q) succeeded", value)
+		}
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	overrides, err := ParseOverrides([]string{"bot1:messages=100/10s", "bot1:api=5/1s", "bot2:typing=1/1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := overrides["bot1"][BudgetMessages]; got != (Rate{Burst: 100, Interval: 10 * time.Second}) {
+		t.Errorf("bot1 messages = %+v", got)
+	}
+	if got := overrides["bot1"][BudgetAPI]; got != (Rate{Burst: 5, Interval: time.Second}) {
+		t.Errorf("bot1 api = %+v", got)
+	}
+	if got := overrides["bot2"][BudgetTyping]; got != (Rate{Burst: 1, Interval: time.Minute}) {
+		t.Errorf("bot2 typing = %+v", got)
+	}
+
+	for _, entry := range []string{"bot1", "bot1:messages", ":messages=1/1s", "bot1:reactions=1/1s", "bot1:messages=0/1s"} {
+		if _, err := ParseOverrides([]string{entry}); err == nil {
+			t.Errorf("ParseOverrides(%q) succeeded", entry)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy := NewPolicy(map[string]map[string]Rate{
+		RoleUser: {BudgetMessages: {Burst: 2, Interval: time.Hour}},
+		RoleBot:  {BudgetMessages: {Burst: 1, Interval: time.Hour}},
+	}, map[string]map[string]Rate{
+		"bot1": {BudgetMessages: {Burst: 3, Interval: time.Hour}},
+	})
+
+	allowed := func(role, userID, budget string) int {
+		n := 0
+		for i := 0; i < 5; i++ {
+			if ok, _ := policy.Allow(role, userID, budget); ok {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := allowed(RoleUser, "u1", BudgetMessages); n != 2 {
+		t.Errorf("user got %d messages, want 2", n)
+	}
+	// Each user has their own budget
+	if n := allowed(RoleUser, "u2", BudgetMessages); n != 2 {
+		t.Errorf("second user got %d messages, want 2", n)
+	}
+	if n := allowed(RoleBot, "bot2", BudgetMessages); n != 1 {
+		t.Errorf("bot got %d messages, want 1", n)
+	}
+	if n := allowed(RoleBot, "bot1", BudgetMessages); n != 3 {
+		t.Errorf("bot with an override got %d messages, want 3", n)
+	}
+	// Budgets without a rate are not limited
+	if n := allowed(RoleUser, "u1", BudgetTyping); n != 5 {
+		t.Errorf("user got %d typing frames, want 5", n)
+	}
+
+	ok, retryAfter := policy.Allow(RoleUser, "u1", BudgetMessages)
+	if ok {
+		t.Fatal("message allowed after the budget was used up")
+	}
+	// One message is refilled every 30 minutes
+	if retryAfter <= 29*time.Minute || retryAfter > 30*time.Minute {
+		t.Errorf("retry after = %s, want about 30m", retryAfter)
+	}
+}
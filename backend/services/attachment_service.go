@@ -0,0 +1,167 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/google/uuid"
+)
+
+const (
+	AttachmentStatusPending  = "pending"
+	AttachmentStatusUploaded = "uploaded"
+)
+
+var (
+	ErrAttachmentTooLarge       = errors.New("attachment exceeds the maximum size")
+	ErrAttachmentSizeMismatch   = errors.New("uploaded size does not match the declared size")
+	ErrAttachmentDigestMismatch = errors.New("uploaded content does not match the declared digest")
+	ErrAttachmentNotPending     = errors.New("attachment has already been uploaded")
+	ErrAttachmentNotUploaded    = errors.New("attachment has not been uploaded yet")
+)
+
+// AttachmentService stores encrypted attachment blobs on local disk. Clients
+// declare the ciphertext size and SHA-256 digest up front and the upload is
+// only accepted if the streamed bytes match both.
+type AttachmentService struct {
+	db      *sql.DB
+	dir     string
+	maxSize int64
+}
+
+func NewAttachmentService(db *sql.DB, dir string, maxSize int64) (*AttachmentService, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating attachments directory: %v", err)
+	}
+	return &AttachmentService{
+		db:      db,
+		dir:     dir,
+		maxSize: maxSize,
+	}, nil
+}
+
+// CreateAttachment reserves an attachment for a later upload
+func (s *AttachmentService) CreateAttachment(conversationID, uploaderID string, size int64, digest []byte) (*models.Attachment, error) {
+	if size <= 0 || size > s.maxSize {
+		return nil, ErrAttachmentTooLarge
+	}
+	if len(digest) != sha256.Size {
+		return nil, errors.New("digest must be a SHA-256 hash")
+	}
+
+	attachment := &models.Attachment{
+		ID:             uuid.New().String(),
+		ConversationID: conversationID,
+		UploaderID:     uploaderID,
+		Size:           size,
+		Digest:         digest,
+		Status:         AttachmentStatusPending,
+	}
+	err := s.db.QueryRow(`
+		INSERT INTO attachments (id, conversation_id, uploader_id, size, digest, status)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at
+	`, attachment.ID, attachment.ConversationID, attachment.UploaderID,
+		attachment.Size, attachment.Digest, attachment.Status,
+	).Scan(&attachment.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+func (s *AttachmentService) GetAttachment(id string) (*models.Attachment, error) {
+	attachment := &models.Attachment{}
+	var uploadedAt sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT id, conversation_id, uploader_id, size, digest, status, created_at, uploaded_at
+		FROM attachments
+		WHERE id = $1
+	`, id).Scan(
+		&attachment.ID,
+		&attachment.ConversationID,
+		&attachment.UploaderID,
+		&attachment.Size,
+		&attachment.Digest,
+		&attachment.Status,
+		&attachment.CreatedAt,
+		&uploadedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if uploadedAt.Valid {
+		attachment.UploadedAt = &uploadedAt.Time
+	}
+	return attachment, nil
+}
+
+// Upload streams ciphertext to storage, verifying its size and digest against
+// what was declared when the attachment was created
+func (s *AttachmentService) Upload(attachment *models.Attachment, body io.Reader) error {
+	if attachment.Status != AttachmentStatusPending {
+		return ErrAttachmentNotPending
+	}
+
+	tmp, err := os.CreateTemp(s.dir, attachment.ID+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Read one byte past the declared size so oversized uploads are caught
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(body, attachment.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != attachment.Size {
+		return ErrAttachmentSizeMismatch
+	}
+	if subtle.ConstantTimeCompare(hash.Sum(nil), attachment.Digest) != 1 {
+		return ErrAttachmentDigestMismatch
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(attachment.ID)); err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec(`
+		UPDATE attachments
+		SET status = $2, uploaded_at = NOW()
+		WHERE id = $1 AND status = $3
+	`, attachment.ID, AttachmentStatusUploaded, AttachmentStatusPending)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrAttachmentNotPending
+	}
+	return nil
+}
+
+// Open returns the stored ciphertext of an uploaded attachment
+func (s *AttachmentService) Open(attachment *models.Attachment) (*os.File, error) {
+	if attachment.Status != AttachmentStatusUploaded {
+		return nil, ErrAttachmentNotUploaded
+	}
+	return os.Open(s.path(attachment.ID))
+}
+
+func (s *AttachmentService) path(id string) string {
+	return filepath.Join(s.dir, id)
+}
@@ -0,0 +1,337 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrBotNotFound      = errors.New("bot not found")
+	ErrAPITokenNotFound = errors.New("API token not found")
+	// ErrInvalidScope is returned for API tokens without scopes or with a
+	// scope other than read and send
+	ErrInvalidScope = errors.New("scopes must be read and/or send")
+	// ErrConversationsRequired is returned for API tokens not limited to any
+	// conversation
+	ErrConversationsRequired = errors.New("API tokens must be limited to at least one conversation")
+	// ErrNotParticipant is returned when a bot owner grants access to a
+	// conversation they are not a member of
+	ErrNotParticipant = errors.New("not a participant of the conversation")
+)
+
+// apiTokenTouchInterval limits how often last_used_at is written for a token
+const apiTokenTouchInterval = time.Minute
+
+type BotService struct {
+	db       *sql.DB
+	webhooks *WebhookService
+}
+
+func NewBotService(db *sql.DB, webhooks *WebhookService) *BotService {
+	return &BotService{
+		db:       db,
+		webhooks: webhooks,
+	}
+}
+
+// queryRower is a *sql.DB or *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// CreateBot creates a bot account owned by the user
+func (s *BotService) CreateBot(ownerID, name, avatarURL string) (*models.User, error) {
+	return createBotUser(s.db, ownerID, name, avatarURL)
+}
+
+// createBotUser inserts a user without a login that belongs to ownerID
+func createBotUser(q queryRower, ownerID, name, avatarURL string) (*models.User, error) {
+	bot := &models.User{
+		ID:         uuid.New().String(),
+		Name:       name,
+		AvatarURL:  avatarURL,
+		IsBot:      true,
+		BotOwnerID: ownerID,
+	}
+	// Bots never sign in, but every user needs a unique email
+	bot.Email = "bot-" + bot.ID + "@bots.invalid"
+
+	err := q.QueryRow(`
+		INSERT INTO users (id, email, name, avatar_url, public_key, is_bot, bot_owner_id)
+		VALUES ($1, $2, $3, $4, '', true, $5)
+		RETURNING created_at, last_seen
+	`, bot.ID, bot.Email, bot.Name, bot.AvatarURL, ownerID).Scan(&bot.CreatedAt, &bot.LastSeen)
+	if err != nil {
+		return nil, err
+	}
+	return bot, nil
+}
+
+// GetBots lists the bots owned by the user
+func (s *BotService) GetBots(ownerID string) ([]models.User, error) {
+	rows, err := s.db.Query(`
+		SELECT id, email, name, COALESCE(avatar_url, ''), created_at, last_seen
+		FROM users
+		WHERE bot_owner_id = $1
+		ORDER BY created_at
+	`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := []models.User{}
+	for rows.Next() {
+		bot := models.User{IsBot: true, BotOwnerID: ownerID}
+		if err := rows.Scan(&bot.ID, &bot.Email, &bot.Name, &bot.AvatarURL, &bot.CreatedAt, &bot.LastSeen); err != nil {
+			return nil, err
+		}
+		bots = append(bots, bot)
+	}
+	return bots, rows.Err()
+}
+
+// checkBotOwner returns ErrBotNotFound unless the bot belongs to the owner
+func checkBotOwner(q queryRower, ownerID, botID string) error {
+	var owned bool
+	err := q.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND bot_owner_id = $2)
+	`, botID, ownerID).Scan(&owned)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return ErrBotNotFound
+	}
+	return nil
+}
+
+// CreateAPIToken issues a token for the owner's bot, limited to the scopes
+// and conversations given. The owner must be a member of each conversation;
+// the bot is added to any it is not in yet. The token is returned once and
+// only its hash is stored.
+func (s *BotService) CreateAPIToken(ownerID, botID, name string, scopes, conversationIDs []string, expiresAt *time.Time) (*models.APIToken, string, error) {
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(conversationIDs) == 0 {
+		return nil, "", ErrConversationsRequired
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	if err := checkBotOwner(tx, ownerID, botID); err != nil {
+		return nil, "", err
+	}
+
+	for _, conversationID := range conversationIDs {
+		if _, err := uuid.Parse(conversationID); err != nil {
+			return nil, "", ErrNotParticipant
+		}
+		var member bool
+		err := tx.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM conversation_participants
+				WHERE conversation_id = $1 AND user_id = $2
+			)
+		`, conversationID, ownerID).Scan(&member)
+		if err != nil {
+			return nil, "", err
+		}
+		if !member {
+			return nil, "", ErrNotParticipant
+		}
+
+		result, err := tx.Exec(`
+			INSERT INTO conversation_participants (conversation_id, user_id, joined_at)
+			VALUES ($1, $2, NOW())
+			ON CONFLICT DO NOTHING
+		`, conversationID, botID)
+		if err != nil {
+			return nil, "", err
+		}
+		added, err := result.RowsAffected()
+		if err != nil {
+			return nil, "", err
+		}
+		if added > 0 {
+			err = s.webhooks.enqueue(tx, conversationID, EventMemberJoined, map[string]interface{}{
+				"user_id":  botID,
+				"added_by": ownerID,
+			})
+			if err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	token := auth.APITokenPrefix + secret
+
+	apiToken := &models.APIToken{
+		BotID:           botID,
+		Name:            name,
+		Scopes:          scopes,
+		ConversationIDs: conversationIDs,
+		ExpiresAt:       expiresAt,
+	}
+	err = tx.QueryRow(`
+		INSERT INTO api_tokens (bot_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, botID, name, hashSecretToken(token), pq.Array(scopes), expiresAt).Scan(&apiToken.ID, &apiToken.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, conversationID := range conversationIDs {
+		_, err = tx.Exec(`
+			INSERT INTO api_token_conversations (token_id, conversation_id)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, apiToken.ID, conversationID)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	s.webhooks.wake()
+	return apiToken, token, nil
+}
+
+func normalizeScopes(scopes []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var normalized []string
+	for _, scope := range scopes {
+		if scope != auth.ScopeRead && scope != auth.ScopeSend {
+			return nil, ErrInvalidScope
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, ErrInvalidScope
+	}
+	return normalized, nil
+}
+
+// GetAPITokens lists the tokens of the owner's bot, including revoked ones
+func (s *BotService) GetAPITokens(ownerID, botID string) ([]models.APIToken, error) {
+	if err := checkBotOwner(s.db, ownerID, botID); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT t.id, t.bot_id, t.name, t.scopes,
+			ARRAY(SELECT conversation_id::text FROM api_token_conversations WHERE token_id = t.id),
+			t.created_at, t.last_used_at, t.expires_at, t.revoked_at
+		FROM api_tokens t
+		WHERE t.bot_id = $1
+		ORDER BY t.created_at
+	`, botID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		var token models.APIToken
+		err := rows.Scan(
+			&token.ID,
+			&token.BotID,
+			&token.Name,
+			pq.Array(&token.Scopes),
+			pq.Array(&token.ConversationIDs),
+			&token.CreatedAt,
+			&token.LastUsedAt,
+			&token.ExpiresAt,
+			&token.RevokedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken stops a token of the owner's bot from working
+func (s *BotService) RevokeAPIToken(ownerID, botID, tokenID string) error {
+	if err := checkBotOwner(s.db, ownerID, botID); err != nil {
+		return err
+	}
+	if _, err := uuid.Parse(tokenID); err != nil {
+		return ErrAPITokenNotFound
+	}
+
+	result, err := s.db.Exec(`
+		UPDATE api_tokens
+		SET revoked_at = NOW()
+		WHERE id = $1 AND bot_id = $2 AND revoked_at IS NULL
+	`, tokenID, botID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+// AuthenticateAPIToken implements auth.APITokenValidator
+func (s *BotService) AuthenticateAPIToken(token string) (*auth.APIToken, error) {
+	apiToken := &auth.APIToken{}
+	err := s.db.QueryRow(`
+		SELECT t.id, t.bot_id, t.scopes,
+			ARRAY(SELECT conversation_id::text FROM api_token_conversations WHERE token_id = t.id)
+		FROM api_tokens t
+		WHERE t.token_hash = $1
+			AND t.revoked_at IS NULL
+			AND (t.expires_at IS NULL OR t.expires_at > NOW())
+	`, hashSecretToken(token)).Scan(
+		&apiToken.ID,
+		&apiToken.BotID,
+		pq.Array(&apiToken.Scopes),
+		pq.Array(&apiToken.ConversationIDs),
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(`
+		UPDATE api_tokens
+		SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $2)
+	`, apiToken.ID, time.Now().Add(-apiTokenTouchInterval))
+	if err != nil {
+		return nil, err
+	}
+	return apiToken, nil
+}
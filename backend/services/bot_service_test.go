@@ -0,0 +1,122 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+)
+
+func TestAPITokens(t *testing.T) {
+	db := dbtest.Open(t)
+	alice := dbtest.CreateUser(t, db, "alice")
+	bob := dbtest.CreateUser(t, db, "bob")
+	conversation := dbtest.CreateConversation(t, db, alice, bob)
+	other := dbtest.CreateConversation(t, db, bob)
+	bots := NewBotService(db, NewWebhookService(db, NewContentCipher(db, nil), egress.NewPolicy(), time.Second, 1))
+
+	bot, err := bots.CreateBot(alice, "builds", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bot.IsBot || bot.BotOwnerID != alice {
+		t.Fatalf("CreateBot = %+v", bot)
+	}
+	if owned, err := bots.GetBots(alice); err != nil || len(owned) != 1 || owned[0].ID != bot.ID {
+		t.Fatalf("GetBots = %v, %v", owned, err)
+	}
+
+	for name, tt := range map[string]struct {
+		ownerID, botID string
+		scopes         []string
+		conversations  []string
+		err            error
+	}{
+		"no scopes":          {alice, bot.ID, nil, []string{conversation}, ErrInvalidScope},
+		"unknown scope":      {alice, bot.ID, []string{"admin"}, []string{conversation}, ErrInvalidScope},
+		"no conversations":   {alice, bot.ID, []string{auth.ScopeRead}, nil, ErrConversationsRequired},
+		"not the owner":      {bob, bot.ID, []string{auth.ScopeRead}, []string{conversation}, ErrBotNotFound},
+		"owner not a member": {alice, bot.ID, []string{auth.ScopeRead}, []string{other}, ErrNotParticipant},
+		"not a conversation": {alice, bot.ID, []string{auth.ScopeRead}, []string{"nope"}, ErrNotParticipant},
+	} {
+		if _, _, err := bots.CreateAPIToken(tt.ownerID, tt.botID, "ci", tt.scopes, tt.conversations, nil); !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", name, err, tt.err)
+		}
+	}
+
+	apiToken, token, err := bots.CreateAPIToken(alice, bot.ID, "ci", []string{auth.ScopeSend, auth.ScopeRead, auth.ScopeSend}, []string{conversation}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !auth.IsAPIToken(token) || len(apiToken.Scopes) != 2 {
+		t.Fatalf("CreateAPIToken = %+v, %q", apiToken, token)
+	}
+	var stored string
+	if err := db.QueryRow(`SELECT token_hash FROM api_tokens WHERE id = $1`, apiToken.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, strings.TrimPrefix(token, auth.APITokenPrefix)) {
+		t.Fatal("the token is stored in the clear")
+	}
+	var member bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM conversation_participants WHERE conversation_id = $1 AND user_id = $2)`, conversation, bot.ID).Scan(&member); err != nil || !member {
+		t.Fatalf("bot added to the conversation: %v, %v", member, err)
+	}
+
+	grant, err := bots.AuthenticateAPIToken(token)
+	if err != nil || grant == nil {
+		t.Fatalf("AuthenticateAPIToken = %+v, %v", grant, err)
+	}
+	if grant.BotID != bot.ID || !grant.Allows(auth.ScopeSend, conversation) || grant.Allows(auth.ScopeSend, other) {
+		t.Fatalf("grant = %+v", grant)
+	}
+	if grant, err := bots.AuthenticateAPIToken(auth.APITokenPrefix + "unknown"); err != nil || grant != nil {
+		t.Fatalf("unknown token = %+v, %v", grant, err)
+	}
+
+	if err := bots.RevokeAPIToken(bob, bot.ID, apiToken.ID); !errors.Is(err, ErrBotNotFound) {
+		t.Errorf("revoke by another user: err = %v, want ErrBotNotFound", err)
+	}
+	if err := bots.RevokeAPIToken(alice, bot.ID, apiToken.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := bots.RevokeAPIToken(alice, bot.ID, apiToken.ID); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Errorf("second revoke: err = %v, want ErrAPITokenNotFound", err)
+	}
+	if grant, err := bots.AuthenticateAPIToken(token); err != nil || grant != nil {
+		t.Fatalf("revoked token = %+v, %v", grant, err)
+	}
+	if listed, err := bots.GetAPITokens(alice, bot.ID); err != nil || len(listed) != 1 || listed[0].RevokedAt == nil {
+		t.Fatalf("GetAPITokens = %+v, %v", listed, err)
+	}
+}
+
+func TestExpiredAPIToken(t *testing.T) {
+	db := dbtest.Open(t)
+	alice := dbtest.CreateUser(t, db, "alice")
+	conversation := dbtest.CreateConversation(t, db, alice)
+	bots := NewBotService(db, NewWebhookService(db, NewContentCipher(db, nil), egress.NewPolicy(), time.Second, 1))
+	bot, err := bots.CreateBot(alice, "builds", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour)
+	apiToken, token, err := bots.CreateAPIToken(alice, bot.ID, "ci", []string{auth.ScopeRead}, []string{conversation}, &expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant, err := bots.AuthenticateAPIToken(token); err != nil || grant == nil {
+		t.Fatalf("AuthenticateAPIToken before expiry = %+v, %v", grant, err)
+	}
+	if _, err := db.Exec(`UPDATE api_tokens SET expires_at = NOW() - INTERVAL '1 second' WHERE id = $1`, apiToken.ID); err != nil {
+		t.Fatal(err)
+	}
+	if grant, err := bots.AuthenticateAPIToken(token); err != nil || grant != nil {
+		t.Fatalf("expired token = %+v, %v", grant, err)
+	}
+}
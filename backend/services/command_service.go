@@ -0,0 +1,423 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/commands"
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/google/uuid"
+)
+
+const (
+	// helpCommand lists the commands of a conversation. It is answered by
+	// the service itself and cannot be registered.
+	helpCommand = "help"
+	// maxCommandResponseText caps the reply a bot can post, like the text of
+	// an integration message
+	maxCommandResponseText = 4000
+	// maxCommandResponseBody caps how much of a bot's response is read
+	maxCommandResponseBody = 64 * 1024
+)
+
+var (
+	ErrCommandNotFound = errors.New("command not found")
+	// ErrInvalidCommandName is returned for names that are not 1 to 32
+	// lowercase letters, digits, dashes and underscores
+	ErrInvalidCommandName = errors.New("command names must be 1-32 lowercase letters, digits, - or _")
+	// ErrCommandNameTaken is returned when the conversation already has a
+	// command with the name, built in or registered
+	ErrCommandNameTaken = errors.New("a command with this name already exists in the conversation")
+	// ErrCommandFailed is returned when a bot's endpoint could not be reached
+	// or answered with something other than a valid reply
+	ErrCommandFailed = errors.New("command failed")
+)
+
+// CommandResult is the reply to a slash command. Bot is set when a bot
+// handled the command; public replies are then posted as the bot.
+type CommandResult struct {
+	Text       string
+	Visibility string
+	Bot        *models.User
+}
+
+// commandRequest is the JSON body POSTed to a bot's command endpoint
+type commandRequest struct {
+	CommandID      string `json:"command_id"`
+	Command        string `json:"command"`
+	Text           string `json:"text"`
+	ConversationID string `json:"conversation_id"`
+	UserID         string `json:"user_id"`
+	UserName       string `json:"user_name"`
+}
+
+// commandResponse is what a bot's endpoint may answer with. An empty body
+// acknowledges the command without a reply.
+type commandResponse struct {
+	Text         string `json:"text"`
+	ResponseType string `json:"response_type"`
+}
+
+// CommandService runs slash commands. Built-in commands are handled in
+// process; commands registered by bots are POSTed to the bot's endpoint,
+// signed like webhook events, and the bot's answer is the reply. Like
+// webhooks, bots are only called at addresses the egress policy allows.
+type CommandService struct {
+	db       *sql.DB
+	cipher   *ContentCipher
+	builtins *commands.Registry
+	egress   *egress.Policy
+	client   *http.Client
+}
+
+func NewCommandService(db *sql.DB, cipher *ContentCipher, builtins *commands.Registry, policy *egress.Policy, timeout time.Duration) *CommandService {
+	return &CommandService{
+		db:       db,
+		cipher:   cipher,
+		builtins: builtins,
+		egress:   policy,
+		client:   policy.Client(timeout),
+	}
+}
+
+// RegisterCommand registers a command in a conversation that is handled by
+// the owner's bot at url. Both the owner and the bot must be members of the
+// conversation. The signing secret is returned once.
+func (s *CommandService) RegisterCommand(ownerID, botID, conversationID, name, description, usage, rawURL string) (*models.SlashCommand, string, error) {
+	name = strings.ToLower(strings.TrimPrefix(name, "/"))
+	if !commands.ValidName(name) {
+		return nil, "", ErrInvalidCommandName
+	}
+	if _, ok := s.builtins.Lookup(name); ok || name == helpCommand {
+		return nil, "", ErrCommandNameTaken
+	}
+	endpoint, err := checkEndpointURL(s.egress, rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := uuid.Parse(conversationID); err != nil {
+		return nil, "", ErrNotParticipant
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	if err := checkBotOwner(tx, ownerID, botID); err != nil {
+		return nil, "", err
+	}
+	var members int
+	err = tx.QueryRow(`
+		SELECT COUNT(*)
+		FROM conversation_participants
+		WHERE conversation_id = $1 AND user_id IN ($2, $3)
+	`, conversationID, ownerID, botID).Scan(&members)
+	if err != nil {
+		return nil, "", err
+	}
+	if members != 2 {
+		return nil, "", ErrNotParticipant
+	}
+
+	raw, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	secret := "whsec_" + raw
+
+	command := &models.SlashCommand{
+		ID:             uuid.New().String(),
+		ConversationID: conversationID,
+		BotID:          botID,
+		Name:           name,
+		Description:    description,
+		Usage:          usage,
+		URL:            endpoint,
+	}
+	storedSecret, secretSealed, err := s.cipher.Seal(conversationID, command.ID, secret)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var createdAt time.Time
+	err = tx.QueryRow(`
+		INSERT INTO slash_commands (id, conversation_id, bot_id, name, description, usage, url, secret, secret_sealed)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (conversation_id, name) DO NOTHING
+		RETURNING created_at
+	`, command.ID, conversationID, botID, name, description, usage, endpoint, storedSecret, secretSealed).Scan(&createdAt)
+	if err == sql.ErrNoRows {
+		return nil, "", ErrCommandNameTaken
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	command.CreatedAt = &createdAt
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	return command, secret, nil
+}
+
+// GetBotCommands lists the commands registered for the owner's bot
+func (s *CommandService) GetBotCommands(ownerID, botID string) ([]models.SlashCommand, error) {
+	if err := checkBotOwner(s.db, ownerID, botID); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, conversation_id, bot_id, name, description, usage, url, created_at
+		FROM slash_commands
+		WHERE bot_id = $1
+		ORDER BY created_at
+	`, botID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	registered := []models.SlashCommand{}
+	for rows.Next() {
+		var command models.SlashCommand
+		var createdAt time.Time
+		err := rows.Scan(
+			&command.ID,
+			&command.ConversationID,
+			&command.BotID,
+			&command.Name,
+			&command.Description,
+			&command.Usage,
+			&command.URL,
+			&createdAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		command.CreatedAt = &createdAt
+		registered = append(registered, command)
+	}
+	return registered, rows.Err()
+}
+
+// DeleteCommand removes a command registered for the owner's bot
+func (s *CommandService) DeleteCommand(ownerID, botID, commandID string) error {
+	if _, err := uuid.Parse(commandID); err != nil {
+		return ErrCommandNotFound
+	}
+	if err := checkBotOwner(s.db, ownerID, botID); err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec(`
+		DELETE FROM slash_commands
+		WHERE id = $1 AND bot_id = $2
+	`, commandID, botID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrCommandNotFound
+	}
+	return nil
+}
+
+// ListCommands returns the commands that can be run in a conversation, built
+// in and registered, sorted by name
+func (s *CommandService) ListCommands(conversationID string) ([]models.SlashCommand, error) {
+	available := []models.SlashCommand{{
+		Name:        helpCommand,
+		Description: "Lists the commands you can use here",
+		Usage:       "/help",
+		Builtin:     true,
+	}}
+	for _, command := range s.builtins.Commands() {
+		available = append(available, models.SlashCommand{
+			Name:        command.Name,
+			Description: command.Description,
+			Usage:       command.Usage,
+			Builtin:     true,
+		})
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, bot_id, name, description, usage, created_at
+		FROM slash_commands
+		WHERE conversation_id = $1
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		command := models.SlashCommand{ConversationID: conversationID}
+		var createdAt time.Time
+		err := rows.Scan(&command.ID, &command.BotID, &command.Name, &command.Description, &command.Usage, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		command.CreatedAt = &createdAt
+		available = append(available, command)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(available, func(i, j int) bool {
+		return available[i].Name < available[j].Name
+	})
+	return available, nil
+}
+
+// Execute runs a command for a member of the conversation. Unknown commands
+// return ErrCommandNotFound and failing bots ErrCommandFailed.
+func (s *CommandService) Execute(ctx context.Context, inv commands.Invocation) (*CommandResult, error) {
+	var member bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM conversation_participants
+			WHERE conversation_id = $1 AND user_id = $2
+		)
+	`, inv.ConversationID, inv.UserID).Scan(&member)
+	if err != nil {
+		return nil, err
+	}
+	if !member {
+		return nil, ErrNotParticipant
+	}
+
+	if inv.Name == helpCommand {
+		return s.help(inv.ConversationID)
+	}
+	if command, ok := s.builtins.Lookup(inv.Name); ok {
+		response, err := command.Handler(ctx, inv)
+		if err != nil {
+			return nil, err
+		}
+		return &CommandResult{Text: response.Text, Visibility: response.Visibility}, nil
+	}
+
+	var commandID, endpoint, storedSecret string
+	var secretSealed bool
+	bot := &models.User{IsBot: true}
+	err = s.db.QueryRowContext(ctx, `
+		SELECT c.id, c.url, c.secret, c.secret_sealed, u.id, u.name, COALESCE(u.avatar_url, '')
+		FROM slash_commands c
+		JOIN users u ON u.id = c.bot_id
+		WHERE c.conversation_id = $1 AND c.name = $2
+	`, inv.ConversationID, inv.Name).Scan(&commandID, &endpoint, &storedSecret, &secretSealed, &bot.ID, &bot.Name, &bot.AvatarURL)
+	if err == sql.ErrNoRows {
+		return nil, ErrCommandNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	secret, err := s.cipher.Open(inv.ConversationID, commandID, storedSecret, secretSealed)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.call(ctx, endpoint, secret, commandRequest{
+		CommandID:      commandID,
+		Command:        "/" + inv.Name,
+		Text:           inv.Args,
+		ConversationID: inv.ConversationID,
+		UserID:         inv.UserID,
+		UserName:       inv.UserName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCommandFailed, err)
+	}
+
+	visibility := commands.Ephemeral
+	if response.ResponseType == commands.Public {
+		visibility = commands.Public
+	}
+	return &CommandResult{Text: response.Text, Visibility: visibility, Bot: bot}, nil
+}
+
+// help lists the commands of the conversation as an ephemeral reply
+func (s *CommandService) help(conversationID string) (*CommandResult, error) {
+	available, err := s.ListCommands(conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	b.WriteString("Commands you can use here:")
+	for _, command := range available {
+		fmt.Fprintf(&b, "\n%s", command.Usage)
+		if command.Usage == "" {
+			fmt.Fprintf(&b, "/%s", command.Name)
+		}
+		if command.Description != "" {
+			fmt.Fprintf(&b, " - %s", command.Description)
+		}
+	}
+	return &CommandResult{Text: b.String(), Visibility: commands.Ephemeral}, nil
+}
+
+// call POSTs an invocation to a bot and decodes its reply. Only a 2xx
+// answer is a reply: a refused address, a redirect or any other status is an
+// error, so nothing is posted for it.
+func (s *CommandService) call(ctx context.Context, endpoint, secret string, invocation commandRequest) (*commandResponse, error) {
+	body, err := json.Marshal(invocation)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "not-whatsapp-commands")
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(secret, time.Now(), body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	responseBody, err := io.ReadAll(io.LimitReader(resp.Body, maxCommandResponseBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(responseBody) > maxCommandResponseBody {
+		return nil, errors.New("response is too large")
+	}
+
+	response := &commandResponse{}
+	if len(bytes.TrimSpace(responseBody)) == 0 {
+		return response, nil
+	}
+	if err := json.Unmarshal(responseBody, response); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	if utf8.RuneCountInString(response.Text) > maxCommandResponseText {
+		return nil, errors.New("response text is too long")
+	}
+	return response, nil
+}
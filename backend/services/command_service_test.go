@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/commands"
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+)
+
+// commandFixture is a conversation between alice and her bot, which handles
+// commands at a test server whose answer the test sets
+type commandFixture struct {
+	db           *sql.DB
+	alice, bot   string
+	conversation string
+	commands     *CommandService
+	server       *httptest.Server
+	requests     int32
+	// respond answers requests to the bot's endpoint
+	respond atomic.Value
+}
+
+func newCommandFixture(t *testing.T) *commandFixture {
+	t.Helper()
+	db := dbtest.Open(t)
+	cipher := NewContentCipher(db, nil)
+	f := &commandFixture{db: db, alice: dbtest.CreateUser(t, db, "alice")}
+	bot, err := NewBotService(db, NewWebhookService(db, cipher, egress.NewPolicy(), time.Second, 1)).CreateBot(f.alice, "deployer", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.bot = bot.ID
+	f.conversation = dbtest.CreateConversation(t, db, f.alice, f.bot)
+	f.commands = NewCommandService(db, cipher, commands.Builtins(), loopbackPolicy(t), time.Second)
+
+	f.respond.Store(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.requests, 1)
+		f.respond.Load().(http.HandlerFunc)(w, r)
+	}))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// answer has the bot's endpoint answer with status and body
+func (f *commandFixture) answer(status int, body string) {
+	f.respond.Store(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+}
+
+func (f *commandFixture) run(name, args string) (*CommandResult, error) {
+	return f.commands.Execute(context.Background(), commands.Invocation{
+		Name:           name,
+		Args:           args,
+		ConversationID: f.conversation,
+		UserID:         f.alice,
+		UserName:       "alice",
+	})
+}
+
+func TestRegisterCommandValidation(t *testing.T) {
+	f := newCommandFixture(t)
+	guarded := NewCommandService(f.db, NewContentCipher(f.db, nil), commands.Builtins(), egress.NewPolicy(), time.Second)
+	outside := dbtest.CreateConversation(t, f.db, f.alice)
+
+	tests := []struct {
+		name         string
+		ownerID      string
+		conversation string
+		command      string
+		url          string
+		err          error
+	}{
+		{name: "invalid name", ownerID: f.alice, conversation: f.conversation, command: "Deploy Now", url: f.server.URL, err: ErrInvalidCommandName},
+		{name: "built in", ownerID: f.alice, conversation: f.conversation, command: "/shrug", url: f.server.URL, err: ErrCommandNameTaken},
+		{name: "help", ownerID: f.alice, conversation: f.conversation, command: "help", url: f.server.URL, err: ErrCommandNameTaken},
+		{name: "not http", ownerID: f.alice, conversation: f.conversation, command: "deploy", url: "gopher://example.com", err: ErrInvalidWebhookURL},
+		{name: "not the owner", ownerID: f.bot, conversation: f.conversation, command: "deploy", url: f.server.URL, err: ErrBotNotFound},
+		{name: "bot not a member", ownerID: f.alice, conversation: outside, command: "deploy", url: f.server.URL, err: ErrNotParticipant},
+		{name: "not a conversation", ownerID: f.alice, conversation: "nope", command: "deploy", url: f.server.URL, err: ErrNotParticipant},
+	}
+	for _, tt := range tests {
+		if _, _, err := f.commands.RegisterCommand(tt.ownerID, f.bot, tt.conversation, tt.command, "", "", tt.url); !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+	for _, url := range []string{f.server.URL, "http://localhost/deploy", "http://10.1.2.3/deploy", "http://169.254.169.254/"} {
+		if _, _, err := guarded.RegisterCommand(f.alice, f.bot, f.conversation, "deploy", "", "", url); !errors.Is(err, ErrForbiddenWebhookURL) {
+			t.Errorf("register at %s: err = %v, want ErrForbiddenWebhookURL", url, err)
+		}
+	}
+
+	if _, _, err := f.commands.RegisterCommand(f.alice, f.bot, f.conversation, "/Deploy", "Deploys", "/deploy <env>", f.server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := f.commands.RegisterCommand(f.alice, f.bot, f.conversation, "deploy", "", "", f.server.URL); !errors.Is(err, ErrCommandNameTaken) {
+		t.Errorf("second deploy: err = %v, want ErrCommandNameTaken", err)
+	}
+}
+
+func TestExecuteBotCommand(t *testing.T) {
+	f := newCommandFixture(t)
+	command, secret, err := f.commands.RegisterCommand(f.alice, f.bot, f.conversation, "deploy", "", "", f.server.URL+"/deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signatureOK atomic.Value
+	f.respond.Store(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature := r.Header.Get(WebhookSignatureHeader)
+		timestamp, _ := strconv.ParseInt(strings.TrimPrefix(strings.SplitN(signature, ",", 2)[0], "t="), 10, 64)
+		signatureOK.Store(signature == SignWebhookPayload(secret, time.Unix(timestamp, 0), body) &&
+			strings.Contains(string(body), `"command_id":"`+command.ID+`"`))
+		io.WriteString(w, `{"text": "Deploying staging", "response_type": "public"}`)
+	}))
+
+	result, err := f.run("deploy", "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Text != "Deploying staging" || result.Visibility != commands.Public || result.Bot == nil || result.Bot.ID != f.bot {
+		t.Fatalf("result = %+v", result)
+	}
+	if ok, _ := signatureOK.Load().(bool); !ok {
+		t.Error("the invocation was not signed with the command's secret")
+	}
+
+	f.answer(http.StatusOK, `{"text": "Only you can see this"}`)
+	if result, err := f.run("deploy", ""); err != nil || result.Visibility != commands.Ephemeral {
+		t.Fatalf("reply without a response type = %+v, %v, want ephemeral", result, err)
+	}
+	f.answer(http.StatusOK, "")
+	if result, err := f.run("deploy", ""); err != nil || result.Text != "" {
+		t.Fatalf("empty reply = %+v, %v", result, err)
+	}
+
+	if _, err := f.run("rollback", ""); !errors.Is(err, ErrCommandNotFound) {
+		t.Errorf("unknown command: err = %v, want ErrCommandNotFound", err)
+	}
+	if result, err := f.run("help", ""); err != nil || !strings.Contains(result.Text, "/deploy") {
+		t.Errorf("help = %+v, %v, want it to list /deploy", result, err)
+	}
+}
+
+func TestExecuteBotCommandFailures(t *testing.T) {
+	f := newCommandFixture(t)
+	if _, _, err := f.commands.RegisterCommand(f.alice, f.bot, f.conversation, "deploy", "", "", f.server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{name: "server error", status: http.StatusInternalServerError, body: `{"text": "public?", "response_type": "public"}`},
+		{name: "redirect", status: http.StatusFound, body: `{"text": "public?", "response_type": "public"}`},
+		{name: "not JSON", status: http.StatusOK, body: "ok"},
+		{name: "text too long", status: http.StatusOK, body: `{"text": "` + strings.Repeat("a", maxCommandResponseText+1) + `"}`},
+		{name: "body too large", status: http.StatusOK, body: strings.Repeat(" ", maxCommandResponseBody+1)},
+	}
+	for _, tt := range tests {
+		f.answer(tt.status, tt.body)
+		if result, err := f.run("deploy", ""); !errors.Is(err, ErrCommandFailed) || result != nil {
+			t.Errorf("%s: %+v, %v, want ErrCommandFailed", tt.name, result, err)
+		}
+	}
+
+	// The endpoint was allowed when the command was registered, but is not
+	// any more
+	f.answer(http.StatusOK, `{"text": "public?", "response_type": "public"}`)
+	f.commands.client = egress.NewPolicy().Client(time.Second)
+	before := atomic.LoadInt32(&f.requests)
+	if result, err := f.run("deploy", ""); !errors.Is(err, ErrCommandFailed) || result != nil {
+		t.Errorf("refused address: %+v, %v, want ErrCommandFailed", result, err)
+	}
+	if atomic.LoadInt32(&f.requests) != before {
+		t.Error("the refused endpoint was called")
+	}
+}
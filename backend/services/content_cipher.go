@@ -0,0 +1,355 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/crypto"
+)
+
+// ContentCipher transparently seals message content that is not end-to-end
+// encrypted before it is written, and opens it again on read. Each
+// conversation gets its own data encryption key, wrapped by the keyring's
+// primary master key. With no keyring configured content is stored as-is.
+type ContentCipher struct {
+	db      *sql.DB
+	keyring *crypto.Keyring
+
+	mu   sync.RWMutex
+	deks map[string][]byte
+}
+
+func NewContentCipher(db *sql.DB, keyring *crypto.Keyring) *ContentCipher {
+	return &ContentCipher{
+		db:      db,
+		keyring: keyring,
+		deks:    make(map[string][]byte),
+	}
+}
+
+// Enabled reports whether content is being sealed
+func (c *ContentCipher) Enabled() bool {
+	return c.keyring != nil
+}
+
+func contentContext(conversationID, messageID string) string {
+	return conversationID + "/" + messageID
+}
+
+// Seal encrypts the content of a message about to be stored. It also reports
+// whether the content was sealed, which is stored next to it and passed back
+// to Open: with no keyring configured content is stored as-is.
+func (c *ContentCipher) Seal(conversationID, messageID, content string) (string, bool, error) {
+	if !c.Enabled() {
+		return content, false, nil
+	}
+
+	dek, err := c.dataKey(conversationID)
+	if err != nil {
+		return "", false, err
+	}
+	sealed, err := crypto.SealContent(dek, content, contentContext(conversationID, messageID))
+	if err != nil {
+		return "", false, err
+	}
+	return sealed, true, nil
+}
+
+// Open decrypts stored content if it was stored sealed. Content written
+// before sealing was enabled is returned unchanged.
+func (c *ContentCipher) Open(conversationID, messageID, content string, sealed bool) (string, error) {
+	if !sealed {
+		return content, nil
+	}
+	if !c.Enabled() {
+		return "", crypto.ErrUnknownMasterKey
+	}
+
+	dek, err := c.dataKey(conversationID)
+	if err != nil {
+		return "", err
+	}
+	return crypto.OpenContent(dek, content, contentContext(conversationID, messageID))
+}
+
+// SealSecret wraps a secret that belongs to a user rather than a
+// conversation, such as a TOTP secret, directly under the primary master
+// key. It returns the master key ID to store next to it, which is empty when
+// no keyring is configured and the secret is stored as-is.
+func (c *ContentCipher) SealSecret(secret []byte, context string) ([]byte, string, error) {
+	if !c.Enabled() {
+		return secret, "", nil
+	}
+	masterKeyID, wrapped, err := c.keyring.WrapDataKey(secret, context)
+	if err != nil {
+		return nil, "", err
+	}
+	return wrapped, masterKeyID, nil
+}
+
+// OpenSecret unwraps a secret stored by SealSecret. A secret without a
+// master key ID was stored as-is.
+func (c *ContentCipher) OpenSecret(stored []byte, masterKeyID sql.NullString, context string) ([]byte, error) {
+	if !masterKeyID.Valid {
+		return stored, nil
+	}
+	if !c.Enabled() {
+		return nil, crypto.ErrUnknownMasterKey
+	}
+	return c.keyring.UnwrapDataKey(masterKeyID.String, stored, context)
+}
+
+// PrimaryKeyID returns the ID of the master key new secrets are sealed with,
+// or "" when sealing is off
+func (c *ContentCipher) PrimaryKeyID() string {
+	if !c.Enabled() {
+		return ""
+	}
+	return c.keyring.Primary().ID
+}
+
+// dataKey returns the conversation's DEK, creating it on first use
+func (c *ContentCipher) dataKey(conversationID string) ([]byte, error) {
+	c.mu.RLock()
+	dek, ok := c.deks[conversationID]
+	c.mu.RUnlock()
+	if ok {
+		return dek, nil
+	}
+
+	dek, err := c.loadDataKey(conversationID)
+	if err == sql.ErrNoRows {
+		dek, err = c.createDataKey(conversationID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.deks[conversationID] = dek
+	c.mu.Unlock()
+	return dek, nil
+}
+
+func (c *ContentCipher) loadDataKey(conversationID string) ([]byte, error) {
+	var masterKeyID string
+	var wrapped []byte
+	err := c.db.QueryRow(`
+		SELECT master_key_id, wrapped_key
+		FROM conversation_keys
+		WHERE conversation_id = $1
+	`, conversationID).Scan(&masterKeyID, &wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return c.keyring.UnwrapDataKey(masterKeyID, wrapped, conversationID)
+}
+
+func (c *ContentCipher) createDataKey(conversationID string) ([]byte, error) {
+	dek, err := crypto.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	masterKeyID, wrapped, err := c.keyring.WrapDataKey(dek, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Another request may have created the key first, in which case theirs wins
+	_, err = c.db.Exec(`
+		INSERT INTO conversation_keys (conversation_id, master_key_id, wrapped_key)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (conversation_id) DO NOTHING
+	`, conversationID, masterKeyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return c.loadDataKey(conversationID)
+}
+
+// RewrapKeys rewraps up to batchSize DEKs that are not yet wrapped by the
+// primary master key and returns how many were rewrapped. DEKs themselves
+// don't change, so this is safe while the server is serving traffic.
+func (c *ContentCipher) RewrapKeys(batchSize int) (int, error) {
+	if !c.Enabled() {
+		return 0, nil
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	primary := c.keyring.Primary()
+	rows, err := tx.Query(`
+		SELECT conversation_id, master_key_id, wrapped_key
+		FROM conversation_keys
+		WHERE master_key_id <> $1
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`, primary.ID, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	type wrappedKey struct {
+		conversationID string
+		masterKeyID    string
+		wrapped        []byte
+	}
+	var keys []wrappedKey
+	for rows.Next() {
+		var k wrappedKey
+		if err := rows.Scan(&k.conversationID, &k.masterKeyID, &k.wrapped); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, k := range keys {
+		dek, err := c.keyring.UnwrapDataKey(k.masterKeyID, k.wrapped, k.conversationID)
+		if err != nil {
+			return 0, err
+		}
+		masterKeyID, wrapped, err := c.keyring.WrapDataKey(dek, k.conversationID)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`
+			UPDATE conversation_keys
+			SET master_key_id = $2, wrapped_key = $3, rewrapped_at = NOW()
+			WHERE conversation_id = $1
+		`, k.conversationID, masterKeyID, wrapped)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// RewrapAll rewraps every DEK under the primary master key in batches. Once
+// it finishes, retired master keys can be removed from the keyring.
+func (c *ContentCipher) RewrapAll() (int, error) {
+	total := 0
+	for {
+		n, err := c.RewrapKeys(100)
+		total += n
+		if err != nil || n == 0 {
+			return total, err
+		}
+	}
+}
+
+// SealPlaintext seals up to batchSize messages that were stored before
+// sealing was enabled and returns how many were sealed. End-to-end encrypted
+// messages are never sealed.
+func (c *ContentCipher) SealPlaintext(batchSize int) (int, error) {
+	if !c.Enabled() {
+		return 0, nil
+	}
+	return c.rewriteMessages(`
+		SELECT id, conversation_id, content
+		FROM messages
+		WHERE NOT encrypted AND NOT sealed
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, batchSize, true, func(conversationID, messageID, content string) (string, error) {
+		sealed, _, err := c.Seal(conversationID, messageID, content)
+		return sealed, err
+	})
+}
+
+// UnsealAll decrypts up to batchSize sealed messages back to plaintext, for
+// switching sealing off, and returns how many were unsealed
+func (c *ContentCipher) UnsealAll(batchSize int) (int, error) {
+	return c.rewriteMessages(`
+		SELECT id, conversation_id, content
+		FROM messages
+		WHERE sealed
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, batchSize, false, func(conversationID, messageID, content string) (string, error) {
+		return c.Open(conversationID, messageID, content, true)
+	})
+}
+
+// rewriteMessages transforms the content of the messages selected by query
+// and marks them as sealed or not
+func (c *ContentCipher) rewriteMessages(query string, batchSize int, sealed bool, transform func(conversationID, messageID, content string) (string, error)) (int, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	type storedMessage struct {
+		id             string
+		conversationID string
+		content        string
+	}
+	var messages []storedMessage
+	for rows.Next() {
+		var m storedMessage
+		if err := rows.Scan(&m.id, &m.conversationID, &m.content); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, m := range messages {
+		content, err := transform(m.conversationID, m.id, m.content)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE messages SET content = $2, sealed = $3 WHERE id = $1`, m.id, content, sealed); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(messages), nil
+}
+
+// StartRewrapping rewraps DEKs left under retired master keys in the
+// background, so a master key can be rotated without downtime
+func (c *ContentCipher) StartRewrapping() {
+	if !c.Enabled() || c.keyring.Len() < 2 {
+		return
+	}
+
+	go func() {
+		start := time.Now()
+		n, err := c.RewrapAll()
+		if err != nil {
+			log.Printf("Failed to rewrap conversation keys: %v", err)
+			return
+		}
+		if n > 0 {
+			log.Printf("Rewrapped %d conversation keys under master key %s in %s", n, c.keyring.Primary().ID, time.Since(start))
+		}
+	}()
+}
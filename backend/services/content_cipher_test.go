@@ -0,0 +1,149 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/crypto"
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/google/uuid"
+)
+
+func newTestCipher(t *testing.T, db *sql.DB) *ContentCipher {
+	t.Helper()
+	keyring, err := crypto.ParseKeyring("k1:" + base64.StdEncoding.EncodeToString(make([]byte, crypto.MasterKeySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewContentCipher(db, keyring)
+}
+
+func newTestMessageService(db *sql.DB, cipher *ContentCipher) *MessageService {
+	return NewMessageService(db, cipher, NewWebhookService(db, cipher, egress.NewPolicy(), time.Second, 1))
+}
+
+func createTestMessage(t *testing.T, messages *MessageService, conversationID, senderID, content string, encrypted bool) *models.Message {
+	t.Helper()
+	message := &models.Message{
+		ID:             uuid.New().String(),
+		ConversationID: conversationID,
+		SenderID:       senderID,
+		Content:        content,
+		Encrypted:      encrypted,
+		MessageType:    "text",
+		CreatedAt:      time.Now(),
+	}
+	if err := messages.CreateMessage(message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// storedContent returns a message row as it is in the database
+func storedContent(t *testing.T, db *sql.DB, id string) (string, bool) {
+	t.Helper()
+	var content string
+	var sealed bool
+	if err := db.QueryRow(`SELECT content, sealed FROM messages WHERE id = $1`, id).Scan(&content, &sealed); err != nil {
+		t.Fatal(err)
+	}
+	return content, sealed
+}
+
+func TestMessageContentSealedAtRest(t *testing.T) {
+	db := dbtest.Open(t)
+	alice := dbtest.CreateUser(t, db, "alice")
+	conversationID := dbtest.CreateConversation(t, db, alice, dbtest.CreateUser(t, db, "bob"))
+	cipher := newTestCipher(t, db)
+	messages := newTestMessageService(db, cipher)
+
+	plain := createTestMessage(t, messages, conversationID, alice, "hello", false)
+	if content, sealed := storedContent(t, db, plain.ID); !sealed || strings.Contains(content, "hello") {
+		t.Fatalf("stored %q, sealed = %v", content, sealed)
+	}
+
+	// Neither looks sealed to the server: one is plaintext that happens to
+	// start with the prefix, the other is opaque end-to-end ciphertext
+	lookalike := createTestMessage(t, NewMessageService(db, NewContentCipher(db, nil), messages.webhooks), conversationID, alice, "nwa:v1:just text", false)
+	e2e := createTestMessage(t, messages, conversationID, alice, "nwa:v1:e2e ciphertext", true)
+	if content, sealed := storedContent(t, db, e2e.ID); sealed || content != e2e.Content {
+		t.Fatalf("end-to-end message stored as %q, sealed = %v", content, sealed)
+	}
+
+	for _, want := range []*models.Message{plain, lookalike, e2e} {
+		got, err := messages.GetMessageByID(want.ID)
+		if err != nil {
+			t.Fatalf("%q: %v", want.Content, err)
+		}
+		if got.Content != want.Content {
+			t.Errorf("GetMessageByID = %q, want %q", got.Content, want.Content)
+		}
+	}
+
+	history, err := messages.GetMessagesByConversation(conversationID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Content != plain.Content || history[2].Content != e2e.Content {
+		t.Errorf("history = %+v", history)
+	}
+
+	conversations, err := NewConversationService(db, cipher, nil).GetRecentConversations(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversations) != 1 || conversations[0].LastMessage == nil || conversations[0].LastMessage.Content != e2e.Content {
+		t.Errorf("conversations = %+v", conversations)
+	}
+}
+
+func TestSealPlaintextAndUnsealAll(t *testing.T) {
+	db := dbtest.Open(t)
+	alice := dbtest.CreateUser(t, db, "alice")
+	conversationID := dbtest.CreateConversation(t, db, alice, dbtest.CreateUser(t, db, "bob"))
+
+	// Written before sealing was switched on
+	unsealed := newTestMessageService(db, NewContentCipher(db, nil))
+	plain := createTestMessage(t, unsealed, conversationID, alice, "nwa:v1:plaintext", false)
+	e2e := createTestMessage(t, unsealed, conversationID, alice, "e2e ciphertext", true)
+
+	cipher := newTestCipher(t, db)
+	if n, err := cipher.SealPlaintext(10); err != nil || n != 1 {
+		t.Fatalf("SealPlaintext = %d, %v, want 1 message sealed", n, err)
+	}
+	if n, err := cipher.SealPlaintext(10); err != nil || n != 0 {
+		t.Fatalf("second SealPlaintext = %d, %v, want nothing left", n, err)
+	}
+	if content, sealed := storedContent(t, db, plain.ID); !sealed || content == plain.Content {
+		t.Fatalf("plaintext stored as %q, sealed = %v", content, sealed)
+	}
+	got, err := newTestMessageService(db, cipher).GetMessageByID(plain.ID)
+	if err != nil || got.Content != plain.Content {
+		t.Fatalf("GetMessageByID = %+v, %v", got, err)
+	}
+
+	if n, err := cipher.UnsealAll(10); err != nil || n != 1 {
+		t.Fatalf("UnsealAll = %d, %v, want 1 message unsealed", n, err)
+	}
+	for _, m := range []*models.Message{plain, e2e} {
+		if content, sealed := storedContent(t, db, m.ID); sealed || content != m.Content {
+			t.Errorf("after UnsealAll %q is stored as %q, sealed = %v", m.Content, content, sealed)
+		}
+	}
+}
+
+func TestOpenWithoutKeyring(t *testing.T) {
+	db := dbtest.Open(t)
+	alice := dbtest.CreateUser(t, db, "alice")
+	conversationID := dbtest.CreateConversation(t, db, alice)
+	message := createTestMessage(t, newTestMessageService(db, newTestCipher(t, db)), conversationID, alice, "hello", false)
+
+	if _, err := newTestMessageService(db, NewContentCipher(db, nil)).GetMessageByID(message.ID); err != crypto.ErrUnknownMasterKey {
+		t.Errorf("err = %v, want ErrUnknownMasterKey", err)
+	}
+}
@@ -9,11 +9,17 @@ import (
 )
 
 type ConversationService struct {
-	db *sql.DB
+	db       *sql.DB
+	cipher   *ContentCipher
+	webhooks *WebhookService
 }
 
-func NewConversationService(db *sql.DB) *ConversationService {
-	return &ConversationService{db: db}
+func NewConversationService(db *sql.DB, cipher *ContentCipher, webhooks *WebhookService) *ConversationService {
+	return &ConversationService{
+		db:       db,
+		cipher:   cipher,
+		webhooks: webhooks,
+	}
 }
 
 func (s *ConversationService) GetRecentConversations(userID string) ([]models.Conversation, error) {
@@ -24,6 +30,8 @@ func (s *ConversationService) GetRecentConversations(userID string) ([]models.Co
             c.created_at,
             m.id as message_id,
             m.content,
+            m.encrypted,
+            m.sealed,
             m.sender_id,
             m.created_at as message_created_at,
             u.id as participant_id,
@@ -34,7 +42,7 @@ func (s *ConversationService) GetRecentConversations(userID string) ([]models.Co
         JOIN conversation_participants cp ON c.id = cp.conversation_id
         JOIN users u ON cp.user_id = u.id
         LEFT JOIN LATERAL (
-            SELECT id, content, sender_id, created_at
+            SELECT id, content, encrypted, sealed, sender_id, created_at
             FROM messages
             WHERE conversation_id = c.id
             ORDER BY created_at DESC
@@ -63,6 +71,8 @@ func (s *ConversationService) GetRecentConversations(userID string) ([]models.Co
 			convCreatedAt     time.Time
 			messageID         sql.NullString
 			messageContent    sql.NullString
+			messageEncrypted  sql.NullBool
+			messageSealed     sql.NullBool
 			messageSenderID   sql.NullString
 			messageCreatedAt  sql.NullTime
 			participantID     string
@@ -73,7 +83,7 @@ func (s *ConversationService) GetRecentConversations(userID string) ([]models.Co
 
 		err := rows.Scan(
 			&convID, &convName, &convCreatedAt,
-			&messageID, &messageContent, &messageSenderID, &messageCreatedAt,
+			&messageID, &messageContent, &messageEncrypted, &messageSealed, &messageSenderID, &messageCreatedAt,
 			&participantID, &participantName, &participantEmail, &participantAvatar,
 		)
 		if err != nil {
@@ -100,9 +110,17 @@ func (s *ConversationService) GetRecentConversations(userID string) ([]models.Co
 		conv.Participants = append(conv.Participants, participant)
 
 		if messageID.Valid {
+			content := messageContent.String
+			if !messageEncrypted.Bool {
+				content, err = s.cipher.Open(convID, messageID.String, content, messageSealed.Bool)
+				if err != nil {
+					return nil, err
+				}
+			}
 			conv.LastMessage = &models.Message{
 				ID:        messageID.String,
-				Content:   messageContent.String,
+				Content:   content,
+				Encrypted: messageEncrypted.Bool,
 				SenderID:  messageSenderID.String,
 				CreatedAt: messageCreatedAt.Time,
 			}
@@ -164,12 +182,20 @@ func (s *ConversationService) CreateConversation(name string, participantIDs []s
 		if err != nil {
 			return nil, err
 		}
+
+		err = s.webhooks.enqueue(tx, conversationID, EventMemberJoined, map[string]interface{}{
+			"user_id": participantID,
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Commit the transaction
 	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
+	s.webhooks.wake()
 
 	// Return the created conversation
 	return s.GetConversationByID(conversationID)
@@ -239,3 +265,16 @@ func (s *ConversationService) GetConversationByID(id string) (*models.Conversati
 
 	return conversation, nil
 }
+
+// IsParticipant reports whether the user is a member of the conversation
+func (s *ConversationService) IsParticipant(conversationID, userID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM conversation_participants
+			WHERE conversation_id = $1 AND user_id = $2
+		)
+	`, conversationID, userID).Scan(&exists)
+	return exists, err
+}
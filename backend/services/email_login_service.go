@@ -0,0 +1,74 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/google/uuid"
+)
+
+// ErrInvalidLoginLink is returned for email login links that are forged,
+// expired or already used
+var ErrInvalidLoginLink = errors.New("invalid or expired login link")
+
+type EmailLoginService struct {
+	db     *sql.DB
+	tokens *auth.TokenManager
+	ttl    time.Duration
+}
+
+func NewEmailLoginService(db *sql.DB, tokens *auth.TokenManager, ttl time.Duration) *EmailLoginService {
+	return &EmailLoginService{
+		db:     db,
+		tokens: tokens,
+		ttl:    ttl,
+	}
+}
+
+// CreateLoginToken records a new login link for the email address and
+// returns its signed token
+func (s *EmailLoginService) CreateLoginToken(email, ipAddress string) (string, error) {
+	tokenID := uuid.New().String()
+	_, err := s.db.Exec(`
+		INSERT INTO email_login_tokens (id, email, ip_address, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, tokenID, email, ipAddress, time.Now().Add(s.ttl))
+	if err != nil {
+		return "", err
+	}
+
+	// Expired links are no longer needed
+	if _, err := s.db.Exec(`DELETE FROM email_login_tokens WHERE expires_at < NOW() - INTERVAL '1 day'`); err != nil {
+		return "", err
+	}
+
+	return s.tokens.IssueEmailLoginToken(email, tokenID, s.ttl)
+}
+
+// RedeemLoginToken verifies a login link and marks it used. It returns the
+// email address the link was sent to.
+func (s *EmailLoginService) RedeemLoginToken(token string) (string, error) {
+	email, tokenID, err := s.tokens.ParseEmailLoginToken(token)
+	if err != nil {
+		return "", ErrInvalidLoginLink
+	}
+
+	result, err := s.db.Exec(`
+		UPDATE email_login_tokens
+		SET used_at = NOW()
+		WHERE id = $1 AND email = $2 AND used_at IS NULL AND expires_at > NOW()
+	`, tokenID, email)
+	if err != nil {
+		return "", err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if rows == 0 {
+		return "", ErrInvalidLoginLink
+	}
+	return email, nil
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+)
+
+// newTestTokens returns a token manager for single-purpose tokens, which
+// only need the HMAC secret
+func newTestTokens() *auth.TokenManager {
+	return auth.NewTokenManager(auth.NewKeyring(), "http://localhost:8080", strings.Repeat("s", 32), time.Minute)
+}
+
+func TestEmailLoginToken(t *testing.T) {
+	db := dbtest.Open(t)
+	logins := NewEmailLoginService(db, newTestTokens(), time.Minute)
+
+	token, err := logins.CreateLoginToken("alice@example.com", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	email, err := logins.RedeemLoginToken(token)
+	if err != nil || email != "alice@example.com" {
+		t.Fatalf("RedeemLoginToken = %q, %v", email, err)
+	}
+	if _, err := logins.RedeemLoginToken(token); err != ErrInvalidLoginLink {
+		t.Errorf("second use: err = %v, want ErrInvalidLoginLink", err)
+	}
+
+	// A token signed by another server, or for a link that was never sent
+	other := NewEmailLoginService(db, auth.NewTokenManager(auth.NewKeyring(), "", strings.Repeat("x", 32), time.Minute), time.Minute)
+	forged, err := other.tokens.IssueEmailLoginToken("alice@example.com", "00000000-0000-0000-0000-000000000000", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logins.RedeemLoginToken(forged); err != ErrInvalidLoginLink {
+		t.Errorf("forged token: err = %v, want ErrInvalidLoginLink", err)
+	}
+	unsent, _ := logins.tokens.IssueEmailLoginToken("alice@example.com", "00000000-0000-0000-0000-000000000000", time.Minute)
+	if _, err := logins.RedeemLoginToken(unsent); err != ErrInvalidLoginLink {
+		t.Errorf("token for a link never sent: err = %v, want ErrInvalidLoginLink", err)
+	}
+}
+
+func TestEmailLoginTokenExpiry(t *testing.T) {
+	db := dbtest.Open(t)
+	logins := NewEmailLoginService(db, newTestTokens(), time.Minute)
+	token, err := logins.CreateLoginToken("alice@example.com", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The link expires in the database even while the token is still valid
+	if _, err := db.Exec(`UPDATE email_login_tokens SET expires_at = NOW() - INTERVAL '1 second'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logins.RedeemLoginToken(token); err != ErrInvalidLoginLink {
+		t.Errorf("err = %v, want ErrInvalidLoginLink", err)
+	}
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/google/uuid"
+)
+
+// IncomingWebhookTokenPrefix starts every incoming webhook token
+const IncomingWebhookTokenPrefix = "nwh_"
+
+var ErrIncomingWebhookNotFound = errors.New("incoming webhook not found")
+
+// IncomingWebhookService manages the URLs integrations post messages to a
+// conversation through. Each webhook has its own integration user, owned by
+// the participant who created it, that the messages are sent as.
+type IncomingWebhookService struct {
+	db       *sql.DB
+	webhooks *WebhookService
+}
+
+func NewIncomingWebhookService(db *sql.DB, webhooks *WebhookService) *IncomingWebhookService {
+	return &IncomingWebhookService{
+		db:       db,
+		webhooks: webhooks,
+	}
+}
+
+// CreateIncomingWebhook creates a webhook and its integration user, adds the
+// user to the conversation and returns the token that authorizes posting.
+// The token is only returned here.
+func (s *IncomingWebhookService) CreateIncomingWebhook(conversationID, userID, name, avatarURL string) (*models.IncomingWebhook, string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	integration, err := createBotUser(tx, userID, name, avatarURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO conversation_participants (conversation_id, user_id, joined_at)
+		VALUES ($1, $2, NOW())
+	`, conversationID, integration.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	err = s.webhooks.enqueue(tx, conversationID, EventMemberJoined, map[string]interface{}{
+		"user_id":  integration.ID,
+		"added_by": userID,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	raw, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	token := IncomingWebhookTokenPrefix + raw
+
+	webhook := &models.IncomingWebhook{
+		ConversationID: conversationID,
+		CreatedBy:      userID,
+		UserID:         integration.ID,
+		Name:           name,
+	}
+	err = tx.QueryRow(`
+		INSERT INTO incoming_webhooks (conversation_id, created_by, user_id, name, token_hash)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, conversationID, userID, integration.ID, name, hashSecretToken(token)).Scan(&webhook.ID, &webhook.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	s.webhooks.wake()
+	return webhook, token, nil
+}
+
+// GetIncomingWebhooks lists the incoming webhooks of a conversation
+func (s *IncomingWebhookService) GetIncomingWebhooks(conversationID string) ([]models.IncomingWebhook, error) {
+	rows, err := s.db.Query(`
+		SELECT id, conversation_id, created_by, user_id, name, created_at, last_used_at
+		FROM incoming_webhooks
+		WHERE conversation_id = $1
+		ORDER BY created_at
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []models.IncomingWebhook{}
+	for rows.Next() {
+		var webhook models.IncomingWebhook
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.ConversationID,
+			&webhook.CreatedBy,
+			&webhook.UserID,
+			&webhook.Name,
+			&webhook.CreatedAt,
+			&webhook.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteIncomingWebhook stops a webhook from accepting messages. Its
+// integration user stays so earlier messages keep their sender.
+func (s *IncomingWebhookService) DeleteIncomingWebhook(conversationID, webhookID string) error {
+	if _, err := uuid.Parse(webhookID); err != nil {
+		return ErrIncomingWebhookNotFound
+	}
+	result, err := s.db.Exec(`
+		DELETE FROM incoming_webhooks
+		WHERE id = $1 AND conversation_id = $2
+	`, webhookID, conversationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrIncomingWebhookNotFound
+	}
+	return nil
+}
+
+// AuthenticateIncomingWebhook returns the webhook if the token is its
+// token, or nil otherwise
+func (s *IncomingWebhookService) AuthenticateIncomingWebhook(webhookID, token string) (*models.IncomingWebhook, error) {
+	if _, err := uuid.Parse(webhookID); err != nil {
+		return nil, nil
+	}
+
+	webhook := &models.IncomingWebhook{}
+	var tokenHash []byte
+	err := s.db.QueryRow(`
+		SELECT id, conversation_id, created_by, user_id, name, token_hash, created_at
+		FROM incoming_webhooks
+		WHERE id = $1
+	`, webhookID).Scan(
+		&webhook.ID,
+		&webhook.ConversationID,
+		&webhook.CreatedBy,
+		&webhook.UserID,
+		&webhook.Name,
+		&tokenHash,
+		&webhook.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(tokenHash, hashSecretToken(token)) != 1 {
+		return nil, nil
+	}
+
+	_, err = s.db.Exec(`
+		UPDATE incoming_webhooks
+		SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $2)
+	`, webhook.ID, time.Now().Add(-apiTokenTouchInterval))
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
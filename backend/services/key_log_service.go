@@ -0,0 +1,382 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/RatneshMaurya/not-whatsapp/backend/transparency"
+	"github.com/lib/pq"
+)
+
+const (
+	KeyLogEventRegister = "register"
+	KeyLogEventRotate   = "rotate"
+
+	// maxKeyLogEntries caps a single entries page
+	maxKeyLogEntries = 1000
+)
+
+// ErrTreeSizeUnknown is returned when a proof is requested for a tree the log
+// has not grown to yet
+var ErrTreeSizeUnknown = errors.New("tree size not in log")
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type KeyLogService struct {
+	db         *sql.DB
+	signingKey ed25519.PrivateKey
+}
+
+func NewKeyLogService(db *sql.DB, signingKey ed25519.PrivateKey) *KeyLogService {
+	return &KeyLogService{
+		db:         db,
+		signingKey: signingKey,
+	}
+}
+
+// PublicKey returns the key tree heads are signed with
+func (s *KeyLogService) PublicKey() ed25519.PublicKey {
+	return s.signingKey.Public().(ed25519.PublicKey)
+}
+
+// Append adds a key event to the log inside the caller's transaction and signs
+// the resulting tree head. The frontier row stays locked until the
+// transaction ends, which serialises appends so leaf indexes never race.
+func (s *KeyLogService) Append(tx *sql.Tx, userID, publicKey, event string) (*models.KeyLogEntry, error) {
+	frontier, err := s.lockFrontier(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	leafData, err := json.Marshal(models.KeyLogLeaf{
+		UserID:    userID,
+		PublicKey: publicKey,
+		Event:     event,
+		Timestamp: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &models.KeyLogEntry{
+		LeafIndex: frontier.Size,
+		UserID:    userID,
+		PublicKey: publicKey,
+		Event:     event,
+		LeafData:  leafData,
+		CreatedAt: now,
+	}
+	leafHash := transparency.LeafHash(leafData)
+
+	_, err = tx.Exec(`
+		INSERT INTO key_log_entries (leaf_index, user_id, public_key, event, leaf_data, leaf_hash, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, entry.LeafIndex, entry.UserID, entry.PublicKey, entry.Event, entry.LeafData, leafHash, entry.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	frontier.Append(leafHash)
+	_, err = tx.Exec(`
+		UPDATE key_log_frontier
+		SET tree_size = $1, nodes = $2
+	`, frontier.Size, pq.ByteaArray(frontier.Nodes))
+	if err != nil {
+		return nil, err
+	}
+
+	sth := &transparency.SignedTreeHead{
+		TreeSize:  frontier.Size,
+		Timestamp: now.UnixMilli(),
+		RootHash:  frontier.Root(),
+	}
+	sth.Sign(s.signingKey)
+
+	_, err = tx.Exec(`
+		INSERT INTO key_log_tree_heads (tree_size, root_hash, timestamp, signature)
+		VALUES ($1, $2, $3, $4)
+	`, sth.TreeSize, sth.RootHash, sth.Timestamp, sth.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// lockFrontier loads the frontier of the log and locks it until tx ends. A
+// log written before the frontier was stored has its frontier built from the
+// leaves, once.
+func (s *KeyLogService) lockFrontier(tx *sql.Tx) (*transparency.Frontier, error) {
+	frontier, err := selectFrontierForUpdate(tx)
+	if err != sql.ErrNoRows {
+		return frontier, err
+	}
+
+	// Keep other appends out while the leaves are read. One that got here
+	// first has stored the frontier by the time the lock is granted.
+	if _, err := tx.Exec(`LOCK TABLE key_log_entries IN EXCLUSIVE MODE`); err != nil {
+		return nil, err
+	}
+	leaves, err := s.leafHashes(tx, -1)
+	if err != nil {
+		return nil, err
+	}
+	frontier = transparency.NewFrontier(leaves)
+	_, err = tx.Exec(`
+		INSERT INTO key_log_frontier (tree_size, nodes)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, frontier.Size, pq.ByteaArray(frontier.Nodes))
+	if err != nil {
+		return nil, err
+	}
+	return selectFrontierForUpdate(tx)
+}
+
+func selectFrontierForUpdate(tx *sql.Tx) (*transparency.Frontier, error) {
+	frontier := &transparency.Frontier{}
+	err := tx.QueryRow(`
+		SELECT tree_size, nodes
+		FROM key_log_frontier
+		FOR UPDATE
+	`).Scan(&frontier.Size, (*pq.ByteaArray)(&frontier.Nodes))
+	if err != nil {
+		return nil, err
+	}
+	return frontier, nil
+}
+
+// Backfill logs the keys of users registered before the log existed
+func (s *KeyLogService) Backfill() (int, error) {
+	rows, err := s.db.Query(`
+		SELECT u.id, u.public_key
+		FROM users u
+		WHERE u.public_key <> ''
+		AND NOT EXISTS (SELECT 1 FROM key_log_entries e WHERE e.user_id = u.id)
+		ORDER BY u.created_at
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	type pending struct{ userID, publicKey string }
+	var users []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.userID, &p.publicKey); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		users = append(users, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, p := range users {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return i, err
+		}
+		if _, err := s.Append(tx, p.userID, p.publicKey, KeyLogEventRegister); err != nil {
+			tx.Rollback()
+			return i, err
+		}
+		if err := tx.Commit(); err != nil {
+			return i, err
+		}
+	}
+
+	if len(users) > 0 {
+		log.Printf("Backfilled %d identity keys into the key log", len(users))
+	}
+	return len(users), nil
+}
+
+// leafHashes loads the leaf hashes of the first treeSize entries, or of the
+// whole log when treeSize is negative
+func (s *KeyLogService) leafHashes(q queryer, treeSize int64) ([][]byte, error) {
+	query := `SELECT leaf_hash FROM key_log_entries ORDER BY leaf_index`
+	args := []interface{}{}
+	if treeSize >= 0 {
+		query = `SELECT leaf_hash FROM key_log_entries WHERE leaf_index < $1 ORDER BY leaf_index`
+		args = append(args, treeSize)
+	}
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leaves := make([][]byte, 0)
+	for rows.Next() {
+		var leafHash []byte
+		if err := rows.Scan(&leafHash); err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, leafHash)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if treeSize >= 0 && int64(len(leaves)) != treeSize {
+		return nil, ErrTreeSizeUnknown
+	}
+	return leaves, nil
+}
+
+// LatestTreeHead returns the most recent signed tree head
+func (s *KeyLogService) LatestTreeHead() (*transparency.SignedTreeHead, error) {
+	sth := &transparency.SignedTreeHead{}
+	err := s.db.QueryRow(`
+		SELECT tree_size, root_hash, timestamp, signature
+		FROM key_log_tree_heads
+		ORDER BY tree_size DESC
+		LIMIT 1
+	`).Scan(&sth.TreeSize, &sth.RootHash, &sth.Timestamp, &sth.Signature)
+	if err == sql.ErrNoRows {
+		// Nothing logged yet, so commit to the empty tree
+		sth = &transparency.SignedTreeHead{
+			Timestamp: time.Now().UnixMilli(),
+			RootHash:  transparency.RootHash(nil),
+		}
+		sth.Sign(s.signingKey)
+		return sth, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sth, nil
+}
+
+// TreeHead returns the tree head signed when the log reached treeSize
+func (s *KeyLogService) TreeHead(treeSize uint64) (*transparency.SignedTreeHead, error) {
+	sth := &transparency.SignedTreeHead{}
+	err := s.db.QueryRow(`
+		SELECT tree_size, root_hash, timestamp, signature
+		FROM key_log_tree_heads
+		WHERE tree_size = $1
+	`, treeSize).Scan(&sth.TreeSize, &sth.RootHash, &sth.Timestamp, &sth.Signature)
+	if err == sql.ErrNoRows {
+		return nil, ErrTreeSizeUnknown
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sth, nil
+}
+
+// Entries returns log entries in [start, end)
+func (s *KeyLogService) Entries(start, end uint64) ([]models.KeyLogEntry, error) {
+	if end <= start {
+		return nil, fmt.Errorf("%w: end must be greater than start", transparency.ErrInvalidRange)
+	}
+	if end-start > maxKeyLogEntries {
+		end = start + maxKeyLogEntries
+	}
+
+	rows, err := s.db.Query(`
+		SELECT leaf_index, user_id, public_key, event, leaf_data, created_at
+		FROM key_log_entries
+		WHERE leaf_index >= $1 AND leaf_index < $2
+		ORDER BY leaf_index
+	`, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]models.KeyLogEntry, 0)
+	for rows.Next() {
+		var entry models.KeyLogEntry
+		err := rows.Scan(
+			&entry.LeafIndex,
+			&entry.UserID,
+			&entry.PublicKey,
+			&entry.Event,
+			&entry.LeafData,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// LatestEntryForUser returns the entry holding the user's current key
+func (s *KeyLogService) LatestEntryForUser(userID string) (*models.KeyLogEntry, error) {
+	var entry models.KeyLogEntry
+	err := s.db.QueryRow(`
+		SELECT leaf_index, user_id, public_key, event, leaf_data, created_at
+		FROM key_log_entries
+		WHERE user_id = $1
+		ORDER BY leaf_index DESC
+		LIMIT 1
+	`, userID).Scan(
+		&entry.LeafIndex,
+		&entry.UserID,
+		&entry.PublicKey,
+		&entry.Event,
+		&entry.LeafData,
+		&entry.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// InclusionProof proves that the entry at leafIndex is in the tree of treeSize
+func (s *KeyLogService) InclusionProof(leafIndex, treeSize uint64) (*models.KeyLogProof, error) {
+	leaves, err := s.leafHashes(s.db, int64(treeSize))
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := transparency.InclusionProof(leaves, leafIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.KeyLogProof{
+		LeafIndex: leafIndex,
+		TreeSize:  treeSize,
+		AuditPath: path,
+	}, nil
+}
+
+// ConsistencyProof proves that the tree of size first is a prefix of the tree
+// of size second
+func (s *KeyLogService) ConsistencyProof(first, second uint64) (*models.KeyLogConsistency, error) {
+	leaves, err := s.leafHashes(s.db, int64(second))
+	if err != nil {
+		return nil, err
+	}
+
+	proof, err := transparency.ConsistencyProof(leaves, first)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.KeyLogConsistency{
+		First:  first,
+		Second: second,
+		Proof:  proof,
+	}, nil
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/RatneshMaurya/not-whatsapp/backend/transparency"
+)
+
+func appendKey(t *testing.T, db *sql.DB, keyLog *KeyLogService, userID string) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := keyLog.Append(tx, userID, testPublicKey(t), KeyLogEventRegister); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkLog verifies the latest tree head against every leaf in the log
+func checkLog(t *testing.T, keyLog *KeyLogService, size uint64) {
+	t.Helper()
+	sth, err := keyLog.LatestTreeHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sth.Verify(keyLog.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if sth.TreeSize != size {
+		t.Fatalf("tree size = %d, want %d", sth.TreeSize, size)
+	}
+
+	leaves, err := keyLog.leafHashes(keyLog.db, int64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := transparency.RootHash(leaves); !bytes.Equal(sth.RootHash, want) {
+		t.Fatalf("root hash = %x, want %x", sth.RootHash, want)
+	}
+
+	for i := uint64(0); i < size; i++ {
+		proof, err := keyLog.InclusionProof(i, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := transparency.VerifyInclusion(leaves[i], i, size, proof.AuditPath, sth.RootHash); err != nil {
+			t.Fatalf("inclusion of leaf %d: %v", i, err)
+		}
+	}
+}
+
+func TestKeyLogAppend(t *testing.T) {
+	db := dbtest.Open(t)
+	_, signingKey, _ := ed25519.GenerateKey(nil)
+	keyLog := NewKeyLogService(db, signingKey)
+
+	empty, err := keyLog.LatestTreeHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.TreeSize != 0 || empty.Verify(keyLog.PublicKey()) != nil {
+		t.Fatalf("tree head of the empty log = %+v", empty)
+	}
+
+	users := make([]string, 5)
+	for i := range users {
+		users[i] = dbtest.CreateUser(t, db, string(rune('a'+i)))
+		appendKey(t, db, keyLog, users[i])
+		checkLog(t, keyLog, uint64(i+1))
+	}
+
+	first, err := keyLog.TreeHead(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, err := keyLog.LatestTreeHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	consistency, err := keyLog.ConsistencyProof(2, latest.TreeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := transparency.VerifyConsistency(2, latest.TreeSize, first.RootHash, latest.RootHash, consistency.Proof); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := keyLog.LatestEntryForUser(users[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.LeafIndex != 3 {
+		t.Errorf("leaf index of the fourth key = %d, want 3", entry.LeafIndex)
+	}
+
+	if _, err := keyLog.TreeHead(6); !errors.Is(err, ErrTreeSizeUnknown) {
+		t.Errorf("TreeHead past the end: err = %v, want ErrTreeSizeUnknown", err)
+	}
+	if _, err := keyLog.InclusionProof(0, 6); !errors.Is(err, ErrTreeSizeUnknown) {
+		t.Errorf("InclusionProof past the end: err = %v, want ErrTreeSizeUnknown", err)
+	}
+}
+
+func TestKeyLogBuildsMissingFrontier(t *testing.T) {
+	db := dbtest.Open(t)
+	_, signingKey, _ := ed25519.GenerateKey(nil)
+	keyLog := NewKeyLogService(db, signingKey)
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		appendKey(t, db, keyLog, dbtest.CreateUser(t, db, name))
+	}
+
+	// A log written before the frontier was stored
+	if _, err := db.Exec(`DELETE FROM key_log_frontier`); err != nil {
+		t.Fatal(err)
+	}
+
+	appendKey(t, db, keyLog, dbtest.CreateUser(t, db, "dave"))
+	checkLog(t, keyLog, 4)
+
+	var size int
+	if err := db.QueryRow(`SELECT tree_size FROM key_log_frontier`).Scan(&size); err != nil {
+		t.Fatal(err)
+	}
+	if size != 4 {
+		t.Errorf("stored frontier size = %d, want 4", size)
+	}
+}
+
+func TestKeyLogIsAppendOnly(t *testing.T) {
+	db := dbtest.Open(t)
+	_, signingKey, _ := ed25519.GenerateKey(nil)
+	keyLog := NewKeyLogService(db, signingKey)
+	appendKey(t, db, keyLog, dbtest.CreateUser(t, db, "alice"))
+
+	if _, err := db.Exec(`UPDATE key_log_entries SET public_key = 'forged'`); err == nil {
+		t.Error("a logged key was rewritten")
+	}
+	if _, err := db.Exec(`DELETE FROM key_log_tree_heads`); err == nil {
+		t.Error("a tree head was deleted")
+	}
+}
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/crypto"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/google/uuid"
+)
+
+// ErrKeyNotRegistered is returned when a safety number is requested for a
+// user that has no identity key yet
+var ErrKeyNotRegistered = errors.New("identity key not registered")
+
+// ErrKeyChanged is returned when a contact's key is no longer the one the
+// user compared
+var ErrKeyChanged = errors.New("identity key changed")
+
+type KeyService struct {
+	db     *sql.DB
+	keyLog *KeyLogService
+	cipher *ContentCipher
+}
+
+func NewKeyService(db *sql.DB, keyLog *KeyLogService, cipher *ContentCipher) *KeyService {
+	return &KeyService{
+		db:     db,
+		keyLog: keyLog,
+		cipher: cipher,
+	}
+}
+
+// UpdatePublicKey stores a new identity key for the user and records it in the
+// key transparency log. When an existing key is replaced, every verification
+// of the old key is dropped and a system message is added to each of the
+// user's conversations. The inserted notices are returned so they can be
+// delivered to connected participants.
+func (s *KeyService) UpdatePublicKey(userID, publicKey string) ([]models.Message, error) {
+	if _, err := crypto.KeyFingerprint(publicKey); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var name, oldKey string
+	err = tx.QueryRow(`
+		SELECT name, public_key
+		FROM users
+		WHERE id = $1
+		FOR UPDATE
+	`, userID).Scan(&name, &oldKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if oldKey == publicKey {
+		return nil, tx.Commit()
+	}
+
+	if _, err = tx.Exec(`UPDATE users SET public_key = $2 WHERE id = $1`, userID, publicKey); err != nil {
+		return nil, err
+	}
+
+	event := KeyLogEventRotate
+	if oldKey == "" {
+		event = KeyLogEventRegister
+	}
+	if _, err = s.keyLog.Append(tx, userID, publicKey, event); err != nil {
+		return nil, err
+	}
+
+	// Anyone who verified the old key has to verify again
+	if _, err = tx.Exec(`DELETE FROM key_verifications WHERE contact_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	// Registering a first key is not a change worth announcing
+	if oldKey == "" {
+		return nil, tx.Commit()
+	}
+
+	rows, err := tx.Query(`
+		SELECT conversation_id
+		FROM conversation_participants
+		WHERE user_id = $1
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var conversationIDs []string
+	for rows.Next() {
+		var conversationID string
+		if err := rows.Scan(&conversationID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		conversationIDs = append(conversationIDs, conversationID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	content := fmt.Sprintf("%s's safety number has changed", name)
+	notices := make([]models.Message, 0, len(conversationIDs))
+	for _, conversationID := range conversationIDs {
+		notice := models.Message{
+			ID:             uuid.New().String(),
+			ConversationID: conversationID,
+			Content:        content,
+			SenderID:       userID,
+			MessageType:    "system",
+			CreatedAt:      now,
+			Sender: models.User{
+				ID:   userID,
+				Name: name,
+			},
+		}
+		stored, sealed, err := s.cipher.Seal(notice.ConversationID, notice.ID, notice.Content)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO messages (id, conversation_id, sender_id, content, sealed, encrypted, message_type, created_at)
+			VALUES ($1, $2, $3, $4, $5, false, 'system', $6)
+		`, notice.ID, notice.ConversationID, notice.SenderID, stored, sealed, notice.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		notices = append(notices, notice)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return notices, nil
+}
+
+// GetSafetyNumber computes the safety number between a user and a contact and
+// reports whether the user has verified the contact's current key
+func (s *KeyService) GetSafetyNumber(userID, contactID string) (*models.SafetyNumber, error) {
+	var userKey, contactKey string
+	err := s.db.QueryRow(`SELECT public_key FROM users WHERE id = $1`, userID).Scan(&userKey)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.QueryRow(`SELECT public_key FROM users WHERE id = $1`, contactID).Scan(&contactKey)
+	if err != nil {
+		return nil, err
+	}
+	result, err := safetyNumber(userID, userKey, contactID, contactKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var verifiedFingerprint string
+	var verifiedAt time.Time
+	err = s.db.QueryRow(`
+		SELECT contact_key_fingerprint, verified_at
+		FROM key_verifications
+		WHERE user_id = $1 AND contact_id = $2
+	`, userID, contactID).Scan(&verifiedFingerprint, &verifiedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// A verification only counts for the exact key that was verified
+	if err == nil && verifiedFingerprint == result.ContactFingerprint {
+		result.Verified = true
+		result.VerifiedAt = &verifiedAt
+	}
+
+	return result, nil
+}
+
+// safetyNumber computes the safety number and key fingerprints of a user and
+// a contact
+func safetyNumber(userID, userKey, contactID, contactKey string) (*models.SafetyNumber, error) {
+	if userKey == "" || contactKey == "" {
+		return nil, ErrKeyNotRegistered
+	}
+
+	number, err := crypto.SafetyNumber(userID, userKey, contactID, contactKey)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := crypto.KeyFingerprint(userKey)
+	if err != nil {
+		return nil, err
+	}
+	contactFingerprint, err := crypto.KeyFingerprint(contactKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.SafetyNumber{
+		ContactID:          contactID,
+		SafetyNumber:       number,
+		Fingerprint:        fingerprint,
+		ContactFingerprint: contactFingerprint,
+	}, nil
+}
+
+// MarkVerified records that the user has verified the contact's key with the
+// given fingerprint. The contact's key is locked like UpdatePublicKey does,
+// so ErrKeyChanged is returned if it was rotated after the user compared it.
+func (s *KeyService) MarkVerified(userID, contactID, contactFingerprint string) (*models.SafetyNumber, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userKey, contactKey string
+	err = tx.QueryRow(`SELECT public_key FROM users WHERE id = $1`, userID).Scan(&userKey)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(`
+		SELECT public_key
+		FROM users
+		WHERE id = $1
+		FOR UPDATE
+	`, contactID).Scan(&contactKey)
+	if err != nil {
+		return nil, err
+	}
+	result, err := safetyNumber(userID, userKey, contactID, contactKey)
+	if err != nil {
+		return nil, err
+	}
+	if result.ContactFingerprint != contactFingerprint {
+		return nil, ErrKeyChanged
+	}
+
+	var verifiedAt time.Time
+	err = tx.QueryRow(`
+		INSERT INTO key_verifications (user_id, contact_id, contact_key_fingerprint, verified_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (user_id, contact_id) DO UPDATE
+		SET contact_key_fingerprint = $3, verified_at = NOW()
+		RETURNING verified_at
+	`, userID, contactID, contactFingerprint).Scan(&verifiedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	result.Verified = true
+	result.VerifiedAt = &verifiedAt
+	return result, nil
+}
+
+// ClearVerification removes the user's verification of a contact
+func (s *KeyService) ClearVerification(userID, contactID string) error {
+	_, err := s.db.Exec(`
+		DELETE FROM key_verifications
+		WHERE user_id = $1 AND contact_id = $2
+	`, userID, contactID)
+	return err
+}
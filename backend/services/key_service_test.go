@@ -0,0 +1,169 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+)
+
+// testPublicKey returns a fresh PEM encoded identity key
+func testPublicKey(t *testing.T) string {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func newTestKeyService(t *testing.T, db *sql.DB) *KeyService {
+	t.Helper()
+	_, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewKeyService(db, NewKeyLogService(db, signingKey), NewContentCipher(db, nil))
+}
+
+func TestKeyServiceVerification(t *testing.T) {
+	db := dbtest.Open(t)
+	keys := newTestKeyService(t, db)
+	alice := dbtest.CreateUser(t, db, "alice")
+	bob := dbtest.CreateUser(t, db, "bob")
+
+	if _, err := keys.GetSafetyNumber(alice, bob); !errors.Is(err, ErrKeyNotRegistered) {
+		t.Fatalf("GetSafetyNumber without keys: err = %v, want ErrKeyNotRegistered", err)
+	}
+
+	for _, userID := range []string{alice, bob} {
+		notices, err := keys.UpdatePublicKey(userID, testPublicKey(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(notices) != 0 {
+			t.Errorf("registering a first key sent %d notices", len(notices))
+		}
+	}
+
+	number, err := keys.GetSafetyNumber(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number.Verified {
+		t.Error("contact is verified before MarkVerified")
+	}
+	fromBob, err := keys.GetSafetyNumber(bob, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromBob.SafetyNumber != number.SafetyNumber {
+		t.Errorf("safety numbers differ: %q and %q", number.SafetyNumber, fromBob.SafetyNumber)
+	}
+
+	verified, err := keys.MarkVerified(alice, bob, number.ContactFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified.Verified || verified.VerifiedAt == nil {
+		t.Fatalf("MarkVerified = %+v, want verified", verified)
+	}
+	if number, err = keys.GetSafetyNumber(alice, bob); err != nil || !number.Verified {
+		t.Fatalf("GetSafetyNumber after MarkVerified = %+v, %v", number, err)
+	}
+
+	if err := keys.ClearVerification(alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	if number, err = keys.GetSafetyNumber(alice, bob); err != nil || number.Verified {
+		t.Fatalf("GetSafetyNumber after ClearVerification = %+v, %v", number, err)
+	}
+}
+
+func TestKeyServiceRotationResetsVerification(t *testing.T) {
+	db := dbtest.Open(t)
+	keys := newTestKeyService(t, db)
+	alice := dbtest.CreateUser(t, db, "alice")
+	bob := dbtest.CreateUser(t, db, "bob")
+	first := dbtest.CreateConversation(t, db, alice, bob)
+	second := dbtest.CreateConversation(t, db, alice, bob)
+
+	bobKey := testPublicKey(t)
+	for userID, key := range map[string]string{alice: testPublicKey(t), bob: bobKey} {
+		if _, err := keys.UpdatePublicKey(userID, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compared, err := keys.GetSafetyNumber(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.MarkVerified(alice, bob, compared.ContactFingerprint); err != nil {
+		t.Fatal(err)
+	}
+
+	// Storing the same key again is not a rotation
+	notices, err := keys.UpdatePublicKey(bob, bobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notices) != 0 {
+		t.Errorf("unchanged key sent %d notices", len(notices))
+	}
+
+	notices, err = keys.UpdatePublicKey(bob, testPublicKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, notice := range notices {
+		if notice.MessageType != "system" || notice.SenderID != bob {
+			t.Errorf("notice = %+v, want a system message from bob", notice)
+		}
+		got[notice.ConversationID] = true
+	}
+	if len(notices) != 2 || !got[first] || !got[second] {
+		t.Errorf("notices went to %v, want both conversations", got)
+	}
+
+	number, err := keys.GetSafetyNumber(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number.Verified {
+		t.Error("verification of the old key survived a rotation")
+	}
+	// The key the user compared before the rotation can't be verified
+	if _, err := keys.MarkVerified(alice, bob, compared.ContactFingerprint); !errors.Is(err, ErrKeyChanged) {
+		t.Errorf("MarkVerified with the old key: err = %v, want ErrKeyChanged", err)
+	}
+	if number, err = keys.GetSafetyNumber(alice, bob); err != nil || number.Verified {
+		t.Errorf("GetSafetyNumber after verifying the old key = %+v, %v", number, err)
+	}
+
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages WHERE message_type = 'system'`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 2 {
+		t.Errorf("stored %d system messages, want 2", stored)
+	}
+}
+
+func TestKeyServiceRejectsEmptyKey(t *testing.T) {
+	db := dbtest.Open(t)
+	keys := newTestKeyService(t, db)
+	alice := dbtest.CreateUser(t, db, "alice")
+
+	if _, err := keys.UpdatePublicKey(alice, " "); err == nil {
+		t.Error("UpdatePublicKey accepted an empty key")
+	}
+}
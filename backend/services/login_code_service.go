@@ -0,0 +1,69 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrInvalidLoginCode is returned for login codes that are unknown, expired
+// or already exchanged
+var ErrInvalidLoginCode = errors.New("invalid or expired login code")
+
+// LoginCodeService issues the one-time codes a finished login redirects to
+// the frontend with, so that tokens never appear in a URL
+type LoginCodeService struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+func NewLoginCodeService(db *sql.DB, ttl time.Duration) *LoginCodeService {
+	return &LoginCodeService{
+		db:  db,
+		ttl: ttl,
+	}
+}
+
+// CreateLoginCode returns a new code that can be exchanged once for a
+// session of the user
+func (s *LoginCodeService) CreateLoginCode(userID string) (string, error) {
+	code, codeHash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO login_codes (code_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, codeHash, userID, time.Now().Add(s.ttl))
+	if err != nil {
+		return "", err
+	}
+
+	// Codes that were never exchanged are no longer needed
+	if _, err := s.db.Exec(`DELETE FROM login_codes WHERE expires_at < NOW()`); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// RedeemLoginCode consumes a code and returns the user it was issued for
+func (s *LoginCodeService) RedeemLoginCode(code string) (string, error) {
+	var userID string
+	var valid bool
+	err := s.db.QueryRow(`
+		DELETE FROM login_codes
+		WHERE code_hash = $1
+		RETURNING user_id, expires_at > NOW()
+	`, hashSecretToken(code)).Scan(&userID, &valid)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidLoginCode
+	}
+	if err != nil {
+		return "", err
+	}
+	if !valid {
+		return "", ErrInvalidLoginCode
+	}
+	return userID, nil
+}
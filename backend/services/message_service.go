@@ -7,35 +7,91 @@ import (
 )
 
 type MessageService struct {
-	db *sql.DB
+	db       *sql.DB
+	cipher   *ContentCipher
+	webhooks *WebhookService
 }
 
-func NewMessageService(db *sql.DB) *MessageService {
-	return &MessageService{db: db}
+func NewMessageService(db *sql.DB, cipher *ContentCipher, webhooks *WebhookService) *MessageService {
+	return &MessageService{
+		db:       db,
+		cipher:   cipher,
+		webhooks: webhooks,
+	}
 }
 
+// CreateMessage stores a message and queues its message.created webhook
+// event. Content that is not end-to-end encrypted is sealed at rest.
 func (s *MessageService) CreateMessage(message *models.Message) error {
+	content, sealed := message.Content, false
+	if !message.Encrypted {
+		var err error
+		content, sealed, err = s.cipher.Seal(message.ConversationID, message.ID, content)
+		if err != nil {
+			return err
+		}
+	}
+
 	query := `
-		INSERT INTO messages (id, conversation_id, content, sender_id, encrypted, message_type, created_at, delivered_at, read_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		INSERT INTO messages (id, conversation_id, content, sealed, sender_id, encrypted, message_type, bot, display_name, created_at, delivered_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, $11)
 	`
-	_, err := s.db.Exec(query,
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(query,
 		message.ID,
 		message.ConversationID,
-		message.Content,
+		content,
+		sealed,
 		message.SenderID,
 		message.Encrypted,
 		message.MessageType,
+		message.Bot,
+		message.DisplayName,
 		message.CreatedAt,
 		message.DeliveredAt,
-		message.ReadAt,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	err = s.webhooks.enqueue(tx, message.ConversationID, EventMessageCreated, map[string]interface{}{
+		"id":           message.ID,
+		"sender_id":    message.SenderID,
+		"content":      message.Content,
+		"encrypted":    message.Encrypted,
+		"message_type": message.MessageType,
+		"bot":          message.Bot,
+		"display_name": message.DisplayName,
+		"created_at":   message.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.webhooks.wake()
+	return nil
+}
+
+// openContent returns the plaintext of a stored message. End-to-end
+// encrypted content is returned as the client sent it.
+func (s *MessageService) openContent(msg *models.Message, sealed bool) (string, error) {
+	if msg.Encrypted {
+		return msg.Content, nil
+	}
+	return s.cipher.Open(msg.ConversationID, msg.ID, msg.Content, sealed)
 }
 
 func (s *MessageService) GetMessages(limit int) ([]models.Message, error) {
 	query := `
-		SELECT id, conversation_id, content, sender_id, encrypted, message_type, created_at, delivered_at, read_at
+		SELECT id, conversation_id, content, sealed, sender_id, encrypted, message_type, bot, COALESCE(display_name, ''), created_at, delivered_at, read_at
 		FROM messages
 		ORDER BY created_at DESC
 		LIMIT $1
@@ -49,13 +105,17 @@ func (s *MessageService) GetMessages(limit int) ([]models.Message, error) {
 	var messages []models.Message
 	for rows.Next() {
 		var msg models.Message
+		var sealed bool
 		err := rows.Scan(
 			&msg.ID,
 			&msg.ConversationID,
 			&msg.Content,
+			&sealed,
 			&msg.SenderID,
 			&msg.Encrypted,
 			&msg.MessageType,
+			&msg.Bot,
+			&msg.DisplayName,
 			&msg.CreatedAt,
 			&msg.DeliveredAt,
 			&msg.ReadAt,
@@ -63,6 +123,9 @@ func (s *MessageService) GetMessages(limit int) ([]models.Message, error) {
 		if err != nil {
 			return nil, err
 		}
+		if msg.Content, err = s.openContent(&msg, sealed); err != nil {
+			return nil, err
+		}
 		messages = append(messages, msg)
 	}
 
@@ -71,18 +134,22 @@ func (s *MessageService) GetMessages(limit int) ([]models.Message, error) {
 
 func (s *MessageService) GetMessageByID(id string) (*models.Message, error) {
 	query := `
-		SELECT id, conversation_id, content, sender_id, encrypted, message_type, created_at, delivered_at, read_at
+		SELECT id, conversation_id, content, sealed, sender_id, encrypted, message_type, bot, COALESCE(display_name, ''), created_at, delivered_at, read_at
 		FROM messages
 		WHERE id = $1
 	`
 	var msg models.Message
+	var sealed bool
 	err := s.db.QueryRow(query, id).Scan(
 		&msg.ID,
 		&msg.ConversationID,
 		&msg.Content,
+		&sealed,
 		&msg.SenderID,
 		&msg.Encrypted,
 		&msg.MessageType,
+		&msg.Bot,
+		&msg.DisplayName,
 		&msg.CreatedAt,
 		&msg.DeliveredAt,
 		&msg.ReadAt,
@@ -90,6 +157,9 @@ func (s *MessageService) GetMessageByID(id string) (*models.Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	if msg.Content, err = s.openContent(&msg, sealed); err != nil {
+		return nil, err
+	}
 	return &msg, nil
 }
 
@@ -98,7 +168,12 @@ func (s *MessageService) GetMessagesByConversation(conversationID string, limit
 		SELECT 
 			m.id,
 			m.content,
+			m.sealed,
 			m.sender_id,
+			m.encrypted,
+			m.message_type,
+			m.bot,
+			COALESCE(m.display_name, ''),
 			m.created_at,
 			u.name as sender_name,
 			u.avatar_url as sender_avatar_url
@@ -119,10 +194,16 @@ func (s *MessageService) GetMessagesByConversation(conversationID string, limit
 	for rows.Next() {
 		var msg models.Message
 		var senderName, senderAvatarURL string
+		var sealed bool
 		err := rows.Scan(
 			&msg.ID,
 			&msg.Content,
+			&sealed,
 			&msg.SenderID,
+			&msg.Encrypted,
+			&msg.MessageType,
+			&msg.Bot,
+			&msg.DisplayName,
 			&msg.CreatedAt,
 			&senderName,
 			&senderAvatarURL,
@@ -131,10 +212,16 @@ func (s *MessageService) GetMessagesByConversation(conversationID string, limit
 			return nil, err
 		}
 
+		msg.ConversationID = conversationID
+		if msg.Content, err = s.openContent(&msg, sealed); err != nil {
+			return nil, err
+		}
+
 		msg.Sender = models.User{
 			ID:        msg.SenderID,
 			Name:      senderName,
 			AvatarURL: senderAvatarURL,
+			IsBot:     msg.Bot,
 		}
 		messages = append(messages, msg)
 	}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// newSecret returns a random URL-safe string of 32 bytes, for the tokens,
+// secrets and codes handed to users, bots and integrations
+func newSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// newSecretToken returns a new secret and the hash it is stored as
+func newSecretToken() (string, []byte, error) {
+	token, err := newSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	return token, hashSecretToken(token), nil
+}
+
+// hashSecretToken returns the hash a secret is stored and looked up by
+func hashSecretToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
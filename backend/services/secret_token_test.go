@@ -0,0 +1,23 @@
+package services
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewSecretToken(t *testing.T) {
+	token, hash, err := newSecretToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 32 bytes in unpadded base64url
+	if len(token) != 43 {
+		t.Errorf("token %q has %d characters, want 43", token, len(token))
+	}
+	if !bytes.Equal(hash, hashSecretToken(token)) {
+		t.Error("token is not stored as its hash")
+	}
+	if other, _, _ := newSecretToken(); other == token {
+		t.Error("two tokens are the same")
+	}
+}
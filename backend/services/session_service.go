@@ -0,0 +1,210 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused means an already rotated refresh token was
+	// presented again, which indicates it was stolen. The session is revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+)
+
+const (
+	SessionRevokedLogout    = "logout"
+	SessionRevokedLogoutAll = "logout_all"
+	SessionRevokedReuse     = "refresh_token_reuse"
+)
+
+type SessionService struct {
+	db         *sql.DB
+	refreshTTL time.Duration
+}
+
+func NewSessionService(db *sql.DB, refreshTTL time.Duration) *SessionService {
+	return &SessionService{
+		db:         db,
+		refreshTTL: refreshTTL,
+	}
+}
+
+// CreateSession starts a new login session and returns it with its first
+// refresh token
+func (s *SessionService) CreateSession(userID, userAgent, ipAddress string) (*models.Session, string, error) {
+	token, tokenHash, err := newSecretToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	session := &models.Session{
+		UserID:    userID,
+		UserAgent: userAgent,
+		IPAddress: ipAddress,
+	}
+	err = tx.QueryRow(`
+		INSERT INTO sessions (user_id, user_agent, ip_address, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, last_used_at, expires_at
+	`, userID, userAgent, ipAddress, time.Now().Add(s.refreshTTL)).Scan(
+		&session.ID,
+		&session.CreatedAt,
+		&session.LastUsedAt,
+		&session.ExpiresAt,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (token_hash, session_id)
+		VALUES ($1, $2)
+	`, tokenHash, session.ID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	return session, token, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one. Each token can
+// be used once; a second use revokes the whole session and returns
+// ErrRefreshTokenReused along with the revoked session.
+func (s *SessionService) RotateRefreshToken(token, userAgent, ipAddress string) (*models.Session, string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	session := &models.Session{}
+	var usedAt, revokedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT s.id, s.user_id, s.created_at, s.expires_at, s.revoked_at, rt.used_at
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE
+	`, hashSecretToken(token)).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.CreatedAt,
+		&session.ExpiresAt,
+		&revokedAt,
+		&usedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if revokedAt.Valid || time.Now().After(session.ExpiresAt) {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	if usedAt.Valid {
+		_, err = tx.Exec(`
+			UPDATE sessions
+			SET revoked_at = NOW(), revoked_reason = $2
+			WHERE id = $1
+		`, session.ID, SessionRevokedReuse)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, "", err
+		}
+		return session, "", ErrRefreshTokenReused
+	}
+
+	newToken, newTokenHash, err := newSecretToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, err = tx.Exec(`UPDATE refresh_tokens SET used_at = NOW() WHERE token_hash = $1`, hashSecretToken(token)); err != nil {
+		return nil, "", err
+	}
+	if _, err = tx.Exec(`INSERT INTO refresh_tokens (token_hash, session_id) VALUES ($1, $2)`, newTokenHash, session.ID); err != nil {
+		return nil, "", err
+	}
+
+	err = tx.QueryRow(`
+		UPDATE sessions
+		SET last_used_at = NOW(), user_agent = $2, ip_address = $3
+		WHERE id = $1
+		RETURNING user_agent, ip_address, last_used_at
+	`, session.ID, userAgent, ipAddress).Scan(&session.UserAgent, &session.IPAddress, &session.LastUsedAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	return session, newToken, nil
+}
+
+// IsSessionActive reports whether a session exists and has not been revoked
+// or expired
+func (s *SessionService) IsSessionActive(sessionID string) (bool, error) {
+	var active bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM sessions
+			WHERE id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		)
+	`, sessionID).Scan(&active)
+	return active, err
+}
+
+// RevokeSession revokes one of the user's sessions
+func (s *SessionService) RevokeSession(userID, sessionID, reason string) error {
+	_, err := s.db.Exec(`
+		UPDATE sessions
+		SET revoked_at = NOW(), revoked_reason = $3
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, sessionID, userID, reason)
+	return err
+}
+
+// RevokeAllSessions revokes every active session of the user and returns
+// their IDs
+func (s *SessionService) RevokeAllSessions(userID, reason string) ([]string, error) {
+	rows, err := s.db.Query(`
+		UPDATE sessions
+		SET revoked_at = NOW(), revoked_reason = $2
+		WHERE user_id = $1 AND revoked_at IS NULL
+		RETURNING id
+	`, userID, reason)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessionIDs []string
+	for rows.Next() {
+		var sessionID string
+		if err := rows.Scan(&sessionID); err != nil {
+			return nil, err
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	return sessionIDs, rows.Err()
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	db := dbtest.Open(t)
+	sessions := NewSessionService(db, time.Hour)
+	alice := dbtest.CreateUser(t, db, "alice")
+
+	session, first, err := sessions.CreateSession(alice, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active, err := sessions.IsSessionActive(session.ID); err != nil || !active {
+		t.Fatalf("new session active = %v, %v", active, err)
+	}
+
+	rotated, second, err := sessions.RotateRefreshToken(first, "test 2", "127.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ID != session.ID || rotated.UserID != alice || second == first {
+		t.Fatalf("rotated session = %+v, same token = %v", rotated, second == first)
+	}
+	if rotated.UserAgent != "test 2" || rotated.IPAddress != "127.0.0.2" {
+		t.Errorf("session client = %q %q, want the latest", rotated.UserAgent, rotated.IPAddress)
+	}
+
+	// Presenting the first token again means it was copied: the whole
+	// session goes, including the token rotated to
+	reused, _, err := sessions.RotateRefreshToken(first, "attacker", "10.0.0.1")
+	if err != ErrRefreshTokenReused {
+		t.Fatalf("reuse: err = %v, want ErrRefreshTokenReused", err)
+	}
+	if reused == nil || reused.ID != session.ID {
+		t.Fatalf("reuse returned session %+v, want %s", reused, session.ID)
+	}
+	if active, _ := sessions.IsSessionActive(session.ID); active {
+		t.Error("session is still active after refresh token reuse")
+	}
+	if _, _, err := sessions.RotateRefreshToken(second, "test", "127.0.0.1"); err != ErrInvalidRefreshToken {
+		t.Errorf("token of a revoked session: err = %v, want ErrInvalidRefreshToken", err)
+	}
+
+	if _, _, err := sessions.RotateRefreshToken("unknown", "test", "127.0.0.1"); err != ErrInvalidRefreshToken {
+		t.Errorf("unknown token: err = %v, want ErrInvalidRefreshToken", err)
+	}
+}
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	db := dbtest.Open(t)
+	sessions := NewSessionService(db, -time.Minute)
+	session, token, err := sessions.CreateSession(dbtest.CreateUser(t, db, "alice"), "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if active, _ := sessions.IsSessionActive(session.ID); active {
+		t.Error("expired session is active")
+	}
+	if _, _, err := sessions.RotateRefreshToken(token, "test", "127.0.0.1"); err != ErrInvalidRefreshToken {
+		t.Errorf("err = %v, want ErrInvalidRefreshToken", err)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	db := dbtest.Open(t)
+	sessions := NewSessionService(db, time.Hour)
+	alice := dbtest.CreateUser(t, db, "alice")
+	bob := dbtest.CreateUser(t, db, "bob")
+
+	phone, _, _ := sessions.CreateSession(alice, "phone", "127.0.0.1")
+	laptop, _, _ := sessions.CreateSession(alice, "laptop", "127.0.0.1")
+	bobs, _, _ := sessions.CreateSession(bob, "phone", "127.0.0.1")
+
+	// Only the owner can revoke a session
+	if err := sessions.RevokeSession(bob, phone.ID, SessionRevokedLogout); err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := sessions.IsSessionActive(phone.ID); !active {
+		t.Fatal("another user revoked the session")
+	}
+
+	if err := sessions.RevokeSession(alice, phone.ID, SessionRevokedLogout); err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := sessions.IsSessionActive(phone.ID); active {
+		t.Fatal("session is active after logout")
+	}
+
+	revoked, err := sessions.RevokeAllSessions(alice, SessionRevokedLogoutAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0] != laptop.ID {
+		t.Errorf("RevokeAllSessions = %v, want only the laptop session", revoked)
+	}
+	if active, _ := sessions.IsSessionActive(bobs.ID); !active {
+		t.Error("logging out all of alice's devices revoked bob's session")
+	}
+}
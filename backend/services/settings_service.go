@@ -0,0 +1,63 @@
+package services
+
+import (
+	"database/sql"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+)
+
+// SettingsService keeps the settings admins can change at runtime in the
+// database, so every server sees the same values
+type SettingsService struct {
+	db *sql.DB
+	// requireTwoFactor is REQUIRE_TWO_FACTOR, which admins can't turn off
+	requireTwoFactor bool
+}
+
+func NewSettingsService(db *sql.DB, requireTwoFactor bool) *SettingsService {
+	return &SettingsService{
+		db:               db,
+		requireTwoFactor: requireTwoFactor,
+	}
+}
+
+// GetSettings returns the current settings
+func (s *SettingsService) GetSettings() (*models.ServerSettings, error) {
+	settings := &models.ServerSettings{RequireTwoFactorByConfig: s.requireTwoFactor}
+	var updatedBy sql.NullString
+	err := s.db.QueryRow(`
+		SELECT require_two_factor, updated_by, updated_at
+		FROM server_settings
+	`).Scan(&settings.RequireTwoFactor, &updatedBy, &settings.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	settings.UpdatedBy = updatedBy.String
+	return settings, nil
+}
+
+// SetRequireTwoFactor turns the two-factor requirement on or off for every
+// user, recording the admin who changed it
+func (s *SettingsService) SetRequireTwoFactor(adminID string, require bool) (*models.ServerSettings, error) {
+	_, err := s.db.Exec(`
+		UPDATE server_settings
+		SET require_two_factor = $1, updated_by = $2, updated_at = NOW()
+	`, require, adminID)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetSettings()
+}
+
+// RequireTwoFactor reports whether every user has to use two-factor
+// authentication, because of REQUIRE_TWO_FACTOR or an admin's setting
+func (s *SettingsService) RequireTwoFactor() (bool, error) {
+	if s.requireTwoFactor {
+		return true, nil
+	}
+	var require bool
+	if err := s.db.QueryRow(`SELECT require_two_factor FROM server_settings`).Scan(&require); err != nil {
+		return false, err
+	}
+	return require, nil
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	stdcrypto "crypto"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/crypto"
+)
+
+const (
+	// signingKeyRefreshInterval is how often every server reloads the
+	// keyring and checks whether a rotation is due
+	signingKeyRefreshInterval = time.Minute
+	// signingKeyLockID is the advisory lock that keeps servers from
+	// rotating at the same time
+	signingKeyLockID = 36036
+)
+
+// SigningKeyService keeps the access token keyring in the database so every
+// server signs with the same key, and rotates it on a schedule. Each key
+// signs for the rotation interval. Its successor is published in the JWKS an
+// overlap period before it activates, and the old key stays published for
+// the overlap afterwards so tokens it signed can still be verified.
+type SigningKeyService struct {
+	db         *sql.DB
+	masterKeys *crypto.Keyring
+	keyring    *auth.Keyring
+	algorithm  string
+	rotation   time.Duration
+	overlap    time.Duration
+}
+
+func NewSigningKeyService(db *sql.DB, masterKeys *crypto.Keyring, keyring *auth.Keyring, algorithm string, rotation, overlap time.Duration) *SigningKeyService {
+	return &SigningKeyService{
+		db:         db,
+		masterKeys: masterKeys,
+		keyring:    keyring,
+		algorithm:  algorithm,
+		rotation:   rotation,
+		overlap:    overlap,
+	}
+}
+
+type storedSigningKey struct {
+	id          string
+	algorithm   string
+	privateKey  []byte
+	masterKeyID sql.NullString
+	activatesAt time.Time
+}
+
+// Rotate creates the next signing key when one is due, deletes retired keys
+// and reloads the keyring
+func (s *SigningKeyService) Rotate() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, signingKeyLockID); err != nil {
+		return err
+	}
+
+	stored, err := loadSigningKeys(tx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var current, pending *storedSigningKey
+	for i := range stored {
+		if stored[i].activatesAt.After(now) {
+			if pending == nil {
+				pending = &stored[i]
+			}
+		} else {
+			current = &stored[i]
+		}
+	}
+
+	// Start signing right away on first run. Otherwise publish the next key
+	// an overlap ahead of its activation, or as soon as possible if the
+	// algorithm was changed.
+	var activatesAt time.Time
+	switch {
+	case current == nil && pending == nil:
+		activatesAt = now
+	case pending != nil:
+	case current.algorithm != s.algorithm:
+		activatesAt = now.Add(2 * signingKeyRefreshInterval)
+	case !now.Before(current.activatesAt.Add(s.rotation - s.overlap)):
+		activatesAt = current.activatesAt.Add(s.rotation)
+		// Give the other servers time to load the key if rotation is
+		// overdue
+		if earliest := now.Add(2 * signingKeyRefreshInterval); activatesAt.Before(earliest) {
+			activatesAt = earliest
+		}
+	}
+	if !activatesAt.IsZero() {
+		key, err := s.createSigningKey(tx, activatesAt)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, *key)
+		log.Printf("Created %s signing key %s, active from %s", key.algorithm, key.id, key.activatesAt.Format(time.RFC3339))
+	}
+
+	keys := make([]auth.SigningKey, 0, len(stored))
+	for i, key := range stored {
+		var retiresAt time.Time
+		if i+1 < len(stored) {
+			retiresAt = stored[i+1].activatesAt.Add(s.overlap)
+		}
+		if !retiresAt.IsZero() && retiresAt.Before(now) {
+			if _, err := tx.Exec(`DELETE FROM signing_keys WHERE id = $1`, key.id); err != nil {
+				return err
+			}
+			log.Printf("Deleted retired signing key %s", key.id)
+			continue
+		}
+
+		privateKey, err := s.openPrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %v", key.id, err)
+		}
+		keys = append(keys, auth.SigningKey{
+			ID:          key.id,
+			Algorithm:   key.algorithm,
+			PrivateKey:  privateKey,
+			ActivatesAt: key.activatesAt,
+			RetiresAt:   retiresAt,
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.keyring.SetKeys(keys)
+	return nil
+}
+
+// Start rotates and reloads the keyring in the background
+func (s *SigningKeyService) Start() {
+	go func() {
+		ticker := time.NewTicker(signingKeyRefreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.Rotate(); err != nil {
+				log.Printf("Failed to rotate signing keys: %v", err)
+			}
+		}
+	}()
+}
+
+func loadSigningKeys(tx *sql.Tx) ([]storedSigningKey, error) {
+	rows, err := tx.Query(`
+		SELECT id, algorithm, private_key, master_key_id, activates_at
+		FROM signing_keys
+		ORDER BY activates_at, created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []storedSigningKey
+	for rows.Next() {
+		var key storedSigningKey
+		if err := rows.Scan(&key.id, &key.algorithm, &key.privateKey, &key.masterKeyID, &key.activatesAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// createSigningKey generates a key, sealing it with the primary master key
+// when one is configured
+func (s *SigningKeyService) createSigningKey(tx *sql.Tx, activatesAt time.Time) (*storedSigningKey, error) {
+	privateKey, err := auth.GenerateSigningKey(s.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	der, err := auth.MarshalSigningKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rawID := make([]byte, 9)
+	if _, err := rand.Read(rawID); err != nil {
+		return nil, err
+	}
+	key := &storedSigningKey{
+		id:          base64.RawURLEncoding.EncodeToString(rawID),
+		algorithm:   s.algorithm,
+		privateKey:  der,
+		activatesAt: activatesAt,
+	}
+	if s.masterKeys != nil {
+		masterKeyID, wrapped, err := s.masterKeys.WrapDataKey(der, signingKeyContext(key.id))
+		if err != nil {
+			return nil, err
+		}
+		key.privateKey = wrapped
+		key.masterKeyID = sql.NullString{String: masterKeyID, Valid: true}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO signing_keys (id, algorithm, private_key, master_key_id, activates_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, key.id, key.algorithm, key.privateKey, key.masterKeyID, key.activatesAt)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// openPrivateKey decodes a stored key, unsealing it if needed
+func (s *SigningKeyService) openPrivateKey(key storedSigningKey) (stdcrypto.Signer, error) {
+	der := key.privateKey
+	if key.masterKeyID.Valid {
+		if s.masterKeys == nil {
+			return nil, crypto.ErrUnknownMasterKey
+		}
+		var err error
+		der, err = s.masterKeys.UnwrapDataKey(key.masterKeyID.String, key.privateKey, signingKeyContext(key.id))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return auth.ParseSigningKey(der)
+}
+
+func signingKeyContext(keyID string) string {
+	return "signing-key:" + keyID
+}
@@ -0,0 +1,578 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+var (
+	ErrTwoFactorAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnrolling   = errors.New("no two-factor enrollment in progress")
+	ErrTwoFactorNotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrInvalidTwoFactorCode    = errors.New("invalid two-factor code")
+	// ErrInvalidTwoFactorChallenge is returned for challenges that are
+	// unknown, expired, already used or out of attempts
+	ErrInvalidTwoFactorChallenge = errors.New("invalid or expired two-factor challenge")
+)
+
+const (
+	totpPeriod        = 30
+	recoveryCodeCount = 10
+	// twoFactorChallengeTTL is how long the user has to enter their second
+	// factor, and maxTwoFactorAttempts how many codes they may try
+	twoFactorChallengeTTL = 5 * time.Minute
+	maxTwoFactorAttempts  = 5
+)
+
+var totpValidateOpts = totp.ValidateOpts{
+	Period:    totpPeriod,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactorService manages TOTP secrets, which are sealed with the master
+// keyring when one is configured, recovery codes and the challenges of the
+// second login step
+type TwoFactorService struct {
+	db     *sql.DB
+	cipher *ContentCipher
+	issuer string
+}
+
+func NewTwoFactorService(db *sql.DB, cipher *ContentCipher, issuer string) *TwoFactorService {
+	return &TwoFactorService{
+		db:     db,
+		cipher: cipher,
+		issuer: issuer,
+	}
+}
+
+// Status reports whether the user has two-factor authentication enabled and
+// how many unused recovery codes they have left
+func (s *TwoFactorService) Status(userID string) (*models.TwoFactorStatus, error) {
+	status := &models.TwoFactorStatus{}
+	err := s.db.QueryRow(`
+		SELECT
+			EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL),
+			(SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL)
+	`, userID).Scan(&status.Enabled, &status.RecoveryCodesRemaining)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// BeginEnrollment generates a new TOTP secret for the user. It only takes
+// effect once confirmed with a code from the authenticator app.
+func (s *TwoFactorService) BeginEnrollment(userID, accountName string) (*models.TwoFactorEnrollment, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      s.issuer,
+		AccountName: accountName,
+		Period:      totpPeriod,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	secret, masterKeyID, err := s.cipher.SealSecret([]byte(key.Secret()), totpSecretContext(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.db.Exec(`
+		INSERT INTO user_totp (user_id, secret, master_key_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = $2, master_key_id = $3, last_used_step = 0, created_at = NOW()
+		WHERE user_totp.confirmed_at IS NULL
+	`, userID, secret, sql.NullString{String: masterKeyID, Valid: masterKeyID != ""})
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, ErrTwoFactorAlreadyEnabled
+	}
+
+	return enrollmentForKey(key)
+}
+
+// Enrollment returns the enrollment in progress for the user
+func (s *TwoFactorService) Enrollment(userID, accountName string) (*models.TwoFactorEnrollment, error) {
+	key, err := s.pendingKey(userID, accountName)
+	if err != nil {
+		return nil, err
+	}
+	return enrollmentForKey(key)
+}
+
+// EnrollmentQRCode returns a PNG QR code of the enrollment in progress
+func (s *TwoFactorService) EnrollmentQRCode(userID, accountName string) ([]byte, error) {
+	key, err := s.pendingKey(userID, accountName)
+	if err != nil {
+		return nil, err
+	}
+	return qrCodePNG(key)
+}
+
+func (s *TwoFactorService) pendingKey(userID, accountName string) (*otp.Key, error) {
+	var stored []byte
+	var masterKeyID sql.NullString
+	err := s.db.QueryRow(`
+		SELECT secret, master_key_id
+		FROM user_totp
+		WHERE user_id = $1 AND confirmed_at IS NULL
+	`, userID).Scan(&stored, &masterKeyID)
+	if err == sql.ErrNoRows {
+		return nil, ErrTwoFactorNotEnrolling
+	}
+	if err != nil {
+		return nil, err
+	}
+	secret, err := s.openSecret(userID, stored, masterKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	rawSecret, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	return totp.Generate(totp.GenerateOpts{
+		Issuer:      s.issuer,
+		AccountName: accountName,
+		Period:      totpPeriod,
+		Secret:      rawSecret,
+	})
+}
+
+func enrollmentForKey(key *otp.Key) (*models.TwoFactorEnrollment, error) {
+	qrCode, err := qrCodePNG(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TwoFactorEnrollment{
+		Secret:     key.Secret(),
+		OTPAuthURI: key.URL(),
+		QRCode:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(qrCode),
+	}, nil
+}
+
+func qrCodePNG(key *otp.Key) ([]byte, error) {
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ConfirmEnrollment enables two-factor authentication once the user enters
+// a valid code, and returns a fresh set of recovery codes
+func (s *TwoFactorService) ConfirmEnrollment(userID, code string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var stored []byte
+	var masterKeyID sql.NullString
+	err = tx.QueryRow(`
+		SELECT secret, master_key_id
+		FROM user_totp
+		WHERE user_id = $1 AND confirmed_at IS NULL
+		FOR UPDATE
+	`, userID).Scan(&stored, &masterKeyID)
+	if err == sql.ErrNoRows {
+		return nil, ErrTwoFactorNotEnrolling
+	}
+	if err != nil {
+		return nil, err
+	}
+	secret, err := s.openSecret(userID, stored, masterKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	step, ok := validateTOTP(secret, code, 0)
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	_, err = tx.Exec(`
+		UPDATE user_totp
+		SET confirmed_at = NOW(), last_used_step = $2
+		WHERE user_id = $1
+	`, userID, step)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Verify checks a TOTP code or, failing that, consumes a recovery code.
+// Each TOTP code is accepted only once.
+func (s *TwoFactorService) Verify(userID, code string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var stored []byte
+	var masterKeyID sql.NullString
+	var lastStep int64
+	err = tx.QueryRow(`
+		SELECT secret, master_key_id, last_used_step
+		FROM user_totp
+		WHERE user_id = $1 AND confirmed_at IS NOT NULL
+		FOR UPDATE
+	`, userID).Scan(&stored, &masterKeyID, &lastStep)
+	if err == sql.ErrNoRows {
+		return ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return err
+	}
+	secret, err := s.openSecret(userID, stored, masterKeyID)
+	if err != nil {
+		return err
+	}
+
+	if step, ok := validateTOTP(secret, code, lastStep); ok {
+		if _, err := tx.Exec(`UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1`, userID, step); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	result, err := tx.Exec(`
+		UPDATE recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return tx.Commit()
+}
+
+// RegenerateRecoveryCodes replaces all of the user's recovery codes
+func (s *TwoFactorService) RegenerateRecoveryCodes(userID string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Disable turns off two-factor authentication and drops the recovery codes
+func (s *TwoFactorService) Disable(userID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM user_totp WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateChallenge starts the second login step of a user who has proven
+// their first factor. The challenge is exchanged once for a session
+// together with a code.
+func (s *TwoFactorService) CreateChallenge(userID string) (string, error) {
+	challenge, challengeHash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO two_factor_challenges (challenge_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, challengeHash, userID, time.Now().Add(twoFactorChallengeTTL))
+	if err != nil {
+		return "", err
+	}
+
+	// Challenges that were never completed are no longer needed
+	if _, err := s.db.Exec(`DELETE FROM two_factor_challenges WHERE expires_at < NOW()`); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// ChallengeUser returns the user a pending challenge was issued for without
+// using up an attempt
+func (s *TwoFactorService) ChallengeUser(challenge string) (string, error) {
+	var userID string
+	err := s.db.QueryRow(`
+		SELECT user_id
+		FROM two_factor_challenges
+		WHERE challenge_hash = $1 AND expires_at > NOW() AND attempts < $2
+	`, hashSecretToken(challenge), maxTwoFactorAttempts).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidTwoFactorChallenge
+	}
+	if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// AttemptChallenge counts a code guess against a pending challenge and
+// returns its user. The attempt is recorded before the code is checked, so
+// concurrent guesses can't exceed the limit.
+func (s *TwoFactorService) AttemptChallenge(challenge string) (string, error) {
+	var userID string
+	err := s.db.QueryRow(`
+		UPDATE two_factor_challenges
+		SET attempts = attempts + 1
+		WHERE challenge_hash = $1 AND expires_at > NOW() AND attempts < $2
+		RETURNING user_id
+	`, hashSecretToken(challenge), maxTwoFactorAttempts).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidTwoFactorChallenge
+	}
+	if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// CompleteChallenge deletes a challenge once its code has been accepted. It
+// fails if another request completed the challenge first.
+func (s *TwoFactorService) CompleteChallenge(challenge string) error {
+	result, err := s.db.Exec(`DELETE FROM two_factor_challenges WHERE challenge_hash = $1`, hashSecretToken(challenge))
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrInvalidTwoFactorChallenge
+	}
+	return nil
+}
+
+// SealSecrets seals up to batchSize TOTP secrets that are stored in
+// plaintext or under a retired master key, and returns how many were sealed
+func (s *TwoFactorService) SealSecrets(batchSize int) (int, error) {
+	if !s.cipher.Enabled() {
+		return 0, nil
+	}
+	return s.rewriteSecrets(`
+		SELECT user_id, secret, master_key_id
+		FROM user_totp
+		WHERE master_key_id IS DISTINCT FROM $2
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, func(userID string, secret []byte) ([]byte, string, error) {
+		return s.cipher.SealSecret(secret, totpSecretContext(userID))
+	}, batchSize, s.cipher.PrimaryKeyID())
+}
+
+// UnsealSecrets stores up to batchSize sealed TOTP secrets in plaintext
+// again, for switching sealing off, and returns how many were unsealed
+func (s *TwoFactorService) UnsealSecrets(batchSize int) (int, error) {
+	return s.rewriteSecrets(`
+		SELECT user_id, secret, master_key_id
+		FROM user_totp
+		WHERE master_key_id IS NOT NULL
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, func(userID string, secret []byte) ([]byte, string, error) {
+		return secret, "", nil
+	}, batchSize)
+}
+
+// rewriteSecrets opens the TOTP secrets selected by query and stores them
+// again as transform returns them
+func (s *TwoFactorService) rewriteSecrets(query string, transform func(userID string, secret []byte) ([]byte, string, error), args ...interface{}) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	type storedSecret struct {
+		userID      string
+		secret      []byte
+		masterKeyID sql.NullString
+	}
+	var secrets []storedSecret
+	for rows.Next() {
+		var stored storedSecret
+		if err := rows.Scan(&stored.userID, &stored.secret, &stored.masterKeyID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		secrets = append(secrets, stored)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, stored := range secrets {
+		secret, err := s.cipher.OpenSecret(stored.secret, stored.masterKeyID, totpSecretContext(stored.userID))
+		if err != nil {
+			return 0, err
+		}
+		rewritten, masterKeyID, err := transform(stored.userID, secret)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`
+			UPDATE user_totp SET secret = $2, master_key_id = $3 WHERE user_id = $1
+		`, stored.userID, rewritten, sql.NullString{String: masterKeyID, Valid: masterKeyID != ""})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(secrets), nil
+}
+
+// openSecret returns a stored TOTP secret in base32
+func (s *TwoFactorService) openSecret(userID string, stored []byte, masterKeyID sql.NullString) (string, error) {
+	secret, err := s.cipher.OpenSecret(stored, masterKeyID, totpSecretContext(userID))
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+func totpSecretContext(userID string) string {
+	return "totp:" + userID
+}
+
+// validateTOTP accepts a code for the current time step or one step either
+// side of it, as long as the step is after lastStep. It returns the step the
+// code matched.
+func validateTOTP(secret, code string, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != 6 {
+		return 0, false
+	}
+
+	now := time.Now()
+	current := now.Unix() / totpPeriod
+	for _, step := range []int64{current - 1, current, current + 1} {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totpValidateOpts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID string) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash)
+			VALUES ($1, $2)
+		`, userID, hashRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// newRecoveryCode returns 80 random bits as xxxx-xxxx-xxxx-xxxx
+func newRecoveryCode() (string, error) {
+	raw := make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	encoded := strings.ToLower(base32NoPadding.EncodeToString(raw))
+	return encoded[0:4] + "-" + encoded[4:8] + "-" + encoded[8:12] + "-" + encoded[12:16], nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes so codes can be typed
+// loosely
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return sum[:]
+}
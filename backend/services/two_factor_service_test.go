@@ -0,0 +1,189 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+	"github.com/pquerna/otp/totp"
+)
+
+// totpCode returns the code of secret at the given time
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	code, err := totp.GenerateCodeCustom(secret, at, totpValidateOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// storedTOTPSecret returns a user's TOTP secret as it is in the database
+func storedTOTPSecret(t *testing.T, db *sql.DB, userID string) (string, sql.NullString) {
+	t.Helper()
+	var secret []byte
+	var masterKeyID sql.NullString
+	if err := db.QueryRow(`SELECT secret, master_key_id FROM user_totp WHERE user_id = $1`, userID).Scan(&secret, &masterKeyID); err != nil {
+		t.Fatal(err)
+	}
+	return string(secret), masterKeyID
+}
+
+func TestTOTPSecretSealedAtRest(t *testing.T) {
+	db := dbtest.Open(t)
+	alice := dbtest.CreateUser(t, db, "alice")
+	twoFactor := NewTwoFactorService(db, newTestCipher(t, db), "test")
+
+	enrollment, err := twoFactor.BeginEnrollment(alice, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, masterKeyID := storedTOTPSecret(t, db, alice)
+	if stored == enrollment.Secret || masterKeyID.String != "k1" {
+		t.Fatalf("secret is stored as %q under master key %v, want it sealed under k1", stored, masterKeyID)
+	}
+
+	if _, err := twoFactor.ConfirmEnrollment(alice, totpCode(t, enrollment.Secret, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	if err := twoFactor.Verify(alice, totpCode(t, enrollment.Secret, time.Now().Add(totpPeriod*time.Second))); err != nil {
+		t.Fatalf("Verify with a sealed secret: %v", err)
+	}
+
+	// The sealed secret is bound to its user
+	bob := dbtest.CreateUser(t, db, "bob")
+	if _, err := db.Exec(`UPDATE user_totp SET user_id = $1 WHERE user_id = $2`, bob, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := twoFactor.Verify(bob, totpCode(t, enrollment.Secret, time.Now().Add(-totpPeriod*time.Second))); err == nil {
+		t.Fatal("a secret moved to another user was opened")
+	}
+}
+
+func TestSealAndUnsealTOTPSecrets(t *testing.T) {
+	db := dbtest.Open(t)
+	alice := dbtest.CreateUser(t, db, "alice")
+	plain := NewTwoFactorService(db, NewContentCipher(db, nil), "test")
+	sealed := NewTwoFactorService(db, newTestCipher(t, db), "test")
+
+	// Written before sealing was turned on
+	enrollment, err := plain.BeginEnrollment(alice, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, masterKeyID := storedTOTPSecret(t, db, alice); stored != enrollment.Secret || masterKeyID.Valid {
+		t.Fatalf("without a keyring the secret is stored as %q under %v", stored, masterKeyID)
+	}
+	if n, err := plain.SealSecrets(10); err != nil || n != 0 {
+		t.Fatalf("SealSecrets without a keyring = %d, %v", n, err)
+	}
+
+	if n, err := sealed.SealSecrets(10); err != nil || n != 1 {
+		t.Fatalf("SealSecrets = %d, %v, want 1 secret sealed", n, err)
+	}
+	if n, err := sealed.SealSecrets(10); err != nil || n != 0 {
+		t.Fatalf("second SealSecrets = %d, %v, want nothing left", n, err)
+	}
+	if _, err := sealed.ConfirmEnrollment(alice, totpCode(t, enrollment.Secret, time.Now())); err != nil {
+		t.Fatalf("ConfirmEnrollment after sealing: %v", err)
+	}
+	if err := plain.Verify(alice, totpCode(t, enrollment.Secret, time.Now().Add(totpPeriod*time.Second))); err == nil {
+		t.Fatal("a sealed secret was opened without a keyring")
+	}
+
+	if n, err := sealed.UnsealSecrets(10); err != nil || n != 1 {
+		t.Fatalf("UnsealSecrets = %d, %v, want 1 secret unsealed", n, err)
+	}
+	if stored, masterKeyID := storedTOTPSecret(t, db, alice); stored != enrollment.Secret || masterKeyID.Valid {
+		t.Fatalf("after UnsealSecrets the secret is stored as %q under %v", stored, masterKeyID)
+	}
+}
+
+func TestTwoFactorChallenge(t *testing.T) {
+	db := dbtest.Open(t)
+	alice := dbtest.CreateUser(t, db, "alice")
+	twoFactor := NewTwoFactorService(db, NewContentCipher(db, nil), "test")
+
+	challenge, err := twoFactor.CreateChallenge(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if userID, err := twoFactor.ChallengeUser(challenge); err != nil || userID != alice {
+			t.Fatalf("ChallengeUser = %q, %v", userID, err)
+		}
+	}
+
+	// Looking the challenge up doesn't use attempts, guessing does
+	for i := 0; i < maxTwoFactorAttempts; i++ {
+		if userID, err := twoFactor.AttemptChallenge(challenge); err != nil || userID != alice {
+			t.Fatalf("attempt %d = %q, %v", i+1, userID, err)
+		}
+	}
+	if _, err := twoFactor.AttemptChallenge(challenge); !errors.Is(err, ErrInvalidTwoFactorChallenge) {
+		t.Fatalf("attempt past the limit: err = %v, want ErrInvalidTwoFactorChallenge", err)
+	}
+	if _, err := twoFactor.ChallengeUser(challenge); !errors.Is(err, ErrInvalidTwoFactorChallenge) {
+		t.Fatalf("challenge out of attempts: err = %v, want ErrInvalidTwoFactorChallenge", err)
+	}
+
+	// A challenge is completed once
+	challenge, _ = twoFactor.CreateChallenge(alice)
+	if _, err := twoFactor.AttemptChallenge(challenge); err != nil {
+		t.Fatal(err)
+	}
+	if err := twoFactor.CompleteChallenge(challenge); err != nil {
+		t.Fatal(err)
+	}
+	if err := twoFactor.CompleteChallenge(challenge); !errors.Is(err, ErrInvalidTwoFactorChallenge) {
+		t.Fatalf("second CompleteChallenge: err = %v, want ErrInvalidTwoFactorChallenge", err)
+	}
+	if _, err := twoFactor.AttemptChallenge(challenge); !errors.Is(err, ErrInvalidTwoFactorChallenge) {
+		t.Fatalf("completed challenge: err = %v, want ErrInvalidTwoFactorChallenge", err)
+	}
+
+	challenge, _ = twoFactor.CreateChallenge(alice)
+	if _, err := db.Exec(`UPDATE two_factor_challenges SET expires_at = NOW() - INTERVAL '1 second'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := twoFactor.AttemptChallenge(challenge); !errors.Is(err, ErrInvalidTwoFactorChallenge) {
+		t.Fatalf("expired challenge: err = %v, want ErrInvalidTwoFactorChallenge", err)
+	}
+	if _, err := twoFactor.ChallengeUser("unknown"); !errors.Is(err, ErrInvalidTwoFactorChallenge) {
+		t.Fatalf("unknown challenge: err = %v, want ErrInvalidTwoFactorChallenge", err)
+	}
+}
+
+func TestRequireTwoFactorSetting(t *testing.T) {
+	db := dbtest.Open(t)
+	admin := dbtest.CreateUser(t, db, "admin")
+	settings := NewSettingsService(db, false)
+
+	if required, err := settings.RequireTwoFactor(); err != nil || required {
+		t.Fatalf("RequireTwoFactor = %v, %v, want off by default", required, err)
+	}
+	updated, err := settings.SetRequireTwoFactor(admin, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.RequireTwoFactor || updated.RequireTwoFactorByConfig || updated.UpdatedBy != admin {
+		t.Fatalf("settings after turning the requirement on = %+v", updated)
+	}
+	if required, err := settings.RequireTwoFactor(); err != nil || !required {
+		t.Fatalf("RequireTwoFactor = %v, %v, want on", required, err)
+	}
+
+	// REQUIRE_TWO_FACTOR can't be turned off by an admin
+	forced := NewSettingsService(db, true)
+	if _, err := forced.SetRequireTwoFactor(admin, false); err != nil {
+		t.Fatal(err)
+	}
+	if required, err := forced.RequireTwoFactor(); err != nil || !required {
+		t.Fatalf("RequireTwoFactor with REQUIRE_TWO_FACTOR = %v, %v, want on", required, err)
+	}
+	if current, err := forced.GetSettings(); err != nil || current.RequireTwoFactor || !current.RequireTwoFactorByConfig {
+		t.Fatalf("GetSettings = %+v, %v", current, err)
+	}
+}
@@ -2,10 +2,26 @@ package services
 
 import (
 	"database/sql"
+	"errors"
+	"strings"
 
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
 	"github.com/RatneshMaurya/not-whatsapp/backend/models"
 )
 
+var (
+	// ErrIdentityEmailRequired is returned when a new account signs in without
+	// an email address to create the user with
+	ErrIdentityEmailRequired = errors.New("identity provider did not return an email address")
+	// ErrIdentityEmailUnverified is returned when a new account's email has
+	// not been verified by the provider. Users are matched by email, so an
+	// unverified one could claim someone else's account.
+	ErrIdentityEmailUnverified = errors.New("email is not verified by the identity provider")
+	ErrIdentityNotFound        = errors.New("identity not found")
+	ErrLastIdentity            = errors.New("cannot unlink the last identity")
+	ErrUserNotFound            = errors.New("user not found")
+)
+
 type UserService struct {
 	db *sql.DB
 }
@@ -14,37 +30,185 @@ func NewUserService(db *sql.DB) *UserService {
 	return &UserService{db: db}
 }
 
-func (s *UserService) CreateOrUpdateUser(googleID, email, name, avatarURL, publicKey string) (*models.User, error) {
-	query := `
-		INSERT INTO users (google_id, email, name, avatar_url, public_key, last_seen)
-		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)
-		ON CONFLICT (google_id) DO UPDATE
-		SET email = $2, name = $3, avatar_url = $4, public_key = $5, last_seen = CURRENT_TIMESTAMP
-		RETURNING id, google_id, email, name, avatar_url, public_key, created_at, last_seen
-	`
+// LoginWithIdentity returns the user linked to an identity provider account,
+// creating the user on first sign in. The provider must have verified the
+// email of an account signing in for the first time, which is then linked to
+// the existing user with that email, so one user can sign in with several
+// providers. A name or avatar sent by the provider replaces the user's
+// current one.
+func (s *UserService) LoginWithIdentity(identity *auth.Identity) (*models.User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRow(`
+		UPDATE user_identities
+		SET email = $3, last_login_at = CURRENT_TIMESTAMP
+		WHERE provider = $1 AND subject = $2
+		RETURNING user_id
+	`, identity.Provider, identity.Subject, identity.Email).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows {
+		if identity.Email == "" {
+			return nil, ErrIdentityEmailRequired
+		}
+		if !identity.EmailVerified {
+			return nil, ErrIdentityEmailUnverified
+		}
+
+		err = tx.QueryRow(`SELECT id FROM users WHERE email = $1`, identity.Email).Scan(&userID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+
+		if err == sql.ErrNoRows {
+			name := identity.Name
+			if name == "" {
+				name = strings.SplitN(identity.Email, "@", 2)[0]
+			}
+			err = tx.QueryRow(`
+				INSERT INTO users (email, name, avatar_url, public_key, last_seen)
+				VALUES ($1, $2, $3, '', CURRENT_TIMESTAMP)
+				RETURNING id
+			`, identity.Email, name, identity.AvatarURL).Scan(&userID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO user_identities (provider, subject, user_id, email)
+			VALUES ($1, $2, $3, $4)
+		`, identity.Provider, identity.Subject, userID, identity.Email)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	user := &models.User{}
-	err := s.db.QueryRow(query, googleID, email, name, avatarURL, publicKey).Scan(
+	err = tx.QueryRow(`
+		UPDATE users
+		SET name = COALESCE(NULLIF($2, ''), name),
+			avatar_url = COALESCE(NULLIF($3, ''), avatar_url),
+			last_seen = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING id, email, name, avatar_url, public_key, created_at, last_seen,
+			EXISTS (SELECT 1 FROM user_totp WHERE user_id = users.id AND confirmed_at IS NOT NULL)
+	`, userID, identity.Name, identity.AvatarURL).Scan(
 		&user.ID,
-		&user.GoogleID,
 		&user.Email,
 		&user.Name,
 		&user.AvatarURL,
 		&user.PublicKey,
 		&user.CreatedAt,
 		&user.LastSeen,
+		&user.TwoFactorEnabled,
 	)
-
 	if err != nil {
 		return nil, err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 	return user, nil
 }
 
+// GetIdentities lists the identity provider accounts linked to the user
+func (s *UserService) GetIdentities(userID string) ([]models.UserIdentity, error) {
+	rows, err := s.db.Query(`
+		SELECT provider, subject, user_id, email, created_at, last_login_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at ASC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []models.UserIdentity{}
+	for rows.Next() {
+		var identity models.UserIdentity
+		err := rows.Scan(
+			&identity.Provider,
+			&identity.Subject,
+			&identity.UserID,
+			&identity.Email,
+			&identity.CreatedAt,
+			&identity.LastLoginAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// UnlinkIdentity removes a linked identity provider account. The last one
+// cannot be removed, or the user could no longer sign in.
+func (s *UserService) UnlinkIdentity(userID, provider, subject string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT provider, subject
+		FROM user_identities
+		WHERE user_id = $1
+		FOR UPDATE
+	`, userID)
+	if err != nil {
+		return err
+	}
+	count, found := 0, false
+	for rows.Next() {
+		var p, sub string
+		if err := rows.Scan(&p, &sub); err != nil {
+			rows.Close()
+			return err
+		}
+		count++
+		if p == provider && sub == subject {
+			found = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if !found {
+		return ErrIdentityNotFound
+	}
+	if count == 1 {
+		return ErrLastIdentity
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM user_identities
+		WHERE user_id = $1 AND provider = $2 AND subject = $3
+	`, userID, provider, subject)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (s *UserService) GetUserByID(id string) (*models.User, error) {
 	query := `
-		SELECT id, google_id, email, name, avatar_url, public_key, created_at, last_seen
+		SELECT id, email, name, avatar_url, public_key, created_at, last_seen,
+			EXISTS (SELECT 1 FROM user_totp WHERE user_id = users.id AND confirmed_at IS NOT NULL),
+			is_bot, COALESCE(bot_owner_id::text, ''), role
 		FROM users
 		WHERE id = $1
 	`
@@ -52,13 +216,16 @@ func (s *UserService) GetUserByID(id string) (*models.User, error) {
 	user := &models.User{}
 	err := s.db.QueryRow(query, id).Scan(
 		&user.ID,
-		&user.GoogleID,
 		&user.Email,
 		&user.Name,
 		&user.AvatarURL,
 		&user.PublicKey,
 		&user.CreatedAt,
 		&user.LastSeen,
+		&user.TwoFactorEnabled,
+		&user.IsBot,
+		&user.BotOwnerID,
+		&user.Role,
 	)
 
 	if err != nil {
@@ -68,6 +235,33 @@ func (s *UserService) GetUserByID(id string) (*models.User, error) {
 	return user, nil
 }
 
+// GetRole returns the role of a user, or an empty role if there is no such
+// user
+func (s *UserService) GetRole(userID string) (string, error) {
+	var role string
+	err := s.db.QueryRow(`SELECT role FROM users WHERE id = $1`, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// SetRole gives the user with the email a role, or returns ErrUserNotFound
+func (s *UserService) SetRole(email, role string) error {
+	result, err := s.db.Exec(`
+		UPDATE users
+		SET role = $2
+		WHERE email = $1 AND NOT is_bot
+	`, email, role)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
 func (s *UserService) UpdateLastSeen(userID string) error {
 	query := `
 		UPDATE users
@@ -81,7 +275,8 @@ func (s *UserService) UpdateLastSeen(userID string) error {
 
 func (s *UserService) GetUsers() ([]models.User, error) {
 	query := `
-		SELECT id, email, name, avatar_url, public_key, created_at, last_seen
+		SELECT id, email, name, avatar_url, public_key, created_at, last_seen,
+			is_bot, COALESCE(bot_owner_id::text, '')
 		FROM users
 		ORDER BY name ASC
 	`
@@ -102,6 +297,8 @@ func (s *UserService) GetUsers() ([]models.User, error) {
 			&user.PublicKey,
 			&user.CreatedAt,
 			&user.LastSeen,
+			&user.IsBot,
+			&user.BotOwnerID,
 		)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/auth"
+	"github.com/RatneshMaurya/not-whatsapp/backend/db/dbtest"
+)
+
+func TestLoginWithIdentity(t *testing.T) {
+	db := dbtest.Open(t)
+	users := NewUserService(db)
+	alice := dbtest.CreateUser(t, db, "alice")
+
+	google := &auth.Identity{Provider: "google", Subject: "g-alice", Email: "alice@example.com", EmailVerified: true, Name: "Alice"}
+	user, err := users.LoginWithIdentity(google)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != alice || user.Name != "Alice" {
+		t.Fatalf("signed in as %+v, want the existing user %s renamed to Alice", user, alice)
+	}
+
+	// Once linked, the identity keeps signing in whatever its email says
+	relinked := *google
+	relinked.Email, relinked.EmailVerified = "alice@work.example.com", false
+	if user, err := users.LoginWithIdentity(&relinked); err != nil || user.ID != alice {
+		t.Fatalf("linked identity signed in as %+v, %v", user, err)
+	}
+
+	carol, err := users.LoginWithIdentity(&auth.Identity{Provider: "dex", Subject: "carol", Email: "carol@example.com", EmailVerified: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if carol.ID == alice || carol.Name != "carol" {
+		t.Errorf("new user = %+v, want a new user named after the email", carol)
+	}
+
+	identities, err := users.GetIdentities(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 {
+		t.Errorf("alice has %d identities, want 1", len(identities))
+	}
+}
+
+func TestLoginWithIdentityRequiresVerifiedEmail(t *testing.T) {
+	db := dbtest.Open(t)
+	users := NewUserService(db)
+	dbtest.CreateUser(t, db, "bob")
+
+	tests := []struct {
+		name     string
+		identity auth.Identity
+		err      error
+	}{
+		{"existing user's email", auth.Identity{Provider: "dex", Subject: "mallory", Email: "bob@example.com"}, ErrIdentityEmailUnverified},
+		{"new email", auth.Identity{Provider: "dex", Subject: "mallory", Email: "mallory@example.com"}, ErrIdentityEmailUnverified},
+		{"no email", auth.Identity{Provider: "dex", Subject: "mallory", EmailVerified: true}, ErrIdentityEmailRequired},
+	}
+	for _, tt := range tests {
+		if _, err := users.LoginWithIdentity(&tt.identity); err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	var userCount, identityCount int
+	db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&userCount)
+	db.QueryRow(`SELECT COUNT(*) FROM user_identities`).Scan(&identityCount)
+	if userCount != 1 || identityCount != 0 {
+		t.Errorf("%d users and %d identities exist, want only bob", userCount, identityCount)
+	}
+}
@@ -0,0 +1,580 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RatneshMaurya/not-whatsapp/backend/egress"
+	"github.com/RatneshMaurya/not-whatsapp/backend/models"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Conversation events webhooks can subscribe to
+const (
+	EventMessageCreated = "message.created"
+	EventMemberJoined   = "member.joined"
+	// EventMessageEdited is reserved for when messages can be edited; until
+	// then webhooks can't subscribe to it
+	EventMessageEdited = "message.edited"
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Headers sent with every webhook request
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+)
+
+const (
+	// webhookPollInterval is how often the queue is checked for due
+	// deliveries when nothing wakes the worker earlier
+	webhookPollInterval = 5 * time.Second
+	// webhookBatchSize is how many deliveries are sent concurrently
+	webhookBatchSize = 20
+	// webhookBaseBackoff and webhookMaxBackoff bound the exponential delay
+	// between attempts
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	// webhookMaxErrorLength caps the error text kept in the delivery log
+	webhookMaxErrorLength = 1024
+	// endpointLookupTimeout bounds resolving the host of an endpoint when it
+	// is saved
+	endpointLookupTimeout = 5 * time.Second
+)
+
+var (
+	ErrWebhookNotFound = errors.New("webhook not found")
+	// ErrInvalidWebhookURL is returned for URLs that are not absolute http or
+	// https URLs
+	ErrInvalidWebhookURL = errors.New("webhook URL must be an absolute http or https URL")
+	// ErrForbiddenWebhookURL is returned for URLs whose host is or resolves
+	// to a loopback, private or otherwise internal address
+	ErrForbiddenWebhookURL = errors.New("webhook URL must resolve to a public address")
+	// ErrInvalidWebhookEvent is returned for webhooks without events or with
+	// an unknown event
+	ErrInvalidWebhookEvent = errors.New("events must be message.created and/or member.joined")
+	// ErrReservedWebhookEvent is returned for webhooks subscribing to an
+	// event that is reserved but not sent yet
+	ErrReservedWebhookEvent = errors.New("message.edited is reserved: messages can't be edited yet")
+)
+
+// WebhookService manages conversation webhooks and delivers their events.
+// Events are queued in the database in the same transaction as the change
+// that caused them, then sent with an HMAC signature and retried with
+// exponential backoff until the endpoint accepts them or maxAttempts is
+// reached. Any number of servers can run the worker. Requests only go to
+// addresses the egress policy allows.
+type WebhookService struct {
+	db          *sql.DB
+	cipher      *ContentCipher
+	egress      *egress.Policy
+	client      *http.Client
+	timeout     time.Duration
+	maxAttempts int
+	wakeup      chan struct{}
+}
+
+func NewWebhookService(db *sql.DB, cipher *ContentCipher, policy *egress.Policy, timeout time.Duration, maxAttempts int) *WebhookService {
+	return &WebhookService{
+		db:     db,
+		cipher: cipher,
+		egress: policy,
+		// A redirect is treated as a failed delivery rather than followed
+		// somewhere the subscriber did not register
+		client:      policy.Client(timeout),
+		timeout:     timeout,
+		maxAttempts: maxAttempts,
+		wakeup:      make(chan struct{}, 1),
+	}
+}
+
+// webhookEvent is the JSON body POSTed to webhooks
+type webhookEvent struct {
+	ID             string      `json:"id"`
+	Type           string      `json:"type"`
+	ConversationID string      `json:"conversation_id"`
+	CreatedAt      time.Time   `json:"created_at"`
+	Data           interface{} `json:"data"`
+}
+
+// CreateWebhook subscribes a URL to events in a conversation and returns the
+// secret its deliveries are signed with. The secret is only returned here.
+func (s *WebhookService) CreateWebhook(conversationID, userID, rawURL string, events []string) (*models.Webhook, string, error) {
+	endpoint, err := checkEndpointURL(s.egress, rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	events, err = normalizeWebhookEvents(events)
+	if err != nil {
+		return nil, "", err
+	}
+
+	raw, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	secret := "whsec_" + raw
+
+	webhook := &models.Webhook{
+		ID:             uuid.New().String(),
+		ConversationID: conversationID,
+		CreatedBy:      userID,
+		URL:            endpoint,
+		Events:         events,
+	}
+	storedSecret, secretSealed, err := s.cipher.Seal(conversationID, webhook.ID, secret)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = s.db.QueryRow(`
+		INSERT INTO webhooks (id, conversation_id, created_by, url, events, secret, secret_sealed)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING created_at
+	`, webhook.ID, conversationID, userID, webhook.URL, pq.Array(events), storedSecret, secretSealed).Scan(&webhook.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return webhook, secret, nil
+}
+
+// parseEndpointURL checks that an endpoint the server will call is an
+// absolute http or https URL without credentials
+func parseEndpointURL(rawURL string) (string, bool) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.User != nil {
+		return "", false
+	}
+	return parsed.String(), true
+}
+
+// checkEndpointURL parses an endpoint like parseEndpointURL and checks that
+// its host resolves to addresses the policy allows
+func checkEndpointURL(policy *egress.Policy, rawURL string) (string, error) {
+	endpoint, ok := parseEndpointURL(rawURL)
+	if !ok {
+		return "", ErrInvalidWebhookURL
+	}
+	parsed, _ := url.Parse(endpoint)
+
+	ctx, cancel := context.WithTimeout(context.Background(), endpointLookupTimeout)
+	defer cancel()
+	if err := policy.CheckHost(ctx, parsed.Hostname()); err != nil {
+		if !errors.Is(err, egress.ErrForbiddenAddress) {
+			log.Printf("Failed to resolve endpoint host %q: %v", parsed.Hostname(), err)
+		}
+		return "", ErrForbiddenWebhookURL
+	}
+	return endpoint, nil
+}
+
+func normalizeWebhookEvents(events []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var normalized []string
+	for _, event := range events {
+		if event == EventMessageEdited {
+			return nil, ErrReservedWebhookEvent
+		}
+		if event != EventMessageCreated && event != EventMemberJoined {
+			return nil, ErrInvalidWebhookEvent
+		}
+		if !seen[event] {
+			seen[event] = true
+			normalized = append(normalized, event)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, ErrInvalidWebhookEvent
+	}
+	return normalized, nil
+}
+
+// GetWebhooks lists the webhooks of a conversation
+func (s *WebhookService) GetWebhooks(conversationID string) ([]models.Webhook, error) {
+	rows, err := s.db.Query(`
+		SELECT id, conversation_id, created_by, url, events, created_at
+		FROM webhooks
+		WHERE conversation_id = $1
+		ORDER BY created_at
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []models.Webhook{}
+	for rows.Next() {
+		var webhook models.Webhook
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.ConversationID,
+			&webhook.CreatedBy,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+			&webhook.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook removes a webhook of the conversation along with its pending
+// deliveries and delivery log
+func (s *WebhookService) DeleteWebhook(conversationID, webhookID string) error {
+	if _, err := uuid.Parse(webhookID); err != nil {
+		return ErrWebhookNotFound
+	}
+	result, err := s.db.Exec(`
+		DELETE FROM webhooks
+		WHERE id = $1 AND conversation_id = $2
+	`, webhookID, conversationID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// GetDeliveries returns the most recent deliveries of a webhook of the
+// conversation, newest first
+func (s *WebhookService) GetDeliveries(conversationID, webhookID string, limit int) ([]models.WebhookDelivery, error) {
+	if _, err := uuid.Parse(webhookID); err != nil {
+		return nil, ErrWebhookNotFound
+	}
+	var exists bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = $1 AND conversation_id = $2)
+	`, webhookID, conversationID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWebhookNotFound
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, webhook_id, event_id, event_type, status, attempts,
+			CASE WHEN status = 'pending' THEN next_attempt_at END,
+			last_attempt_at, response_status, COALESCE(last_error, ''), created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var d models.WebhookDelivery
+		var responseStatus sql.NullInt64
+		err := rows.Scan(
+			&d.ID,
+			&d.WebhookID,
+			&d.EventID,
+			&d.EventType,
+			&d.Status,
+			&d.Attempts,
+			&d.NextAttemptAt,
+			&d.LastAttemptAt,
+			&responseStatus,
+			&d.LastError,
+			&d.CreatedAt,
+			&d.DeliveredAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if responseStatus.Valid {
+			status := int(responseStatus.Int64)
+			d.ResponseStatus = &status
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// enqueue queues an event for every webhook of the conversation subscribed
+// to it, as part of tx. Call wake once tx has been committed.
+func (s *WebhookService) enqueue(tx *sql.Tx, conversationID, eventType string, data interface{}) error {
+	rows, err := tx.Query(`
+		SELECT id
+		FROM webhooks
+		WHERE conversation_id = $1 AND $2 = ANY(events)
+	`, conversationID, eventType)
+	if err != nil {
+		return err
+	}
+	var webhookIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		webhookIDs = append(webhookIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(webhookIDs) == 0 {
+		return nil
+	}
+
+	event := webhookEvent{
+		ID:             uuid.New().String(),
+		Type:           eventType,
+		ConversationID: conversationID,
+		CreatedAt:      time.Now().UTC(),
+		Data:           data,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	payload, payloadSealed, err := s.cipher.Seal(conversationID, event.ID, string(body))
+	if err != nil {
+		return err
+	}
+
+	for _, webhookID := range webhookIDs {
+		_, err := tx.Exec(`
+			INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, payload_sealed)
+			VALUES ($1, $2, $3, $4, $5)
+		`, webhookID, event.ID, eventType, payload, payloadSealed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wake has the worker check the queue now instead of at its next poll
+func (s *WebhookService) wake() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Start delivers queued events in the background
+func (s *WebhookService) Start() {
+	go func() {
+		ticker := time.NewTicker(webhookPollInterval)
+		defer ticker.Stop()
+		for {
+			for {
+				sent, err := s.DeliverDue()
+				if err != nil {
+					log.Printf("Failed to deliver webhooks: %v", err)
+					break
+				}
+				if sent < webhookBatchSize {
+					break
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-s.wakeup:
+			}
+		}
+	}()
+}
+
+// queuedDelivery is a delivery claimed by DeliverDue
+type queuedDelivery struct {
+	id             string
+	eventID        string
+	eventType      string
+	payload        string
+	payloadSealed  bool
+	attempts       int
+	webhookID      string
+	conversationID string
+	url            string
+	secret         string
+	secretSealed   bool
+}
+
+// DeliverDue sends a batch of deliveries that are due and returns how many
+// were attempted. Claimed deliveries are leased by pushing their next
+// attempt past the request timeout, so another server does not send them at
+// the same time and a crash mid-delivery only delays them.
+func (s *WebhookService) DeliverDue() (int, error) {
+	rows, err := s.db.Query(`
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = $2
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id
+			FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.event_id, d.event_type, d.payload, d.payload_sealed, d.attempts, w.id, w.conversation_id, w.url, w.secret, w.secret_sealed
+	`, webhookBatchSize, time.Now().Add(s.timeout+time.Minute))
+	if err != nil {
+		return 0, err
+	}
+
+	var batch []queuedDelivery
+	for rows.Next() {
+		var d queuedDelivery
+		if err := rows.Scan(&d.id, &d.eventID, &d.eventType, &d.payload, &d.payloadSealed, &d.attempts, &d.webhookID, &d.conversationID, &d.url, &d.secret, &d.secretSealed); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range batch {
+		wg.Add(1)
+		go func(d queuedDelivery) {
+			defer wg.Done()
+			statusCode, err := s.send(d)
+			if err := s.recordAttempt(d, statusCode, err); err != nil {
+				log.Printf("Failed to record webhook delivery %s: %v", d.id, err)
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	return len(batch), nil
+}
+
+// send POSTs a delivery and returns the response status code. Any status
+// outside 2xx is an error.
+func (s *WebhookService) send(d queuedDelivery) (int, error) {
+	body, err := s.cipher.Open(d.conversationID, d.eventID, d.payload, d.payloadSealed)
+	if err != nil {
+		return 0, fmt.Errorf("opening payload: %v", err)
+	}
+	secret, err := s.cipher.Open(d.conversationID, d.webhookID, d.secret, d.secretSealed)
+	if err != nil {
+		return 0, fmt.Errorf("opening secret: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader([]byte(body)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "not-whatsapp-webhooks")
+	req.Header.Set(WebhookEventHeader, d.eventType)
+	req.Header.Set(WebhookDeliveryHeader, d.id)
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(secret, time.Now(), []byte(body)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// recordAttempt logs the outcome of a delivery attempt and schedules the
+// next one after a failure
+func (s *WebhookService) recordAttempt(d queuedDelivery, statusCode int, sendErr error) error {
+	responseStatus := sql.NullInt64{Int64: int64(statusCode), Valid: statusCode != 0}
+	attempts := d.attempts + 1
+
+	if sendErr == nil {
+		_, err := s.db.Exec(`
+			UPDATE webhook_deliveries
+			SET status = 'succeeded', attempts = $2, last_attempt_at = NOW(),
+				response_status = $3, last_error = NULL, delivered_at = NOW()
+			WHERE id = $1
+		`, d.id, attempts, responseStatus)
+		return err
+	}
+
+	message := sendErr.Error()
+	if len(message) > webhookMaxErrorLength {
+		message = message[:webhookMaxErrorLength]
+	}
+	status := DeliveryPending
+	if attempts >= s.maxAttempts {
+		status = DeliveryFailed
+		log.Printf("Giving up on webhook delivery %s after %d attempts: %s", d.id, attempts, message)
+	}
+	_, err := s.db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, last_attempt_at = NOW(), next_attempt_at = $4,
+			response_status = $5, last_error = $6
+		WHERE id = $1
+	`, d.id, status, attempts, time.Now().Add(webhookBackoff(attempts)), responseStatus, message)
+	return err
+}
+
+// webhookBackoff returns the delay before the attempt after the given
+// number of failed attempts, doubling each time with up to 10% jitter
+func webhookBackoff(attempts int) time.Duration {
+	delay := webhookMaxBackoff
+	if attempts < 20 {
+		if d := webhookBaseBackoff << (attempts - 1); d < webhookMaxBackoff {
+			delay = d
+		}
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay/10)+1))
+}
+
+// SignWebhookPayload returns the signature header value for a webhook body:
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">". Receivers
+// should recompute it with their secret and reject old timestamps.
+func SignWebhookPayload(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
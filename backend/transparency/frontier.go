@@ -0,0 +1,44 @@
+package transparency
+
+// Frontier is the compact form of a growing Merkle tree: the roots of its
+// perfect subtrees, largest first, one for each bit set in Size. It is all
+// that is needed to append leaves and compute the root hash, so the log
+// doesn't have to read every leaf on each append.
+type Frontier struct {
+	Size  uint64
+	Nodes [][]byte
+}
+
+// NewFrontier returns the frontier of the tree formed by leaves
+func NewFrontier(leaves [][]byte) *Frontier {
+	f := &Frontier{Nodes: [][]byte{}}
+	for _, leaf := range leaves {
+		f.Append(leaf)
+	}
+	return f
+}
+
+// Append adds a leaf hash to the tree
+func (f *Frontier) Append(leafHash []byte) {
+	f.Nodes = append(f.Nodes[:len(f.Nodes):len(f.Nodes)], leafHash)
+	// Every trailing one bit of the old size is a subtree of the same height
+	// as the one being completed, so the two are merged
+	for size := f.Size; size&1 == 1; size >>= 1 {
+		n := len(f.Nodes)
+		f.Nodes = append(f.Nodes[:n-2], hashChildren(f.Nodes[n-2], f.Nodes[n-1]))
+	}
+	f.Size++
+}
+
+// Root returns the Merkle tree hash of the tree, the same as RootHash over
+// its leaves
+func (f *Frontier) Root() []byte {
+	if len(f.Nodes) == 0 {
+		return RootHash(nil)
+	}
+	root := f.Nodes[len(f.Nodes)-1]
+	for i := len(f.Nodes) - 2; i >= 0; i-- {
+		root = hashChildren(f.Nodes[i], root)
+	}
+	return root
+}
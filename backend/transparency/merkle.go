@@ -0,0 +1,192 @@
+// Package transparency implements the Merkle tree used by the append-only
+// key transparency log. Hashing and proofs follow RFC 9162 (Certificate
+// Transparency 2.0) so that any off-the-shelf verifier can audit the log.
+package transparency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidProof is returned when a proof does not verify
+	ErrInvalidProof = errors.New("invalid proof")
+	// ErrInvalidRange is returned when proof parameters fall outside the tree
+	ErrInvalidRange = errors.New("invalid tree range")
+)
+
+// LeafHash returns the hash of a single log entry
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hashChildren(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// splitPoint returns the largest power of two strictly smaller than n
+func splitPoint(n uint64) uint64 {
+	k := uint64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// RootHash computes the Merkle tree hash over a list of leaf hashes
+func RootHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+
+	k := splitPoint(uint64(len(leaves)))
+	return hashChildren(RootHash(leaves[:k]), RootHash(leaves[k:]))
+}
+
+// InclusionProof returns the audit path proving that leaves[index] is part
+// of the tree formed by all of leaves
+func InclusionProof(leaves [][]byte, index uint64) ([][]byte, error) {
+	n := uint64(len(leaves))
+	if index >= n {
+		return nil, fmt.Errorf("%w: leaf %d not in tree of size %d", ErrInvalidRange, index, n)
+	}
+	return inclusionPath(leaves, index), nil
+}
+
+func inclusionPath(leaves [][]byte, index uint64) [][]byte {
+	n := uint64(len(leaves))
+	if n <= 1 {
+		return [][]byte{}
+	}
+
+	k := splitPoint(n)
+	if index < k {
+		return append(inclusionPath(leaves[:k], index), RootHash(leaves[k:]))
+	}
+	return append(inclusionPath(leaves[k:], index-k), RootHash(leaves[:k]))
+}
+
+// ConsistencyProof returns the proof that the tree of size first is a prefix
+// of the tree formed by all of leaves
+func ConsistencyProof(leaves [][]byte, first uint64) ([][]byte, error) {
+	n := uint64(len(leaves))
+	if first == 0 || first > n {
+		return nil, fmt.Errorf("%w: cannot prove size %d against size %d", ErrInvalidRange, first, n)
+	}
+	return subproof(leaves, first, true), nil
+}
+
+func subproof(leaves [][]byte, m uint64, complete bool) [][]byte {
+	n := uint64(len(leaves))
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{RootHash(leaves)}
+	}
+
+	k := splitPoint(n)
+	if m <= k {
+		return append(subproof(leaves[:k], m, complete), RootHash(leaves[k:]))
+	}
+	return append(subproof(leaves[k:], m-k, false), RootHash(leaves[:k]))
+}
+
+// VerifyInclusion checks an audit path for the leaf at index against the root
+// of a tree of the given size
+func VerifyInclusion(leafHash []byte, index, treeSize uint64, proof [][]byte, root []byte) error {
+	if index >= treeSize {
+		return ErrInvalidRange
+	}
+
+	fn, sn := index, treeSize-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = hashChildren(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = hashChildren(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || !bytes.Equal(r, root) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// VerifyConsistency checks that the tree with firstRoot is a prefix of the
+// tree with secondRoot
+func VerifyConsistency(first, second uint64, firstRoot, secondRoot []byte, proof [][]byte) error {
+	switch {
+	case first > second:
+		return ErrInvalidRange
+	case first == second:
+		if len(proof) != 0 || !bytes.Equal(firstRoot, secondRoot) {
+			return ErrInvalidProof
+		}
+		return nil
+	case first == 0:
+		// The empty tree is a prefix of every tree
+		return nil
+	case len(proof) == 0:
+		return ErrInvalidProof
+	}
+
+	// When first is a complete subtree its root is the start of the path
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return ErrInvalidProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = hashChildren(c, fr)
+			sr = hashChildren(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = hashChildren(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return ErrInvalidProof
+	}
+	return nil
+}
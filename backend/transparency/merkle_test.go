@@ -0,0 +1,149 @@
+package transparency
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = LeafHash([]byte(fmt.Sprintf("leaf %d", i)))
+	}
+	return leaves
+}
+
+func TestRootHash(t *testing.T) {
+	empty := sha256.Sum256(nil)
+	if got := RootHash(nil); !bytes.Equal(got, empty[:]) {
+		t.Errorf("root of the empty tree = %x, want %x", got, empty)
+	}
+
+	leaves := testLeaves(3)
+	want := hashChildren(hashChildren(leaves[0], leaves[1]), leaves[2])
+	if got := RootHash(leaves); !bytes.Equal(got, want) {
+		t.Errorf("root of 3 leaves = %x, want %x", got, want)
+	}
+}
+
+func TestFrontierMatchesRootHash(t *testing.T) {
+	leaves := testLeaves(70)
+	frontier := NewFrontier(nil)
+	for n := 0; n <= len(leaves); n++ {
+		if frontier.Size != uint64(n) {
+			t.Fatalf("frontier size = %d, want %d", frontier.Size, n)
+		}
+		if want := RootHash(leaves[:n]); !bytes.Equal(frontier.Root(), want) {
+			t.Fatalf("frontier root of %d leaves = %x, want %x", n, frontier.Root(), want)
+		}
+		if n < len(leaves) {
+			frontier.Append(leaves[n])
+		}
+	}
+
+	// One node per perfect subtree: 70 = 64 + 4 + 2
+	if len(frontier.Nodes) != 3 {
+		t.Errorf("frontier of 70 leaves has %d nodes, want 3", len(frontier.Nodes))
+	}
+}
+
+func TestFrontierAppendDoesNotAlias(t *testing.T) {
+	leaves := testLeaves(4)
+	base := NewFrontier(leaves[:3])
+	// Spare capacity would let an append write into the shared array
+	base.Nodes = append(make([][]byte, 0, 8), base.Nodes...)
+	saved := append([][]byte{}, base.Nodes...)
+
+	copied := &Frontier{Size: base.Size, Nodes: base.Nodes}
+	copied.Append(leaves[3])
+	for i := range saved {
+		if !bytes.Equal(base.Nodes[i], saved[i]) {
+			t.Fatalf("appending to a copy changed node %d of the original frontier", i)
+		}
+	}
+	if !bytes.Equal(copied.Root(), RootHash(leaves)) {
+		t.Error("root of the copy is wrong")
+	}
+}
+
+func TestInclusionProofs(t *testing.T) {
+	for n := 1; n <= 33; n++ {
+		leaves := testLeaves(n)
+		root := RootHash(leaves)
+		for i := 0; i < n; i++ {
+			proof, err := InclusionProof(leaves, uint64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyInclusion(leaves[i], uint64(i), uint64(n), proof, root); err != nil {
+				t.Fatalf("leaf %d of %d: %v", i, n, err)
+			}
+			if n > 1 {
+				other := leaves[(i+1)%n]
+				if err := VerifyInclusion(other, uint64(i), uint64(n), proof, root); !errors.Is(err, ErrInvalidProof) {
+					t.Fatalf("leaf %d of %d: wrong leaf verified, err = %v", i, n, err)
+				}
+			}
+		}
+	}
+
+	if _, err := InclusionProof(testLeaves(2), 2); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("proof past the end: err = %v, want ErrInvalidRange", err)
+	}
+}
+
+func TestConsistencyProofs(t *testing.T) {
+	leaves := testLeaves(33)
+	for second := 1; second <= len(leaves); second++ {
+		secondRoot := RootHash(leaves[:second])
+		for first := 1; first <= second; first++ {
+			firstRoot := RootHash(leaves[:first])
+			proof, err := ConsistencyProof(leaves[:second], uint64(first))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyConsistency(uint64(first), uint64(second), firstRoot, secondRoot, proof); err != nil {
+				t.Fatalf("%d to %d: %v", first, second, err)
+			}
+			if first < second {
+				forged := RootHash(testLeaves(first + 1)[1:])
+				if err := VerifyConsistency(uint64(first), uint64(second), forged, secondRoot, proof); err == nil {
+					t.Fatalf("%d to %d: forged first root verified", first, second)
+				}
+			}
+		}
+	}
+
+	if _, err := ConsistencyProof(testLeaves(2), 3); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("proof past the end: err = %v, want ErrInvalidRange", err)
+	}
+}
+
+func TestSignedTreeHead(t *testing.T) {
+	seed := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+	key, err := ParseSigningKey(base64.StdEncoding.EncodeToString(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sth := &SignedTreeHead{TreeSize: 3, Timestamp: 1700000000000, RootHash: RootHash(testLeaves(3))}
+	sth.Sign(key)
+	public := key.Public().(ed25519.PublicKey)
+	if err := sth.Verify(public); err != nil {
+		t.Fatal(err)
+	}
+
+	sth.TreeSize++
+	if err := sth.Verify(public); err == nil {
+		t.Error("tree head verified after its size changed")
+	}
+
+	if _, err := ParseSigningKey(base64.StdEncoding.EncodeToString(seed[:16])); err == nil {
+		t.Error("ParseSigningKey accepted a short seed")
+	}
+}